@@ -1,24 +1,34 @@
 package awstee
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
 	"github.com/samber/lo"
 	"golang.org/x/sync/errgroup"
 )
@@ -27,6 +37,9 @@ import (
 
 type S3Client interface {
 	s3.HeadObjectAPIClient
+	s3.HeadBucketAPIClient
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
 	manager.UploadAPIClient
 }
 
@@ -35,6 +48,7 @@ type CloudwatchLogsClient interface {
 	PutLogEvents(ctx context.Context, input *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error)
 	CreateLogGroup(ctx context.Context, input *cloudwatchlogs.CreateLogGroupInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogGroupOutput, error)
 	CreateLogStream(ctx context.Context, input *cloudwatchlogs.CreateLogStreamInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.CreateLogStreamOutput, error)
+	GetLogEvents(ctx context.Context, input *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error)
 }
 
 type AWSClient struct {
@@ -43,190 +57,1026 @@ type AWSClient struct {
 }
 
 type AWSTee struct {
-	cfg    *Config
-	client AWSClient
+	cfg                   *Config
+	client                AWSClient
+	s3Clients             map[*S3Config]S3Client
+	cloudwatchClients     map[*CloudwatchLogsConfig]CloudwatchLogsClient
+	kms                   kmsDataKeyAPI
+	kmsClients            map[*S3Config]kmsDataKeyAPI
+	cloudwatchMetrics     cloudwatchMetricsAPI
+	sns                   snsPublishAPI
+	eventBridge           eventBridgePutEventsAPI
+	credentials           aws.CredentialsProvider
+	region                string
+	logger                *slog.Logger
+	now                   func() time.Time
+	retryer               func() aws.Retryer
+	errorHandler          func(dest string, err error)
+	metrics               MetricsHook
+	destinations          []customDestination
+	s3Options             []func(*s3.Options)
+	cloudwatchLogsOptions []func(*cloudwatchlogs.Options)
+	httpClient            aws.HTTPClient
+	tracer                Tracer
 }
 
-func New(ctx context.Context, cfg *Config) (*AWSTee, error) {
-	opts := []func(*awsConfig.LoadOptions) error{
-		awsConfig.WithRegion(cfg.AWSRegion),
+func New(ctx context.Context, cfg *Config, opts ...Option) (*AWSTee, error) {
+	app, err := NewWithClient(cfg, AWSClient{}, opts...)
+	if err != nil {
+		return nil, err
 	}
-	if endpointsResolver, ok := cfg.EndpointResolver(); ok {
-		opts = append(opts, awsConfig.WithEndpointResolver(endpointsResolver))
+	loadOpts, err := app.awsLoadOptions()
+	if err != nil {
+		return nil, err
 	}
-	awsCfg, err := awsConfig.LoadDefaultConfig(ctx, opts...)
+	awsCfg, err := awsConfig.LoadDefaultConfig(ctx, loadOpts...)
 	if err != nil {
 		return nil, err
 	}
-	client := AWSClient{
-		S3:             s3.NewFromConfig(awsCfg),
-		CloudwatchLogs: cloudwatchlogs.NewFromConfig(awsCfg),
+	if app.client.S3 == nil || app.client.CloudwatchLogs == nil {
+		if err := ensureSSOLogin(ctx, app.logger, awsCfg, cfg.AWSProfile); err != nil {
+			return nil, err
+		}
+	}
+	if err := app.setupClients(ctx, awsCfg, loadOpts); err != nil {
+		return nil, err
 	}
-	return NewWithClient(cfg, client)
+	return app, nil
 }
 
-func NewWithClient(cfg *Config, client AWSClient) (*AWSTee, error) {
-	return &AWSTee{
-		cfg:    cfg,
-		client: client,
-	}, nil
+// NewWithAWSConfig returns AWSTee with the clients created from awsCfg, for the applications that already manage the aws config.
+// aws_region, aws_profile, max_attempts, retry_mode, endpoints and http of cfg and WithRetryer are not applied to awsCfg,
+// they are only used to load the profiles of the destination credentials.
+func NewWithAWSConfig(ctx context.Context, cfg *Config, awsCfg aws.Config, opts ...Option) (*AWSTee, error) {
+	app, err := NewWithClient(cfg, AWSClient{}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	loadOpts, err := app.awsLoadOptions()
+	if err != nil {
+		return nil, err
+	}
+	if app.httpClient != nil {
+		awsCfg.HTTPClient = app.httpClient
+	}
+	awsCfg.APIOptions = append(awsCfg.APIOptions[:len(awsCfg.APIOptions):len(awsCfg.APIOptions)], app.apiOptions()...)
+	if cfg.DebugAWS {
+		awsCfg.ClientLogMode |= debugAWSClientLogMode
+		awsCfg.Logger = slogAWSLogger{logger: app.logger}
+	}
+	if err := app.setupClients(ctx, awsCfg, loadOpts); err != nil {
+		return nil, err
+	}
+	return app, nil
 }
 
-type AWSTeeReader struct {
+func (app *AWSTee) awsLoadOptions() ([]func(*awsConfig.LoadOptions) error, error) {
+	cfg := app.cfg
+	loadOpts := []func(*awsConfig.LoadOptions) error{
+		awsConfig.WithRegion(cfg.AWSRegion),
+		awsConfig.WithAssumeRoleCredentialOptions(func(o *stscreds.AssumeRoleOptions) {
+			o.TokenProvider = mfaTokenProvider
+		}),
+		awsConfig.WithCredentialsCacheOptions(withCredentialsExpiryWindow),
+	}
+	if cfg.AWSProfile != "" {
+		loadOpts = append(loadOpts, awsConfig.WithSharedConfigProfile(cfg.AWSProfile))
+	}
+	if cfg.MaxAttempts > 0 {
+		loadOpts = append(loadOpts, awsConfig.WithRetryMaxAttempts(cfg.MaxAttempts))
+	}
+	if cfg.retryMode != "" {
+		loadOpts = append(loadOpts, awsConfig.WithRetryMode(cfg.retryMode))
+	}
+	if app.retryer != nil {
+		loadOpts = append(loadOpts, awsConfig.WithRetryer(app.retryer))
+	}
+	loadOpts = append(loadOpts, awsConfig.WithAPIOptions(app.apiOptions()))
+	if cfg.DebugAWS {
+		loadOpts = append(loadOpts,
+			awsConfig.WithClientLogMode(debugAWSClientLogMode),
+			awsConfig.WithLogger(slogAWSLogger{logger: app.logger}),
+		)
+	}
+	loadOpts = append(loadOpts, cfg.endpointLoadOptions()...)
+	if endpointsResolver, ok := cfg.EndpointResolver(); ok {
+		loadOpts = append(loadOpts, awsConfig.WithEndpointResolver(endpointsResolver))
+	}
+	switch {
+	case app.httpClient != nil:
+		loadOpts = append(loadOpts, awsConfig.WithHTTPClient(app.httpClient))
+	case cfg.HTTP.Enabled():
+		client, err := cfg.HTTP.newClient()
+		if err != nil {
+			return nil, fmt.Errorf("http client: %w", err)
+		}
+		loadOpts = append(loadOpts, awsConfig.WithHTTPClient(client))
+	}
+	return loadOpts, nil
+}
+
+// apiOptions returns the options of the aws api calls, adding lib/awstee and app/<app_id> to the user agent,
+// so that CloudTrail and the s3 server access logs attribute the writes to awstee.
+func (app *AWSTee) apiOptions() []func(*middleware.Stack) error {
+	apiOptions := []func(*middleware.Stack) error{
+		awsmiddleware.AddSDKAgentKey(awsmiddleware.FrameworkMetadata, "awstee"),
+	}
+	if app.cfg.AppID != "" {
+		apiOptions = append(apiOptions, awsmiddleware.AddSDKAgentKey(awsmiddleware.ApplicationIdentifier, app.cfg.AppID))
+	}
+	if app.cfg.DebugAWS {
+		apiOptions = append(apiOptions, debugAWSMiddleware(app.logger))
+	}
+	return apiOptions
+}
+
+// setupClients creates the clients not set by the options from awsCfg, and the ones of the destinations with their own credentials.
+// The clients refresh the expired credentials and sign the calls again, for the streams longer than the role sessions.
+func (app *AWSTee) setupClients(ctx context.Context, awsCfg aws.Config, loadOpts []func(*awsConfig.LoadOptions) error) error {
+	s3Options := append(app.s3Options[:len(app.s3Options):len(app.s3Options)], s3RefreshExpiredCredentials)
+	cloudwatchLogsOptions := append(app.cloudwatchLogsOptions[:len(app.cloudwatchLogsOptions):len(app.cloudwatchLogsOptions)], cloudwatchLogsRefreshExpiredCredentials)
+	if app.client.S3 == nil {
+		app.client.S3 = s3.NewFromConfig(awsCfg, s3Options...)
+	}
+	if app.client.CloudwatchLogs == nil {
+		app.client.CloudwatchLogs = cloudwatchlogs.NewFromConfig(awsCfg, cloudwatchLogsOptions...)
+	}
+	app.credentials = awsCfg.Credentials
+	app.region = awsCfg.Region
+	// the kms clients of the encryption, and the decryption by Cat
+	if app.kms == nil {
+		app.kms = kms.NewFromConfig(awsCfg)
+	}
+	if app.cfg.SelfMetrics.Enabled() && app.cloudwatchMetrics == nil {
+		app.cloudwatchMetrics = cloudwatch.NewFromConfig(awsCfg)
+	}
+	if app.cfg.Notify.SNSTopicARN != "" && app.sns == nil {
+		app.sns = sns.NewFromConfig(awsCfg)
+	}
+	if app.cfg.Notify.EventBusName != "" && app.eventBridge == nil {
+		app.eventBridge = eventbridge.NewFromConfig(awsCfg)
+	}
+	for _, s3Cfg := range app.cfg.allS3Configs() {
+		if !s3Cfg.Credentials.Enabled() {
+			continue
+		}
+		destCfg, err := destinationAWSConfig(ctx, awsCfg, loadOpts, &s3Cfg.Credentials)
+		if err != nil {
+			return fmt.Errorf("s3 %s credentials: %w", s3Cfg.URLPrefix, err)
+		}
+		app.s3Clients[s3Cfg] = s3.NewFromConfig(destCfg, s3Options...)
+		app.kmsClients[s3Cfg] = kms.NewFromConfig(destCfg)
+	}
+	for _, cwCfg := range app.cfg.allCloudwatchConfigs() {
+		if !cwCfg.Credentials.Enabled() {
+			continue
+		}
+		destCfg, err := destinationAWSConfig(ctx, awsCfg, loadOpts, &cwCfg.Credentials)
+		if err != nil {
+			return fmt.Errorf("cloudwatch %s credentials: %w", cwCfg.LogGroup, err)
+		}
+		app.cloudwatchClients[cwCfg] = cloudwatchlogs.NewFromConfig(destCfg, cloudwatchLogsOptions...)
+	}
+	return nil
+}
+
+// NewWithClient returns AWSTee with the clients, without loading the aws config.
+//
+// Deprecated: use New with WithS3Client and WithCloudwatchLogsClient.
+func NewWithClient(cfg *Config, client AWSClient, opts ...Option) (*AWSTee, error) {
+	app := &AWSTee{
+		cfg:               cfg,
+		client:            client,
+		s3Clients:         make(map[*S3Config]S3Client),
+		cloudwatchClients: make(map[*CloudwatchLogsConfig]CloudwatchLogsClient),
+		kmsClients:        make(map[*S3Config]kmsDataKeyAPI),
+		region:            cfg.AWSRegion,
+		logger:            slog.Default(),
+		now:               time.Now,
+	}
+	for _, opt := range opts {
+		opt(app)
+	}
+	return app, nil
+}
+
+// AWSTeeWriter is an io.WriteCloser writing to the destinations of an output name.
+// Close must be called to complete the destinations.
+// It is safe for concurrent use: the writes are serialized, so the lines of one Write are not interleaved with the others.
+type AWSTeeWriter struct {
+	lines        int64
+	bytes        int64
 	writeClosers []io.WriteCloser
-	r            io.Reader
-	isClosed     bool
+	mu           sync.Mutex
+	lw           *lineWriter
+	sanitizer    *lineSanitizer
+	selfMetrics  *selfMetricsPublisher
+	prometheus   *prometheusMetrics
+	notifier     *runNotifier
+	summary      *summaryWriter
+	started      time.Time
+	pipeline     *pipelineWriter
+	fanout       *fanoutWriter
+	w            io.Writer
+	isClosed     atomic.Bool
+	lock         *outputLock
+	manifest     *manifestWriter
+	outputName   string
+	now          func() time.Time
+	logger       *slog.Logger
+	abort        context.CancelFunc
+	span         Span
+	resultMu     sync.Mutex
+	result       Result
 }
 
-func (app *AWSTee) TeeReader(r io.Reader, outputName string) (*AWSTeeReader, error) {
-	log.Println("[debug] try create aws tee reader")
-	writeClosers := make([]io.WriteCloser, 0)
-	if app.cfg.EnableS3() {
-		w, err := newS3Writer(app.client.S3, app.cfg.S3, outputName)
+// AWSTeeReader is an io.Reader writing what is read to the destinations of an output name.
+type AWSTeeReader struct {
+	w *AWSTeeWriter
+	r io.Reader
+}
+
+// Writer returns an AWSTeeWriter for outputName, for programs that write their output directly.
+// max_rate is not applied, because it limits the input of TeeReader. opts override the options of New for this writer.
+// ctx is used for the creation and the whole uploads of the destinations: canceling it aborts the in-flight AWS calls,
+// and the writes and Close return the error.
+func (app *AWSTee) Writer(ctx context.Context, outputName string, opts ...Option) (t *AWSTeeWriter, err error) {
+	app = app.with(opts...)
+	// abort cancels the destinations that do not complete in CloseWithContext
+	ctx, abort := context.WithCancel(ctx)
+	defer func() {
 		if err != nil {
-			return nil, fmt.Errorf("s3 writer: %w", err)
+			abort()
 		}
-		writeClosers = append(writeClosers, w)
-		log.Println("[info] s3 destination: ", w)
+	}()
+	app.logger.Debug("try create aws tee writer")
+	hooks := app.destinationHooks()
+	var selfMetrics *selfMetricsCounter
+	if app.cfg.SelfMetrics.Enabled() && app.cloudwatchMetrics != nil {
+		selfMetrics = newSelfMetricsCounter(hooks.metrics)
+		hooks.metrics = selfMetrics
+	}
+	var prometheus *prometheusMetrics
+	var metricsListener net.Listener
+	if app.cfg.MetricsListen != "" {
+		prometheus = newPrometheusMetrics(hooks.metrics, outputName)
+		hooks.metrics = prometheus
+		if metricsListener, err = prometheus.listen(app.cfg.MetricsListen); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				metricsListener.Close()
+			}
+		}()
 	}
-	if app.cfg.EnableCloudwatchLogs() {
-		w, err := newCloudWatchLogsWriter(app.client.CloudwatchLogs, app.cfg.Cloudwatch, outputName)
+	ctx, span := hooks.startSpan(ctx, "awstee.Writer", Attribute{"awstee.output_name", outputName})
+	defer func() {
 		if err != nil {
-			return nil, fmt.Errorf("cloudwatch logs writer: %w", err)
+			endSpan(span, err)
 		}
-		writeClosers = append(writeClosers, w)
-		log.Println("[info] cloudwatch logs destination: ", w)
+	}()
+	s3Configs, cloudwatchConfigs := app.cfg.destinations(outputName)
+	var lock *outputLock
+	if app.cfg.Lock {
+		if len(s3Configs) == 0 {
+			return nil, fmt.Errorf("lock requires an s3 destination, %s has none", outputName)
+		}
+		lock, err = app.acquireLock(ctx, s3Configs[0], outputName)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				// release even if ctx is canceled, not to leave the lock
+				if err := lock.Release(context.Background()); err != nil {
+					app.logger.Warn("release lock", "error", err)
+				}
+			}
+		}()
+	}
+	mw, err := app.openManifest(ctx, s3Configs, outputName)
+	if err != nil {
+		return nil, err
+	}
+	var summary *summaryWriter
+	if app.cfg.Summary {
+		summary = newSummaryWriter(app.logger)
+	}
+	writeClosers, err := app.openDestinations(ctx, outputName, s3Configs, cloudwatchConfigs, hooks, summary, mw)
+	if err != nil {
+		mw.discard()
+		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			for _, w := range writeClosers {
+				w.Close()
+			}
+			mw.discard()
+		}
+	}()
 	if len(writeClosers) == 0 {
 		return nil, errors.New("no destination")
 	}
-	return newAWSTeeReader(r, writeClosers), nil
+	if app.cfg.Overflow.Enabled() {
+		app.logger.Info("destinations are queued", "overflow", app.cfg.Overflow.policy, "max_bytes", app.cfg.Overflow.maxBytes)
+		for i, w := range writeClosers {
+			o, err := newOverflowWriter(app.logger, &app.cfg.Overflow, w)
+			if err != nil {
+				return nil, err
+			}
+			writeClosers[i] = o
+		}
+	}
+	sanitizer := app.cfg.newLineSanitizer()
+	processors, err := app.lineProcessors(outputName, sanitizer)
+	if err != nil {
+		return nil, err
+	}
+	t = newAWSTeeWriter(writeClosers, processors...)
+	t.sanitizer = sanitizer
+	if t.pipeline == nil && app.cfg.Raw && app.cfg.RawCloudwatch == RawCloudwatchBase64 && len(cloudwatchConfigs) > 0 {
+		// the base64 encoding of the cloudwatch logs destinations is off the write path as well as the line processors
+		t.startPipeline()
+	}
+	t.lock = lock
+	t.logger = app.logger
+	t.fanout.logger = app.logger
+	t.fanout.bestEffort = app.cfg.Delivery == DeliveryBestEffort
+	t.abort = abort
+	t.span = span
+	if selfMetrics != nil {
+		t.selfMetrics = newSelfMetricsPublisher(app.logger, app.cloudwatchMetrics, &app.cfg.SelfMetrics, selfMetrics, outputName, app.now)
+		t.selfMetrics.start(ctx, t.Stats)
+	}
+	if prometheus != nil {
+		prometheus.serve(app.logger, metricsListener, t.Stats)
+		t.prometheus = prometheus
+	}
+	if app.cfg.Notify.Enabled() {
+		t.notifier = &runNotifier{cfg: &app.cfg.Notify, sns: app.sns, eventBridge: app.eventBridge, logger: app.logger}
+	}
+	t.summary = summary
+	t.outputName = outputName
+	t.now = app.now
+	t.started = app.now()
+	if mw != nil {
+		mw.next = t.w
+		t.w = mw
+		t.manifest = mw
+	}
+	return t, nil
 }
 
-func newAWSTeeReader(r io.Reader, writeClosers []io.WriteCloser) *AWSTeeReader {
+// openManifest returns the manifest writer of outputName in the first s3 destination with manifest, or nil without it.
+func (app *AWSTee) openManifest(ctx context.Context, s3Configs []*S3Config, outputName string) (*manifestWriter, error) {
+	if !app.cfg.Manifest {
+		return nil, nil
+	}
+	if len(s3Configs) == 0 {
+		return nil, fmt.Errorf("manifest requires an s3 destination, %s has none", outputName)
+	}
+	store := newManifestStore(app.s3Client(s3Configs[0]), s3Configs[0], outputName)
+	delivered, err := store.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newManifestWriter(app.logger, store, delivered)
+}
 
-	t := &AWSTeeReader{
+// openDestinations opens the s3, cloudwatch logs and custom destinations of outputName.
+// They are opened by the first write while mw holds back the writes, not to create them for the skipped run.
+// On error, the destinations opened are closed.
+func (app *AWSTee) openDestinations(ctx context.Context, outputName string, s3Configs []*S3Config, cloudwatchConfigs []*CloudwatchLogsConfig, hooks *destinationHooks, summary *summaryWriter, mw *manifestWriter) (writeClosers []io.WriteCloser, err error) {
+	defer func() {
+		if err != nil {
+			for _, w := range writeClosers {
+				w.Close()
+			}
+			writeClosers = nil
+		}
+	}()
+	meta := newRunMetadata(outputName)
+	openDestination := func(name string, open func() (io.WriteCloser, error)) (io.WriteCloser, error) {
+		if mw != nil && mw.held != nil {
+			return &lazyDestination{name: name, open: open}, nil
+		}
+		return open()
+	}
+	for _, cfg := range s3Configs {
+		cfg := cfg
+		bucket, key := s3ObjectLocation(cfg, outputName)
+		w, err := openDestination(fmt.Sprintf("s3://%s/%s", bucket, key), func() (io.WriteCloser, error) {
+			return app.openS3Destination(ctx, cfg, outputName, hooks, summary, meta)
+		})
+		if err != nil {
+			return writeClosers, fmt.Errorf("s3 writer: %w", err)
+		}
+		writeClosers = append(writeClosers, w)
+		app.logger.Info("s3 destination", "destination", fmt.Sprint(w))
+	}
+	for _, cfg := range cloudwatchConfigs {
+		cfg := cfg
+		name := fmt.Sprintf("LogGroup=%s, LogStream=%s", cfg.LogGroup, cloudwatchLogStreamName(outputName))
+		if app.cfg.Raw && app.cfg.RawCloudwatch == RawCloudwatchSkip {
+			app.logger.Info("cloudwatch logs destination is skipped by raw, the binary stream is not line oriented", "destination", name)
+			continue
+		}
+		w, err := openDestination(name, func() (io.WriteCloser, error) {
+			return app.openCloudwatchDestination(ctx, cfg, outputName, hooks, meta)
+		})
+		if err != nil {
+			return writeClosers, fmt.Errorf("cloudwatch logs writer: %w", err)
+		}
+		writeClosers = append(writeClosers, w)
+		app.logger.Info("cloudwatch logs destination", "destination", fmt.Sprint(w))
+	}
+	for _, d := range app.destinations {
+		d := d
+		w, err := openDestination(d.name, func() (io.WriteCloser, error) {
+			w, err := d.open(ctx, outputName)
+			if err != nil {
+				return nil, err
+			}
+			return namedDestination{WriteCloser: w, name: d.name}, nil
+		})
+		if err != nil {
+			return writeClosers, fmt.Errorf("%s writer: %w", d.name, err)
+		}
+		writeClosers = append(writeClosers, w)
+		app.logger.Info("custom destination", "destination", d.name)
+	}
+	return writeClosers, nil
+}
+
+// openS3Destination opens the s3 destination of cfg, with the capture size guard, the encryption and the line processors.
+func (app *AWSTee) openS3Destination(ctx context.Context, cfg *S3Config, outputName string, hooks *destinationHooks, summary *summaryWriter, meta *runMetadata) (io.WriteCloser, error) {
+	w, err := newLimitedDestination(app.logger, &cfg.Limit, outputName, func(outputName string) (io.WriteCloser, error) {
+		var key *dataKey
+		if cfg.Encrypt.Enabled() {
+			// the data key of each object
+			var err error
+			if key, err = generateDataKey(ctx, app.kmsClient(cfg), &cfg.Encrypt); err != nil {
+				return nil, fmt.Errorf("s3 encrypt: %w", err)
+			}
+		}
+		w, err := newS3Writer(ctx, app.logger, app.s3Client(cfg), cfg, outputName, hooks)
+		if err != nil {
+			return nil, err
+		}
+		if summary != nil {
+			summary.add(app.s3Client(cfg), w)
+		}
+		if key == nil {
+			return w, nil
+		}
+		return newEncryptWriter(w, key), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	processors, finish := cfg.Lines.processors(meta)
+	return newLineDestination(w, append(app.cfg.severityProcessors(cfg), processors...), finish), nil
+}
+
+// openCloudwatchDestination opens the cloudwatch logs destination of cfg, with the capture size guard and the line processors.
+func (app *AWSTee) openCloudwatchDestination(ctx context.Context, cfg *CloudwatchLogsConfig, outputName string, hooks *destinationHooks, meta *runMetadata) (io.WriteCloser, error) {
+	w, err := newLimitedDestination(app.logger, &cfg.Limit, outputName, func(outputName string) (io.WriteCloser, error) {
+		return newCloudWatchLogsWriter(ctx, app.logger, app.cloudwatchClient(cfg), cfg, outputName, app.now, hooks)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if app.cfg.Raw {
+		return newBase64LineWriter(w), nil
+	}
+	processors, finish := cfg.Lines.processors(meta)
+	return newLineDestination(w, append(app.cfg.severityProcessors(cfg), processors...), finish), nil
+}
+
+// TeeReader returns an AWSTeeReader writing what is read from r to the destinations of outputName.
+// r beginning with the gzip magic number is decompressed, unless no_auto_decompress or raw.
+// opts override the options of New for this reader. ctx is the same as Writer.
+func (app *AWSTee) TeeReader(ctx context.Context, r io.Reader, outputName string, opts ...Option) (*AWSTeeReader, error) {
+	app = app.with(opts...)
+	w, err := app.Writer(ctx, outputName)
+	if err != nil {
+		return nil, err
+	}
+	if !app.cfg.NoAutoDecompress && !app.cfg.Raw {
+		r = newAutoDecompressReader(app.logger, r)
+	}
+	if app.cfg.maxRate != nil {
+		app.logger.Info("input rate is limited", "max_rate", app.cfg.maxRate.String())
+		r = newRateLimitedReader(r, app.cfg.maxRate)
+	}
+	return &AWSTeeReader{
+		w: w,
+		r: io.TeeReader(r, w),
+	}, nil
+}
+
+// DryRun resolves the destinations for outputName and runs the same preflight checks as TeeReader,
+// but creates and writes nothing. It returns the resolved destinations.
+func (app *AWSTee) DryRun(ctx context.Context, outputName string) ([]string, error) {
+	app.logger.Debug("try dry run")
+	if app.credentials != nil {
+		creds, err := app.credentials.Retrieve(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("credentials resolve: %w", err)
+		}
+		app.logger.Info("aws credentials resolved", "source", creds.Source)
+	}
+	s3Configs, cloudwatchConfigs := app.cfg.destinations(outputName)
+	destinations := make([]string, 0)
+	for _, cfg := range s3Configs {
+		bucket, key := s3ObjectLocation(cfg, outputName)
+		if err := checkS3Object(ctx, app.logger, app.s3Client(cfg), cfg, bucket, key); err != nil {
+			return nil, fmt.Errorf("s3 destination: %w", err)
+		}
+		destinations = append(destinations, fmt.Sprintf("s3://%s/%s", bucket, key))
+	}
+	for _, cfg := range cloudwatchConfigs {
+		logGroup := cfg.LogGroup
+		logStream := cloudwatchLogStreamName(outputName)
+		if err := checkCloudwatchLogs(ctx, app.logger, app.cloudwatchClient(cfg), logGroup, logStream, cfg.CreateLogGroup); err != nil {
+			return nil, fmt.Errorf("cloudwatch logs destination: %w", err)
+		}
+		destinations = append(destinations, fmt.Sprintf("LogGroup=%s, LogStream=%s", logGroup, logStream))
+	}
+	if len(destinations) == 0 {
+		return nil, errors.New("no destination")
+	}
+	return destinations, nil
+}
+
+func newAWSTeeWriter(writeClosers []io.WriteCloser, processors ...lineProcessor) *AWSTeeWriter {
+	t := &AWSTeeWriter{
 		writeClosers: writeClosers,
+		logger:       slog.Default(),
+		span:         noopSpan{},
 	}
 	writers := lo.Map(t.writeClosers, func(w io.WriteCloser, _ int) io.Writer { return w })
-	t.r = io.TeeReader(r, io.MultiWriter(writers...))
+	t.fanout = newFanoutWriter(t.logger, writers)
+	t.w = t.fanout
+	if len(processors) > 0 {
+		t.lw = newLineWriter(t.w, processors)
+		t.w = t.lw
+		t.startPipeline()
+	}
 	return t
 }
 
-func (t *AWSTeeReader) Close() error {
-	log.Println("[debug] closing aws tee writer")
-	eg := errgroup.Group{}
-	for _, writeCloser := range t.writeClosers {
-		w := writeCloser
-		eg.Go(w.Close)
+// startPipeline moves the stages of the writes so far to the pipeline goroutine, see pipelineWriter.
+func (t *AWSTeeWriter) startPipeline() {
+	t.pipeline = newPipelineWriter(t.w)
+	t.w = t.pipeline
+}
+
+func newAWSTeeReader(r io.Reader, writeClosers []io.WriteCloser, processors ...lineProcessor) *AWSTeeReader {
+	w := newAWSTeeWriter(writeClosers, processors...)
+	return &AWSTeeReader{
+		w: w,
+		r: io.TeeReader(r, w),
 	}
-	err := eg.Wait()
-	t.isClosed = true
-	if err != nil {
-		return err
+}
+
+// Write writes p to all destinations. A destination failing a write is degraded and not written any more,
+// and Write fails only when all destinations are degraded, or never with delivery: best_effort. The errors of the degraded destinations are returned by Close.
+func (t *AWSTeeWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.isClosed.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := t.w.Write(p)
+	atomic.AddInt64(&t.bytes, int64(n))
+	atomic.AddInt64(&t.lines, int64(bytes.Count(p[:n], []byte("\n"))))
+	return n, err
+}
+
+// Close flushes the last line and completes all destinations, and releases the lock.
+// It waits for the destinations as long as they take, see CloseWithContext to bound it.
+// The errors of the failed destinations are returned as DestinationError, joined by errors.Join.
+func (t *AWSTeeWriter) Close() error {
+	return t.CloseWithContext(context.Background())
+}
+
+// CloseAbortedError is returned by CloseWithContext when ctx is done before all destinations complete.
+// When a write is blocked, the writes not drained are lost, and the pipeline and the held writes are torn down once it returns.
+type CloseAbortedError struct {
+	// Completed is the destinations completed before ctx is done.
+	Completed []string
+	// Aborted is the destinations aborted, their data may be lost.
+	Aborted []string
+	// Err is the error of ctx.
+	Err error
+}
+
+func (e *CloseAbortedError) Error() string {
+	return fmt.Sprintf("close aborted: %s: %v", strings.Join(e.Aborted, ", "), e.Err)
+}
+
+func (e *CloseAbortedError) Unwrap() error {
+	return e.Err
+}
+
+func newCloseAbortedError(err error, names []string, completed []bool) *CloseAbortedError {
+	abortErr := &CloseAbortedError{Err: err}
+	for i, name := range names {
+		if completed[i] {
+			abortErr.Completed = append(abortErr.Completed, name)
+		} else {
+			abortErr.Aborted = append(abortErr.Aborted, name)
+		}
 	}
+	return abortErr
+}
 
-	log.Println("[debug] close complete aws tee writer")
+// DestinationError is the error of a destination, returned by Close joined with the ones of the other destinations.
+// Use errors.As to find the destination of a single failure,
+// or the method Unwrap() []error of the error returned by Close to find all of them.
+type DestinationError struct {
+	// Destination is the name of the destination, such as s3://bucket/key.
+	Destination string
+	Err         error
+}
+
+func (e *DestinationError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Destination, e.Err)
+}
+
+func (e *DestinationError) Unwrap() error {
+	return e.Err
+}
+
+// CloseWithContext is Close bounded by ctx. If ctx is done before all destinations complete,
+// it aborts the rest (e.g. the multipart upload of s3) without waiting for them,
+// and returns CloseAbortedError reporting the completed and the aborted destinations.
+func (t *AWSTeeWriter) CloseWithContext(ctx context.Context) (err error) {
+	t.logger.Debug("closing aws tee writer")
+	// the writes after this fail
+	t.isClosed.Store(true)
+	// a write blocked on a stuck destination holds the lock until the destinations are aborted below
+	drained := t.lockContext(ctx)
+	if drained {
+		if t.manifest != nil {
+			if err := t.manifest.finish(); err != nil {
+				t.logger.Warn("finish manifest", "error", err)
+			}
+		}
+		if t.pipeline != nil {
+			if err := t.pipeline.Close(); err != nil {
+				t.logger.Warn("drain pipeline", "error", err)
+			}
+		}
+		if t.lw != nil {
+			if err := t.lw.Flush(); err != nil {
+				t.logger.Warn("flush last line", "error", err)
+			}
+		}
+		t.mu.Unlock()
+	} else {
+		t.logger.Warn("a write is blocked, the writes not drained are lost", "error", ctx.Err())
+		// the blocked write returns when the destinations are aborted below
+		defer func() { go t.teardown() }()
+	}
+	defer func() {
+		t.span.SetAttributes(
+			Attribute{"awstee.bytes", atomic.LoadInt64(&t.bytes)},
+			Attribute{"awstee.lines", atomic.LoadInt64(&t.lines)},
+		)
+		endSpan(t.span, err)
+		if t.summary == nil && t.notifier == nil {
+			return
+		}
+		event := newRunEvent(t.outputName, t.Result(), t.Stats(), err, t.started, t.now())
+		if t.summary != nil {
+			t.summary.put(event)
+		}
+		if t.notifier != nil {
+			t.notifier.notify(event)
+		}
+	}()
+	type closed struct {
+		index int
+		err   error
+	}
+	// the names before closing, some destinations can not tell it while closing
+	names := lo.Map(t.writeClosers, func(w io.WriteCloser, _ int) string { return fmt.Sprint(w) })
+	done := make(chan closed, len(t.writeClosers))
+	for i, w := range t.writeClosers {
+		i, w := i, w
+		go func() {
+			done <- closed{index: i, err: w.Close()}
+		}()
+	}
+	errs := make([]error, len(t.writeClosers))
+	completed := make([]bool, len(t.writeClosers))
+	var abortErr *CloseAbortedError
+	for remaining := len(t.writeClosers); remaining > 0 && abortErr == nil; remaining-- {
+		select {
+		case c := <-done:
+			errs[c.index] = c.err
+			completed[c.index] = true
+		case <-ctx.Done():
+			abortErr = newCloseAbortedError(ctx.Err(), names, completed)
+		}
+	}
+	if !drained && abortErr == nil {
+		// the destinations completed, but without the writes blocked
+		abortErr = newCloseAbortedError(ctx.Err(), names, make([]bool, len(names)))
+	}
+	for i := range errs {
+		// a destination failing the writes may close without an error, but it has lost the rest of the writes
+		if d := t.fanout.degraded[i].Load(); d != nil && completed[i] && errs[i] == nil {
+			errs[i] = d.Err
+		}
+	}
+	result := t.closeResult(ctx, names, completed, errs)
+	if t.manifest != nil {
+		result.Skipped = t.manifest.skipped
+		if !result.Skipped && abortErr == nil && lo.EveryBy(errs, func(err error) bool { return err == nil }) {
+			if err := t.manifest.record(ctx, t.outputName, names, t.now()); err != nil {
+				t.logger.Warn("record manifest, the re-run of the output name is not skipped", "error", err)
+			}
+		}
+	}
+	t.resultMu.Lock()
+	t.result = result
+	t.resultMu.Unlock()
+	if t.selfMetrics != nil {
+		// the last metrics of the destinations closed
+		t.selfMetrics.stop(ctx)
+	}
+	if t.prometheus != nil {
+		t.prometheus.shutdown(ctx)
+	}
+	if t.abort != nil {
+		t.abort()
+	}
+	if t.lock != nil {
+		// release even if the context of Writer is canceled, not to leave the lock
+		if lockErr := t.lock.Release(context.Background()); lockErr != nil {
+			t.logger.Warn("release lock", "error", lockErr)
+		}
+	}
+	if abortErr != nil {
+		return abortErr
+	}
+	var destErrs []error
+	for i, err := range errs {
+		if err != nil {
+			destErrs = append(destErrs, &DestinationError{Destination: names[i], Err: err})
+		}
+	}
+	if len(destErrs) > 0 {
+		return errors.Join(destErrs...)
+	}
+
+	t.logger.Debug("close complete aws tee writer")
 	return nil
 }
 
+// teardown stops the stages of the writes not drained by CloseWithContext, once the write blocked on them returns.
+// The writes held by the manifest and the last line are dropped, the destinations are already aborted.
+func (t *AWSTeeWriter) teardown() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.manifest != nil {
+		t.manifest.discard()
+	}
+	if t.pipeline != nil {
+		if err := t.pipeline.Close(); err != nil {
+			t.logger.Debug("drain pipeline after abort", "error", err)
+		}
+	}
+	t.logger.Debug("the writes not drained are torn down")
+}
+
+// lockContext locks t.mu, or gives up when ctx is done first, such as while a write is blocked on a stuck destination.
+// It reports whether t.mu is locked.
+func (t *AWSTeeWriter) lockContext(ctx context.Context) bool {
+	locked := make(chan struct{})
+	go func() {
+		t.mu.Lock()
+		select {
+		case locked <- struct{}{}:
+		case <-ctx.Done():
+			// given up
+			t.mu.Unlock()
+		}
+	}()
+	select {
+	case <-locked:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+type flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Flush forces the destinations to checkpoint without closing:
+// cloudwatch logs puts the buffered events, and s3 with on_limit: rotate completes the current object and continues to the next one.
+func (t *AWSTeeWriter) Flush(ctx context.Context) error {
+	t.logger.Debug("flush aws tee writer")
+	if t.pipeline != nil {
+		// the writes queued before Flush are flushed too
+		if !t.lockContext(ctx) {
+			return ctx.Err()
+		}
+		err := t.pipeline.wait()
+		t.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	eg := errgroup.Group{}
+	for _, writeCloser := range t.writeClosers {
+		if f, ok := writeCloser.(flusher); ok {
+			eg.Go(func() error {
+				return f.Flush(ctx)
+			})
+		}
+	}
+	return eg.Wait()
+}
+
 func (t *AWSTeeReader) Read(p []byte) (int, error) {
-	if t.isClosed {
+	if t.w.isClosed.Load() {
 		return 0, io.EOF
 	}
 	return t.r.Read(p)
 }
 
+// Close completes all destinations, see AWSTeeWriter.Close.
+func (t *AWSTeeReader) Close() error {
+	return t.w.Close()
+}
+
+// CloseWithContext completes all destinations bounded by ctx, see AWSTeeWriter.CloseWithContext.
+func (t *AWSTeeReader) CloseWithContext(ctx context.Context) error {
+	return t.w.CloseWithContext(ctx)
+}
+
+// Flush forces the destinations to checkpoint without closing, see AWSTeeWriter.Flush.
+func (t *AWSTeeReader) Flush(ctx context.Context) error {
+	return t.w.Flush(ctx)
+}
+
+// backgroundWriter pipes what is written to a worker running in the background.
+// The errors of the worker are latched: Write returns the first one without waiting, and Close returns all of them.
 type backgroundWriter struct {
-	errCh  chan error
-	wg     sync.WaitGroup
-	pw     *io.PipeWriter
-	cancel context.CancelFunc
+	bytes    int64
+	errors   int64
+	firstErr atomic.Pointer[error]
+	mu       sync.Mutex
+	errs     []error
+	done     chan struct{}
+	wg       sync.WaitGroup
+	pw       *io.PipeWriter
+	cancel   context.CancelFunc
+	dest     string
+	hooks    *destinationHooks
 }
 
-func newBackgroundWriter(worker func(context.Context, *io.PipeReader, chan<- error)) (*backgroundWriter, error) {
+// newBackgroundWriter runs worker with a context derived from ctx, reading what is written until Close.
+// Close waits for the worker without canceling the context, so that the worker can complete with it.
+// The worker reports its errors by report, which is safe for concurrent use.
+// hooks is notified of the written bytes and each error of the worker as soon as it occurs.
+func newBackgroundWriter(ctx context.Context, dest string, hooks *destinationHooks, worker func(ctx context.Context, pr *io.PipeReader, report func(error))) (*backgroundWriter, error) {
 	if worker == nil {
 		return nil, errors.New("worker is nil")
 	}
 	w := &backgroundWriter{
-		errCh: make(chan error, 10),
+		dest:  dest,
+		hooks: hooks,
+		done:  make(chan struct{}),
 	}
 	var pr *io.PipeReader
 	pr, w.pw = io.Pipe()
 	w.wg.Add(1)
-	var ctx context.Context
-	ctx, w.cancel = context.WithCancel(context.Background())
+	ctx, w.cancel = context.WithCancel(ctx)
 	go func() {
 		defer w.wg.Done()
-		worker(ctx, pr, w.errCh)
-		close(w.errCh)
+		worker(ctx, pr, w.report)
+		close(w.done)
 		pr.Close()
 	}()
-	if err := w.Err(); err != nil {
-		w.Close()
-		return nil, err
-	}
 	return w, nil
 }
 
+// report latches err before notifying it, so that the writes after report returns fail.
+func (w *backgroundWriter) report(err error) {
+	if err == nil {
+		return
+	}
+	w.mu.Lock()
+	w.errs = append(w.errs, err)
+	w.mu.Unlock()
+	w.firstErr.CompareAndSwap(nil, &err)
+	atomic.AddInt64(&w.errors, 1)
+	w.hooks.onError(w.dest, err)
+}
+
+// Write is safe for concurrent use, the pipe gates the writes sequentially.
 func (w *backgroundWriter) Write(p []byte) (int, error) {
+	if err := w.Err(); err != nil {
+		return 0, err
+	}
 	n, err := w.pw.Write(p)
+	atomic.AddInt64(&w.bytes, int64(n))
+	w.hooks.onBytesWritten(w.dest, n)
 	if err != nil {
+		// the worker has stopped, its error is more helpful than the closed pipe
+		if workerErr := w.Err(); workerErr != nil {
+			return n, workerErr
+		}
 		return n, err
 	}
-	return n, w.Err()
+	return n, nil
 }
 
+// err returns all errors of the worker so far.
+func (w *backgroundWriter) err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return errors.Join(w.errs...)
+}
+
+// Err returns the first error of the worker, or nil if none has occurred yet.
 func (w *backgroundWriter) Err() error {
-	select {
-	case err, ok := <-w.errCh:
-		if ok {
-			return err
-		}
-	case <-time.After(5 * time.Millisecond):
+	if err := w.firstErr.Load(); err != nil {
+		return *err
 	}
 	return nil
 }
 
+// Close waits for the worker to complete, and returns all of its errors.
 func (w *backgroundWriter) Close() error {
 	err := w.pw.Close()
-	w.cancel()
 	w.wg.Wait()
+	w.cancel()
 	if err != nil {
 		return err
 	}
-	return w.Err()
+	return w.err()
 }
 
-type s3Writer struct {
-	bucket string
-	key    string
+// S3Writer is an io.WriteCloser streaming what is written to an s3 object by a multipart upload.
+// Close must be called to complete the upload. It is safe for concurrent use, each Write is written as a whole.
+type S3Writer struct {
+	retries   int64
+	bucket    string
+	key       string
+	versionID atomic.Pointer[string]
+	spill     *spillFile
+	spilling  atomic.Bool
+	watchdog  *watchdog
+	logger    *slog.Logger
 	*backgroundWriter
+
+	// checksum is the sha256 of the object written, with summary
+	checksum   hash.Hash
+	checksumMu sync.Mutex
 }
 
-func newS3Writer(client S3Client, cfg *S3Config, outputName string) (*s3Writer, error) {
-	bucket := cfg.urlPrefix.Host
-	key := cfg.urlPrefix.Path
-	if strings.HasSuffix(key, "/") {
-		key = filepath.Join(key, outputName)
-	} else {
-		key += outputName
+func newS3Writer(ctx context.Context, logger *slog.Logger, client S3Client, cfg *S3Config, outputName string, hooks *destinationHooks) (*S3Writer, error) {
+	bucket, key := s3ObjectLocation(cfg, outputName)
+	dest := fmt.Sprintf("s3://%s/%s", bucket, key)
+	logger = logger.With("destination", dest)
+	if err := checkS3Object(ctx, logger, client, cfg, bucket, key); err != nil {
+		return nil, err
 	}
-	key = strings.TrimLeft(key, "/")
-	ctx := context.Background()
-	if exists, err := s3ObjectAlreadyExists(ctx, client, bucket, key); err != nil {
-		if !cfg.AllowOverwrite {
-			return nil, err
-		}
-		log.Println("[debug] check s3 object:", err)
-	} else {
-		if exists && !cfg.AllowOverwrite {
-			return nil, fmt.Errorf("s3://%s/%s is already exists, not allow overwrite", bucket, key)
+	w := &S3Writer{
+		bucket:   bucket,
+		key:      key,
+		watchdog: newWatchdog(logger, &cfg.Watchdog, time.Now),
+		logger:   logger,
+	}
+	var watchedClient manager.UploadAPIClient = client
+	if w.watchdog != nil {
+		watchedClient = &watchdogUploadClient{UploadAPIClient: client, watchdog: w.watchdog}
+	}
+	uploadClient := hooks.uploadClient(watchedClient, dest)
+	if cfg.Retry.Enabled() {
+		uploadClient = &retryingUploadClient{
+			UploadAPIClient: uploadClient,
+			cfg:             &cfg.Retry,
+			logger:          logger,
+			retries:         &w.retries,
 		}
 	}
-	uploader := manager.NewUploader(client)
+	uploader := manager.NewUploader(&retryCountingUploadClient{
+		UploadAPIClient: uploadClient,
+		retries:         &w.retries,
+	}, cfg.uploaderOptions)
 	if cfg.FirstlyPutEmptyObject {
-		log.Println("[debug] s3 put empty object")
+		logger.Debug("s3 put empty object")
 		_, err := uploader.Upload(ctx, &s3.PutObjectInput{
 			Bucket: aws.String(bucket),
 			Key:    aws.String(key),
@@ -236,33 +1086,98 @@ func newS3Writer(client S3Client, cfg *S3Config, outputName string) (*s3Writer,
 			return nil, err
 		}
 	}
-	bw, err := newBackgroundWriter(func(_ context.Context, pr *io.PipeReader, c chan<- error) {
-		log.Println("[debug] start s3 writer")
-		defer func() {
-			log.Println("[debug] end s3 writer")
-		}()
-		_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+	upload := func(ctx context.Context, body io.Reader) (*manager.UploadOutput, error) {
+		ctx, span := hooks.startSpan(ctx, "s3.Upload", Attribute{"awstee.destination", dest})
+		output, err := uploader.Upload(ctx, &s3.PutObjectInput{
 			Bucket: aws.String(bucket),
 			Key:    aws.String(key),
-			Body:   pr,
+			Body:   body,
+		})
+		endSpan(span, err)
+		return output, err
+	}
+	if cfg.Spill.Enabled() {
+		spill, err := newSpillFile(logger, &cfg.Spill, spillJournal{
+			Kind:       spillKindS3,
+			Bucket:     bucket,
+			Key:        key,
+			OutputName: outputName,
 		})
 		if err != nil {
-			c <- err
+			return nil, fmt.Errorf("s3 %w", err)
+		}
+		w.spill = spill
+	}
+	bw, err := newBackgroundWriter(ctx, dest, hooks, func(ctx context.Context, pr *io.PipeReader, report func(error)) {
+		logger.Debug("start s3 writer")
+		defer func() {
+			logger.Debug("end s3 writer")
+		}()
+		defer w.watchdog.start()()
+		start := time.Now()
+		var body io.Reader = pr
+		if w.spill != nil {
+			defer w.spill.finish()
+			if !w.spill.wal {
+				// keep a copy to upload it again if the destination is unreachable
+				body = io.TeeReader(pr, spillCopy{w.spill})
+			}
+		}
+		output, err := upload(ctx, body)
+		if err != nil && w.spill != nil && (spillCopy{w.spill}).replayable() && isRetryableError(err) {
+			output, err = w.replaySpill(ctx, &cfg.Retry, pr, upload, err)
+		}
+		if err != nil {
+			// unblock the writes if the upload is aborted
+			pr.CloseWithError(err)
+			report(err)
 		} else {
-			log.Printf("[debug] s3 upload success")
+			logger.Debug("s3 upload success")
+			if w.spill != nil {
+				if err := w.spill.consume(w.spill.Pending()); err != nil {
+					logger.Warn("consume spill", "error", err)
+				}
+			}
+			if output.VersionID != nil {
+				w.versionID.Store(output.VersionID)
+			}
+			hooks.onBatchSent(dest, 1, time.Since(start))
 		}
 	})
 	if err != nil {
 		return nil, err
 	}
-	w := &s3Writer{
-		bucket:           bucket,
-		key:              key,
-		backgroundWriter: bw,
-	}
+	w.backgroundWriter = bw
 	return w, nil
 }
 
+func s3ObjectLocation(cfg *S3Config, outputName string) (string, string) {
+	bucket := cfg.urlPrefix.Host
+	key := cfg.urlPrefix.Path
+	if strings.HasSuffix(key, "/") {
+		key = filepath.Join(key, outputName)
+	} else {
+		key += outputName
+	}
+	key = strings.TrimLeft(key, "/")
+	return bucket, key
+}
+
+func checkS3Object(ctx context.Context, logger *slog.Logger, client S3Client, cfg *S3Config, bucket, key string) error {
+	exists, err := s3ObjectAlreadyExists(ctx, client, bucket, key)
+	if err != nil {
+		if !cfg.AllowOverwrite {
+			return err
+		}
+		logger.Debug("check s3 object", "error", err)
+		return nil
+	}
+	if exists && !cfg.AllowOverwrite {
+		return fmt.Errorf("s3://%s/%s is already exists, not allow overwrite", bucket, key)
+	}
+	return nil
+}
+
 func s3ObjectAlreadyExists(ctx context.Context, client S3Client, bucket, key string) (bool, error) {
 	_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(bucket),
@@ -280,134 +1195,173 @@ func s3ObjectAlreadyExists(ctx context.Context, client S3Client, bucket, key str
 	return true, nil
 }
 
-func (w *s3Writer) Close() error {
-	log.Println("[debug] close s3 writer")
+// replaySpill keeps the rest of the writes in the spill after the upload fails with uploadErr,
+// and uploads the whole object from the spill again after Close.
+func (w *S3Writer) replaySpill(ctx context.Context, retryCfg *RetryConfig, pr *io.PipeReader, upload func(context.Context, io.Reader) (*manager.UploadOutput, error), uploadErr error) (*manager.UploadOutput, error) {
+	w.logger.Warn("s3 destination unreachable, spill until close", "error", uploadErr)
+	w.spilling.Store(true)
+	// the wal has the writes already
+	var rest io.Writer = w.spill
+	if w.spill.wal {
+		rest = io.Discard
+	}
+	if _, err := io.Copy(rest, pr); err != nil {
+		return nil, errors.Join(uploadErr, err)
+	}
+	w.logger.Info("replay spill", "bytes", w.spill.Pending())
+	var output *manager.UploadOutput
+	err := retryCfg.do(ctx, w.logger, "s3 replay spill", &w.retries, func() error {
+		var err error
+		output, err = upload(ctx, w.spill.reader())
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("replay spill: %w", err)
+	}
+	return output, w.spill.consume(w.spill.Pending())
+}
+
+// Write writes p to the upload, after the wal of the spill if it is enabled.
+func (w *S3Writer) Write(p []byte) (int, error) {
+	if w.spill != nil && w.spill.wal {
+		if err := w.backgroundWriter.Err(); err != nil {
+			return 0, err
+		}
+		if _, err := w.spill.Write(p); err != nil && !w.spill.dropsOnFull(err) {
+			return 0, fmt.Errorf("wal: %w", err)
+		}
+	}
+	defer w.watchdog.write()()
+	if w.checksum == nil {
+		return w.backgroundWriter.Write(p)
+	}
+	// in the order of the object
+	w.checksumMu.Lock()
+	defer w.checksumMu.Unlock()
+	n, err := w.backgroundWriter.Write(p)
+	w.checksum.Write(p[:n])
+	return n, err
+}
+
+// Close completes the upload and returns its error.
+func (w *S3Writer) Close() error {
+	w.logger.Debug("close s3 writer")
 	return w.backgroundWriter.Close()
 }
 
-func (w *s3Writer) String() string {
+// String returns the s3 url of the object.
+func (w *S3Writer) String() string {
 	return fmt.Sprintf("s3://%s/%s", w.bucket, w.key)
 }
 
-type cloudwatchLogsWriter struct {
+// CloudWatchLogsWriter is an io.WriteCloser putting each line written to a cloudwatch logs stream as an event, in batches.
+// Close must be called to put the buffered events. It is safe for concurrent use, each Write is written as a whole.
+type CloudWatchLogsWriter struct {
+	buffered  int64
+	written   int64
+	sent      int64
+	retries   int64
 	logGroup  string
 	logStream string
+	arn       string
+	spill     *spillFile
+	wal       *spillFile
+	walMu     sync.Mutex
+	walRest   []byte
+	now       func() time.Time
+	breaker   *circuitBreaker
+	watchdog  *watchdog
+	dropped   int64
+	deduped   int64
+	truncated int64
+	inFlight  int64
+	flushCh   chan cloudwatchFlushRequest
+	logger    *slog.Logger
 	*backgroundWriter
 }
 
-func newCloudWatchLogsWriter(client CloudwatchLogsClient, cfg *CloudwatchLogsConfig, outputName string) (*cloudwatchLogsWriter, error) {
+func newCloudWatchLogsWriter(ctx context.Context, logger *slog.Logger, client CloudwatchLogsClient, cfg *CloudwatchLogsConfig, outputName string, now func() time.Time, hooks *destinationHooks) (*CloudWatchLogsWriter, error) {
 	logGroup := cfg.LogGroup
-	logStream := strings.TrimSuffix(outputName, filepath.Ext(outputName))
-	logStream = strings.ReplaceAll(strings.TrimLeft(logStream, "/"), "/", "-")
-	sequenceToken, err := prepareCloudwatchLogs(context.Background(), client, logGroup, logStream, cfg.CreateLogGroup)
+	logStream := cloudwatchLogStreamName(outputName)
+	dest := fmt.Sprintf("LogGroup=%s, LogStream=%s", logGroup, logStream)
+	logger = logger.With("destination", dest)
+	sequenceToken, arn, err := prepareCloudwatchLogs(ctx, logger, client, logGroup, logStream, cfg.CreateLogGroup)
 	if err != nil {
 		return nil, fmt.Errorf("cloudwatch logs destination initialize: %w", err)
 	}
-	bg, err := newBackgroundWriter(func(ctx context.Context, pr *io.PipeReader, c chan<- error) {
-		log.Println("[debug] start cloudwatch logs writer")
-		defer func() {
-			log.Println("[debug] end cloudwatch logs writer")
-		}()
-		s := bufio.NewScanner(pr)
-		lines := make(chan cwtypes.InputLogEvent, 0)
-		var wg sync.WaitGroup
-		wg.Add(1)
-		go func() {
-			log.Println("[debug] start cloudwatch logs buffering worker")
-			defer func() {
-				log.Println("[debug] end cloudwatch logs buffering worker")
-				wg.Done()
-			}()
-			for s.Scan() {
-				if text := s.Text(); text != "" {
-					lines <- cwtypes.InputLogEvent{
-						Message:   aws.String(s.Text()),
-						Timestamp: aws.Int64(time.Now().UnixMilli()),
-					}
-				}
-			}
-			if err := s.Err(); err != nil && err != io.EOF {
-				c <- err
-			}
-			close(lines)
-		}()
-
-		t := time.NewTicker(cfg.flushInterval)
-		defer t.Stop()
-		events := make([]cwtypes.InputLogEvent, 0)
-		isDone := false
-		for !isDone {
-			select {
-			case line, ok := <-lines:
-				if ok {
-					events = append(events, line)
-				}
-				if len(events) >= cfg.BufferLines {
-					log.Printf("[debug] over limit cloudwatch put log %d events", len(events))
-					output, err := client.PutLogEvents(context.Background(), &cloudwatchlogs.PutLogEventsInput{
-						LogGroupName:  aws.String(logGroup),
-						LogStreamName: aws.String(logStream),
-						LogEvents:     events,
-						SequenceToken: sequenceToken,
-					})
-					if err != nil {
-						log.Println("[error] put log events: ", err)
-						c <- err
-					}
-					sequenceToken = output.NextSequenceToken
-					events = make([]cwtypes.InputLogEvent, 0, len(events))
-				}
-			case <-t.C:
-				if len(events) > 0 {
-					log.Printf("[debug] flush interval cloudwatch put log %d events", len(events))
-					output, err := client.PutLogEvents(context.Background(), &cloudwatchlogs.PutLogEventsInput{
-						LogGroupName:  aws.String(logGroup),
-						LogStreamName: aws.String(logStream),
-						LogEvents:     events,
-						SequenceToken: sequenceToken,
-					})
-					if err != nil {
-						log.Println("[error] put log events: ", err)
-						c <- err
-					}
-					sequenceToken = output.NextSequenceToken
-					events = make([]cwtypes.InputLogEvent, 0, len(events))
-				}
-			case <-ctx.Done():
-				isDone = true
-			}
+	w := &CloudWatchLogsWriter{
+		logGroup:  logGroup,
+		logStream: logStream,
+		arn:       arn,
+		now:       now,
+		breaker:   newCircuitBreaker(logger, &cfg.CircuitBreaker, now),
+		watchdog:  newWatchdog(logger, &cfg.Watchdog, time.Now),
+		flushCh:   make(chan cloudwatchFlushRequest),
+		logger:    logger,
+	}
+	if cfg.Spill.Enabled() {
+		spill, err := newSpillFile(logger, &cfg.Spill, spillJournal{
+			Kind:       spillKindCloudwatch,
+			LogGroup:   logGroup,
+			LogStream:  logStream,
+			OutputName: outputName,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cloudwatch %w", err)
 		}
-		wg.Wait()
-		for line := range lines {
-			events = append(events, line)
-		}
-		if len(events) > 0 {
-			log.Printf("[debug] on close cloudwatch put log %d events", len(events))
-			_, err := client.PutLogEvents(context.Background(), &cloudwatchlogs.PutLogEventsInput{
-				LogGroupName:  aws.String(logGroup),
-				LogStreamName: aws.String(logStream),
-				LogEvents:     events,
-				SequenceToken: sequenceToken,
-			})
-			if err != nil {
-				log.Println("[error] put log events: ", err)
-				c <- err
-			}
+		if spill.wal {
+			w.wal = spill
+		} else {
+			w.spill = spill
 		}
-
+	}
+	bg, err := newBackgroundWriter(ctx, dest, hooks, func(ctx context.Context, pr *io.PipeReader, report func(error)) {
+		w.run(ctx, newCloudwatchSender(ctx, w, client, cfg, hooks, dest, sequenceToken, report), pr, report)
 	})
 	if err != nil {
 		return nil, err
 	}
-	w := &cloudwatchLogsWriter{
-		logGroup:         logGroup,
-		logStream:        logStream,
-		backgroundWriter: bg,
-	}
+	w.backgroundWriter = bg
 	return w, nil
 }
 
-func prepareCloudwatchLogs(ctx context.Context, client CloudwatchLogsClient, logGroupName string, logStreamName string, createLogGroup bool) (*string, error) {
+func cloudwatchLogStreamName(outputName string) string {
+	logStream := strings.TrimSuffix(outputName, filepath.Ext(outputName))
+	return strings.ReplaceAll(strings.TrimLeft(logStream, "/"), "/", "-")
+}
+
+func isLogGroupNotFound(err error) bool {
+	var ae smithy.APIError
+	if !errors.As(err, &ae) {
+		return false
+	}
+	return ae.ErrorCode() == "ResourceNotFoundException" && strings.Contains(ae.ErrorMessage(), "log group does not exist")
+}
+
+// checkCloudwatchLogs is the read-only counterpart of prepareCloudwatchLogs.
+func checkCloudwatchLogs(ctx context.Context, logger *slog.Logger, client CloudwatchLogsClient, logGroupName string, logStreamName string, createLogGroup bool) error {
+	output, err := client.DescribeLogStreams(ctx, &cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(logGroupName),
+		LogStreamNamePrefix: aws.String(logStreamName),
+	})
+	if err != nil {
+		if isLogGroupNotFound(err) && createLogGroup {
+			logger.Info("log group does not exist, it will be created", "log_group", logGroupName)
+			return nil
+		}
+		return err
+	}
+	for _, logStream := range output.LogStreams {
+		if *logStream.LogStreamName == logStreamName {
+			logger.Info("log stream already exists, events will be appended", "log_stream", logStreamName)
+			return nil
+		}
+	}
+	logger.Info("log stream does not exist, it will be created", "log_stream", logStreamName)
+	return nil
+}
+
+func prepareCloudwatchLogs(ctx context.Context, logger *slog.Logger, client CloudwatchLogsClient, logGroupName string, logStreamName string, createLogGroup bool) (sequenceToken *string, arn string, err error) {
 	output, err := client.DescribeLogStreams(ctx, &cloudwatchlogs.DescribeLogStreamsInput{
 		LogGroupName:        aws.String(logGroupName),
 		LogStreamNamePrefix: aws.String(logStreamName),
@@ -417,15 +1371,15 @@ func prepareCloudwatchLogs(ctx context.Context, client CloudwatchLogsClient, log
 		var ae smithy.APIError
 		if errors.As(err, &ae) {
 			if ae.ErrorCode() != "ResourceNotFoundException" {
-				return nil, err
+				return nil, "", err
 			}
 			if !strings.Contains(ae.ErrorMessage(), "log group does not exist") {
-				return nil, err
+				return nil, "", err
 			}
 			if !createLogGroup {
-				return nil, err
+				return nil, "", err
 			}
-			log.Println("[info] create log group ")
+			logger.Info("create log group", "log_group", logGroupName)
 			_, err := client.CreateLogGroup(ctx, &cloudwatchlogs.CreateLogGroupInput{
 				LogGroupName: aws.String(logGroupName),
 				Tags: map[string]string{
@@ -433,7 +1387,7 @@ func prepareCloudwatchLogs(ctx context.Context, client CloudwatchLogsClient, log
 				},
 			})
 			if err != nil {
-				return nil, err
+				return nil, "", err
 			}
 		}
 
@@ -443,9 +1397,9 @@ func prepareCloudwatchLogs(ctx context.Context, client CloudwatchLogsClient, log
 		for _, logStream := range output.LogStreams {
 			if *logStream.LogStreamName == logStreamName {
 				if logStream.UploadSequenceToken != nil {
-					return aws.String(*logStream.UploadSequenceToken), nil
+					sequenceToken = aws.String(*logStream.UploadSequenceToken)
 				}
-				return nil, nil
+				return sequenceToken, aws.ToString(logStream.Arn), nil
 			}
 		}
 	}
@@ -456,17 +1410,103 @@ func prepareCloudwatchLogs(ctx context.Context, client CloudwatchLogsClient, log
 		LogStreamName: aws.String(logStreamName),
 	})
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return nil, nil
+	return nil, "", nil
 }
 
-func (w *cloudwatchLogsWriter) Close() error {
-	log.Println("[debug] close cloudwatch log writer")
-	io.WriteString(w.backgroundWriter, "\n")
-	return w.backgroundWriter.Close()
+// Close puts the buffered events and returns the error of the writer.
+func (w *CloudWatchLogsWriter) Close() error {
+	w.logger.Debug("close cloudwatch log writer")
+	// terminate the last line, the error is the one of the worker if it has stopped
+	var writeErr error
+	if w.wal != nil {
+		w.walMu.Lock()
+		writeErr = w.writeWAL([]byte("\n"))
+		w.walMu.Unlock()
+	}
+	if writeErr == nil {
+		_, writeErr = io.WriteString(w.backgroundWriter, "\n")
+	}
+	if err := w.backgroundWriter.Close(); err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// Flush puts the buffered events to cloudwatch logs immediately, including the lines written just before it.
+func (w *CloudWatchLogsWriter) Flush(ctx context.Context) error {
+	req := cloudwatchFlushRequest{
+		lines: atomic.LoadInt64(&w.written),
+		done:  make(chan error, 1),
+	}
+	select {
+	case w.flushCh <- req:
+	case <-w.backgroundWriter.done:
+		return errors.New("cloudwatch logs writer already closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cloudwatchFlushRequest is answered after the lines written before the request are received.
+type cloudwatchFlushRequest struct {
+	lines int64
+	done  chan error
+}
+
+// cloudwatchPutRequest is a batch put by the sender with in_flight_batches. done receives the result if it is not nil.
+type cloudwatchPutRequest struct {
+	reason    string
+	batch     []cwtypes.InputLogEvent
+	walEvents int64
+	done      chan error
+}
+
+// Write writes p, each line of which is put as an event.
+func (w *CloudWatchLogsWriter) Write(p []byte) (int, error) {
+	if w.wal != nil {
+		w.walMu.Lock()
+		defer w.walMu.Unlock()
+		if err := w.writeWAL(p); err != nil {
+			return 0, err
+		}
+	}
+	end := w.watchdog.write()
+	n, err := w.backgroundWriter.Write(p)
+	end()
+	atomic.AddInt64(&w.written, int64(bytes.Count(p[:n], []byte("\n"))))
+	return n, err
+}
+
+// writeWAL appends the lines completed by p to the wal, before they are written to the worker.
+func (w *CloudWatchLogsWriter) writeWAL(p []byte) error {
+	if err := w.backgroundWriter.Err(); err != nil {
+		return err
+	}
+	if w.wal.isDisabled() {
+		return nil
+	}
+	rest, err := w.wal.walEvents(append(w.walRest, p...), w.now())
+	if w.wal.dropsOnFull(err) {
+		// the wal is stopped, the writes go on without it
+		w.walRest = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	w.walRest = append([]byte{}, rest...)
+	return nil
 }
 
-func (w *cloudwatchLogsWriter) String() string {
+// String returns the log group and the log stream.
+func (w *CloudWatchLogsWriter) String() string {
 	return fmt.Sprintf("LogGroup=%s, LogStream=%s", w.logGroup, w.logStream)
 }
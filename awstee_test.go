@@ -4,18 +4,21 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/smithy-go"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
@@ -47,6 +50,183 @@ func TestAWSTeeReader(t *testing.T) {
 	require.EqualValues(t, expected, buf2.String())
 }
 
+func TestAWSTeeWriter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	s3Client := NewMockS3Client(ctrl)
+	var buf bytes.Buffer
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{Code: "NotFound"},
+	).Times(1)
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			require.EqualValues(t, "logs/app.log", *input.Key)
+			io.Copy(&buf, input.Body)
+			return &s3.PutObjectOutput{}, nil
+		},
+	).Times(1)
+	cfg := &Config{
+		LinePrefix: "[{{ .OutputName }}] ",
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{S3: s3Client})
+	require.NoError(t, err)
+	w, err := app.Writer(context.Background(), "app.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\nfu")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "ga\n")
+	require.NoError(t, err)
+	stats := w.Stats()
+	require.EqualValues(t, 2, stats.Lines)
+	require.EqualValues(t, 10, stats.Bytes)
+	require.NoError(t, w.Close())
+	require.EqualValues(t, "[app.log] hoge\n[app.log] fuga\n", buf.String())
+	_, err = io.WriteString(w, "piyo\n")
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func TestAWSTeeWriterConcurrentWrite(t *testing.T) {
+	buf := &testDestination{}
+	w := newAWSTeeWriter([]io.WriteCloser{buf}, func(line []byte) []byte {
+		return append([]byte("[app] "), line...)
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				fmt.Fprintf(w, "writer%d\nline%d\n", i, j)
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.NoError(t, w.Close())
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2000)
+	for i := 0; i < len(lines); i += 2 {
+		require.Regexp(t, `^\[app\] writer\d$`, lines[i])
+		require.Regexp(t, `^\[app\] line\d+$`, lines[i+1], "the lines of one write are not interleaved")
+	}
+	require.EqualValues(t, 2000, w.Stats().Lines)
+	_, err := io.WriteString(w, "hoge\n")
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func TestAWSTeeWriterCloseWithContext(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{Code: "NotFound"},
+	).Times(1)
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			// stuck until aborted
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	).Times(1)
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("app")}},
+		}, nil,
+	).Times(1)
+	cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.PutLogEventsOutput{}, nil,
+	).Times(1)
+	cfg := &Config{
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+		},
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup: "/awstee/logs",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{S3: s3Client, CloudwatchLogs: cloudwatchLogsClient})
+	require.NoError(t, err)
+	w, err := app.Writer(context.Background(), "app.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err = w.CloseWithContext(ctx)
+	var abortErr *CloseAbortedError
+	require.ErrorAs(t, err, &abortErr)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.EqualValues(t, []string{"LogGroup=/awstee/logs, LogStream=app"}, abortErr.Completed)
+	require.EqualValues(t, []string{"s3://awstee-example-com/logs/app.log"}, abortErr.Aborted)
+}
+
+func TestAWSTeeWriterCloseWithContextBlockedWrite(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{Code: "NotFound"},
+	).Times(1)
+	// the upload is stuck with the first part, and the write of the rest is blocked on it
+	s3Client.EXPECT().CreateMultipartUpload(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	).MaxTimes(1)
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	).MaxTimes(1)
+	cfg := &Config{
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{S3: s3Client})
+	require.NoError(t, err)
+	w, err := app.Writer(context.Background(), "app.log")
+	require.NoError(t, err)
+	written := make(chan error, 1)
+	go func() {
+		_, err := w.Write(bytes.Repeat([]byte("hogehoge\n"), 12*1024*1024/9))
+		written <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- w.CloseWithContext(ctx)
+	}()
+	select {
+	case err := <-closed:
+		var abortErr *CloseAbortedError
+		require.ErrorAs(t, err, &abortErr)
+		require.EqualValues(t, []string{"s3://awstee-example-com/logs/app.log"}, abortErr.Aborted)
+	case <-time.After(5 * time.Second):
+		t.Fatal("CloseWithContext is stuck on the blocked write")
+	}
+	select {
+	case err := <-written:
+		require.Error(t, err, "the blocked write fails with the aborted destination")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blocked write is not released")
+	}
+}
+
 func TestS3WriterPutObject(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -70,7 +250,7 @@ func TestS3WriterPutObject(t *testing.T) {
 		URLPrefix: "s3://awstee-example-com/logs/",
 	}
 	require.NoError(t, cfg.Restrict())
-	w, err := newS3Writer(s3Client, cfg, "/test/hogehoge.log")
+	w, err := newS3Writer(context.Background(), slog.Default(), s3Client, cfg, "/test/hogehoge.log", nil)
 	require.NoError(t, err)
 	require.EqualValues(t, "s3://awstee-example-com/logs/test/hogehoge.log", w.String())
 	require.EqualValues(t, "awstee-example-com", w.bucket)
@@ -145,7 +325,7 @@ func TestS3WriterMultiPart(t *testing.T) {
 	}
 
 	require.NoError(t, cfg.Restrict())
-	w, err := newS3Writer(s3Client, cfg, "/test/hogehoge.log")
+	w, err := newS3Writer(context.Background(), slog.Default(), s3Client, cfg, "/test/hogehoge.log", nil)
 	require.NoError(t, err)
 	require.EqualValues(t, 0, buf.Len())
 	require.NoError(t, err)
@@ -199,10 +379,10 @@ func TestCloudwatchLogsWriter(t *testing.T) {
 	).AnyTimes()
 	cfg := &CloudwatchLogsConfig{
 		LogGroup:      "/awstee/hoge",
-		flushInterval: 1 * time.Millisecond,
+		FlushInterval: "1ms",
 	}
 	require.NoError(t, cfg.Restrict())
-	w, err := newCloudWatchLogsWriter(cloudwatchLogsClient, cfg, "/test/hogehoge.log")
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), cloudwatchLogsClient, cfg, "/test/hogehoge.log", time.Now, nil)
 	require.NoError(t, err)
 	require.EqualValues(t, "LogGroup=/awstee/hoge, LogStream=test-hogehoge", w.String())
 	require.EqualValues(t, "/awstee/hoge", w.logGroup)
@@ -224,6 +404,201 @@ func TestCloudwatchLogsWriter(t *testing.T) {
 	close(lines)
 }
 
+func TestCloudwatchLogsWriterFlush(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{
+				{
+					LogStreamName: aws.String("test-hogehoge"),
+				},
+			},
+		},
+		nil,
+	).Times(1)
+	var putCount int32
+	cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			atomic.AddInt32(&putCount, int32(len(input.LogEvents)))
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).Times(1)
+	cfg := &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/hoge",
+		FlushInterval: "1h",
+	}
+	require.NoError(t, cfg.Restrict())
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), cloudwatchLogsClient, cfg, "/test/hogehoge.log", time.Now, nil)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\nhoge\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return w.Stats().Buffered == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, w.Flush(context.Background()))
+	require.EqualValues(t, 2, atomic.LoadInt32(&putCount))
+	require.EqualValues(t, 0, w.Stats().Buffered)
+	require.NoError(t, w.Close())
+	require.Error(t, w.Flush(context.Background()))
+}
+
+func TestCloudwatchLogsWriterFlushAfterWrite(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("test-hogehoge")}},
+		},
+		nil,
+	).Times(1)
+	var putCount int32
+	cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			atomic.AddInt32(&putCount, int32(len(input.LogEvents)))
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).AnyTimes()
+	cfg := &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/hoge",
+		FlushInterval: "1h",
+	}
+	require.NoError(t, cfg.Restrict())
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), cloudwatchLogsClient, cfg, "/test/hogehoge.log", time.Now, nil)
+	require.NoError(t, err)
+	for i := 1; i <= 20; i++ {
+		_, err = io.WriteString(w, "hoge\n\n")
+		require.NoError(t, err)
+		require.NoError(t, w.Flush(context.Background()))
+		require.EqualValues(t, i, atomic.LoadInt32(&putCount), "the line written just before Flush is put")
+	}
+	require.NoError(t, w.Close())
+}
+
+func TestBackgroundWriterErrors(t *testing.T) {
+	reported := make(chan struct{})
+	w, err := newBackgroundWriter(context.Background(), "test", nil, func(_ context.Context, pr *io.PipeReader, report func(error)) {
+		buf := make([]byte, 1)
+		pr.Read(buf)
+		report(errors.New("first"))
+		close(reported)
+		io.Copy(io.Discard, pr)
+		report(errors.New("second"))
+	})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("a"))
+	require.NoError(t, err)
+	<-reported
+	errs := make(chan error, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := w.Write([]byte("b"))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.EqualError(t, err, "first", "the writes after the error fail without waiting")
+	}
+	require.EqualError(t, w.Close(), "first\nsecond", "Close reports all errors")
+	require.EqualValues(t, 2, w.stats("test").Errors)
+}
+
+func TestWritersCanceled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, &smithy.GenericAPIError{Code: "NotFound"}).Times(1)
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	).MaxTimes(1) // the uploader may stop before PutObject
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("test-hogehoge")}},
+		}, nil,
+	).Times(1)
+	s3Cfg := &S3Config{URLPrefix: "s3://awstee/"}
+	require.NoError(t, s3Cfg.Restrict())
+	cwCfg := &CloudwatchLogsConfig{LogGroup: "/awstee/hoge", FlushInterval: "1h"}
+	require.NoError(t, cwCfg.Restrict())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s3w, err := newS3Writer(ctx, slog.Default(), s3Client, s3Cfg, "/test/hogehoge.log", nil)
+	require.NoError(t, err)
+	cww, err := newCloudWatchLogsWriter(ctx, slog.Default(), cloudwatchLogsClient, cwCfg, "/test/hogehoge.log", time.Now, nil)
+	require.NoError(t, err)
+	_, err = io.WriteString(cww, "hoge\n")
+	require.NoError(t, err)
+	cancel()
+	require.ErrorIs(t, s3w.Close(), context.Canceled)
+	require.ErrorIs(t, cww.Close(), context.Canceled)
+}
+
+func TestDryRun(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&s3.HeadObjectOutput{}, &smithy.GenericAPIError{Code: "NotFound"},
+	).Times(1)
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{
+			Code:    "ResourceNotFoundException",
+			Message: "The specified log group does not exist.",
+		},
+	).Times(1)
+
+	cfg := &Config{
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+		},
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup:       "/awstee/hoge",
+			CreateLogGroup: true,
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{
+		S3:             s3Client,
+		CloudwatchLogs: cloudwatchLogsClient,
+	})
+	require.NoError(t, err)
+	destinations, err := app.DryRun(context.Background(), "/test/hogehoge.log")
+	require.NoError(t, err)
+	require.EqualValues(t, []string{
+		"s3://awstee-example-com/logs/test/hogehoge.log",
+		"LogGroup=/awstee/hoge, LogStream=test-hogehoge",
+	}, destinations)
+
+	cfg.Cloudwatch.CreateLogGroup = false
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{
+			Code:    "ResourceNotFoundException",
+			Message: "The specified log group does not exist.",
+		},
+	).Times(1)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&s3.HeadObjectOutput{}, &smithy.GenericAPIError{Code: "NotFound"},
+	).Times(1)
+	_, err = app.DryRun(context.Background(), "/test/hogehoge.log")
+	require.Error(t, err)
+}
+
 type testWriteCloser struct {
 	w  io.Writer
 	fn func() error
@@ -240,3 +615,45 @@ func (w testWriteCloser) Write(p []byte) (int, error) {
 func (w testWriteCloser) Close() error {
 	return w.fn()
 }
+
+// newTestCloudwatchLogsWriter returns the writer of cfg restricted, to the log stream hoge of the output name hoge.log.
+func newTestCloudwatchLogsWriter(t *testing.T, client CloudwatchLogsClient, cfg *CloudwatchLogsConfig) *CloudWatchLogsWriter {
+	t.Helper()
+	require.NoError(t, cfg.Restrict())
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), client, cfg, "hoge.log", time.Now, &destinationHooks{
+		logger:       slog.Default(),
+		errorHandler: func(string, error) {},
+	})
+	require.NoError(t, err)
+	return w
+}
+
+func TestAWSTeeWriterCloseErrors(t *testing.T) {
+	cfg := &Config{}
+	require.NoError(t, cfg.Restrict())
+	errFirst, errSecond := errors.New("first failed"), errors.New("second failed")
+	app, err := NewWithClient(cfg, AWSClient{},
+		WithDestination("first", func(context.Context, string) (io.WriteCloser, error) {
+			return newTestWriteCloser(io.Discard, func() error { return errFirst }), nil
+		}),
+		WithDestination("ok", func(context.Context, string) (io.WriteCloser, error) {
+			return newTestWriteCloser(io.Discard, func() error { return nil }), nil
+		}),
+		WithDestination("second", func(context.Context, string) (io.WriteCloser, error) {
+			return newTestWriteCloser(io.Discard, func() error { return errSecond }), nil
+		}),
+	)
+	require.NoError(t, err)
+	w, err := app.Writer(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	err = w.Close()
+	require.EqualError(t, err, "first: first failed\nsecond: second failed")
+	require.ErrorIs(t, err, errFirst)
+	require.ErrorIs(t, err, errSecond)
+	var destErr *DestinationError
+	require.ErrorAs(t, err, &destErr)
+	require.Equal(t, "first", destErr.Destination)
+	joined, ok := err.(interface{ Unwrap() []error })
+	require.True(t, ok)
+	require.Len(t, joined.Unwrap(), 2)
+}
@@ -0,0 +1,63 @@
+// Package awsteeotel adapts a trace.TracerProvider of OpenTelemetry to awstee.WithTracerProvider,
+// so that the spans of awstee are recorded by the tracing of the application.
+//
+//	app, err := awstee.New(ctx, cfg, awstee.WithTracerProvider(awsteeotel.TracerProvider(otel.GetTracerProvider())))
+package awsteeotel
+
+import (
+	"context"
+
+	"github.com/mashiike/awstee"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerProvider returns the awstee.TracerProvider of tp.
+func TracerProvider(tp trace.TracerProvider) awstee.TracerProvider {
+	return tracerProvider{tp: tp}
+}
+
+type tracerProvider struct{ tp trace.TracerProvider }
+
+func (p tracerProvider) Tracer(name string) awstee.Tracer {
+	return tracer{tracer: p.tp.Tracer(name)}
+}
+
+type tracer struct{ tracer trace.Tracer }
+
+func (t tracer) Start(ctx context.Context, spanName string, attrs ...awstee.Attribute) (context.Context, awstee.Span) {
+	ctx, s := t.tracer.Start(ctx, spanName, trace.WithAttributes(attributes(attrs)...))
+	return ctx, span{span: s}
+}
+
+type span struct{ span trace.Span }
+
+func (s span) SetAttributes(attrs ...awstee.Attribute) {
+	s.span.SetAttributes(attributes(attrs)...)
+}
+
+func (s span) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s span) End() {
+	s.span.End()
+}
+
+// attributes converts attrs to the attributes of OpenTelemetry, skipping the values of the other types than awstee.Attribute documents.
+func attributes(attrs []awstee.Attribute) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		switch v := a.Value.(type) {
+		case string:
+			kvs = append(kvs, attribute.String(a.Key, v))
+		case int64:
+			kvs = append(kvs, attribute.Int64(a.Key, v))
+		case bool:
+			kvs = append(kvs, attribute.Bool(a.Key, v))
+		}
+	}
+	return kvs
+}
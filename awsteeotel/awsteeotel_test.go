@@ -0,0 +1,38 @@
+package awsteeotel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mashiike/awstee"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracerProvider(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := TracerProvider(tp).Tracer("github.com/mashiike/awstee")
+
+	ctx, parent := tracer.Start(context.Background(), "awstee.Writer", awstee.Attribute{Key: "awstee.output_name", Value: "hoge.log"})
+	_, child := tracer.Start(ctx, "s3.UploadPart", awstee.Attribute{Key: "s3.part_number", Value: int64(1)})
+	child.RecordError(errors.New("access denied"))
+	child.End()
+	parent.SetAttributes(awstee.Attribute{Key: "awstee.bytes", Value: int64(10)}, awstee.Attribute{Key: "unknown", Value: 1.5})
+	parent.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	require.Equal(t, "s3.UploadPart", spans[0].Name())
+	require.Equal(t, spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID(), "the span in ctx is the parent")
+	require.Equal(t, []attribute.KeyValue{attribute.Int64("s3.part_number", 1)}, spans[0].Attributes())
+	require.Equal(t, codes.Error, spans[0].Status().Code)
+	require.Len(t, spans[0].Events(), 1, "the error is recorded")
+	require.Equal(t, "awstee.Writer", spans[1].Name())
+	require.Equal(t, []attribute.KeyValue{attribute.String("awstee.output_name", "hoge.log"), attribute.Int64("awstee.bytes", 10)}, spans[1].Attributes())
+	require.Equal(t, "github.com/mashiike/awstee", spans[1].InstrumentationScope().Name)
+}
@@ -0,0 +1,76 @@
+package awstee
+
+import (
+	"log/slog"
+	"time"
+
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+const (
+	// maxPutLogEventsBytes is the bytes of a batch accepted by cloudwatch logs PutLogEvents, counted by cloudwatchEventSize.
+	maxPutLogEventsBytes = 1048576
+	// putLogEventOverheadBytes is the bytes counted for each event in addition to its message.
+	putLogEventOverheadBytes = 26
+
+	// adaptiveMinLinger is how long the first line of a batch waits for the next ones with adaptive_batch, while the input trickles.
+	adaptiveMinLinger = 200 * time.Millisecond
+)
+
+// cloudwatchEventSize is the bytes of event counted for the limit of a batch.
+func cloudwatchEventSize(event cwtypes.InputLogEvent) int {
+	if event.Message == nil {
+		return putLogEventOverheadBytes
+	}
+	return len(*event.Message) + putLogEventOverheadBytes
+}
+
+// batchSizer is the lines of a batch of cloudwatch logs. It is buffer_lines,
+// or with adaptive_batch it grows up to the limit of PutLogEvents while the batches fill up, and shrinks back to buffer_lines while the input trickles.
+// With adaptive_batch, a batch is put when it has waited the linger since its first line, which is short for the small batches. It is used by the worker of a writer only.
+type batchSizer struct {
+	adaptive  bool
+	min       int
+	limit     int
+	maxLinger time.Duration
+	logger    *slog.Logger
+}
+
+func newBatchSizer(logger *slog.Logger, cfg *CloudwatchLogsConfig) *batchSizer {
+	return &batchSizer{
+		adaptive:  cfg.AdaptiveBatch,
+		min:       cfg.BufferLines,
+		limit:     cfg.BufferLines,
+		maxLinger: cfg.flushInterval,
+		logger:    logger,
+	}
+}
+
+// lines is the lines of a batch put as full.
+func (b *batchSizer) lines() int {
+	return b.limit
+}
+
+// linger is how long the first line of a batch waits for the next ones, which grows with the batch up to flush_interval.
+func (b *batchSizer) linger() time.Duration {
+	return min(b.maxLinger, adaptiveMinLinger*time.Duration(b.limit/b.min))
+}
+
+// filled grows the batch, a batch has filled up before the linger.
+func (b *batchSizer) filled() {
+	if b.adaptive && b.limit < maxPutLogEventsCount {
+		b.resize(min(b.limit*2, maxPutLogEventsCount))
+	}
+}
+
+// lingered shrinks the batch, if the batch of n lines put after the linger was much smaller than it.
+func (b *batchSizer) lingered(n int) {
+	if b.adaptive && b.limit > b.min && n < b.limit/4 {
+		b.resize(max(b.limit/2, b.min))
+	}
+}
+
+func (b *batchSizer) resize(limit int) {
+	b.limit = limit
+	b.logger.Debug("cloudwatch logs batch resized", "lines", b.limit, "linger", b.linger())
+}
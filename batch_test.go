@@ -0,0 +1,106 @@
+package awstee
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchSizer(t *testing.T) {
+	cfg := &CloudwatchLogsConfig{LogGroup: "/awstee/logs", BufferLines: 50, AdaptiveBatch: true}
+	require.NoError(t, cfg.Restrict())
+	b := newBatchSizer(slog.Default(), cfg)
+	require.Equal(t, 50, b.lines())
+	require.Equal(t, adaptiveMinLinger, b.linger())
+	for i := 0; i < 10; i++ {
+		b.filled()
+	}
+	require.Equal(t, maxPutLogEventsCount, b.lines(), "up to the limit of PutLogEvents")
+	require.Equal(t, 5*time.Second, b.linger(), "up to flush_interval")
+	b.lingered(maxPutLogEventsCount / 2)
+	require.Equal(t, maxPutLogEventsCount, b.lines(), "not shrunk by a large batch")
+	for i := 0; i < 10; i++ {
+		b.lingered(1)
+	}
+	require.Equal(t, 50, b.lines(), "down to buffer_lines")
+
+	cfg = &CloudwatchLogsConfig{LogGroup: "/awstee/logs", BufferLines: 50}
+	require.NoError(t, cfg.Restrict())
+	b = newBatchSizer(slog.Default(), cfg)
+	b.filled()
+	require.Equal(t, 50, b.lines(), "fixed without adaptive_batch")
+}
+
+func TestCloudwatchLogsWriterAdaptiveBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	var mu sync.Mutex
+	var batches []int
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			batches = append(batches, len(input.LogEvents))
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).AnyTimes()
+	cfg := &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/logs",
+		FlushInterval: "1h",
+		BufferLines:   2,
+		AdaptiveBatch: true,
+	}
+	require.NoError(t, cfg.Restrict())
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), client, cfg, "hoge.log", time.Now, nil)
+	require.NoError(t, err)
+	// a trickle is put after the linger, not flush_interval
+	_, err = io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(batches) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	// the batches grow while they fill up
+	_, err = io.WriteString(w, strings.Repeat("fuga\n", 14))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, []int{1, 2, 4, 8}, batches)
+}
+
+func TestCloudwatchLogsWriterBatchBytes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	var batches []int
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			size := 0
+			for _, e := range input.LogEvents {
+				size += cloudwatchEventSize(e)
+			}
+			require.LessOrEqual(t, size, maxPutLogEventsBytes)
+			batches = append(batches, len(input.LogEvents))
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).AnyTimes()
+	cfg := &CloudwatchLogsConfig{LogGroup: "/awstee/logs", FlushInterval: "1h", BufferLines: 10}
+	require.NoError(t, cfg.Restrict())
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), client, cfg, "hoge.log", time.Now, nil)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, strings.Repeat(strings.Repeat("a", 256000)+"\n", 5))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, []int{4, 1}, batches, "the batches are split by the bytes of PutLogEvents")
+}
@@ -0,0 +1,165 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+)
+
+// The benchmarks fail when the allocations per line exceed these thresholds, so that `make bench` catches the regressions in CI.
+// The time per op is not checked, it depends on the runner.
+const (
+	benchTeeReaderMaxAllocs          = 0.1
+	benchTeeReaderProcessorMaxAllocs = 1.5
+	benchCloudwatchMaxAllocs         = 1
+	benchS3MaxAllocs                 = 0.1
+)
+
+// benchmarkInput is lines of lineBytes each, the last byte of which is a newline.
+func benchmarkInput(lines, lineBytes int) []byte {
+	line := append(bytes.Repeat([]byte("x"), lineBytes-1), '\n')
+	return bytes.Repeat(line, lines)
+}
+
+// measureAllocs runs fn b.N times and then wait with the timer, and fails b when the allocations per line exceed max.
+// wait is for the goroutines of the destinations to catch up, so that their allocations are counted.
+func measureAllocs(b *testing.B, lines int, max float64, fn func(), wait func() error) {
+	b.Helper()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	mallocs := ms.Mallocs
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fn()
+	}
+	if err := wait(); err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&ms)
+	allocs := float64(ms.Mallocs-mallocs) / float64(b.N*lines)
+	b.ReportMetric(allocs, "allocs/line")
+	if allocs > max {
+		b.Errorf("%.2f allocs/line exceeds the threshold %.2f", allocs, max)
+	}
+}
+
+func BenchmarkAWSTeeReader(b *testing.B) {
+	input := benchmarkInput(1024, 128)
+	cases := []struct {
+		name       string
+		processors []lineProcessor
+		maxAllocs  float64
+	}{
+		{name: "plain", maxAllocs: benchTeeReaderMaxAllocs},
+		{name: "line_prefix", processors: []lineProcessor{newPrefixProcessor("[app] ")}, maxAllocs: benchTeeReaderProcessorMaxAllocs},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+			w := newAWSTeeWriter(
+				[]io.WriteCloser{newTestWriteCloser(io.Discard, func() error { return nil })},
+				c.processors...,
+			)
+			r := bytes.NewReader(input)
+			buf := make([]byte, 32*1024)
+			measureAllocs(b, 1024, c.maxAllocs, func() {
+				r.Reset(input)
+				if _, err := io.CopyBuffer(w, r, buf); err != nil {
+					b.Fatal(err)
+				}
+			}, func() error {
+				return w.Flush(context.Background())
+			})
+			if err := w.Close(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkCloudwatchLogsWriter(b *testing.B) {
+	for _, lineBytes := range []int{64, 1024} {
+		b.Run(fmt.Sprintf("line_%dB", lineBytes), func(b *testing.B) {
+			ctrl := gomock.NewController(b)
+			defer ctrl.Finish()
+			client := NewMockCloudwatchLogsClient(ctrl)
+			expectDescribeLogStreams(client)
+			client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudwatchlogs.PutLogEventsOutput{}, nil).AnyTimes()
+			cfg := &CloudwatchLogsConfig{LogGroup: "/awstee/logs", FlushInterval: "1h"}
+			if err := cfg.Restrict(); err != nil {
+				b.Fatal(err)
+			}
+			now := time.Now()
+			w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), client, cfg, "hoge.log", func() time.Time { return now }, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			input := benchmarkInput(256, lineBytes)
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+			measureAllocs(b, 256, benchCloudwatchMaxAllocs, func() {
+				if _, err := w.Write(input); err != nil {
+					b.Fatal(err)
+				}
+			}, func() error {
+				return w.Flush(context.Background())
+			})
+			if err := w.Close(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkS3Writer(b *testing.B) {
+	ctrl := gomock.NewController(b)
+	defer ctrl.Finish()
+	client := NewMockS3Client(ctrl)
+	client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, &smithy.GenericAPIError{Code: "NotFound"}).AnyTimes()
+	client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			_, err := io.Copy(io.Discard, input.Body)
+			return &s3.PutObjectOutput{}, err
+		},
+	).AnyTimes()
+	client.EXPECT().CreateMultipartUpload(gomock.Any(), gomock.Any(), gomock.Any()).Return(&s3.CreateMultipartUploadOutput{UploadId: aws.String("upload_id")}, nil).AnyTimes()
+	client.EXPECT().UploadPart(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+			_, err := io.Copy(io.Discard, input.Body)
+			return &s3.UploadPartOutput{ETag: aws.String("etag")}, err
+		},
+	).AnyTimes()
+	client.EXPECT().CompleteMultipartUpload(gomock.Any(), gomock.Any(), gomock.Any()).Return(&s3.CompleteMultipartUploadOutput{}, nil).AnyTimes()
+	cfg := &S3Config{URLPrefix: "s3://awstee-example-com/logs/"}
+	if err := cfg.Restrict(); err != nil {
+		b.Fatal(err)
+	}
+	w, err := newS3Writer(context.Background(), slog.Default(), client, cfg, "hoge.log", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	input := benchmarkInput(512, 128)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	measureAllocs(b, 512, benchS3MaxAllocs, func() {
+		if _, err := w.Write(input); err != nil {
+			b.Fatal(err)
+		}
+	}, func() error { return nil })
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
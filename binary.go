@@ -0,0 +1,80 @@
+package awstee
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+)
+
+// The policies of binary, for the binary lines written to a destination.
+const (
+	// BinaryBase64 writes the binary line as binaryBase64Prefix and the base64 of it.
+	BinaryBase64 = "base64"
+	// BinaryMarker replaces the binary line with a marker of its size.
+	BinaryMarker = "marker"
+	// BinaryRaw switches the destination to raw at the first binary line: the lines from it are written as they are, without the processing of the destination.
+	BinaryRaw = "raw"
+)
+
+// binaryBase64Prefix starts the line of a binary line encoded by BinaryBase64.
+const binaryBase64Prefix = "[awstee] base64 "
+
+func restrictBinary(policy string) error {
+	switch policy {
+	case "", BinaryBase64, BinaryMarker, BinaryRaw:
+		return nil
+	}
+	return fmt.Errorf("binary must be one of %s, %s, %s", BinaryBase64, BinaryMarker, BinaryRaw)
+}
+
+// isBinaryLine reports whether line has a NUL or the other control characters not of a text, such as the ones of a binary chunk.
+// The tabs, the escape sequences of the colors and the like are of a text.
+func isBinaryLine(line []byte) bool {
+	for _, c := range line {
+		if c >= 0x20 {
+			continue
+		}
+		switch c {
+		case '\t', '\b', '\v', '\f', '\r', 0x1b:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// binaryProcessor returns the line processor of the binary lines by BinaryBase64 or BinaryMarker, which writes the text lines as they are.
+func binaryProcessor(policy string) lineProcessor {
+	var buf []byte
+	return func(line []byte) []byte {
+		if !isBinaryLine(line) {
+			return line
+		}
+		buf = buf[:0]
+		if policy == BinaryMarker {
+			buf = append(buf, "[awstee] binary line of "...)
+			buf = strconv.AppendInt(buf, int64(len(line)), 10)
+			return append(buf, " bytes omitted"...)
+		}
+		buf = append(buf, binaryBase64Prefix...)
+		n := len(buf)
+		buf = append(buf, make([]byte, base64.StdEncoding.EncodedLen(len(line)))...)
+		base64.StdEncoding.Encode(buf[n:], line)
+		return buf
+	}
+}
+
+// binaryRawProcessor returns the line processor running processors until the first binary line, and writing the lines from it as they are by BinaryRaw.
+func binaryRawProcessor(processors []lineProcessor) lineProcessor {
+	lw := newLineWriter(nil, processors)
+	raw := false
+	return func(line []byte) []byte {
+		if !raw && isBinaryLine(line) {
+			raw = true
+		}
+		if raw {
+			return line
+		}
+		return lw.process(line)
+	}
+}
@@ -0,0 +1,64 @@
+package awstee
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsBinaryLine(t *testing.T) {
+	for line, expected := range map[string]bool{
+		"hoge":                    false,
+		"":                        false,
+		"ho\tge\r":                false,
+		"\x1b[31mred\x1b[0m":      false,
+		"ほげ":                      false,
+		"ho\x00ge":                true,
+		"\x7fELF\x02\x01\x01\x03": true,
+	} {
+		require.Equal(t, expected, isBinaryLine([]byte(line)), "%q", line)
+	}
+}
+
+func TestLinesConfigBinary(t *testing.T) {
+	input := "hoge\nfu\x00ga\nDEBUG piyo\n"
+	cases := []struct {
+		cfg      LinesConfig
+		expected string
+	}{
+		{
+			cfg:      LinesConfig{Binary: BinaryBase64},
+			expected: "hoge\n[awstee] base64 ZnUAZ2E=\nDEBUG piyo\n",
+		},
+		{
+			cfg:      LinesConfig{Binary: BinaryMarker},
+			expected: "hoge\n[awstee] binary line of 5 bytes omitted\nDEBUG piyo\n",
+		},
+		{
+			cfg:      LinesConfig{Binary: BinaryRaw, Filters: FilterConfig{Exclude: []string{"^DEBUG"}}},
+			expected: "hoge\nfu\x00ga\nDEBUG piyo\n",
+		},
+		{
+			cfg:      LinesConfig{Filters: FilterConfig{Exclude: []string{"^DEBUG"}}},
+			expected: "hoge\nfu\x00ga\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.cfg.Binary, func(t *testing.T) {
+			require.NoError(t, c.cfg.Restrict())
+			var buf bytes.Buffer
+			processors, _ := c.cfg.processors(newRunMetadata("hoge.log"))
+			w := newLineWriter(&buf, processors)
+			_, err := io.WriteString(w, input)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, buf.String())
+		})
+	}
+
+	cfg := &LinesConfig{Binary: "hex"}
+	require.EqualError(t, cfg.Restrict(), "binary must be one of base64, marker, raw")
+	cwCfg := &CloudwatchLogsConfig{LogGroup: "/awstee/logs", Lines: LinesConfig{Binary: BinaryRaw}}
+	require.EqualError(t, cwCfg.Restrict(), "cloudwatch binary must be base64 or marker, the events of cloudwatch logs can not have the binary lines")
+}
@@ -0,0 +1,77 @@
+package awstee
+
+import (
+	"errors"
+	"strconv"
+)
+
+// CaptureConfig keeps only the first head lines and the last tail lines written to a destination, and a marker of the lines omitted between them.
+type CaptureConfig struct {
+	Head int `yaml:"head,omitempty"`
+	Tail int `yaml:"tail,omitempty"`
+}
+
+func (cfg *CaptureConfig) Enabled() bool {
+	return cfg.Head > 0 || cfg.Tail > 0
+}
+
+func (cfg *CaptureConfig) Restrict() error {
+	if cfg.Head < 0 {
+		return errors.New("capture head must not be negative")
+	}
+	if cfg.Tail < 0 {
+		return errors.New("capture tail must not be negative")
+	}
+	return nil
+}
+
+func (cfg *CaptureConfig) newCapturer() *capturer {
+	return &capturer{head: cfg.Head, tail: make([][]byte, 0, cfg.Tail), size: cfg.Tail}
+}
+
+// capturer writes the first head lines, and holds the last ones in the ring of tail, written by Close after the marker of the lines omitted.
+// It is not safe for concurrent use.
+type capturer struct {
+	head    int
+	lines   int
+	size    int
+	tail    [][]byte
+	next    int
+	omitted int64
+}
+
+func (c *capturer) process(line []byte) []byte {
+	c.lines++
+	if c.lines <= c.head {
+		return line
+	}
+	if c.size == 0 {
+		c.omitted++
+		return nil
+	}
+	if len(c.tail) < c.size {
+		c.tail = append(c.tail, append([]byte(nil), line...))
+		return nil
+	}
+	// the oldest line of the ring is omitted, its buffer is reused
+	c.omitted++
+	c.tail[c.next] = append(c.tail[c.next][:0], line...)
+	c.next = (c.next + 1) % c.size
+	return nil
+}
+
+// finish returns the marker of the lines omitted and the lines of the tail.
+func (c *capturer) finish() []byte {
+	var out []byte
+	if c.omitted > 0 {
+		out = append(out, "[awstee] "...)
+		out = strconv.AppendInt(out, c.omitted, 10)
+		out = append(out, " lines omitted\n"...)
+	}
+	for i := range c.tail {
+		out = append(out, c.tail[(c.next+i)%len(c.tail)]...)
+		out = append(out, '\n')
+	}
+	c.tail, c.next, c.omitted = c.tail[:0], 0, 0
+	return out
+}
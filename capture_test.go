@@ -0,0 +1,73 @@
+package awstee
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureConfig(t *testing.T) {
+	lines := func(from, to int) string {
+		var b strings.Builder
+		for i := from; i <= to; i++ {
+			fmt.Fprintf(&b, "line %d\n", i)
+		}
+		return b.String()
+	}
+	cases := []struct {
+		name     string
+		cfg      LinesConfig
+		input    string
+		expected string
+	}{
+		{
+			name:     "head and tail",
+			cfg:      LinesConfig{Capture: CaptureConfig{Head: 2, Tail: 3}},
+			input:    lines(1, 10),
+			expected: lines(1, 2) + "[awstee] 5 lines omitted\n" + lines(8, 10),
+		},
+		{
+			name:     "head",
+			cfg:      LinesConfig{Capture: CaptureConfig{Head: 2}},
+			input:    lines(1, 10),
+			expected: lines(1, 2) + "[awstee] 8 lines omitted\n",
+		},
+		{
+			name:     "tail",
+			cfg:      LinesConfig{Capture: CaptureConfig{Tail: 3}},
+			input:    lines(1, 10),
+			expected: "[awstee] 7 lines omitted\n" + lines(8, 10),
+		},
+		{
+			name:     "short",
+			cfg:      LinesConfig{Capture: CaptureConfig{Head: 2, Tail: 3}},
+			input:    lines(1, 4),
+			expected: lines(1, 4),
+		},
+		{
+			name:     "repeats collapsed before",
+			cfg:      LinesConfig{DedupRepeats: true, Capture: CaptureConfig{Head: 1, Tail: 2}},
+			input:    "hoge\nfuga\npiyo\nretry\nretry\nretry",
+			expected: "hoge\n[awstee] 2 lines omitted\nretry\nlast message repeated 2 times\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.NoError(t, c.cfg.Restrict())
+			processors, finish := c.cfg.processors(&runMetadata{})
+			var buf bytes.Buffer
+			w := newLineDestination(newTestWriteCloser(&buf, func() error { return nil }), processors, finish)
+			_, err := io.WriteString(w, c.input)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			require.Equal(t, c.expected, buf.String())
+		})
+	}
+
+	cfg := &CaptureConfig{Tail: -1}
+	require.EqualError(t, cfg.Restrict(), "capture tail must not be negative")
+}
@@ -0,0 +1,94 @@
+package awstee
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Cat writes the captured output of outputName to w.
+// It reads the S3 object if s3 is configured, otherwise the cloudwatch logs stream. With multiple destinations, the first one is read.
+func (app *AWSTee) Cat(ctx context.Context, outputName string, w io.Writer) error {
+	s3Configs, cloudwatchConfigs := app.cfg.destinations(outputName)
+	switch {
+	case len(s3Configs) > 0:
+		return app.catS3(ctx, s3Configs[0], outputName, w)
+	case len(cloudwatchConfigs) > 0:
+		return app.catCloudwatchLogs(ctx, cloudwatchConfigs[0], outputName, w)
+	default:
+		return errors.New("no destination")
+	}
+}
+
+func (app *AWSTee) catS3(ctx context.Context, cfg *S3Config, outputName string, w io.Writer) error {
+	bucket, key := s3ObjectLocation(cfg, outputName)
+	app.logger.Debug("get s3 object", "destination", fmt.Sprintf("s3://%s/%s", bucket, key))
+	output, err := app.s3Client(cfg).GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("get s3://%s/%s: %w", bucket, key, err)
+	}
+	defer output.Body.Close()
+	br := bufio.NewReader(output.Body)
+	var r io.Reader = br
+	if isEncrypted(br) {
+		dr, err := newDecryptReader(ctx, app.kmsClient(cfg), br)
+		if err != nil {
+			return fmt.Errorf("decrypt s3://%s/%s: %w", bucket, key, err)
+		}
+		r = dr
+	} else if isGzip(br, key, aws.ToString(output.ContentEncoding)) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("decompress s3://%s/%s: %w", bucket, key, err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// isGzip reports whether the object is gzip compressed, by the key, the content encoding or the magic number.
+func isGzip(br *bufio.Reader, key string, contentEncoding string) bool {
+	if strings.HasSuffix(key, ".gz") || strings.EqualFold(contentEncoding, "gzip") {
+		return true
+	}
+	magic, err := br.Peek(2)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+func (app *AWSTee) catCloudwatchLogs(ctx context.Context, cfg *CloudwatchLogsConfig, outputName string, w io.Writer) error {
+	logGroup := cfg.LogGroup
+	logStream := cloudwatchLogStreamName(outputName)
+	app.logger.Debug("get log events", "destination", fmt.Sprintf("LogGroup=%s, LogStream=%s", logGroup, logStream))
+	p := cloudwatchlogs.NewGetLogEventsPaginator(app.cloudwatchClient(cfg), &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(logGroup),
+		LogStreamName: aws.String(logStream),
+		StartFromHead: aws.Bool(true),
+	}, func(o *cloudwatchlogs.GetLogEventsPaginatorOptions) {
+		o.StopOnDuplicateToken = true
+	})
+	for p.HasMorePages() {
+		output, err := p.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("get log events %s: %w", logStream, err)
+		}
+		for _, event := range output.Events {
+			if _, err := fmt.Fprintln(w, aws.ToString(event.Message)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package awstee
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatS3(t *testing.T) {
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	io.WriteString(gw, "hoge\nfuga\n")
+	require.NoError(t, gw.Close())
+	cases := []struct {
+		casename string
+		body     []byte
+	}{
+		{casename: "plain", body: []byte("hoge\nfuga\n")},
+		{casename: "gzip", body: gz.Bytes()},
+	}
+	for _, c := range cases {
+		t.Run(c.casename, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			s3Client := NewMockS3Client(ctrl)
+			s3Client.EXPECT().GetObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+				func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					require.EqualValues(t, "awstee-example-com", *input.Bucket)
+					require.EqualValues(t, "logs/test/hogehoge.log", *input.Key)
+					return &s3.GetObjectOutput{
+						Body: io.NopCloser(bytes.NewReader(c.body)),
+					}, nil
+				},
+			).Times(1)
+			cfg := &Config{
+				S3: &S3Config{
+					URLPrefix: "s3://awstee-example-com/logs/",
+				},
+			}
+			require.NoError(t, cfg.Restrict())
+			app, err := NewWithClient(cfg, AWSClient{S3: s3Client})
+			require.NoError(t, err)
+			var buf bytes.Buffer
+			require.NoError(t, app.Cat(context.Background(), "/test/hogehoge.log", &buf))
+			require.EqualValues(t, "hoge\nfuga\n", buf.String())
+		})
+	}
+}
+
+func TestCatCloudwatchLogs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	pages := map[string]*cloudwatchlogs.GetLogEventsOutput{
+		"": {
+			Events:           []types.OutputLogEvent{{Message: aws.String("hoge")}},
+			NextForwardToken: aws.String("f/1"),
+		},
+		"f/1": {
+			Events:           []types.OutputLogEvent{{Message: aws.String("fuga")}},
+			NextForwardToken: aws.String("f/2"),
+		},
+		"f/2": {
+			NextForwardToken: aws.String("f/2"),
+		},
+	}
+	cloudwatchLogsClient.EXPECT().GetLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.GetLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+			require.EqualValues(t, "/awstee/hoge", *input.LogGroupName)
+			require.EqualValues(t, "test-hogehoge", *input.LogStreamName)
+			require.True(t, *input.StartFromHead)
+			return pages[aws.ToString(input.NextToken)], nil
+		},
+	).Times(3)
+	cfg := &Config{
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup: "/awstee/hoge",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{CloudwatchLogs: cloudwatchLogsClient})
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, app.Cat(context.Background(), "/test/hogehoge.log", &buf))
+	require.EqualValues(t, "hoge\nfuga\n", buf.String())
+}
@@ -0,0 +1,111 @@
+package awstee
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const defaultCircuitBreakerProbe = 30 * time.Second
+
+// errCircuitOpen is the error of the batches not put while the circuit is open.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreakerConfig isolates a cloudwatch logs destination failing consecutively.
+// After failures consecutive failures of PutLogEvents, the circuit opens and the batches are not put until probe elapses,
+// then the next batch probes the destination: its success closes the circuit, and its failure opens it again.
+// The failed batches are dropped (or spilled, see SpillConfig) without stopping the writes.
+type CircuitBreakerConfig struct {
+	Failures int    `yaml:"failures,omitempty"`
+	Probe    string `yaml:"probe,omitempty"`
+
+	probe time.Duration
+}
+
+func (cfg *CircuitBreakerConfig) Enabled() bool {
+	return cfg.Failures > 0
+}
+
+func (cfg *CircuitBreakerConfig) Restrict() error {
+	if cfg.Failures < 0 {
+		return errors.New("circuit_breaker failures must not be negative")
+	}
+	var err error
+	if cfg.probe, err = parseOptionalDuration(cfg.Probe); err != nil {
+		return fmt.Errorf("circuit_breaker probe is invalid format: %w", err)
+	}
+	if cfg.probe == 0 {
+		cfg.probe = defaultCircuitBreakerProbe
+	}
+	return nil
+}
+
+// circuitBreaker counts the consecutive failures of a destination. It is used by the worker of the destination,
+// and only Open is safe for concurrent use. The nil circuitBreaker is always closed.
+type circuitBreaker struct {
+	cfg      *CircuitBreakerConfig
+	logger   *slog.Logger
+	now      func() time.Time
+	failures int
+	lastErr  error
+	openedAt time.Time
+	open     atomic.Bool
+}
+
+func newCircuitBreaker(logger *slog.Logger, cfg *CircuitBreakerConfig, now func() time.Time) *circuitBreaker {
+	if !cfg.Enabled() {
+		return nil
+	}
+	return &circuitBreaker{
+		cfg:    cfg,
+		logger: logger,
+		now:    now,
+	}
+}
+
+// allow reports whether the next call is allowed: the circuit is closed, or it is the time to probe.
+func (b *circuitBreaker) allow() bool {
+	if b == nil || !b.open.Load() {
+		return true
+	}
+	return b.now().Sub(b.openedAt) >= b.cfg.probe
+}
+
+// err returns the error of the calls not allowed, with the last failure.
+func (b *circuitBreaker) err() error {
+	return fmt.Errorf("%w: %w", errCircuitOpen, b.lastErr)
+}
+
+// record counts the result of the call allowed.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	if err == nil {
+		if b.open.Load() {
+			b.logger.Info("circuit breaker is closed", "failures", b.failures)
+			b.open.Store(false)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	b.lastErr = err
+	if b.failures < b.cfg.Failures {
+		return
+	}
+	if b.open.Load() {
+		b.logger.Warn("circuit breaker probe failed", "failures", b.failures, "next_probe", b.cfg.probe, "error", err)
+	} else {
+		b.logger.Warn("circuit breaker is open", "failures", b.failures, "next_probe", b.cfg.probe, "error", err)
+		b.open.Store(true)
+	}
+	b.openedAt = b.now()
+}
+
+// Open reports whether the circuit is open.
+func (b *circuitBreaker) Open() bool {
+	return b != nil && b.open.Load()
+}
@@ -0,0 +1,83 @@
+package awstee
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreakerConfigRestrict(t *testing.T) {
+	cfg := &CircuitBreakerConfig{Failures: 3}
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, 30*time.Second, cfg.probe)
+	require.EqualError(t, (&CircuitBreakerConfig{Failures: -1}).Restrict(), "circuit_breaker failures must not be negative")
+	require.Error(t, (&CircuitBreakerConfig{Probe: "soon"}).Restrict())
+}
+
+func TestCloudwatchLogsWriterCircuitBreaker(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	var messages []string
+	gomock.InOrder(
+		client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			nil, &smithy.GenericAPIError{Code: "ThrottlingException"},
+		).Times(2),
+		client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+				for _, event := range input.LogEvents {
+					messages = append(messages, *event.Message)
+				}
+				return &cloudwatchlogs.PutLogEventsOutput{}, nil
+			},
+		).Times(2),
+	)
+	cfg := &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/logs",
+		FlushInterval: "1h",
+		CircuitBreaker: CircuitBreakerConfig{
+			Failures: 2,
+			Probe:    "1m",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	now := time.Date(2022, 6, 3, 17, 20, 0, 0, time.UTC)
+	var notified int
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), client, cfg, "hoge.log", func() time.Time { return now }, &destinationHooks{
+		logger:       slog.Default(),
+		errorHandler: func(string, error) { notified++ },
+	})
+	require.NoError(t, err)
+
+	for _, line := range []string{"hoge\n", "fuga\n"} {
+		_, err = io.WriteString(w, line)
+		require.NoError(t, err)
+		require.Error(t, w.Flush(context.Background()))
+	}
+	require.True(t, w.Stats().CircuitOpen, "opened by 2 consecutive failures")
+
+	_, err = io.WriteString(w, "piyo\n")
+	require.NoError(t, err, "the writes go on while the circuit is open")
+	require.ErrorIs(t, w.Flush(context.Background()), errCircuitOpen, "not put until the probe")
+	require.EqualValues(t, 3, w.Stats().Dropped)
+
+	now = now.Add(time.Minute)
+	_, err = io.WriteString(w, "tora\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Flush(context.Background()), "the probe succeeds")
+	require.False(t, w.Stats().CircuitOpen)
+
+	_, err = io.WriteString(w, "neko\n")
+	require.NoError(t, err)
+	require.EqualError(t, w.Close(), "put log events: 3 events are dropped by the circuit breaker: api error ThrottlingException: ")
+	require.Equal(t, []string{"tora", "neko"}, messages)
+	require.Equal(t, 3, notified, "2 failures and the drop on close")
+}
@@ -0,0 +1,530 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// run is the background writer of w: the lines read from pr are buffered by cloudwatchBatcher and put by cloudwatchSender.
+func (w *CloudWatchLogsWriter) run(ctx context.Context, sender *cloudwatchSender, pr *io.PipeReader, report func(error)) {
+	w.logger.Debug("start cloudwatch logs writer")
+	defer func() {
+		w.logger.Debug("end cloudwatch logs writer")
+	}()
+	defer w.watchdog.start()()
+	if w.spill != nil {
+		defer w.spill.Close()
+	}
+	if w.wal != nil {
+		defer w.wal.finish()
+	}
+	cfg := sender.cfg
+	lr := newLineReader(pr, cfg.maxLineBytes, cfg.onLongLine, func() {
+		atomic.AddInt64(&w.truncated, 1)
+		w.logger.Warn("line is longer than max_line_bytes", "max_line_bytes", cfg.maxLineBytes, "on_long_line", cfg.onLongLine)
+	})
+	// the lines of a read are sent at once, their messages sharing a string
+	lines := make(chan *cloudwatchLineChunk, 0)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.readChunks(ctx, lr, cfg.timestamps, lines, report)
+	}()
+
+	b := newCloudwatchBatcher(w, sender)
+	t := time.NewTicker(cfg.flushInterval)
+	defer t.Stop()
+	isDone := false
+	for !isDone {
+		select {
+		case chunk, ok := <-lines:
+			if !ok {
+				// closed
+				isDone = true
+				break
+			}
+			b.add(chunk)
+			putLineChunk(chunk)
+			b.answerFlushRequests()
+		case <-t.C:
+			b.putEvents("flush interval", false)
+		case <-b.lingerC:
+			b.lingerC = nil
+			n := len(b.events)
+			b.putEvents("linger", false)
+			b.sizer.lingered(n)
+		case req := <-w.flushCh:
+			b.flushRequests = append(b.flushRequests, req)
+			b.answerFlushRequests()
+		case <-ctx.Done():
+			// canceled, the buffered events can not be put
+			pr.CloseWithError(ctx.Err())
+			isDone = true
+		}
+		atomic.StoreInt64(&w.buffered, int64(len(b.events)))
+	}
+	for chunk := range lines {
+		b.walEvents += int64(chunk.lines)
+		b.events = append(b.events, chunk.events...)
+		putLineChunk(chunk)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		b.stopSender()
+		b.answerAll(err)
+		report(err)
+		return
+	}
+	err := b.putEvents("on close", true)
+	b.stopSender()
+	for _, e := range sender.closeErrors(err) {
+		err = e
+		report(e)
+	}
+	b.answerAll(err)
+	atomic.StoreInt64(&w.buffered, 0)
+}
+
+// readChunks reads the lines of lr to the chunks of events sent to lines, until lr ends. lines is closed at the end.
+func (w *CloudWatchLogsWriter) readChunks(ctx context.Context, lr *lineReader, timestamps *TimestampConfig, lines chan<- *cloudwatchLineChunk, report func(error)) {
+	w.logger.Debug("start cloudwatch logs buffering worker")
+	defer func() {
+		w.logger.Debug("end cloudwatch logs buffering worker")
+	}()
+	defer close(lines)
+	var arena cloudwatchEventArena
+	var stamper *eventStamper
+	if timestamps != nil {
+		stamper = &eventStamper{cfg: timestamps}
+	}
+	for {
+		chunk := getLineChunk()
+		// empty lines are also counted for Flush
+		_, err := lr.readLines(chunk.add)
+		if err != nil {
+			putLineChunk(chunk)
+			if err != io.EOF && ctx.Err() == nil {
+				report(err)
+			}
+			return
+		}
+		arrival := w.now()
+		chunk.build(&arena, arrival.UnixMilli())
+		if stamper != nil {
+			stamper.stamp(chunk.events, arrival)
+		}
+		lines <- chunk
+	}
+}
+
+// cloudwatchBatcher buffers the events into the batches by the size, the linger and the flushes,
+// and hands them to the sender, in order by the goroutine of in_flight_batches if set.
+// It is used by the goroutine of run only.
+type cloudwatchBatcher struct {
+	w           *CloudWatchLogsWriter
+	sender      *cloudwatchSender
+	events      []cwtypes.InputLogEvent
+	eventsBytes int
+	sizer       *batchSizer
+	// with adaptive_batch, linger is the timer of the first line buffered
+	linger  *time.Timer
+	lingerC <-chan time.Time
+	// walEvents is the events in the wal of the lines received after the last batch, including the empty lines.
+	walEvents int64
+	// received is the number of the lines received, and the flush requests wait for the lines written before them
+	received      int64
+	flushRequests []cloudwatchFlushRequest
+	// with in_flight_batches, the batches are put in order by the sender while the lines keep being buffered.
+	sendQueue  chan cloudwatchPutRequest
+	senderDone chan struct{}
+}
+
+func newCloudwatchBatcher(w *CloudWatchLogsWriter, sender *cloudwatchSender) *cloudwatchBatcher {
+	b := &cloudwatchBatcher{
+		w:          w,
+		sender:     sender,
+		events:     getEventBatch(sender.cfg.BufferLines),
+		sizer:      newBatchSizer(w.logger, sender.cfg),
+		senderDone: make(chan struct{}),
+	}
+	if n := sender.cfg.inFlightBatches; n > 1 {
+		b.sendQueue = make(chan cloudwatchPutRequest, n-1)
+		go b.send(b.sendQueue)
+	} else {
+		close(b.senderDone)
+	}
+	return b
+}
+
+// send puts the batches queued in order. The errors of the batches not waited are returned by the next one waited.
+func (b *cloudwatchBatcher) send(queue <-chan cloudwatchPutRequest) {
+	defer close(b.senderDone)
+	var sendErr error
+	for req := range queue {
+		err := b.sender.putBatch(req.reason, req.batch, req.walEvents)
+		atomic.AddInt64(&b.w.inFlight, -int64(len(req.batch)))
+		if req.done == nil {
+			if sendErr == nil {
+				sendErr = err
+			}
+			continue
+		}
+		if err == nil {
+			err = sendErr
+		}
+		sendErr = nil
+		req.done <- err
+	}
+}
+
+func (b *cloudwatchBatcher) stopSender() {
+	if b.sendQueue != nil {
+		close(b.sendQueue)
+		b.sendQueue = nil
+	}
+	<-b.senderDone
+}
+
+// add buffers the events of chunk, putting the batches filled by the count or the bytes.
+func (b *cloudwatchBatcher) add(chunk *cloudwatchLineChunk) {
+	// the lines up to the event completing a batch are in the wal of the batch
+	consumed := 0
+	putFull := func(lines int) {
+		b.walEvents += int64(lines - consumed)
+		consumed = lines
+		b.putEvents("over limit", false)
+		b.sizer.filled()
+	}
+	for i, event := range chunk.events {
+		size := cloudwatchEventSize(event)
+		if len(b.events) > 0 && b.eventsBytes+size > maxPutLogEventsBytes {
+			putFull(chunk.starts[i])
+		}
+		b.events = append(b.events, event)
+		b.eventsBytes += size
+		if len(b.events) >= b.sizer.lines() {
+			putFull(chunk.ends[i])
+		}
+	}
+	b.walEvents += int64(chunk.lines - consumed)
+	if b.sizer.adaptive && len(b.events) > 0 && b.lingerC == nil {
+		if b.linger == nil {
+			b.linger = time.NewTimer(b.sizer.linger())
+		} else {
+			b.linger.Reset(b.sizer.linger())
+		}
+		b.lingerC = b.linger.C
+	}
+	b.received += int64(chunk.lines)
+}
+
+// putEvents puts the buffered events, and wait returns the result of it and of the batches before it.
+func (b *cloudwatchBatcher) putEvents(reason string, wait bool) error {
+	var batch []cwtypes.InputLogEvent
+	if len(b.events) > 0 {
+		batch, b.events = b.events, getEventBatch(b.sizer.lines())
+	}
+	b.eventsBytes = 0
+	if b.linger != nil && !b.linger.Stop() {
+		// drained not to fire the next linger at once
+		select {
+		case <-b.linger.C:
+		default:
+		}
+	}
+	b.lingerC = nil
+	walN := b.walEvents
+	b.walEvents = 0
+	if b.sendQueue == nil {
+		return b.sender.putBatch(reason, batch, walN)
+	}
+	atomic.AddInt64(&b.w.inFlight, int64(len(batch)))
+	req := cloudwatchPutRequest{reason: reason, batch: batch, walEvents: walN}
+	if wait {
+		req.done = make(chan error, 1)
+	}
+	b.sendQueue <- req
+	if !wait {
+		return nil
+	}
+	return <-req.done
+}
+
+// answerFlushRequests puts the buffered events for the flush requests whose lines are received, and answers them.
+func (b *cloudwatchBatcher) answerFlushRequests() {
+	var ready, waiting []cloudwatchFlushRequest
+	for _, req := range b.flushRequests {
+		if req.lines <= b.received {
+			ready = append(ready, req)
+		} else {
+			waiting = append(waiting, req)
+		}
+	}
+	if len(ready) == 0 {
+		return
+	}
+	err := b.putEvents("on flush", true)
+	for _, req := range ready {
+		req.done <- err
+	}
+	b.flushRequests = waiting
+}
+
+// answerAll answers the flush requests left at the end by err.
+func (b *cloudwatchBatcher) answerAll(err error) {
+	for _, req := range b.flushRequests {
+		req.done <- err
+	}
+	b.flushRequests = nil
+}
+
+// cloudwatchSender puts the batches of a CloudWatchLogsWriter with the retries, the dedup of the ambiguous batches,
+// the replay of the spill, the circuit breaker and the trim of the wal. It is used by one goroutine at once.
+type cloudwatchSender struct {
+	w             *CloudWatchLogsWriter
+	ctx           context.Context
+	client        CloudwatchLogsClient
+	cfg           *CloudwatchLogsConfig
+	hooks         *destinationHooks
+	dest          string
+	report        func(error)
+	sequenceToken *string
+	ledger        *batchLedger
+	putOptions    []func(*cloudwatchlogs.Options)
+
+	// the last errors of the batches spilled, dropped by the circuit breaker and dropped by the full spill
+	spillErr, dropErr, fullErr  error
+	breakerDropped, fullDropped int64
+	// walKept is set when a batch is not acknowledged, and the wal is kept from it
+	walKept bool
+}
+
+func newCloudwatchSender(ctx context.Context, w *CloudWatchLogsWriter, client CloudwatchLogsClient, cfg *CloudwatchLogsConfig, hooks *destinationHooks, dest string, sequenceToken *string, report func(error)) *cloudwatchSender {
+	s := &cloudwatchSender{
+		w:             w,
+		ctx:           ctx,
+		client:        client,
+		cfg:           cfg,
+		hooks:         hooks,
+		dest:          dest,
+		report:        report,
+		sequenceToken: sequenceToken,
+		ledger:        newBatchLedger(),
+	}
+	if cfg.Dedup {
+		// the retries of the SDK put the batch again without confirming it, they are done by cfg.Retry instead
+		s.putOptions = append(s.putOptions, func(o *cloudwatchlogs.Options) {
+			o.RetryMaxAttempts = 1
+		})
+	}
+	return s
+}
+
+// putBatch replays the spill and puts batch through the circuit breaker, and trims the wal of the walN events acknowledged.
+func (s *cloudwatchSender) putBatch(reason string, batch []cwtypes.InputLogEvent, walN int64) error {
+	w := s.w
+	if len(batch) == 0 && w.spill.Pending() == 0 {
+		s.trimWAL(walN, nil)
+		return nil
+	}
+	var err error
+	if !w.breaker.allow() {
+		err = s.failed(batch, w.breaker.err())
+	} else {
+		err = s.replaySpill()
+		if err == nil && len(batch) > 0 {
+			err = s.put(reason, batch)
+		}
+		w.breaker.record(err)
+		if err != nil {
+			err = s.failed(batch, err)
+		} else if len(s.ledger.ambiguous) == 0 {
+			// no ambiguous batch refers the events
+			putEventBatch(batch)
+		}
+	}
+	s.trimWAL(walN, err)
+	return err
+}
+
+// put puts events with the retries, skipping the ones of the ambiguous batches confirmed in the log stream with dedup.
+func (s *cloudwatchSender) put(reason string, events []cwtypes.InputLogEvent) error {
+	w := s.w
+	id := cloudwatchBatchID(w.logGroup, w.logStream, events)
+	w.logger.Debug("cloudwatch put log events", "reason", reason, "batch_id", id, "events", len(events))
+	sent, start := len(events), time.Now()
+	spanCtx, span := s.hooks.startSpan(s.ctx, "cloudwatchlogs.PutLogEvents",
+		Attribute{"awstee.destination", s.dest},
+		Attribute{"cloudwatchlogs.events", int64(sent)},
+		Attribute{"cloudwatchlogs.reason", reason},
+		Attribute{"cloudwatchlogs.batch_id", id},
+	)
+	var output *cloudwatchlogs.PutLogEventsOutput
+	err := s.cfg.Retry.do(s.ctx, w.logger, "cloudwatch put log events", &w.retries, func() error {
+		rest := events
+		if s.cfg.Dedup {
+			if rest = events[s.skipAccepted(events):]; len(rest) == 0 {
+				output = &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: s.sequenceToken}
+				return nil
+			}
+		}
+		callCtx, end := w.watchdog.call(spanCtx)
+		var err error
+		output, err = s.client.PutLogEvents(callCtx, &cloudwatchlogs.PutLogEventsInput{
+			LogGroupName:  aws.String(w.logGroup),
+			LogStreamName: aws.String(w.logStream),
+			LogEvents:     rest,
+			SequenceToken: s.sequenceToken,
+		}, s.putOptions...)
+		err = end(err)
+		if accepted, ok := alreadyAcceptedOutput(err); ok {
+			w.logger.Info("cloudwatch logs batch was already accepted", "batch_id", id, "events", len(rest))
+			atomic.AddInt64(&w.deduped, int64(len(rest)))
+			output, err = accepted, nil
+		}
+		if err != nil {
+			if s.cfg.Dedup {
+				s.ledger.fail(cloudwatchBatch{id: cloudwatchBatchID(w.logGroup, w.logStream, rest), events: rest}, err)
+			}
+			return err
+		}
+		countRetries(&w.retries, output.ResultMetadata)
+		return nil
+	})
+	endSpan(span, err)
+	if err != nil {
+		if w.spill == nil {
+			// not replayed, the same events written later are not the ambiguous ones
+			s.ledger.resolve(events)
+		}
+		return err
+	}
+	s.ledger.resolve(events)
+	s.sequenceToken = output.NextSequenceToken
+	atomic.AddInt64(&w.sent, int64(sent))
+	s.hooks.onBatchSent(s.dest, sent, time.Since(start))
+	return nil
+}
+
+// skipAccepted returns the number of the events at the head of events, of the ambiguous batches confirmed in the log stream.
+func (s *cloudwatchSender) skipAccepted(events []cwtypes.InputLogEvent) int {
+	w := s.w
+	skipped := 0
+	for {
+		batch := s.ledger.ambiguousAt(events[skipped:])
+		if batch == nil {
+			return skipped
+		}
+		if !batch.confirmed {
+			accepted, err := cloudwatchBatchAccepted(s.ctx, s.client, w.logGroup, w.logStream, batch.events)
+			if err != nil {
+				w.logger.Warn("cloudwatch logs batch can not be confirmed, put again", "batch_id", batch.id, "error", withRequiredPermission(err, "logs:GetLogEvents"))
+			}
+			if !accepted {
+				s.ledger.forget(batch.id)
+				return skipped
+			}
+			w.logger.Info("cloudwatch logs batch was accepted by the failed attempt, not put again", "batch_id", batch.id, "events", len(batch.events))
+			batch.confirmed = true
+			atomic.AddInt64(&w.deduped, int64(len(batch.events)))
+		}
+		skipped += len(batch.events)
+	}
+}
+
+// replaySpill puts the spilled events in order, before the events buffered after them.
+func (s *cloudwatchSender) replaySpill() error {
+	spill := s.w.spill
+	for spill.Pending() > 0 {
+		batch, n, err := spill.peekEvents(s.cfg.BufferLines)
+		if err != nil {
+			return err
+		}
+		if err := s.put("replay spill", batch); err != nil {
+			return err
+		}
+		if err := spill.consume(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// failed spills the batch failed by the destination unreachable to replay it later,
+// or drops it with the circuit breaker or the full spill with on_full: drop, or reports err.
+func (s *cloudwatchSender) failed(batch []cwtypes.InputLogEvent, err error) error {
+	w := s.w
+	if w.spill != nil && (isRetryableError(err) || errors.Is(err, errCircuitOpen)) {
+		if len(batch) == 0 {
+			return nil
+		}
+		e := w.spill.spillEvents(batch)
+		if e == nil {
+			w.logger.Warn("cloudwatch logs destination unreachable, spilled", "events", len(batch), "error", err)
+			s.spillErr = err
+			return nil
+		}
+		if w.spill.dropsOnFull(e) {
+			// the writes go on, the drop is reported on close
+			atomic.AddInt64(&w.dropped, int64(len(batch)))
+			s.fullDropped += int64(len(batch))
+			s.fullErr = errors.Join(err, e)
+			w.logger.Warn("cloudwatch logs events dropped, the spill is full", "events", len(batch), "error", err)
+			return s.fullErr
+		}
+		err = errors.Join(err, e)
+	}
+	if w.breaker != nil {
+		// the writes go on, the drop is reported on close
+		atomic.AddInt64(&w.dropped, int64(len(batch)))
+		s.breakerDropped += int64(len(batch))
+		if !errors.Is(err, errCircuitOpen) {
+			s.dropErr = err
+			s.hooks.onError(s.dest, fmt.Errorf("put log events: %w", err))
+		}
+		w.logger.Warn("cloudwatch logs events dropped", "events", len(batch), "error", err)
+		return err
+	}
+	s.report(fmt.Errorf("put log events: %w", err))
+	return err
+}
+
+// trimWAL trims the wal by the n events of the batches acknowledged in order, and keeps it from the first batch not acknowledged.
+func (s *cloudwatchSender) trimWAL(n int64, err error) {
+	wal := s.w.wal
+	if wal == nil || s.walKept || wal.isDisabled() {
+		return
+	}
+	if err == nil {
+		err = wal.consumeEvents(n)
+	}
+	if err != nil {
+		s.w.logger.Warn("wal is kept from the events not delivered", "error", err)
+		s.walKept = true
+	}
+}
+
+// closeErrors returns the errors of the events not delivered at the close, the spill not replayed unless the last batch failed by err, and the events dropped.
+func (s *cloudwatchSender) closeErrors(err error) []error {
+	var errs []error
+	if pending := s.w.spill.Pending(); err == nil && pending > 0 {
+		errs = append(errs, fmt.Errorf("put log events: %d bytes of the spill are not replayed: %w", pending, s.spillErr))
+	}
+	if s.breakerDropped > 0 {
+		errs = append(errs, fmt.Errorf("put log events: %d events are dropped by the circuit breaker: %w", s.breakerDropped, s.dropErr))
+	}
+	if s.fullDropped > 0 {
+		errs = append(errs, fmt.Errorf("put log events: %d events are dropped by the full spill: %w", s.fullDropped, s.fullErr))
+	}
+	return errs
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// levelNotice is between info and warn, kept for the compatibility of -log-level notice.
+const levelNotice = slog.LevelInfo + 2
+
+func parseLogLevel(str string) (slog.Level, error) {
+	if strings.EqualFold(str, "notice") {
+		return levelNotice, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(str)); err != nil {
+		return 0, fmt.Errorf("log level must be one of debug, info, notice, warn, error: %s", str)
+	}
+	return level, nil
+}
+
+func levelName(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return "debug"
+	case level < levelNotice:
+		return "info"
+	case level < slog.LevelWarn:
+		return "notice"
+	case level < slog.LevelError:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+var levelColors = map[string]*color.Color{
+	"debug":  color.New(color.FgHiBlack),
+	"notice": color.New(color.FgHiBlue),
+	"warn":   color.New(color.FgYellow),
+	"error":  color.New(color.FgRed, color.BgBlack),
+}
+
+// newLogHandler returns the slog handler of the CLI.
+// format text is the colored `2006/01/02 15:04:05 [level] message key=value` lines, json is JSON lines.
+func newLogHandler(w io.Writer, format string, level slog.Level) (slog.Handler, error) {
+	switch format {
+	case "text":
+		return &consoleHandler{
+			mu:    &sync.Mutex{},
+			w:     w,
+			level: level,
+		}, nil
+	case "json":
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) > 0 {
+					return a
+				}
+				switch a.Key {
+				case slog.TimeKey:
+					a.Key = "ts"
+				case slog.LevelKey:
+					a.Value = slog.StringValue(levelName(a.Value.Any().(slog.Level)))
+				}
+				return a
+			},
+		}), nil
+	default:
+		return nil, fmt.Errorf("log format must be text or json: %s", format)
+	}
+}
+
+type consoleHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  slog.Level
+	attrs  string
+	prefix string
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	name := levelName(r.Level)
+	if !r.Time.IsZero() {
+		buf.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	}
+	fmt.Fprintf(&buf, "[%s] %s%s", name, r.Message, h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&buf, h.prefix, a)
+		return true
+	})
+	line := buf.String()
+	if c, ok := levelColors[name]; ok {
+		line = c.Sprint(line)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line+"\n")
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var buf bytes.Buffer
+	for _, a := range attrs {
+		appendAttr(&buf, h.prefix, a)
+	}
+	cloned := *h
+	cloned.attrs += buf.String()
+	return &cloned
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	cloned := *h
+	cloned.prefix += name + "."
+	return &cloned
+}
+
+func appendAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(buf, prefix, ga)
+		}
+		return
+	}
+	value := a.Value.String()
+	if value == "" || strings.ContainsAny(value, " \t\"=") {
+		value = strconv.Quote(value)
+	}
+	fmt.Fprintf(buf, " %s%s=%s", prefix, a.Key, value)
+}
@@ -3,134 +3,685 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/fatih/color"
-	"github.com/fujiwara/logutils"
 	"github.com/mashiike/awstee"
 )
 
 var (
-	Version string = "current"
+	Version  string = "current"
+	Revision string = ""
+	// ReleasePublicKey is the base64 ed25519 public key of the release signatures, verified by self-update.
+	ReleasePublicKey string = ""
 )
 
+type subcommandFunc func(ctx context.Context, cfg *awstee.Config, configs []string) error
+
+var subcommands = map[string]subcommandFunc{
+	"validate":    runValidate,
+	"version":     runVersion,
+	"self-update": runSelfUpdate,
+	"cat":         runCat,
+	"iam-policy":  runIAMPolicy,
+	"resume":      runResume,
+	// run by the wrapper in /opt/extensions of a Lambda layer
+	"lambda-extension": runLambdaExtension,
+}
+
 func main() {
-	cfg := awstee.DefaultConfig()
+	if err := run(); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// run runs awstee by the flags, the error exits with 1 after the deferred closes.
+func run() (err error) {
+	defaultConfigPaths := awstee.DefaultConfigPaths()
+	cfg, err := awstee.DefaultConfig()
+	if err != nil {
+		return err
+	}
 	cfg.SetFlags(flag.CommandLine)
 	var (
-		config          string
-		ignoreInterrupt bool
-		minLevel        string
-		exitOnError     bool
+		configs          configPaths
+		ignoreInterrupt  bool
+		minLevel         string
+		logFormat        string
+		exitOnError      bool
+		dryRun           bool
+		preflight        bool
+		showVersion      bool
+		statsInterval    time.Duration
+		timeout          time.Duration
+		shutdownTimeout  time.Duration
+		ignoreBrokenPipe bool
 	)
 	flag.CommandLine.Usage = func() {
 		fmt.Fprintln(flag.CommandLine.Output(), "awstee is a tee command-like tool with AWS as the output destination")
 		fmt.Fprintln(flag.CommandLine.Output(), "version:", Version)
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: awstee [options] [<output name>]")
+		fmt.Fprintln(flag.CommandLine.Output(), "       awstee [options] -- <output name>  (an output name such as validate)")
+		fmt.Fprintln(flag.CommandLine.Output(), "       awstee [options] validate")
+		fmt.Fprintln(flag.CommandLine.Output(), "       awstee [options] cat <output name>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       awstee [options] iam-policy")
+		fmt.Fprintln(flag.CommandLine.Output(), "       awstee [options] resume")
+		fmt.Fprintln(flag.CommandLine.Output(), "       awstee [options] lambda-extension")
+		fmt.Fprintln(flag.CommandLine.Output(), "       awstee version")
+		fmt.Fprintln(flag.CommandLine.Output(), "       awstee [options] self-update")
 		flag.CommandLine.PrintDefaults()
 	}
-	flag.StringVar(&config, "config", "", "config file path")
+	if config := os.Getenv(awstee.EnvPrefix + "CONFIG"); config != "" {
+		configs.paths = []string{config}
+	}
+	flag.Var(&configs, "config", "config file path or s3://, ssm://, secretsmanager:// URL. It can be repeated, a later file overrides the former ones")
+	flag.Var(&configOverrides, "set", "override a config value by key=value with the yaml keys, e.g. -set s3.url_prefix=s3://bucket/x/ (can be repeated)")
 	flag.StringVar(&minLevel, "log-level", "info", "awstee log level")
+	flag.StringVar(&logFormat, "log-format", "text", "awstee log format, text or json")
 	flag.BoolVar(&ignoreInterrupt, "i", false, "ignore interrupt signal")
+	flag.BoolVar(&ignoreBrokenPipe, "ignore-broken-pipe", false, "if stdout is broken, stop echoing but continue reading stdin and writing to destinations")
 	flag.BoolVar(&exitOnError, "x", false, "exit if an error occurs during initialization")
+	flag.BoolVar(&dryRun, "dry-run", false, "check configuration and destinations, but write nothing")
+	flag.BoolVar(&preflight, "preflight", false, "before the capture, probe the permissions of the destinations and report the missing ones")
+	flag.BoolVar(&showVersion, "version", false, "print the build information as a JSON line, and exit")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 0, "on exit, wait for flushing and uploading up to this duration before force abort (0 means no limit)")
+	flag.DurationVar(&timeout, "timeout", 0, "flush and close all destinations, then exit when this duration has elapsed")
+	flag.DurationVar(&statsInterval, "stats-interval", 0, "print runtime stats at this interval (stats are also printed on SIGUSR1)")
 	flag.Parse()
+	if showVersion {
+		return runVersion(context.Background(), cfg, configs.paths)
+	}
+	subcommand, isSubcommand := subcommandOf(os.Args[1:], flag.Args())
+	if isSubcommand {
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "set" {
+			// setting them again appends the values
+			return
+		}
+		explicitFlags[f.Name] = f.Value.String()
+	})
 
-	filter := &logutils.LevelFilter{
-		Levels: []logutils.LogLevel{"debug", "info", "notice", "warn", "error"},
-		ModifierFuncs: []logutils.ModifierFunc{
-			logutils.Color(color.FgHiBlack),
-			nil,
-			logutils.Color(color.FgHiBlue),
-			logutils.Color(color.FgYellow),
-			logutils.Color(color.FgRed, color.BgBlack),
-		},
-		MinLevel: logutils.LogLevel(strings.ToLower(minLevel)),
-		Writer:   os.Stderr,
+	level, err := parseLogLevel(minLevel)
+	if err != nil {
+		return err
+	}
+	handler, err := newLogHandler(os.Stderr, logFormat, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	if len(defaultConfigPaths) > 0 {
+		slog.Info("default config loaded", "paths", defaultConfigPaths)
 	}
-	log.SetOutput(filter)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if isSubcommand {
+		if err := subcommand(ctx, cfg, configs.paths); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if dryRun {
+		if err := runDryRun(ctx, cfg, configs.paths); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	stdin := openStdin()
 	var r io.Reader
-	if awsTeeReader, err := prepare(ctx, cfg, config); err != nil {
+	var teeReader *awstee.AWSTeeReader
+	if awsTeeReader, err := prepare(ctx, cfg, configs.paths, stdin, preflight); err != nil {
 		if exitOnError {
-			log.Fatal("[error]", err)
-		} else {
-			log.Println("[error] ", err)
+			return err
 		}
-		log.Println("[warn] error occurred during initialization, so only standard output is performed")
-		r = os.Stdin
+		slog.Error(err.Error())
+		slog.Warn("error occurred during initialization, so only standard output is performed")
+		r = stdin
 	} else {
 		r = awsTeeReader
+		teeReader = awsTeeReader
+	}
+	if teeReader != nil {
 		defer func() {
-			if err := awsTeeReader.Close(); err != nil {
-				log.Println("[error] close tee reader:", err)
+			if closeErr := closeWithTimeout(teeReader, shutdownTimeout, cfg.Delivery); closeErr != nil && err == nil {
+				err = closeErr
 			}
 		}()
 	}
 
-	s := bufio.NewScanner(r)
+	if ignoreBrokenPipe {
+		ignoreSIGPIPE()
+	}
 	mainLoopEnd := make(chan struct{})
 	go func() {
-		log.Println("[debug] start main loop")
-		for s.Scan() {
-			fmt.Println(s.Text())
-		}
-		log.Println("[debug] end main loop")
+		slog.Debug("start main loop")
+		// stdout is the exact mirror of stdin, the errors of stdout do not stop reading to the destinations
+		io.Copy(&echoWriter{w: os.Stdout, ignoreBrokenPipe: ignoreBrokenPipe}, r)
+		slog.Debug("end main loop")
 		close(mainLoopEnd)
 	}()
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
-	condition := func() bool {
+	statsCh := make(chan os.Signal, 1)
+	if len(statsSignals) > 0 {
+		signal.Notify(statsCh, statsSignals...)
+	}
+	flushCh := make(chan os.Signal, 1)
+	if len(flushSignals) > 0 {
+		signal.Notify(flushCh, flushSignals...)
+	}
+	var statsTick <-chan time.Time
+	if statsInterval > 0 {
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+		statsTick = ticker.C
+	}
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	printStats := func() {
+		if teeReader == nil {
+			slog.Info("stats: no destination")
+			return
+		}
+		slog.Info("stats", "stats", teeReader.Stats())
+	}
+loop:
+	for {
 		select {
 		case <-c:
-			log.Println("[debug] receive interrupt")
-			return ignoreInterrupt
+			slog.Debug("receive interrupt")
+			if ignoreInterrupt {
+				continue
+			}
+			break loop
+		case <-statsCh:
+			printStats()
+		case <-statsTick:
+			printStats()
+		case <-flushCh:
+			if teeReader != nil {
+				go func() {
+					slog.Info("flush destinations")
+					if err := teeReader.Flush(ctx); err != nil {
+						slog.Error("flush destinations", "error", err)
+					}
+				}()
+			}
+		case <-timeoutCh:
+			slog.Warn("timeout reached, close destinations", "timeout", timeout)
+			break loop
 		case <-mainLoopEnd:
-			return false
-		default:
-			return true
+			return nil
 		}
 	}
-	for condition() {
-		time.Sleep(100 * time.Microsecond)
+	signal.Stop(c)
+	stopReading(stdin, mainLoopEnd)
+	return nil
+}
+
+// stopReading closes stdin so that the blocked Scan of the main loop returns,
+// and waits for the main loop to end so that nothing is written to the destinations while closing them.
+func stopReading(stdin *os.File, mainLoopEnd <-chan struct{}) {
+	slog.Debug("stop reading stdin")
+	if err := stdin.Close(); err != nil {
+		slog.Debug("close stdin", "error", err)
+	}
+	select {
+	case <-mainLoopEnd:
+	case <-time.After(time.Second):
+		// reading from a terminal may not be interrupted by Close.
+		slog.Debug("main loop is still reading stdin, close destinations anyway")
+	}
+}
+
+// configPaths is the value of -config, which can be repeated.
+// The default from AWSTEE_CONFIG is replaced by the flags.
+type configPaths struct {
+	paths []string
+	set   bool
+}
+
+func (c *configPaths) String() string {
+	return strings.Join(c.paths, ",")
+}
+
+func (c *configPaths) Set(value string) error {
+	if !c.set {
+		c.paths, c.set = nil, true
+	}
+	c.paths = append(c.paths, value)
+	return nil
+}
+
+// keyValues is the value of -set, which can be repeated.
+type keyValues []string
+
+func (kv *keyValues) String() string {
+	return strings.Join(*kv, ",")
+}
+
+func (kv *keyValues) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("%s is not key=value", value)
 	}
-	close(c)
+	*kv = append(*kv, value)
+	return nil
+}
+
+// configOverrides is the key=value overrides of -set, applied over the flags.
+var configOverrides keyValues
+
+// explicitFlags is the values of the flags set on the command line.
+var explicitFlags = map[string]string{}
+
+// loadConfig loads the configuration with the precedence: -set > flags > AWSTEE_* environment variables > config file.
+func loadConfig(cfg *awstee.Config, configs []string) error {
+	return loadConfigWithFlags(cfg, configs, flag.CommandLine)
 }
 
-func prepare(ctx context.Context, cfg *awstee.Config, config string) (*awstee.AWSTeeReader, error) {
-	if config == "" {
-		if err := cfg.Restrict(); err != nil {
-			return nil, fmt.Errorf("configuration restrict: %w", err)
+// loadConfigWithFlags is loadConfig with the flags set to fs, such as the one of cfg.SetFlags. The flags not defined by fs are skipped.
+func loadConfigWithFlags(cfg *awstee.Config, configs []string, fs *flag.FlagSet) error {
+	if len(configs) > 0 {
+		if err := cfg.Load(configs...); err != nil {
+			return fmt.Errorf("configuration load: %w", err)
 		}
-	} else {
-		if err := cfg.Load(config); err != nil {
-			return nil, fmt.Errorf("configuration load: %w", err)
+	}
+	if err := cfg.LoadEnv(); err != nil {
+		return fmt.Errorf("configuration load env: %w", err)
+	}
+	for name, value := range explicitFlags {
+		if fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("flag -%s: %w", name, err)
 		}
 	}
+	for _, kv := range configOverrides {
+		key, value, _ := strings.Cut(kv, "=")
+		if err := cfg.Set(key, value); err != nil {
+			return fmt.Errorf("flag -set: %w", err)
+		}
+	}
+	if err := cfg.Restrict(); err != nil {
+		return fmt.Errorf("configuration restrict: %w", err)
+	}
+	return nil
+}
+
+func newApp(ctx context.Context, cfg *awstee.Config, configs []string) (*awstee.AWSTee, error) {
+	if err := loadConfig(cfg, configs); err != nil {
+		return nil, err
+	}
+	return initApp(ctx, cfg)
+}
+
+// reloadApp creates the app of the config loaded again, from the default config files, configs, the environment variables and the flags.
+func reloadApp(ctx context.Context, configs []string) (*awstee.AWSTee, error) {
+	cfg, err := awstee.DefaultConfig()
+	if err != nil {
+		return nil, err
+	}
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	cfg.SetFlags(fs)
+	if err := loadConfigWithFlags(cfg, configs, fs); err != nil {
+		return nil, err
+	}
+	return initApp(ctx, cfg)
+}
+
+func initApp(ctx context.Context, cfg *awstee.Config) (*awstee.AWSTee, error) {
 	if err := cfg.ValidateVersion(Version); err != nil {
 		return nil, fmt.Errorf("version validate: %w", err)
 	}
-	app, err := awstee.New(ctx, cfg)
+	app, err := awstee.New(ctx, cfg, awstee.WithLogger(slog.Default()))
 	if err != nil {
 		return nil, fmt.Errorf("awstee initialize: %w", err)
 	}
-	outputName := flag.Arg(0)
-	if outputName == "" {
-		return nil, fmt.Errorf("output name is empty")
+	return app, nil
+}
+
+// echoWriter writes to the standard output, and never fails not to stop reading the input.
+// With ignoreBrokenPipe, it stops echoing after the standard output is broken.
+type echoWriter struct {
+	w                io.Writer
+	ignoreBrokenPipe bool
+	broken           bool
+}
+
+func (e *echoWriter) Write(p []byte) (int, error) {
+	if e.broken {
+		return len(p), nil
+	}
+	if _, err := e.w.Write(p); err != nil && e.ignoreBrokenPipe {
+		slog.Warn("stdout is broken, stop echoing but continue writing to destinations", "error", err)
+		e.broken = true
 	}
+	return len(p), nil
+}
 
-	r, err := app.TeeReader(os.Stdin, outputName)
+// closeWithTimeout closes the destinations and logs the results. The error is of the destinations aborted by shutdownTimeout,
+// the failures of the destinations are logged.
+func closeWithTimeout(teeReader *awstee.AWSTeeReader, shutdownTimeout time.Duration, delivery string) error {
+	slog.Debug("before close", "stats", teeReader.Stats())
+	ctx := context.Background()
+	if shutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, shutdownTimeout)
+		defer cancel()
+	}
+	err := teeReader.CloseWithContext(ctx)
+	var abortErr *awstee.CloseAbortedError
+	if errors.As(err, &abortErr) {
+		stats := teeReader.Stats()
+		for _, d := range abortErr.Completed {
+			slog.Info("destination completed", "destination", d)
+		}
+		for _, d := range stats.Destinations {
+			if slices.Contains(abortErr.Aborted, d.Name) {
+				slog.Error(fmt.Sprintf("aborted, %d of %d bytes flushed, %d buffered events dropped", d.Bytes, stats.Bytes, d.Buffered), "destination", d.Name)
+			}
+		}
+		return fmt.Errorf("shutdown timeout %s exceeded, force abort: %w", shutdownTimeout, err)
+	}
+	if err != nil {
+		slog.Error("close tee reader", "error", err)
+	}
+	if teeReader.Result().Skipped {
+		slog.Info("the same input was already delivered, the destinations were skipped")
+		return nil
+	}
+	for _, d := range teeReader.Result().Destinations {
+		if d.Err != nil {
+			slog.Error("destination failed", "destination", d.Name, "bytes", d.Bytes, "error", d.Err)
+			continue
+		}
+		attrs := []any{"destination", d.Name, "bytes", d.Bytes}
+		if d.Location != "" && d.Location != d.Name {
+			attrs = append(attrs, "location", d.Location)
+		}
+		if d.Events > 0 {
+			attrs = append(attrs, "events", d.Events)
+		}
+		if d.VersionID != "" {
+			attrs = append(attrs, "version_id", d.VersionID)
+		}
+		if d.Retries > 0 {
+			attrs = append(attrs, "retries", d.Retries)
+		}
+		slog.Info("destination completed", attrs...)
+	}
+	if result := teeReader.Result(); delivery == awstee.DeliveryBestEffort {
+		failed := 0
+		for _, d := range result.Destinations {
+			if d.Err != nil {
+				failed++
+			}
+		}
+		if failed > 0 {
+			slog.Warn(fmt.Sprintf("best effort delivery, %d of %d destinations failed", failed, len(result.Destinations)))
+		}
+	}
+	slog.Debug("all destinations closed", "result", teeReader.Result())
+	return nil
+}
+
+func prepare(ctx context.Context, cfg *awstee.Config, configs []string, stdin io.Reader, preflight bool) (*awstee.AWSTeeReader, error) {
+	app, err := newApp(ctx, cfg, configs)
+	if err != nil {
+		return nil, err
+	}
+	outputName, err := outputNameOrGenerate(cfg)
+	if err != nil {
+		return nil, err
+	}
+	warnLeftoverSpills(app)
+	if preflight {
+		if err := runPreflight(ctx, app, outputName); err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := app.TeeReader(ctx, stdin, outputName)
 	if err != nil {
 		return nil, fmt.Errorf("create tee reader: %w", err)
 	}
 	return r, nil
 }
+
+// runPreflight probes the permissions of the destinations before reading stdin.
+func runPreflight(ctx context.Context, app *awstee.AWSTee, outputName string) error {
+	problems := 0
+	for _, result := range app.Preflight(ctx, outputName) {
+		if !result.OK() {
+			slog.Error("preflight: "+result.Check, "error", result.Err)
+			problems++
+			continue
+		}
+		slog.Info("preflight: " + result.Check)
+	}
+	if problems > 0 {
+		return fmt.Errorf("preflight failed: %d problem(s) found", problems)
+	}
+	return nil
+}
+
+// warnLeftoverSpills tells the spills of the interrupted runs, to deliver them by `awstee resume`.
+func warnLeftoverSpills(app *awstee.AWSTee) {
+	spills, err := app.LeftoverSpills()
+	if err != nil {
+		slog.Debug("find leftover spills", "error", err)
+		return
+	}
+	for _, spill := range spills {
+		slog.Warn("leftover spill of an interrupted run is found, run `awstee resume` to deliver it", "spill", spill.Path, "destination", spill.Destination, "bytes", spill.Bytes)
+	}
+}
+
+// subcommandOf returns the subcommand named by the first of rest, the arguments left after the flags of args.
+// rest after "--" is not a subcommand, so that `awstee -- validate` captures to the output name validate.
+func subcommandOf(args, rest []string) (subcommandFunc, bool) {
+	if len(rest) == 0 {
+		return nil, false
+	}
+	if i := len(args) - len(rest); i > 0 && args[i-1] == "--" {
+		return nil, false
+	}
+	subcommand, ok := subcommands[rest[0]]
+	return subcommand, ok
+}
+
+// outputNameOrGenerate returns the output name argument, or generates one by the output_name template.
+func outputNameOrGenerate(cfg *awstee.Config) (string, error) {
+	if outputName := flag.Arg(0); outputName != "" {
+		return outputName, nil
+	}
+	outputName, err := cfg.GenerateOutputName()
+	if err != nil {
+		return "", fmt.Errorf("generate output name: %w", err)
+	}
+	slog.Info("output name is generated", "output_name", outputName)
+	return outputName, nil
+}
+
+func runDryRun(ctx context.Context, cfg *awstee.Config, configs []string) error {
+	app, err := newApp(ctx, cfg, configs)
+	if err != nil {
+		return err
+	}
+	outputName, err := outputNameOrGenerate(cfg)
+	if err != nil {
+		return err
+	}
+	destinations, err := app.DryRun(ctx, outputName)
+	if err != nil {
+		return fmt.Errorf("dry run: %w", err)
+	}
+	for _, destination := range destinations {
+		fmt.Println(destination)
+	}
+	slog.Info("dry run complete, nothing was written")
+	return nil
+}
+
+func runCat(ctx context.Context, cfg *awstee.Config, configs []string) error {
+	app, err := newApp(ctx, cfg, configs)
+	if err != nil {
+		return err
+	}
+	outputName := flag.Arg(0)
+	if outputName == "" {
+		return fmt.Errorf("output name is empty")
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err := app.Cat(ctx, outputName, w); err != nil {
+		return fmt.Errorf("cat: %w", err)
+	}
+	return w.Flush()
+}
+
+// runResume delivers the leftover spills of the interrupted runs.
+func runResume(ctx context.Context, cfg *awstee.Config, configs []string) error {
+	app, err := newApp(ctx, cfg, configs)
+	if err != nil {
+		return err
+	}
+	results, err := app.Resume(ctx)
+	for _, result := range results {
+		fmt.Printf("[%s] %s\n", result.Name, result)
+	}
+	if err != nil {
+		return fmt.Errorf("resume: %w", err)
+	}
+	if len(results) == 0 {
+		slog.Info("no leftover spill")
+	}
+	return nil
+}
+
+func runValidate(ctx context.Context, cfg *awstee.Config, configs []string) error {
+	app, err := newApp(ctx, cfg, configs)
+	if err != nil {
+		fmt.Println("[NG]", err)
+		return errors.New("validation failed")
+	}
+	problems := 0
+	for _, result := range app.Validate(ctx) {
+		fmt.Println(result)
+		if !result.OK() {
+			problems++
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("validation failed: %d problem(s) found", problems)
+	}
+	return nil
+}
+
+// runIAMPolicy prints the minimal IAM policy for the destinations of the configuration.
+func runIAMPolicy(_ context.Context, cfg *awstee.Config, configs []string) error {
+	if err := loadConfig(cfg, configs); err != nil {
+		return err
+	}
+	if !cfg.EnableS3() && !cfg.EnableCloudwatchLogs() {
+		return errors.New("no destination")
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	return enc.Encode(cfg.IAMPolicy())
+}
+
+// runLambdaExtension runs awstee as an external extension of Lambda, writing the logs of each invocation of the function.
+// On SIGHUP, the config is loaded again for the next invocations; if it fails, the former one is kept.
+func runLambdaExtension(ctx context.Context, cfg *awstee.Config, configs []string) error {
+	app, err := newApp(ctx, cfg, configs)
+	if err != nil {
+		return err
+	}
+	reload := make(chan *awstee.AWSTee)
+	if len(reloadSignals) > 0 {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, reloadSignals...)
+		defer signal.Stop(sig)
+		go func() {
+			for {
+				select {
+				case <-sig:
+				case <-ctx.Done():
+					return
+				}
+				next, err := reloadApp(ctx, configs)
+				if err != nil {
+					slog.Error("reload the config, the former one is kept", "error", err)
+					continue
+				}
+				select {
+				case reload <- next:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return app.RunLambdaExtensionWithReload(ctx, reload)
+}
+
+// runVersion prints the build information, for `awstee version` and -version.
+func runVersion(_ context.Context, _ *awstee.Config, _ []string) error {
+	return printVersion(os.Stdout, currentVersionInfo())
+}
+
+// versionInfo is the build information printed by -version.
+type versionInfo struct {
+	Version  string `json:"version"`
+	Revision string `json:"revision"`
+	Go       string `json:"go"`
+	Platform string `json:"platform"`
+}
+
+func currentVersionInfo() versionInfo {
+	revision := Revision
+	if revision == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "vcs.revision" {
+					revision = setting.Value
+				}
+			}
+		}
+	}
+	return versionInfo{
+		Version:  Version,
+		Revision: revision,
+		Go:       runtime.Version(),
+		Platform: runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// printVersion prints the build information as a JSON line, for the scripts checking the installed version.
+func printVersion(w io.Writer, info versionInfo) error {
+	return json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintVersion(t *testing.T) {
+	var buf bytes.Buffer
+	info := versionInfo{
+		Version:  "v0.3.0",
+		Revision: "0123456789abcdef0123456789abcdef01234567",
+		Go:       "go1.21.0",
+		Platform: "linux/amd64",
+	}
+	require.NoError(t, printVersion(&buf, info))
+	require.Equal(t, `{"version":"v0.3.0","revision":"0123456789abcdef0123456789abcdef01234567","go":"go1.21.0","platform":"linux/amd64"}`+"\n", buf.String(), "a single JSON line")
+
+	var parsed versionInfo
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &parsed))
+	require.Equal(t, info, parsed)
+}
+
+func TestSubcommandOf(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+		rest []string
+		ok   bool
+	}{
+		{"subcommand", []string{"-config", "awstee.yaml", "validate"}, []string{"validate"}, true},
+		{"subcommand with the flags after it", []string{"cat", "-log-level", "debug", "hoge.log"}, []string{"cat", "-log-level", "debug", "hoge.log"}, true},
+		{"output name", []string{"-x", "hoge.log"}, []string{"hoge.log"}, false},
+		{"output name of a subcommand after --", []string{"-x", "--", "validate"}, []string{"validate"}, false},
+		{"output name of -- after --", []string{"--", "--"}, []string{"--"}, false},
+		{"no argument", []string{"-x"}, nil, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, ok := subcommandOf(c.args, c.rest)
+			require.Equal(t, c.ok, ok)
+		})
+	}
+}
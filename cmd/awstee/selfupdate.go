@@ -0,0 +1,285 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	gv "github.com/hashicorp/go-version"
+	"github.com/mashiike/awstee"
+)
+
+const releasesURL = "https://api.github.com/repos/mashiike/awstee/releases?per_page=20"
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Draft   bool   `json:"draft"`
+	Assets  []struct {
+		Name               string `json:"name"`
+		BrowserDownloadURL string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r *githubRelease) assetURL(name string) (string, bool) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset.BrowserDownloadURL, true
+		}
+	}
+	return "", false
+}
+
+// runSelfUpdate replaces the running binary with the newest release that satisfies required_version.
+// The archive is verified against checksums.txt of the release, and checksums.txt against its signature checksums.txt.sig
+// by ReleasePublicKey pinned in the binary, so that a tampered release is not installed.
+func runSelfUpdate(ctx context.Context, cfg *awstee.Config, configs []string) error {
+	if err := loadConfig(cfg, configs); err != nil {
+		return err
+	}
+	if ReleasePublicKey == "" {
+		return errors.New("this build has no release public key pinned to verify the releases, install a release build of awstee")
+	}
+	current, err := gv.NewVersion(Version)
+	if err != nil {
+		slog.Warn("current version is not a release version, any release is treated as newer", "version", Version)
+	}
+	var releases []*githubRelease
+	if err := getJSON(ctx, releasesURL, &releases); err != nil {
+		return fmt.Errorf("list releases: %w", err)
+	}
+	target, targetVersion, err := selectRelease(cfg, releases)
+	if err != nil {
+		return err
+	}
+	if current != nil && !targetVersion.GreaterThan(current) {
+		slog.Info("awstee is up to date", "version", Version)
+		return nil
+	}
+	slog.Info("update awstee", "from", Version, "to", target.TagName)
+
+	archiveName := fmt.Sprintf("awstee_%s_%s_%s.tar.gz", targetVersion.String(), runtime.GOOS, runtime.GOARCH)
+	archiveURL, ok := target.assetURL(archiveName)
+	if !ok {
+		return fmt.Errorf("release %s has no asset %s", target.TagName, archiveName)
+	}
+	checksumsURL, ok := target.assetURL("checksums.txt")
+	if !ok {
+		return fmt.Errorf("release %s has no checksums.txt", target.TagName)
+	}
+	signatureURL, ok := target.assetURL("checksums.txt.sig")
+	if !ok {
+		return fmt.Errorf("release %s has no checksums.txt.sig", target.TagName)
+	}
+	checksums, err := download(ctx, checksumsURL)
+	if err != nil {
+		return fmt.Errorf("download checksums.txt: %w", err)
+	}
+	signature, err := download(ctx, signatureURL)
+	if err != nil {
+		return fmt.Errorf("download checksums.txt.sig: %w", err)
+	}
+	if err := verifySignature(ReleasePublicKey, checksums, signature); err != nil {
+		return fmt.Errorf("verify checksums.txt of release %s: %w", target.TagName, err)
+	}
+	slog.Debug("signature of checksums.txt verified")
+	expected, err := lookupChecksum(checksums, archiveName)
+	if err != nil {
+		return err
+	}
+	archive, err := download(ctx, archiveURL)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", archiveName, err)
+	}
+	sum := sha256.Sum256(archive)
+	if actual := hex.EncodeToString(sum[:]); actual != expected {
+		return fmt.Errorf("checksum mismatch %s: expected %s, actual %s", archiveName, expected, actual)
+	}
+	slog.Debug("checksum verified", "sha256", expected)
+
+	binaryName := "awstee"
+	if runtime.GOOS == "windows" {
+		binaryName += ".exe"
+	}
+	binary, err := extractBinary(archive, binaryName)
+	if err != nil {
+		return fmt.Errorf("extract %s: %w", archiveName, err)
+	}
+	if err := replaceExecutable(binary); err != nil {
+		return err
+	}
+	slog.Info("awstee is updated", "version", target.TagName)
+	return nil
+}
+
+// selectRelease returns the newest release that satisfies required_version, skipping the drafts and the tags not of a version.
+func selectRelease(cfg *awstee.Config, releases []*githubRelease) (*githubRelease, *gv.Version, error) {
+	var target *githubRelease
+	var targetVersion *gv.Version
+	for _, release := range releases {
+		if release.Draft {
+			continue
+		}
+		v, err := gv.NewVersion(release.TagName)
+		if err != nil {
+			slog.Debug("skip release", "release", release.TagName, "error", err)
+			continue
+		}
+		if err := cfg.ValidateVersion(release.TagName); err != nil {
+			slog.Debug("skip release", "release", release.TagName, "error", err)
+			continue
+		}
+		if targetVersion == nil || v.GreaterThan(targetVersion) {
+			target, targetVersion = release, v
+		}
+	}
+	if target == nil {
+		return nil, nil, errors.New("no release satisfies required_version")
+	}
+	return target, targetVersion, nil
+}
+
+func newGitHubRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+func download(ctx context.Context, url string) ([]byte, error) {
+	req, err := newGitHubRequest(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	bs, err := download(ctx, url)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+// verifySignature verifies signature, the base64 ed25519 signature of message by goreleaser signs, with publicKey, the base64 ed25519 public key.
+func verifySignature(publicKey string, message, signature []byte) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("release public key is not a base64 ed25519 public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("signature is not a base64 ed25519 signature")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), message, sig) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// lookupChecksum returns the sha256 of name in checksums.txt of goreleaser, "<sha256>  <name>" for each line.
+func lookupChecksum(checksums []byte, name string) (string, error) {
+	s := bufio.NewScanner(bytes.NewReader(checksums))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[1] == name {
+			if _, err := hex.DecodeString(fields[0]); err != nil || len(fields[0]) != sha256.Size*2 {
+				return "", fmt.Errorf("checksums.txt has an invalid sha256 for %s", name)
+			}
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("checksums.txt has no entry for %s", name)
+}
+
+func extractBinary(archive []byte, binaryName string) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s not found in archive", binaryName)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Base(hdr.Name) == binaryName && hdr.Typeflag == tar.TypeReg {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// replaceExecutable swaps the running binary. The new binary is written next to it and renamed over it,
+// so the swap is atomic on the same filesystem.
+func replaceExecutable(binary []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".awstee-update-*")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// a running executable can not be overwritten on windows, but it can be renamed.
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		return fmt.Errorf("replace %s: %w", exe, err)
+	}
+	return nil
+}
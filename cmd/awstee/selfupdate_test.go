@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/mashiike/awstee"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectRelease(t *testing.T) {
+	releases := []*githubRelease{
+		{TagName: "v0.4.0", Draft: true},
+		{TagName: "v0.3.1"},
+		{TagName: "nightly"},
+		{TagName: "v0.2.0"},
+		{TagName: "v0.3.0"},
+	}
+	cases := []struct {
+		requiredVersion string
+		expected        string
+		expectedErr     string
+	}{
+		{requiredVersion: "", expected: "v0.3.1"},
+		{requiredVersion: "< 0.3.1", expected: "v0.3.0"},
+		{requiredVersion: "~> 0.2.0", expected: "v0.2.0"},
+		{requiredVersion: ">= 0.4.0", expectedErr: "no release satisfies required_version"},
+	}
+	for _, c := range cases {
+		t.Run(c.requiredVersion, func(t *testing.T) {
+			cfg := &awstee.Config{RequiredVersion: c.requiredVersion}
+			require.NoError(t, cfg.Restrict())
+			release, v, err := selectRelease(cfg, releases)
+			if c.expectedErr != "" {
+				require.EqualError(t, err, c.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expected, release.TagName)
+			require.Equal(t, c.expected, "v"+v.String())
+		})
+	}
+}
+
+func TestLookupChecksum(t *testing.T) {
+	linux := strings.Repeat("0123abcd", 8)
+	darwin := strings.Repeat("4567ef01", 8)
+	checksums := []byte(linux + "  awstee_0.3.0_linux_amd64.tar.gz\n" +
+		darwin + "  awstee_0.3.0_darwin_arm64.tar.gz\n" +
+		"0123  awstee_0.3.0_windows_amd64.tar.gz\n" +
+		"malformed line\n")
+	cases := []struct {
+		name        string
+		expected    string
+		expectedErr string
+	}{
+		{name: "awstee_0.3.0_linux_amd64.tar.gz", expected: linux},
+		{name: "awstee_0.3.0_darwin_arm64.tar.gz", expected: darwin},
+		{name: "awstee_0.3.0_windows_amd64.tar.gz", expectedErr: "checksums.txt has an invalid sha256 for awstee_0.3.0_windows_amd64.tar.gz"},
+		{name: "awstee_0.3.0_linux", expectedErr: "checksums.txt has no entry for awstee_0.3.0_linux"},
+		{name: "line", expectedErr: "checksums.txt has an invalid sha256 for line"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sum, err := lookupChecksum(checksums, c.name)
+			if c.expectedErr != "" {
+				require.EqualError(t, err, c.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expected, sum)
+		})
+	}
+}
+
+func TestExtractBinary(t *testing.T) {
+	cases := []struct {
+		name        string
+		files       []*tar.Header
+		expected    string
+		expectedErr string
+	}{
+		{
+			name:     "top level",
+			files:    []*tar.Header{{Name: "README.md", Typeflag: tar.TypeReg}, {Name: "awstee", Typeflag: tar.TypeReg}},
+			expected: "awstee",
+		},
+		{
+			name:     "in a directory",
+			files:    []*tar.Header{{Name: "awstee_0.3.0_linux_amd64/", Typeflag: tar.TypeDir}, {Name: "awstee_0.3.0_linux_amd64/awstee", Typeflag: tar.TypeReg}},
+			expected: "awstee_0.3.0_linux_amd64/awstee",
+		},
+		{
+			name:        "not a regular file",
+			files:       []*tar.Header{{Name: "awstee", Typeflag: tar.TypeSymlink, Linkname: "/bin/sh"}},
+			expectedErr: "awstee not found in archive",
+		},
+		{
+			name:        "missing",
+			files:       []*tar.Header{{Name: "LICENSE", Typeflag: tar.TypeReg}},
+			expectedErr: "awstee not found in archive",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			gw := gzip.NewWriter(&buf)
+			tw := tar.NewWriter(gw)
+			for _, hdr := range c.files {
+				var body []byte
+				if hdr.Typeflag == tar.TypeReg {
+					body = []byte("binary of " + hdr.Name)
+				}
+				hdr.Size = int64(len(body))
+				hdr.Mode = 0755
+				require.NoError(t, tw.WriteHeader(hdr))
+				_, err := tw.Write(body)
+				require.NoError(t, err)
+			}
+			require.NoError(t, tw.Close())
+			require.NoError(t, gw.Close())
+
+			binary, err := extractBinary(buf.Bytes(), "awstee")
+			if c.expectedErr != "" {
+				require.EqualError(t, err, c.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "binary of "+c.expected, string(binary))
+		})
+	}
+
+	_, err := extractBinary([]byte("not gzip"), "awstee")
+	require.Error(t, err)
+}
+
+func TestVerifySignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	publicKey := base64.StdEncoding.EncodeToString(public)
+	checksums := []byte(strings.Repeat("0123abcd", 8) + "  awstee_0.3.0_linux_amd64.tar.gz\n")
+	signature := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(private, checksums)) + "\n")
+
+	require.NoError(t, verifySignature(publicKey, checksums, signature))
+
+	tampered := bytes.Replace(checksums, []byte("0123"), []byte("3210"), 1)
+	require.EqualError(t, verifySignature(publicKey, tampered, signature), "signature mismatch")
+
+	other, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	require.EqualError(t, verifySignature(base64.StdEncoding.EncodeToString(other), checksums, signature), "signature mismatch")
+
+	require.EqualError(t, verifySignature(publicKey, checksums, []byte("not a signature")), "signature is not a base64 ed25519 signature")
+	require.EqualError(t, verifySignature("bm90IGEga2V5", checksums, signature), "release public key is not a base64 ed25519 public key")
+}
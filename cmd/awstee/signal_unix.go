@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var (
+	statsSignals = []os.Signal{syscall.SIGUSR1}
+	flushSignals = []os.Signal{syscall.SIGHUP}
+	// the lambda extension reloads the config by SIGHUP, the capture flushes by it
+	reloadSignals = []os.Signal{syscall.SIGHUP}
+)
+
+// ignoreSIGPIPE makes writes to a broken stdout return EPIPE instead of terminating the process.
+func ignoreSIGPIPE() {
+	signal.Ignore(syscall.SIGPIPE)
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import "os"
+
+var (
+	statsSignals  = []os.Signal{}
+	flushSignals  = []os.Signal{}
+	reloadSignals = []os.Signal{}
+)
+
+// ignoreSIGPIPE is a no-op, writes to a broken stdout always return an error on windows.
+func ignoreSIGPIPE() {}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// openStdin returns stdin as it is, Close does not interrupt a blocked Read on windows.
+func openStdin() *os.File {
+	return os.Stdin
+}
@@ -1,16 +1,22 @@
 package awstee
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
@@ -19,30 +25,130 @@ import (
 )
 
 type Config struct {
-	RequiredVersion string                `yaml:"required_version,omitempty"`
-	AWSRegion       string                `yaml:"aws_region,omitempty"`
-	S3              *S3Config             `yaml:"s3,omitempty"`
-	Cloudwatch      *CloudwatchLogsConfig `yaml:"cloudwatch,omitempty"`
-	Endpoints       *EndpointsConfig      `yaml:"endpoints,omitempty"`
+	RequiredVersion      string                   `yaml:"required_version,omitempty"`
+	AWSRegion            string                   `yaml:"aws_region,omitempty"`
+	AWSProfile           string                   `yaml:"aws_profile,omitempty"`
+	MaxAttempts          int                      `yaml:"max_attempts,omitempty"`
+	RetryMode            string                   `yaml:"retry_mode,omitempty"`
+	AppID                string                   `yaml:"app_id,omitempty"`
+	UseFIPSEndpoint      bool                     `yaml:"use_fips_endpoint,omitempty"`
+	UseDualStackEndpoint bool                     `yaml:"use_dualstack_endpoint,omitempty"`
+	S3                   *S3Config                `yaml:"s3,omitempty"`
+	Cloudwatch           *CloudwatchLogsConfig    `yaml:"cloudwatch,omitempty"`
+	Endpoints            *EndpointsConfig         `yaml:"endpoints,omitempty"`
+	HTTP                 *HTTPConfig              `yaml:"http,omitempty"`
+	PrefixTimestamp      string                   `yaml:"prefix_timestamp,omitempty"`
+	NormalizeTimestamp   TimestampConfig          `yaml:"normalize_timestamp,omitempty"`
+	LinePrefix           string                   `yaml:"line_prefix,omitempty"`
+	OutputName           string                   `yaml:"output_name,omitempty"`
+	StripANSI            bool                     `yaml:"strip_ansi,omitempty"`
+	NormalizeCRLF        bool                     `yaml:"normalize_crlf,omitempty"`
+	SanitizeUTF8         bool                     `yaml:"sanitize_utf8,omitempty"`
+	MaxRate              string                   `yaml:"max_rate,omitempty"`
+	MaxLineBytes         int                      `yaml:"max_line_bytes,omitempty"`
+	OnLongLine           string                   `yaml:"on_long_line,omitempty"`
+	Raw                  bool                     `yaml:"raw,omitempty"`
+	RawCloudwatch        string                   `yaml:"raw_cloudwatch,omitempty"`
+	NoAutoDecompress     bool                     `yaml:"no_auto_decompress,omitempty"`
+	Lock                 bool                     `yaml:"lock,omitempty"`
+	Manifest             bool                     `yaml:"manifest,omitempty"`
+	Summary              bool                     `yaml:"summary,omitempty"`
+	Delivery             string                   `yaml:"delivery,omitempty"`
+	Throughput           string                   `yaml:"throughput,omitempty"`
+	Async                bool                     `yaml:"async,omitempty"`
+	Overflow             OverflowConfig           `yaml:"overflow,omitempty"`
+	SelfMetrics          SelfMetricsConfig        `yaml:"self_metrics,omitempty"`
+	MetricsListen        string                   `yaml:"metrics_listen,omitempty"`
+	DebugAWS             bool                     `yaml:"debug_aws,omitempty"`
+	Notify               NotifyConfig             `yaml:"notify,omitempty"`
+	Targets              map[string]*TargetConfig `yaml:"targets,omitempty"`
+	Target               string                   `yaml:"target,omitempty"`
+	Include              []string                 `yaml:"include,omitempty"`
+	Routes               []*RouteConfig           `yaml:"routes,omitempty"`
+	SeverityRoutes       []*SeverityRouteConfig   `yaml:"severity_routes,omitempty"`
 
 	//private field
 	versionConstraints gv.Constraints `yaml:"-,omitempty"`
+	prefixTimestamp    bool
+	timestampLayout    string
+	linePrefix         *template.Template
+	outputName         *template.Template
+	lambdaOutputName   *template.Template
+	maxRate            *rateLimit
+	retryMode          aws.RetryMode
+	s3Configs          []*S3Config
+	cloudwatchConfigs  []*CloudwatchLogsConfig
+}
+
+// TargetConfig is a named destination set, selected by target.
+type TargetConfig struct {
+	S3         *S3Config             `yaml:"s3,omitempty"`
+	Cloudwatch *CloudwatchLogsConfig `yaml:"cloudwatch,omitempty"`
 }
 
 type S3Config struct {
-	URLPrefix             string `yaml:"url_prefix,omitempty"`
-	AllowOverwrite        bool   `yaml:"allow_overwrite,omitempty"`
-	FirstlyPutEmptyObject bool   `yaml:"firstly_put_empty_object,omitempty"`
-	urlPrefix             *url.URL
+	URLPrefix             string            `yaml:"url_prefix,omitempty"`
+	AllowOverwrite        bool              `yaml:"allow_overwrite,omitempty"`
+	FirstlyPutEmptyObject bool              `yaml:"firstly_put_empty_object,omitempty"`
+	Limit                 LimitConfig       `yaml:",inline"`
+	Credentials           CredentialsConfig `yaml:",inline"`
+	Retry                 RetryConfig       `yaml:"retry,omitempty"`
+	Spill                 SpillConfig       `yaml:"spill,omitempty"`
+	Watchdog              WatchdogConfig    `yaml:"watchdog,omitempty"`
+	Lines                 LinesConfig       `yaml:",inline"`
+	Encrypt               EncryptConfig     `yaml:"encrypt,omitempty"`
+	// Concurrency is the parts uploaded in parallel, and PartSize is the bytes of a part. The memory of the upload is Concurrency * PartSize.
+	Concurrency int   `yaml:"concurrency,omitempty"`
+	PartSize    int64 `yaml:"part_size,omitempty"`
+	urlPrefix   *url.URL
+	// concurrency and partSize are the ones used, Concurrency and PartSize or the preset of throughput
+	concurrency int
+	partSize    int64
 }
 
 type CloudwatchLogsConfig struct {
-	LogGroup       string `yaml:"log_group,omitempty"`
-	FlushInterval  string `yaml:"flush_interval,omitempty"`
-	BufferLines    int    `yaml:"buffer_lines,omitempty"`
-	CreateLogGroup bool   `yaml:"create_log_group,omitempty"`
+	LogGroup       string               `yaml:"log_group,omitempty"`
+	FlushInterval  string               `yaml:"flush_interval,omitempty"`
+	BufferLines    int                  `yaml:"buffer_lines,omitempty"`
+	CreateLogGroup bool                 `yaml:"create_log_group,omitempty"`
+	Limit          LimitConfig          `yaml:",inline"`
+	Credentials    CredentialsConfig    `yaml:",inline"`
+	Retry          RetryConfig          `yaml:"retry,omitempty"`
+	Spill          SpillConfig          `yaml:"spill,omitempty"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker,omitempty"`
+	Watchdog       WatchdogConfig       `yaml:"watchdog,omitempty"`
+	Lines          LinesConfig          `yaml:",inline"`
+	// Dedup confirms the batches failed ambiguously by GetLogEvents before putting them again.
+	Dedup bool `yaml:"dedup,omitempty"`
+	// InFlightBatches is the batches put or queued to be put while the lines keep being buffered, 1 waits for each batch.
+	InFlightBatches int `yaml:"in_flight_batches,omitempty"`
+	// AdaptiveBatch grows the batches from buffer_lines under the load and puts them early while the input trickles.
+	AdaptiveBatch bool `yaml:"adaptive_batch,omitempty"`
+
+	flushInterval   time.Duration
+	maxLineBytes    int
+	inFlightBatches int
+	// onLongLine is the policy of the lines longer than maxLineBytes, overridden by on_long_line of Config
+	onLongLine string
+	// timestamps stamps the events by the timestamps normalized, overridden by normalize_timestamp of Config
+	timestamps *TimestampConfig
+}
+
+// CredentialsConfig overrides the credentials of a destination, e.g. to write to another account.
+type CredentialsConfig struct {
+	Profile       string `yaml:"profile,omitempty"`
+	AssumeRoleARN string `yaml:"assume_role_arn,omitempty"`
+}
 
-	flushInterval time.Duration
+func (cfg *CredentialsConfig) Enabled() bool {
+	return cfg.Profile != "" || cfg.AssumeRoleARN != ""
+}
+
+func (cfg *CredentialsConfig) Restrict() error {
+	if cfg.AssumeRoleARN != "" && !strings.HasPrefix(cfg.AssumeRoleARN, "arn:") {
+		return fmt.Errorf("assume_role_arn is not an ARN: %s", cfg.AssumeRoleARN)
+	}
+	return nil
 }
 
 type EndpointsConfig struct {
@@ -51,20 +157,232 @@ type EndpointsConfig struct {
 	S3             string `yaml:"s3,omitempty"`
 }
 
-func (cfg *Config) Load(path string) error {
+// Load loads the config files at paths in order, a later file overrides the values of the former ones.
+// A path may be an s3://, ssm:// or secretsmanager:// URL.
+// The config can refer SSM parameters and secrets by {{ ssm "..." }} and {{ secretsmanager "..." }},
+// and have KMS encrypted values by `!kms <ciphertext>` or `kms://<ciphertext>`.
+func (cfg *Config) Load(paths ...string) error {
+	ctx := context.Background()
+	fetcher := newConfigFetcher(cfg)
 	loader := gc.New()
-	if err := loader.LoadWithEnv(cfg, path); err != nil {
-		return fmt.Errorf("config load:%w", err)
+	loader.Funcs(fetcher.FuncMap(ctx))
+	for _, path := range paths {
+		if err := cfg.load(ctx, loader, fetcher, path, nil); err != nil {
+			return fmt.Errorf("config load:%w", err)
+		}
 	}
 	return cfg.Restrict()
 }
 
+// load loads the files of include first, and then the file at path over them.
+// Nested values are merged, but lists and the entries of targets are replaced.
+func (cfg *Config) load(ctx context.Context, loader *gc.Loader, fetcher *configFetcher, path string, loading []string) error {
+	loading = append(loading, path)
+	for _, p := range loading[:len(loading)-1] {
+		if p == path {
+			return fmt.Errorf("include cycle %s", strings.Join(loading, " -> "))
+		}
+	}
+	src, err := readConfigSource(ctx, fetcher, path)
+	if err != nil {
+		return err
+	}
+	src, err = loader.ReadWithEnvBytes(src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	src, err = decryptKMSValues(ctx, fetcher, src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := checkConfigKeys(src); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	var includes struct {
+		Include []string `yaml:"include"`
+	}
+	if err := loader.LoadBytes(&includes, src); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, include := range includes.Include {
+		if err := cfg.load(ctx, loader, fetcher, resolveInclude(path, include), loading); err != nil {
+			return err
+		}
+	}
+	if err := loader.LoadBytes(cfg, src); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// EnvPrefix is the prefix of the environment variables that override the configuration.
+const EnvPrefix = "AWSTEE_"
+
+type envVar struct {
+	name string
+	set  func(string) error
+}
+
+func (cfg *Config) envVars() []envVar {
+	s3Cfg := func() *S3Config {
+		if cfg.S3 == nil {
+			cfg.S3 = &S3Config{}
+		}
+		return cfg.S3
+	}
+	cwCfg := func() *CloudwatchLogsConfig {
+		if cfg.Cloudwatch == nil {
+			cfg.Cloudwatch = &CloudwatchLogsConfig{}
+		}
+		return cfg.Cloudwatch
+	}
+	httpCfg := func() *HTTPConfig {
+		if cfg.HTTP == nil {
+			cfg.HTTP = &HTTPConfig{}
+		}
+		return cfg.HTTP
+	}
+	return []envVar{
+		{"AWS_REGION", envString(func() *string { return &cfg.AWSRegion })},
+		{"PROFILE", envString(func() *string { return &cfg.AWSProfile })},
+		{"MAX_ATTEMPTS", envInt(func() *int { return &cfg.MaxAttempts })},
+		{"RETRY_MODE", envString(func() *string { return &cfg.RetryMode })},
+		{"APP_ID", envString(func() *string { return &cfg.AppID })},
+		{"USE_FIPS_ENDPOINT", envBool(func() *bool { return &cfg.UseFIPSEndpoint })},
+		{"USE_DUALSTACK_ENDPOINT", envBool(func() *bool { return &cfg.UseDualStackEndpoint })},
+		{"PREFIX_TIMESTAMP", envString(func() *string { return &cfg.PrefixTimestamp })},
+		{"NORMALIZE_TIMESTAMP", envString(func() *string { return &cfg.NormalizeTimestamp.Format })},
+		{"TIMESTAMP_ZONE", envString(func() *string { return &cfg.NormalizeTimestamp.Zone })},
+		{"LINE_PREFIX", envString(func() *string { return &cfg.LinePrefix })},
+		{"OUTPUT_NAME", envString(func() *string { return &cfg.OutputName })},
+		{"STRIP_ANSI", envBool(func() *bool { return &cfg.StripANSI })},
+		{"NORMALIZE_CRLF", envBool(func() *bool { return &cfg.NormalizeCRLF })},
+		{"SANITIZE_UTF8", envBool(func() *bool { return &cfg.SanitizeUTF8 })},
+		{"MAX_RATE", envString(func() *string { return &cfg.MaxRate })},
+		{"MAX_LINE_BYTES", envInt(func() *int { return &cfg.MaxLineBytes })},
+		{"ON_LONG_LINE", envString(func() *string { return &cfg.OnLongLine })},
+		{"RAW", envBool(func() *bool { return &cfg.Raw })},
+		{"RAW_CLOUDWATCH", envString(func() *string { return &cfg.RawCloudwatch })},
+		{"NO_AUTO_DECOMPRESS", envBool(func() *bool { return &cfg.NoAutoDecompress })},
+		{"LOCK", envBool(func() *bool { return &cfg.Lock })},
+		{"MANIFEST", envBool(func() *bool { return &cfg.Manifest })},
+		{"SUMMARY", envBool(func() *bool { return &cfg.Summary })},
+		{"DELIVERY", envString(func() *string { return &cfg.Delivery })},
+		{"THROUGHPUT", envString(func() *string { return &cfg.Throughput })},
+		{"ASYNC", envBool(func() *bool { return &cfg.Async })},
+		{"SELF_METRICS_NAMESPACE", envString(func() *string { return &cfg.SelfMetrics.Namespace })},
+		{"SELF_METRICS_INTERVAL", envString(func() *string { return &cfg.SelfMetrics.Interval })},
+		{"METRICS_LISTEN", envString(func() *string { return &cfg.MetricsListen })},
+		{"DEBUG_AWS", envBool(func() *bool { return &cfg.DebugAWS })},
+		{"NOTIFY_SNS_TOPIC_ARN", envString(func() *string { return &cfg.Notify.SNSTopicARN })},
+		{"NOTIFY_EVENT_BUS_NAME", envString(func() *string { return &cfg.Notify.EventBusName })},
+		{"OVERFLOW", envString(func() *string { return &cfg.Overflow.Policy })},
+		{"TARGET", envString(func() *string { return &cfg.Target })},
+		{"S3_URL_PREFIX", envString(func() *string { return &s3Cfg().URLPrefix })},
+		{"S3_ALLOW_OVERWRITE", envBool(func() *bool { return &s3Cfg().AllowOverwrite })},
+		{"S3_FIRSTLY_PUT_EMPTY_OBJECT", envBool(func() *bool { return &s3Cfg().FirstlyPutEmptyObject })},
+		{"LOG_GROUP", envString(func() *string { return &cwCfg().LogGroup })},
+		{"FLUSH_INTERVAL", envString(func() *string { return &cwCfg().FlushInterval })},
+		{"BUFFER_LINES", envInt(func() *int { return &cwCfg().BufferLines })},
+		{"CREATE_LOG_GROUP", envBool(func() *bool { return &cwCfg().CreateLogGroup })},
+		{"ADAPTIVE_BATCH", envBool(func() *bool { return &cwCfg().AdaptiveBatch })},
+		{"HTTP_PROXY", envString(func() *string { return &httpCfg().Proxy })},
+		{"CA_BUNDLE", envString(func() *string { return &httpCfg().CABundle })},
+	}
+}
+
+func envString(field func() *string) func(string) error {
+	return func(v string) error {
+		*field() = v
+		return nil
+	}
+}
+
+func envBool(field func() *bool) func(string) error {
+	return func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*field() = b
+		return nil
+	}
+}
+
+func envInt(field func() *int) func(string) error {
+	return func(v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*field() = i
+		return nil
+	}
+}
+
+// LoadEnv overrides the configuration by AWSTEE_* environment variables, e.g. AWSTEE_S3_URL_PREFIX and AWSTEE_LOG_GROUP.
+// Restrict must be called after LoadEnv.
+func (cfg *Config) LoadEnv() error {
+	for _, e := range cfg.envVars() {
+		name := EnvPrefix + e.name
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := e.set(v); err != nil {
+			return fmt.Errorf("%s is invalid: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// EnableS3 reports whether any s3 destination is resolved by Restrict, including the ones of routes.
 func (cfg *Config) EnableS3() bool {
-	return cfg.S3 != nil && cfg.S3.URLPrefix != ""
+	return len(cfg.allS3Configs()) > 0
 }
 
+// EnableCloudwatchLogs reports whether any cloudwatch logs destination is resolved by Restrict, including the ones of routes.
 func (cfg *Config) EnableCloudwatchLogs() bool {
-	return cfg.Cloudwatch != nil && cfg.Cloudwatch.LogGroup != ""
+	return len(cfg.allCloudwatchConfigs()) > 0
+}
+
+// resolveDestinations resolves the destinations of the selected targets, or the top level s3 and cloudwatch if no target is selected.
+func (cfg *Config) resolveDestinations() error {
+	cfg.s3Configs = nil
+	cfg.cloudwatchConfigs = nil
+	if cfg.Target == "" {
+		return cfg.addDestinations("", &TargetConfig{S3: cfg.S3, Cloudwatch: cfg.Cloudwatch})
+	}
+	for _, name := range strings.Split(cfg.Target, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		target, ok := cfg.Targets[name]
+		if !ok || target == nil {
+			return fmt.Errorf("target %s is not defined", name)
+		}
+		if err := cfg.addDestinations(fmt.Sprintf("target %s: ", name), target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) addDestinations(errPrefix string, target *TargetConfig) error {
+	if target.S3 != nil && target.S3.URLPrefix != "" {
+		if err := target.S3.Restrict(); err != nil {
+			return fmt.Errorf("%s%w", errPrefix, err)
+		}
+		cfg.s3Configs = append(cfg.s3Configs, target.S3)
+	}
+	if target.Cloudwatch != nil && target.Cloudwatch.LogGroup != "" {
+		if err := target.Cloudwatch.Restrict(); err != nil {
+			return fmt.Errorf("%s%w", errPrefix, err)
+		}
+		cfg.cloudwatchConfigs = append(cfg.cloudwatchConfigs, target.Cloudwatch)
+	}
+	return nil
 }
 
 // Restrict restricts a configuration.
@@ -76,22 +394,213 @@ func (cfg *Config) Restrict() error {
 		}
 		cfg.versionConstraints = constraints
 	}
+	if cfg.MaxAttempts < 0 {
+		return fmt.Errorf("max_attempts must not be negative")
+	}
+	cfg.retryMode = ""
+	if cfg.RetryMode != "" {
+		mode, err := aws.ParseRetryMode(cfg.RetryMode)
+		if err != nil {
+			return fmt.Errorf("retry_mode must be one of %s, %s", aws.RetryModeStandard, aws.RetryModeAdaptive)
+		}
+		cfg.retryMode = mode
+	}
+	if err := validateAppID(cfg.AppID); err != nil {
+		return err
+	}
+	if cfg.PrefixTimestamp == "" && cfg.prefixTimestamp {
+		cfg.PrefixTimestamp = "rfc3339"
+	}
+	cfg.timestampLayout = timestampLayout(cfg.PrefixTimestamp)
+	if err := cfg.NormalizeTimestamp.Restrict(); err != nil {
+		return err
+	}
+	cfg.linePrefix = nil
+	if cfg.LinePrefix != "" {
+		tmpl, err := template.New("line_prefix").Parse(cfg.LinePrefix)
+		if err != nil {
+			return fmt.Errorf("line_prefix has invalid format: %w", err)
+		}
+		cfg.linePrefix = tmpl
+	}
+	outputName := cfg.OutputName
+	if outputName == "" {
+		outputName = DefaultOutputName
+	}
+	tmpl, err := template.New("output_name").Parse(outputName)
+	if err != nil {
+		return fmt.Errorf("output_name has invalid format: %w", err)
+	}
+	cfg.outputName = tmpl
+	cfg.lambdaOutputName = tmpl
+	if cfg.OutputName == "" {
+		// the invocations of a function have their own objects by default
+		cfg.lambdaOutputName = template.Must(template.New("output_name").Parse(DefaultLambdaOutputName))
+	}
+	cfg.maxRate = nil
+	if cfg.MaxRate != "" {
+		l, err := parseRateLimit(cfg.MaxRate)
+		if err != nil {
+			return fmt.Errorf("max_rate has invalid format: %w", err)
+		}
+		cfg.maxRate = l
+	}
+	if cfg.MaxLineBytes < 0 {
+		return fmt.Errorf("max_line_bytes must not be negative")
+	}
+	if cfg.MaxLineBytes == 0 {
+		cfg.MaxLineBytes = DefaultMaxLineBytes
+	}
+	switch cfg.OnLongLine {
+	case "":
+		cfg.OnLongLine = LongLineTruncate
+	case LongLineTruncate, LongLineSplit, LongLineDrop:
+	default:
+		return fmt.Errorf("on_long_line must be one of %s, %s, %s", LongLineTruncate, LongLineSplit, LongLineDrop)
+	}
+	switch cfg.RawCloudwatch {
+	case "":
+		cfg.RawCloudwatch = RawCloudwatchSkip
+	case RawCloudwatchSkip, RawCloudwatchBase64:
+	default:
+		return fmt.Errorf("raw_cloudwatch must be one of %s, %s", RawCloudwatchSkip, RawCloudwatchBase64)
+	}
+	if cfg.Raw && (cfg.timestampLayout != "" || cfg.linePrefix != nil || cfg.StripANSI) {
+		return fmt.Errorf("raw can not be used with prefix_timestamp, line_prefix or strip_ansi, which rewrite the lines")
+	}
+	if cfg.Raw && cfg.NormalizeTimestamp.Enabled() {
+		return fmt.Errorf("raw can not be used with normalize_timestamp, which rewrites the lines")
+	}
+	if cfg.Raw && (cfg.NormalizeCRLF || cfg.SanitizeUTF8) {
+		return fmt.Errorf("raw can not be used with normalize_crlf or sanitize_utf8, which rewrite the lines")
+	}
 
-	if cfg.EnableS3() {
-		if err := cfg.S3.Restrict(); err != nil {
-			return err
+	preset, err := cfg.throughputPreset()
+	if err != nil {
+		return err
+	}
+	overflowPolicy := preset.overflowPolicy
+	if cfg.Async {
+		// the writes go to the queue of each destination, which drops the lines instead of blocking by default
+		if cfg.Overflow.Policy == OverflowBlock {
+			return fmt.Errorf("async requires overflow policy %s or %s", OverflowBuffer, OverflowDrop)
+		}
+		overflowPolicy = OverflowDrop
+	}
+	switch cfg.Delivery {
+	case "":
+		cfg.Delivery = DeliveryStrict
+	case DeliveryStrict, DeliveryBestEffort:
+	default:
+		return fmt.Errorf("delivery must be one of %s, %s", DeliveryStrict, DeliveryBestEffort)
+	}
+	if err := cfg.Overflow.restrict(overflowPolicy); err != nil {
+		return err
+	}
+	if err := cfg.SelfMetrics.Restrict(); err != nil {
+		return err
+	}
+	if cfg.MetricsListen != "" {
+		if _, _, err := net.SplitHostPort(cfg.MetricsListen); err != nil {
+			return fmt.Errorf("metrics_listen is invalid: %w", err)
 		}
 	}
-	if cfg.EnableCloudwatchLogs() {
-		if err := cfg.Cloudwatch.Restrict(); err != nil {
+	if err := cfg.Notify.Restrict(); err != nil {
+		return err
+	}
+
+	if cfg.HTTP != nil {
+		if err := cfg.HTTP.Restrict(); err != nil {
 			return err
 		}
 	}
+	if err := cfg.resolveDestinations(); err != nil {
+		return err
+	}
+	if err := cfg.restrictRoutes(); err != nil {
+		return err
+	}
+	if err := cfg.restrictSeverityRoutes(); err != nil {
+		return err
+	}
+	for _, s3Cfg := range cfg.allS3Configs() {
+		s3Cfg.Limit.onLongLine = cfg.OnLongLine
+	}
+	cfg.applyThroughput(preset)
+	for _, cwCfg := range cfg.allCloudwatchConfigs() {
+		cwCfg.maxLineBytes = cfg.MaxLineBytes
+		cwCfg.onLongLine = cfg.OnLongLine
+		cwCfg.Limit.onLongLine = cfg.OnLongLine
+		cwCfg.timestamps = nil
+		if cfg.NormalizeTimestamp.Enabled() {
+			cwCfg.timestamps = &cfg.NormalizeTimestamp
+		}
+	}
+	if cfg.Raw && len(cfg.SeverityRoutes) > 0 {
+		return fmt.Errorf("raw can not be used with severity_routes, which select the lines")
+	}
+	if cfg.Raw {
+		for _, s3Cfg := range cfg.allS3Configs() {
+			if s3Cfg.Lines.Enabled() {
+				return fmt.Errorf("raw can not be used with %s of s3 %s, which select or rewrite the lines", strings.Join(s3Cfg.Lines.settings(), ", "), s3Cfg.URLPrefix)
+			}
+		}
+		for _, cwCfg := range cfg.allCloudwatchConfigs() {
+			if cwCfg.Lines.Enabled() {
+				return fmt.Errorf("raw can not be used with %s of cloudwatch %s, which select or rewrite the lines", strings.Join(cwCfg.Lines.settings(), ", "), cwCfg.LogGroup)
+			}
+		}
+	}
+	if cfg.Lock && !cfg.EnableS3() {
+		return fmt.Errorf("lock requires s3 url_prefix, the lock object is put next to the s3 object")
+	}
+	if cfg.Manifest && !cfg.EnableS3() {
+		return fmt.Errorf("manifest requires s3 url_prefix, the manifest object is put next to the s3 object")
+	}
+	if cfg.Summary && !cfg.EnableS3() {
+		return fmt.Errorf("summary requires s3 url_prefix, the summary object is put next to the s3 object")
+	}
 	return nil
 }
 
 func (cfg *Config) SetFlags(f *flag.FlagSet) {
-	flag.StringVar(&cfg.AWSRegion, "aws-region", cfg.AWSRegion, "aws region")
+	f.StringVar(&cfg.AWSRegion, "aws-region", cfg.AWSRegion, "aws region")
+	f.StringVar(&cfg.AWSProfile, "profile", cfg.AWSProfile, "aws shared config profile")
+	f.IntVar(&cfg.MaxAttempts, "max-attempts", cfg.MaxAttempts, "maximum number of attempts of aws api calls (0 means the sdk default)")
+	f.StringVar(&cfg.RetryMode, "retry-mode", cfg.RetryMode, "retry mode of aws api calls, standard or adaptive")
+	f.BoolVar(&cfg.UseFIPSEndpoint, "use-fips-endpoint", cfg.UseFIPSEndpoint, "use the FIPS endpoints of aws api calls")
+	f.BoolVar(&cfg.UseDualStackEndpoint, "use-dualstack-endpoint", cfg.UseDualStackEndpoint, "use the dual-stack (IPv6) endpoints of aws api calls")
+	f.StringVar(&cfg.AppID, "app-id", cfg.AppID, "application id added to the user agent of aws api calls, e.g. the name of the team")
+	f.StringVar(&cfg.LinePrefix, "line-prefix", cfg.LinePrefix, "prefix template of lines written to destinations (e.g. \"[{{ .Hostname }}/{{ .OutputName }}] \")")
+	f.StringVar(&cfg.OutputName, "output-name", cfg.OutputName, "template of the output name used when the argument is omitted (default "+strconv.Quote(DefaultOutputName)+")")
+	f.StringVar(&cfg.MaxRate, "max-rate", cfg.MaxRate, "maximum input rate, e.g. 5MB/s or 1000lines/s")
+	f.IntVar(&cfg.MaxLineBytes, "max-line-bytes", cfg.MaxLineBytes, "maximum size of a line, the longer lines are truncated for cloudwatch logs (default 256KiB)")
+	f.StringVar(&cfg.OnLongLine, "on-long-line", cfg.OnLongLine, "truncate, split or drop. what is done with the lines longer than -max-line-bytes for cloudwatch logs (default truncate)")
+	f.BoolVar(&cfg.Raw, "raw", cfg.Raw, "copy the input verbatim to the standard output and the destinations without the line scanning, for a binary stream")
+	f.StringVar(&cfg.RawCloudwatch, "raw-cloudwatch", cfg.RawCloudwatch, "skip or base64. what is done with the cloudwatch logs destinations with -raw (default skip)")
+	f.BoolVar(&cfg.NoAutoDecompress, "no-auto-decompress", cfg.NoAutoDecompress, "do not decompress the input beginning with the gzip magic number")
+	f.StringVar(&cfg.Target, "target", cfg.Target, "comma separated names of targets to write, instead of the top level s3 and cloudwatch (e.g. ci,audit)")
+	f.BoolVar(&cfg.Lock, "lock", cfg.Lock, "lock the output name with a .lock object in s3, so that another awstee can not use the same output name")
+	f.BoolVar(&cfg.Manifest, "manifest", cfg.Manifest, "record a .manifest.json object in s3, and skip the destinations when the same input was already delivered to the output name")
+	f.BoolVar(&cfg.Summary, "summary", cfg.Summary, "put a .summary.json object next to each s3 object at the end, with the counts, the losses and the sha256 of the run")
+	f.StringVar(&cfg.Delivery, "delivery", cfg.Delivery, "strict or best_effort. with best_effort, the failures of all destinations never stop the standard output (default strict)")
+	f.StringVar(&cfg.Throughput, "throughput", cfg.Throughput, "low, default or high. the preset of the parallelism of the destinations, overridden by the knobs set explicitly (default \"default\")")
+	f.BoolVar(&cfg.Async, "async", cfg.Async, "never block the writes on aws, the lines are queued for each destination and dropped when the queue is full (-overflow drop)")
+	f.StringVar(&cfg.SelfMetrics.Namespace, "self-metrics-namespace", cfg.SelfMetrics.Namespace, "put the metrics of awstee itself to this cloudwatch namespace periodically, such as the bytes and the errors of each destination")
+	f.StringVar(&cfg.SelfMetrics.Interval, "self-metrics-interval", cfg.SelfMetrics.Interval, "interval of putting the self metrics (default 1m)")
+	f.StringVar(&cfg.MetricsListen, "metrics-listen", cfg.MetricsListen, "serve the prometheus metrics on /metrics of this address while running (e.g. :9100)")
+	f.BoolVar(&cfg.DebugAWS, "debug-aws", cfg.DebugAWS, "log each aws call with the request id, the attempts, the status code and the latency, and the retries of the aws sdk")
+	f.StringVar(&cfg.Notify.SNSTopicARN, "notify-sns-topic-arn", cfg.Notify.SNSTopicARN, "publish the event of the run to this sns topic when it finishes")
+	f.StringVar(&cfg.Notify.EventBusName, "notify-event-bus-name", cfg.Notify.EventBusName, "put the event of the run to this eventbridge event bus when it finishes")
+	f.StringVar(&cfg.Overflow.Policy, "overflow", cfg.Overflow.Policy, "block, buffer or drop. what is done with the writes when a destination can not keep up (default block)")
+	f.Int64Var(&cfg.Overflow.MaxBytes, "overflow-max-bytes", cfg.Overflow.MaxBytes, "size of the queue of each destination with -overflow buffer or drop (default 64MiB)")
+	f.StringVar(&cfg.Overflow.Dir, "overflow-dir", cfg.Overflow.Dir, "directory of the queue files with -overflow buffer or drop, instead of the memory")
+	f.BoolVar(&cfg.StripANSI, "strip-ansi", cfg.StripANSI, "strip ANSI escape sequences from lines written to destinations")
+	f.BoolVar(&cfg.NormalizeCRLF, "normalize-crlf", cfg.NormalizeCRLF, "normalize the CRLF line endings to LF in lines written to destinations")
+	f.BoolVar(&cfg.SanitizeUTF8, "sanitize-utf8", cfg.SanitizeUTF8, "replace the invalid UTF-8 sequences in lines written to destinations with U+FFFD")
+	f.BoolVar(&cfg.prefixTimestamp, "t", false, "prefix rfc3339 timestamp to lines written to destinations")
+	f.StringVar(&cfg.NormalizeTimestamp.Format, "normalize-timestamp", cfg.NormalizeTimestamp.Format, "rewrite the timestamps at the start of lines written to destinations to this format, rfc3339, rfc3339nano or a Go time layout")
+	f.StringVar(&cfg.NormalizeTimestamp.Zone, "timestamp-zone", cfg.NormalizeTimestamp.Zone, "zone of the timestamps rewritten by -normalize-timestamp (default UTC)")
 	if cfg.S3 == nil {
 		cfg.S3 = &S3Config{}
 	}
@@ -100,6 +609,10 @@ func (cfg *Config) SetFlags(f *flag.FlagSet) {
 		cfg.Cloudwatch = &CloudwatchLogsConfig{}
 	}
 	cfg.Cloudwatch.SetFlags(f)
+	if cfg.HTTP == nil {
+		cfg.HTTP = &HTTPConfig{}
+	}
+	cfg.HTTP.SetFlags(f)
 }
 
 func (cfg *S3Config) Restrict() error {
@@ -111,13 +624,44 @@ func (cfg *S3Config) Restrict() error {
 		return fmt.Errorf("s3 url_prefix schema is not `s3`: schema is `%s`", u.Scheme)
 	}
 	cfg.urlPrefix = u
+	if err := cfg.Limit.Restrict(); err != nil {
+		return fmt.Errorf("s3 %w", err)
+	}
+	if err := cfg.Credentials.Restrict(); err != nil {
+		return fmt.Errorf("s3 %w", err)
+	}
+	if err := cfg.Retry.Restrict(); err != nil {
+		return fmt.Errorf("s3 %w", err)
+	}
+	if err := cfg.Spill.Restrict(); err != nil {
+		return fmt.Errorf("s3 %w", err)
+	}
+	if err := cfg.Watchdog.Restrict(); err != nil {
+		return fmt.Errorf("s3 %w", err)
+	}
+	if cfg.Concurrency < 0 {
+		return fmt.Errorf("s3 concurrency must not be negative")
+	}
+	if cfg.PartSize != 0 && cfg.PartSize < manager.MinUploadPartSize {
+		return fmt.Errorf("s3 part_size must be at least %d bytes", manager.MinUploadPartSize)
+	}
+	// overridden by throughput of Config
+	cfg.concurrency, cfg.partSize = cfg.Concurrency, cfg.PartSize
+	if err := cfg.Lines.Restrict(); err != nil {
+		return fmt.Errorf("s3 %w", err)
+	}
+	if err := cfg.Encrypt.Restrict(); err != nil {
+		return fmt.Errorf("s3 %w", err)
+	}
 	return nil
 }
 
 func (cfg *S3Config) SetFlags(f *flag.FlagSet) {
-	flag.StringVar(&cfg.URLPrefix, "s3-url-prefix", cfg.URLPrefix, "destination s3 url prefix")
-	flag.BoolVar(&cfg.AllowOverwrite, "s3-allow-overwrite", false, "allow overwriting if the s3 object already exists?")
-	flag.BoolVar(&cfg.FirstlyPutEmptyObject, "s3-firstly-put-empty-object", false, "put object from first for authority checks, etc.")
+	f.StringVar(&cfg.URLPrefix, "s3-url-prefix", cfg.URLPrefix, "destination s3 url prefix")
+	f.BoolVar(&cfg.AllowOverwrite, "s3-allow-overwrite", false, "allow overwriting if the s3 object already exists?")
+	f.BoolVar(&cfg.FirstlyPutEmptyObject, "s3-firstly-put-empty-object", false, "put object from first for authority checks, etc.")
+	f.IntVar(&cfg.Concurrency, "s3-concurrency", cfg.Concurrency, "s3 parts uploaded in parallel (default 5)")
+	f.Int64Var(&cfg.PartSize, "s3-part-size", cfg.PartSize, "s3 bytes of a part, at least 5MiB (default 5MiB)")
 }
 
 func (cfg *CloudwatchLogsConfig) Restrict() error {
@@ -136,13 +680,57 @@ func (cfg *CloudwatchLogsConfig) Restrict() error {
 	if cfg.BufferLines == 0 {
 		cfg.BufferLines = 50
 	}
+	if cfg.maxLineBytes == 0 {
+		// overridden by max_line_bytes of Config
+		cfg.maxLineBytes = DefaultMaxLineBytes
+	}
+	if cfg.onLongLine == "" {
+		cfg.onLongLine = LongLineTruncate
+	}
+	if err := cfg.Limit.Restrict(); err != nil {
+		return fmt.Errorf("cloudwatch %w", err)
+	}
+	if err := cfg.Credentials.Restrict(); err != nil {
+		return fmt.Errorf("cloudwatch %w", err)
+	}
+	if err := cfg.Retry.Restrict(); err != nil {
+		return fmt.Errorf("cloudwatch %w", err)
+	}
+	if cfg.InFlightBatches < 0 {
+		return fmt.Errorf("cloudwatch in_flight_batches must not be negative")
+	}
+	// overridden by throughput of Config
+	cfg.inFlightBatches = cfg.InFlightBatches
+	if cfg.inFlightBatches == 0 {
+		cfg.inFlightBatches = 1
+	}
+	if cfg.Dedup && cfg.Retry.Attempts == 0 {
+		cfg.Retry.Attempts = defaultDedupRetryAttempts
+	}
+	if err := cfg.Spill.Restrict(); err != nil {
+		return fmt.Errorf("cloudwatch %w", err)
+	}
+	if err := cfg.CircuitBreaker.Restrict(); err != nil {
+		return fmt.Errorf("cloudwatch %w", err)
+	}
+	if err := cfg.Watchdog.Restrict(); err != nil {
+		return fmt.Errorf("cloudwatch %w", err)
+	}
+	if err := cfg.Lines.Restrict(); err != nil {
+		return fmt.Errorf("cloudwatch %w", err)
+	}
+	if cfg.Lines.Binary == BinaryRaw {
+		return fmt.Errorf("cloudwatch binary must be %s or %s, the events of cloudwatch logs can not have the binary lines", BinaryBase64, BinaryMarker)
+	}
 	return nil
 }
 func (cfg *CloudwatchLogsConfig) SetFlags(f *flag.FlagSet) {
-	flag.StringVar(&cfg.LogGroup, "log-group-name", cfg.LogGroup, "destination cloudwatch logs log group name")
-	flag.StringVar(&cfg.FlushInterval, "flush-interval", "5s", "cloudwatch logs output flush interval duration")
-	flag.IntVar(&cfg.BufferLines, "buffer-lines", 50, "cloudwatch logs output buffered lines")
-	flag.BoolVar(&cfg.CreateLogGroup, "create-log-group", false, "cloudwatch logs log group if not exists, create target log group")
+	f.StringVar(&cfg.LogGroup, "log-group-name", cfg.LogGroup, "destination cloudwatch logs log group name")
+	f.StringVar(&cfg.FlushInterval, "flush-interval", "5s", "cloudwatch logs output flush interval duration")
+	f.IntVar(&cfg.BufferLines, "buffer-lines", 50, "cloudwatch logs output buffered lines")
+	f.BoolVar(&cfg.CreateLogGroup, "create-log-group", false, "cloudwatch logs log group if not exists, create target log group")
+	f.IntVar(&cfg.InFlightBatches, "in-flight-batches", cfg.InFlightBatches, "cloudwatch logs batches put or queued while the lines keep being buffered (default 1)")
+	f.BoolVar(&cfg.AdaptiveBatch, "adaptive-batch", cfg.AdaptiveBatch, "cloudwatch logs batches sized by the input, from buffer-lines up to 10000 lines")
 }
 
 // ValidateVersion validates a version satisfies required_version.
@@ -153,7 +741,7 @@ func (cfg *Config) ValidateVersion(version string) error {
 	versionParts := strings.SplitN(version, "-", 2)
 	v, err := gv.NewVersion(versionParts[0])
 	if err != nil {
-		log.Printf("[warn] Invalid version format \"%s\". Skip checking required_version.", version)
+		slog.Warn("invalid version format, skip checking required_version", "version", version)
 		// invalid version string (e.g. "current") always allowed
 		return nil
 	}
@@ -165,6 +753,8 @@ func (cfg *Config) ValidateVersion(version string) error {
 
 const (
 	defaultConfigPath = ".config/awstee/default"
+	xdgConfigPath     = "awstee/default"
+	projectConfigName = ".awstee"
 )
 
 func fileExists(path string) bool {
@@ -179,21 +769,60 @@ func newConfig() *Config {
 	return cfg
 }
 
-func DefaultConfig() *Config {
+// DefaultConfig returns the config loaded from the default config files, see DefaultConfigPaths.
+// An invalid default config file is an error, as well as the files given by the flags.
+func DefaultConfig() (*Config, error) {
 	cfg := newConfig()
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return cfg
+	paths := DefaultConfigPaths()
+	if len(paths) == 0 {
+		return cfg, nil
 	}
-	path := filepath.Join(homeDir, defaultConfigPath+".yaml")
-	if fileExists(path) {
-		cfg.Load(path)
+	if err := cfg.Load(paths...); err != nil {
+		return nil, fmt.Errorf("default config %s: %w", strings.Join(paths, ", "), err)
 	}
-	path = filepath.Join(homeDir, defaultConfigPath+".yml")
-	if fileExists(path) {
-		cfg.Load(path)
+	return cfg, nil
+}
+
+// DefaultConfigPaths returns the existing default config files in the order of loading, a later one overrides the former ones:
+// ~/.config/awstee/default.yaml, $XDG_CONFIG_HOME/awstee/default.yaml,
+// and .awstee.yaml in the current directory and its parents (the nearest one is the last).
+func DefaultConfigPaths() []string {
+	homeDir, _ := os.UserHomeDir()
+	cwd, _ := os.Getwd()
+	return defaultConfigPaths(homeDir, os.Getenv("XDG_CONFIG_HOME"), cwd)
+}
+
+func defaultConfigPaths(homeDir string, xdgConfigHome string, cwd string) []string {
+	var paths []string
+	seen := map[string]bool{}
+	add := func(base string) {
+		for _, ext := range []string{".yaml", ".yml"} {
+			path := base + ext
+			if !seen[path] && fileExists(path) {
+				paths = append(paths, path)
+				seen[path] = true
+			}
+		}
 	}
-	return cfg
+	if homeDir != "" {
+		add(filepath.Join(homeDir, defaultConfigPath))
+	}
+	if xdgConfigHome != "" {
+		add(filepath.Join(xdgConfigHome, xdgConfigPath))
+	}
+	if cwd != "" {
+		var dirs []string
+		for dir := cwd; ; dir = filepath.Dir(dir) {
+			dirs = append(dirs, dir)
+			if filepath.Dir(dir) == dir {
+				break
+			}
+		}
+		for i := len(dirs) - 1; i >= 0; i-- {
+			add(filepath.Join(dirs[i], projectConfigName))
+		}
+	}
+	return paths
 }
 
 func (cfg *Config) EndpointResolver() (aws.EndpointResolver, bool) {
@@ -204,34 +833,59 @@ func (cfg *Config) EndpointResolver() (aws.EndpointResolver, bool) {
 		if cfg.AWSRegion != region {
 			return aws.Endpoint{}, &aws.EndpointNotFoundError{}
 		}
+		var url string
 		switch service {
 		case cloudwatchlogs.ServiceID:
-			if cfg.Endpoints.CloudWatchLogs != "" {
-				return aws.Endpoint{
-					PartitionID:   "aws",
-					URL:           cfg.Endpoints.CloudWatchLogs,
-					SigningRegion: cfg.AWSRegion,
-				}, nil
-			}
+			url = cfg.Endpoints.CloudWatchLogs
 		case sts.ServiceID:
-			if cfg.Endpoints.STS != "" {
-				return aws.Endpoint{
-					PartitionID:   "aws",
-					URL:           cfg.Endpoints.STS,
-					SigningRegion: cfg.AWSRegion,
-				}, nil
-			}
+			url = cfg.Endpoints.STS
 		case s3.ServiceID:
-			if cfg.Endpoints.STS != "" {
-				return aws.Endpoint{
-					PartitionID:   "aws",
-					URL:           cfg.Endpoints.STS,
-					SigningRegion: cfg.AWSRegion,
-				}, nil
-			}
+			url = cfg.Endpoints.S3
+		}
+		if url == "" {
+			// the default endpoint, with use_fips_endpoint and use_dualstack_endpoint
+			return aws.Endpoint{}, &aws.EndpointNotFoundError{}
 		}
+		return aws.Endpoint{
+			PartitionID:   awsPartition(region),
+			URL:           url,
+			SigningRegion: region,
+		}, nil
+	}), true
+}
 
-		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+// endpointLoadOptions returns the options of the aws config of use_fips_endpoint and use_dualstack_endpoint.
+func (cfg *Config) endpointLoadOptions() []func(*awsConfig.LoadOptions) error {
+	var loadOpts []func(*awsConfig.LoadOptions) error
+	if cfg.UseFIPSEndpoint {
+		loadOpts = append(loadOpts, awsConfig.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if cfg.UseDualStackEndpoint {
+		loadOpts = append(loadOpts, awsConfig.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+	return loadOpts
+}
 
-	}), true
+// maxAppIDLength is the maximum length of the app id recommended by the AWS SDKs.
+const maxAppIDLength = 50
+
+// validateAppID validates app_id, which must be a token of the user agent.
+func validateAppID(appID string) error {
+	if len(appID) > maxAppIDLength {
+		return fmt.Errorf("app_id must be at most %d characters", maxAppIDLength)
+	}
+	for _, r := range appID {
+		if !isUserAgentTokenRune(r) {
+			return fmt.Errorf("app_id must not contain %q, use alphanumerics and !#$%%&'*+-.^_`|~", r)
+		}
+	}
+	return nil
+}
+
+func isUserAgentTokenRune(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
 }
@@ -1,8 +1,20 @@
 package awstee
 
 import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/stretchr/testify/require"
 )
 
@@ -15,6 +27,18 @@ func TestConfigLoadValid(t *testing.T) {
 			casename: "default_config",
 			path:     "testdata/default.yaml",
 		},
+		{
+			casename: "limit",
+			path:     "testdata/limit.yaml",
+		},
+		{
+			casename: "retry",
+			path:     "testdata/retry.yaml",
+		},
+		{
+			casename: "filters",
+			path:     "testdata/filters.yaml",
+		},
 	}
 
 	for _, c := range cases {
@@ -38,6 +62,49 @@ func TestConfigLoadInValid(t *testing.T) {
 			path:     "testdata/s3_invalid_prefix.yaml",
 			expected: "s3 url_prefix schema is not `s3`: schema is ``",
 		},
+		{
+			casename: "invalid_on_limit",
+			path:     "testdata/invalid_on_limit.yaml",
+			expected: "cloudwatch on_limit must be one of truncate, rotate, abort",
+		},
+		{
+			casename: "invalid_retry_mode",
+			path:     "testdata/invalid_retry_mode.yaml",
+			expected: "retry_mode must be one of standard, adaptive",
+		},
+		{
+			casename: "invalid_delivery",
+			path:     "testdata/invalid_delivery.yaml",
+			expected: "delivery must be one of strict, best_effort",
+		},
+		{
+			casename: "invalid_overflow",
+			path:     "testdata/invalid_overflow.yaml",
+			expected: "overflow policy must be one of block, buffer, drop",
+		},
+		{
+			casename: "invalid_app_id",
+			path:     "testdata/invalid_app_id.yaml",
+			expected: "app_id must not contain ' ', use alphanumerics and !#$%&'*+-.^_`|~",
+		},
+		{
+			casename: "invalid_filters",
+			path:     "testdata/invalid_filters.yaml",
+			expected: "cloudwatch filters include [ERROR is invalid: error parsing regexp: missing closing ]: `[ERROR`",
+		},
+		{
+			casename: "lock_without_s3",
+			path:     "testdata/lock_without_s3.yaml",
+			expected: "lock requires s3 url_prefix, the lock object is put next to the s3 object",
+		},
+		{
+			casename: "unknown_keys",
+			path:     "testdata/unknown_keys.yaml",
+			expected: "config load:testdata/unknown_keys.yaml: line 4, column 3: unknown key s3.allow_overwirte, did you mean allow_overwrite?\n" +
+				"line 7, column 3: unknown key cloudwatch.flash_interval, did you mean flush_interval?\n" +
+				"line 11, column 7: unknown key targets.ci.s3.url_perfix, did you mean url_prefix?\n" +
+				"line 12, column 1: unknown key unknown",
+		},
 	}
 
 	for _, c := range cases {
@@ -50,3 +117,197 @@ func TestConfigLoadInValid(t *testing.T) {
 	}
 
 }
+
+func TestConfigLoadEnv(t *testing.T) {
+	t.Setenv("AWSTEE_S3_URL_PREFIX", "s3://env-example-com/logs/")
+	t.Setenv("AWSTEE_LOG_GROUP", "/env/logs")
+	t.Setenv("AWSTEE_BUFFER_LINES", "100")
+	t.Setenv("AWSTEE_STRIP_ANSI", "true")
+	cfg := newConfig()
+	require.NoError(t, cfg.Load("testdata/default.yaml"))
+	require.NoError(t, cfg.LoadEnv())
+	require.NoError(t, cfg.Restrict())
+	require.EqualValues(t, "s3://env-example-com/logs/", cfg.S3.URLPrefix)
+	require.EqualValues(t, "/env/logs", cfg.Cloudwatch.LogGroup)
+	require.EqualValues(t, 100, cfg.Cloudwatch.BufferLines)
+	require.True(t, cfg.StripANSI)
+
+	t.Setenv("AWSTEE_BUFFER_LINES", "many")
+	require.EqualError(t, cfg.LoadEnv(), `AWSTEE_BUFFER_LINES is invalid: strconv.Atoi: parsing "many": invalid syntax`)
+}
+
+func TestConfigInclude(t *testing.T) {
+	cfg := newConfig()
+	require.NoError(t, cfg.Load("testdata/include/project.yaml"))
+	require.EqualValues(t, "ap-northeast-1", cfg.AWSRegion)
+	require.True(t, cfg.StripANSI)
+	require.EqualValues(t, "s3://awstee-example-com/logs/", cfg.S3.URLPrefix)
+	require.True(t, cfg.S3.AllowOverwrite)
+	require.EqualValues(t, "/awstee/project", cfg.Cloudwatch.LogGroup)
+	require.EqualValues(t, 100, cfg.Cloudwatch.BufferLines)
+
+	cfg = newConfig()
+	require.NoError(t, cfg.Load("testdata/include/project.yaml", "testdata/include/override.yaml"))
+	require.False(t, cfg.StripANSI)
+	require.EqualValues(t, "s3://awstee-example-com/override/", cfg.S3.URLPrefix)
+	require.True(t, cfg.S3.AllowOverwrite)
+	require.EqualValues(t, "/awstee/project", cfg.Cloudwatch.LogGroup)
+
+	cfg = newConfig()
+	require.ErrorContains(t, cfg.Load("testdata/include/cycle_a.yaml"), "include cycle testdata/include/cycle_a.yaml -> testdata/include/cycle_b.yaml -> testdata/include/cycle_a.yaml")
+}
+
+func TestResolveInclude(t *testing.T) {
+	require.EqualValues(t, "testdata/include/base.yaml", resolveInclude("testdata/include/project.yaml", "base.yaml"))
+	require.EqualValues(t, "/etc/awstee/base.yaml", resolveInclude("testdata/include/project.yaml", "/etc/awstee/base.yaml"))
+	require.EqualValues(t, "s3://ops-config/awstee/base.yaml", resolveInclude("s3://ops-config/awstee/prod.yaml", "base.yaml"))
+	require.EqualValues(t, "ssm://awstee/base", resolveInclude("ssm://awstee/prod", "base"))
+	require.EqualValues(t, "ssm://awstee/base", resolveInclude("testdata/include/project.yaml", "ssm://awstee/base"))
+}
+
+func TestConfigTargets(t *testing.T) {
+	cases := []struct {
+		target     string
+		s3         []string
+		cloudwatch []string
+		err        string
+	}{
+		{
+			target: "",
+			s3:     []string{"s3://example-com/logs/"},
+		},
+		{
+			target: "ci",
+			s3:     []string{"s3://ci-example-com/logs/"},
+		},
+		{
+			target:     "ci, audit",
+			s3:         []string{"s3://ci-example-com/logs/", "s3://audit-example-com/logs/"},
+			cloudwatch: []string{"/audit/logs/"},
+		},
+		{
+			target: "ci,unknown",
+			err:    "target unknown is not defined",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.target, func(t *testing.T) {
+			cfg := newConfig()
+			cfg.Target = c.target
+			err := cfg.Load("testdata/targets.yaml")
+			if c.err != "" {
+				require.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			var s3, cloudwatch []string
+			for _, s3Cfg := range cfg.s3Configs {
+				s3 = append(s3, s3Cfg.URLPrefix)
+			}
+			for _, cwCfg := range cfg.cloudwatchConfigs {
+				cloudwatch = append(cloudwatch, cwCfg.LogGroup)
+			}
+			require.EqualValues(t, c.s3, s3)
+			require.EqualValues(t, c.cloudwatch, cloudwatch)
+		})
+	}
+}
+
+func TestDefaultConfigPaths(t *testing.T) {
+	root := t.TempDir()
+	home := filepath.Join(root, "home")
+	xdg := filepath.Join(root, "xdg")
+	project := filepath.Join(root, "src", "project")
+	cwd := filepath.Join(project, "sub", "dir")
+	files := []string{
+		filepath.Join(home, ".config", "awstee", "default.yaml"),
+		filepath.Join(xdg, "awstee", "default.yml"),
+		filepath.Join(root, "src", ".awstee.yaml"),
+		filepath.Join(project, ".awstee.yaml"),
+		filepath.Join(project, "sub", ".awstee.yml"),
+	}
+	for _, f := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(f), 0755))
+		require.NoError(t, os.WriteFile(f, []byte("aws_region: ap-northeast-1\n"), 0644))
+	}
+	require.NoError(t, os.MkdirAll(cwd, 0755))
+	require.EqualValues(t, files, defaultConfigPaths(home, xdg, cwd))
+	require.EqualValues(t, files[:1], defaultConfigPaths(home, "", root))
+	require.Empty(t, defaultConfigPaths("", "", ""))
+}
+
+func TestDefaultConfigInvalid(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(home))
+	t.Cleanup(func() { os.Chdir(wd) })
+	path := filepath.Join(home, ".config", "awstee", "default.yaml")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte("aws_region: ap-northeast-1\n"), 0644))
+	cfg, err := DefaultConfig()
+	require.NoError(t, err)
+	require.Equal(t, "ap-northeast-1", cfg.AWSRegion)
+
+	require.NoError(t, os.WriteFile(path, []byte("s3:\n  url_prefix: hoge\n"), 0644))
+	_, err = DefaultConfig()
+	require.ErrorContains(t, err, path, "the error names the default config files")
+}
+
+func TestConfigEndpointResolver(t *testing.T) {
+	cfg := &Config{
+		AWSRegion: "cn-north-1",
+		Endpoints: &EndpointsConfig{
+			S3:  "http://localhost:9000",
+			STS: "http://localhost:4566",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	resolver, ok := cfg.EndpointResolver()
+	require.True(t, ok)
+	endpoint, err := resolver.ResolveEndpoint(s3.ServiceID, "cn-north-1")
+	require.NoError(t, err)
+	require.Equal(t, aws.Endpoint{PartitionID: "aws-cn", URL: "http://localhost:9000", SigningRegion: "cn-north-1"}, endpoint)
+	endpoint, err = resolver.ResolveEndpoint(sts.ServiceID, "cn-north-1")
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:4566", endpoint.URL)
+	_, err = resolver.ResolveEndpoint(cloudwatchlogs.ServiceID, "cn-north-1")
+	require.Error(t, err, "the default endpoint")
+	_, err = resolver.ResolveEndpoint(s3.ServiceID, "us-east-1")
+	require.Error(t, err, "the other region")
+}
+
+func TestConfigEndpointLoadOptions(t *testing.T) {
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	cfg := &Config{
+		AWSRegion:            "us-east-1",
+		UseFIPSEndpoint:      true,
+		UseDualStackEndpoint: true,
+	}
+	require.NoError(t, cfg.Restrict())
+	loadOpts := append(cfg.endpointLoadOptions(),
+		awsConfig.WithRegion(cfg.AWSRegion),
+		awsConfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider("AKID", "SECRET", "")),
+	)
+	awsCfg, err := awsConfig.LoadDefaultConfig(context.Background(), loadOpts...)
+	require.NoError(t, err)
+	errStop := errors.New("stop")
+	var host string
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("captureHost",
+				func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+					host = in.Request.(*smithyhttp.Request).URL.Host
+					return middleware.FinalizeOutput{}, middleware.Metadata{}, errStop
+				}), middleware.After)
+		})
+	})
+	_, err = client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String("awstee-example-com"),
+		Key:    aws.String("hoge.log"),
+	})
+	require.ErrorIs(t, err, errStop)
+	require.Equal(t, "awstee-example-com.s3-fips.dualstack.us-east-1.amazonaws.com", host)
+}
@@ -0,0 +1,172 @@
+package awstee
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// checkConfigKeys reports the unknown keys of the config source with the line, column and a suggestion,
+// instead of ignoring typos silently.
+func checkConfigKeys(src []byte) error {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(src, &doc); err != nil {
+		// syntax errors are reported by the loader
+		return nil
+	}
+	var errs []error
+	checkConfigNode(&doc, reflect.TypeOf(Config{}), "", &errs)
+	return errors.Join(errs...)
+}
+
+func checkConfigNode(node *yamlv3.Node, t reflect.Type, path string, errs *[]error) {
+	switch node.Kind {
+	case yamlv3.DocumentNode:
+		for _, n := range node.Content {
+			checkConfigNode(n, t, path, errs)
+		}
+		return
+	case yamlv3.AliasNode:
+		checkConfigNode(node.Alias, t, path, errs)
+		return
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yamlv3.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				checkConfigNode(value, t, path, errs)
+				continue
+			}
+			keyPath := joinConfigKey(path, key.Value)
+			index, ok := yamlFieldIndex(t, key.Value)
+			if !ok {
+				err := fmt.Sprintf("line %d, column %d: unknown key %s", key.Line, key.Column, keyPath)
+				if suggestion := suggestConfigKey(key.Value, yamlFieldNames(t)); suggestion != "" {
+					err += fmt.Sprintf(", did you mean %s?", suggestion)
+				}
+				*errs = append(*errs, errors.New(err))
+				continue
+			}
+			checkConfigNode(value, t.FieldByIndex(index).Type, keyPath, errs)
+		}
+	case reflect.Map:
+		if node.Kind != yamlv3.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			checkConfigNode(node.Content[i+1], t.Elem(), joinConfigKey(path, node.Content[i].Value), errs)
+		}
+	case reflect.Slice:
+		if node.Kind != yamlv3.SequenceNode {
+			return
+		}
+		for _, n := range node.Content {
+			checkConfigNode(n, t.Elem(), path, errs)
+		}
+	}
+}
+
+func joinConfigKey(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// yamlFieldIndex returns the index of the field of the struct type t named name in yaml, including the fields of the inline structs.
+func yamlFieldIndex(t reflect.Type, name string) ([]int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		fieldName, inline, ok := yamlFieldName(sf)
+		if !ok {
+			continue
+		}
+		if inline {
+			if index, ok := yamlFieldIndex(sf.Type, name); ok {
+				return append([]int{i}, index...), true
+			}
+			continue
+		}
+		if fieldName == name {
+			return []int{i}, true
+		}
+	}
+	return nil, false
+}
+
+// yamlFieldNames returns the yaml names of the fields of the struct type t.
+func yamlFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		fieldName, inline, ok := yamlFieldName(sf)
+		if !ok {
+			continue
+		}
+		if inline {
+			names = append(names, yamlFieldNames(sf.Type)...)
+			continue
+		}
+		names = append(names, fieldName)
+	}
+	return names
+}
+
+func yamlFieldName(sf reflect.StructField) (name string, inline bool, ok bool) {
+	if !sf.IsExported() {
+		return "", false, false
+	}
+	tag := strings.Split(sf.Tag.Get("yaml"), ",")
+	if tag[0] == "-" {
+		return "", false, false
+	}
+	if len(tag) > 1 && tag[1] == "inline" {
+		return "", true, true
+	}
+	if tag[0] == "" {
+		return strings.ToLower(sf.Name), false, true
+	}
+	return tag[0], false, true
+}
+
+// suggestConfigKey returns the candidate nearest to key, if it is near enough to be a typo.
+func suggestConfigKey(key string, candidates []string) string {
+	var suggestion string
+	best := len(key)/3 + 2
+	for _, c := range candidates {
+		if d := levenshtein(key, c); d < best {
+			suggestion, best = c, d
+		}
+	}
+	return suggestion
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,64 @@
+package awstee
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Set sets the value of the config field at key, the dot separated yaml keys such as s3.url_prefix or targets.ci.s3.url_prefix.
+// The value is used as is for strings, and parsed as YAML for the others (e.g. 500, true, [a, b]).
+// Restrict must be called after Set.
+func (cfg *Config) Set(key string, value string) error {
+	if key == "" {
+		return fmt.Errorf("config key is empty")
+	}
+	if err := setConfigField(reflect.ValueOf(cfg).Elem(), strings.Split(key, "."), value); err != nil {
+		return fmt.Errorf("set %s: %w", key, err)
+	}
+	return nil
+}
+
+func setConfigField(v reflect.Value, names []string, value string) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if len(names) == 0 {
+		if v.Kind() == reflect.String {
+			v.SetString(value)
+			return nil
+		}
+		return yaml.UnmarshalStrict([]byte(value), v.Addr().Interface())
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		index, ok := yamlFieldIndex(v.Type(), names[0])
+		if !ok {
+			return fmt.Errorf("unknown key %s", names[0])
+		}
+		return setConfigField(v.FieldByIndex(index), names[1:], value)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		key := reflect.ValueOf(names[0]).Convert(v.Type().Key())
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if current := v.MapIndex(key); current.IsValid() {
+			elem.Set(current)
+		}
+		if err := setConfigField(elem, names[1:], value); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, elem)
+		return nil
+	}
+	return fmt.Errorf("%s is not a mapping", v.Type())
+}
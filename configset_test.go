@@ -0,0 +1,32 @@
+package awstee
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigSet(t *testing.T) {
+	cfg := newConfig()
+	require.NoError(t, cfg.Load("testdata/default.yaml"))
+	require.NoError(t, cfg.Set("s3.url_prefix", "s3://bucket/x/"))
+	require.NoError(t, cfg.Set("cloudwatch.buffer_lines", "500"))
+	require.NoError(t, cfg.Set("cloudwatch.create_log_group", "true"))
+	require.NoError(t, cfg.Set("s3.assume_role_arn", "arn:aws:iam::123456789012:role/awstee"))
+	require.NoError(t, cfg.Set("targets.ci.cloudwatch.log_group", "/awstee/ci"))
+	require.NoError(t, cfg.Set("include", "[base.yaml, project.yaml]"))
+	require.NoError(t, cfg.Set("line_prefix", "key: value # not a yaml"))
+	require.NoError(t, cfg.Restrict())
+	require.EqualValues(t, "s3://bucket/x/", cfg.S3.URLPrefix)
+	require.EqualValues(t, 500, cfg.Cloudwatch.BufferLines)
+	require.True(t, cfg.Cloudwatch.CreateLogGroup)
+	require.EqualValues(t, "arn:aws:iam::123456789012:role/awstee", cfg.S3.Credentials.AssumeRoleARN)
+	require.EqualValues(t, "/awstee/ci", cfg.Targets["ci"].Cloudwatch.LogGroup)
+	require.EqualValues(t, []string{"base.yaml", "project.yaml"}, cfg.Include)
+	require.EqualValues(t, "key: value # not a yaml", cfg.LinePrefix)
+
+	require.EqualError(t, cfg.Set("s3.url_prfix", "s3://bucket/x/"), "set s3.url_prfix: unknown key url_prfix")
+	require.EqualError(t, cfg.Set("s3.url_prefix.bucket", "x"), "set s3.url_prefix.bucket: string is not a mapping")
+	require.Error(t, cfg.Set("cloudwatch.buffer_lines", "many"))
+	require.Error(t, cfg.Set("", "x"))
+}
@@ -0,0 +1,313 @@
+package awstee
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+const (
+	s3ConfigScheme             = "s3://"
+	ssmConfigScheme            = "ssm://"
+	secretsManagerConfigScheme = "secretsmanager://"
+)
+
+// isRemoteConfig reports whether path is a config URL such as s3://bucket/key, not a local file.
+func isRemoteConfig(path string) bool {
+	for _, scheme := range []string{s3ConfigScheme, ssmConfigScheme, secretsManagerConfigScheme} {
+		if strings.HasPrefix(path, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+type ssmAPI interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+type kmsAPI interface {
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+type secretsManagerAPI interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// configFetcher fetches the config and the values of the template functions from AWS.
+// The clients are created on first use, so that a local config without them does not resolve credentials.
+type configFetcher struct {
+	region       string
+	profile      string
+	useFIPS      bool
+	useDualStack bool
+
+	once           sync.Once
+	err            error
+	s3             S3Client
+	ssm            ssmAPI
+	secretsManager secretsManagerAPI
+	kms            kmsAPI
+}
+
+func newConfigFetcher(cfg *Config) *configFetcher {
+	return &configFetcher{
+		region:       cfg.AWSRegion,
+		profile:      cfg.AWSProfile,
+		useFIPS:      cfg.UseFIPSEndpoint,
+		useDualStack: cfg.UseDualStackEndpoint,
+	}
+}
+
+func (f *configFetcher) init(ctx context.Context) error {
+	f.once.Do(func() {
+		opts := make([]func(*awsConfig.LoadOptions) error, 0, 4)
+		if f.region != "" {
+			opts = append(opts, awsConfig.WithRegion(f.region))
+		}
+		if f.profile != "" {
+			opts = append(opts, awsConfig.WithSharedConfigProfile(f.profile))
+		}
+		if f.useFIPS {
+			opts = append(opts, awsConfig.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+		}
+		if f.useDualStack {
+			opts = append(opts, awsConfig.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+		}
+		awsCfg, err := awsConfig.LoadDefaultConfig(ctx, opts...)
+		if err != nil {
+			f.err = fmt.Errorf("load aws config: %w", err)
+			return
+		}
+		f.s3 = s3.NewFromConfig(awsCfg)
+		f.ssm = ssm.NewFromConfig(awsCfg)
+		f.secretsManager = secretsmanager.NewFromConfig(awsCfg)
+		f.kms = kms.NewFromConfig(awsCfg)
+	})
+	return f.err
+}
+
+// Fetch reads the config at path with the default credentials.
+//
+//	s3://bucket/key
+//	ssm://path/to/param (the parameter /path/to/param)
+//	secretsmanager://secret-id
+func (f *configFetcher) Fetch(ctx context.Context, path string) ([]byte, error) {
+	if err := f.init(ctx); err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(path, s3ConfigScheme):
+		u, err := url.Parse(path)
+		if err != nil {
+			return nil, fmt.Errorf("parse config url: %w", err)
+		}
+		return readS3Config(ctx, f.s3, u)
+	case strings.HasPrefix(path, ssmConfigScheme):
+		name := strings.TrimPrefix(path, ssmConfigScheme)
+		if strings.Contains(name, "/") && !strings.HasPrefix(name, "/") {
+			name = "/" + name
+		}
+		value, err := f.GetParameter(ctx, name)
+		return []byte(value), err
+	case strings.HasPrefix(path, secretsManagerConfigScheme):
+		value, err := f.GetSecretValue(ctx, strings.TrimPrefix(path, secretsManagerConfigScheme))
+		return []byte(value), err
+	}
+	return nil, fmt.Errorf("unsupported config url %s", path)
+}
+
+// GetParameter returns the (decrypted) value of the SSM parameter.
+func (f *configFetcher) GetParameter(ctx context.Context, name string) (string, error) {
+	if err := f.init(ctx); err != nil {
+		return "", err
+	}
+	output, err := f.ssm.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("get parameter %s: %w", name, err)
+	}
+	return aws.ToString(output.Parameter.Value), nil
+}
+
+// GetSecretValue returns the string value of the secret.
+func (f *configFetcher) GetSecretValue(ctx context.Context, secretID string) (string, error) {
+	if err := f.init(ctx); err != nil {
+		return "", err
+	}
+	output, err := f.secretsManager.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return "", fmt.Errorf("get secret value %s: %w", secretID, err)
+	}
+	if output.SecretString == nil {
+		return "", fmt.Errorf("secret %s is not a string", secretID)
+	}
+	return *output.SecretString, nil
+}
+
+// Decrypt returns the plaintext of the base64 encoded KMS ciphertext.
+func (f *configFetcher) Decrypt(ctx context.Context, ciphertext string) (string, error) {
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(ciphertext))
+	if err != nil {
+		return "", fmt.Errorf("kms ciphertext is not base64: %w", err)
+	}
+	if err := f.init(ctx); err != nil {
+		return "", err
+	}
+	output, err := f.kms.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob: blob,
+	})
+	if err != nil {
+		return "", fmt.Errorf("kms decrypt: %w", err)
+	}
+	return string(output.Plaintext), nil
+}
+
+// FuncMap returns the template functions of the config.
+//
+//	{{ ssm "/path/to/param" }}
+//	{{ secretsmanager "secret-id" }}
+//	{{ secretsmanager "secret-id" "json-key" }}
+func (f *configFetcher) FuncMap(ctx context.Context) template.FuncMap {
+	return template.FuncMap{
+		"ssm": func(name string) (string, error) {
+			return f.GetParameter(ctx, name)
+		},
+		"secretsmanager": func(secretID string, keys ...string) (string, error) {
+			value, err := f.GetSecretValue(ctx, secretID)
+			if err != nil || len(keys) == 0 {
+				return value, err
+			}
+			var values map[string]interface{}
+			if err := json.Unmarshal([]byte(value), &values); err != nil {
+				return "", fmt.Errorf("secret %s is not a JSON object: %w", secretID, err)
+			}
+			v, ok := values[keys[0]]
+			if !ok {
+				return "", fmt.Errorf("secret %s has no key %s", secretID, keys[0])
+			}
+			return fmt.Sprint(v), nil
+		},
+	}
+}
+
+// readConfigSource reads the config file or fetches the config URL.
+func readConfigSource(ctx context.Context, fetcher *configFetcher, path string) ([]byte, error) {
+	if isRemoteConfig(path) {
+		return fetcher.Fetch(ctx, path)
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s read failed: %w", path, err)
+	}
+	return src, nil
+}
+
+// resolveInclude resolves a relative include path against the directory of the including config.
+func resolveInclude(parent string, include string) string {
+	if isRemoteConfig(include) || filepath.IsAbs(include) {
+		return include
+	}
+	if isRemoteConfig(parent) {
+		return parent[:strings.LastIndex(parent, "/")+1] + include
+	}
+	return filepath.Join(filepath.Dir(parent), include)
+}
+
+// readS3Config gets the config object. The bucket may be in another region than the destinations.
+func readS3Config(ctx context.Context, client S3Client, u *url.URL) ([]byte, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid config url %s, expected s3://bucket/key", u)
+	}
+	region, err := manager.GetBucketRegion(ctx, client, bucket, func(o *s3.Options) {
+		if o.Region == "" {
+			o.Region = "us-east-1"
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get bucket region of %s: %w", bucket, err)
+	}
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}, func(o *s3.Options) {
+		o.Region = region
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", u, err)
+	}
+	defer output.Body.Close()
+	return io.ReadAll(output.Body)
+}
+
+const (
+	kmsTag    = "!kms"
+	kmsScheme = "kms://"
+)
+
+// decryptKMSValues replaces the values tagged `!kms` or prefixed `kms://` in the config source with the plaintext.
+// The source is returned as is if it has no encrypted values.
+func decryptKMSValues(ctx context.Context, fetcher *configFetcher, src []byte) ([]byte, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(src, &doc); err != nil {
+		// syntax errors are reported by the loader
+		return src, nil
+	}
+	var decrypted bool
+	var walk func(node *yamlv3.Node) error
+	walk = func(node *yamlv3.Node) error {
+		if node.Kind == yamlv3.ScalarNode {
+			var ciphertext string
+			switch {
+			case node.Tag == kmsTag:
+				ciphertext = node.Value
+			case strings.HasPrefix(node.Value, kmsScheme):
+				ciphertext = strings.TrimPrefix(node.Value, kmsScheme)
+			default:
+				return nil
+			}
+			plaintext, err := fetcher.Decrypt(ctx, ciphertext)
+			if err != nil {
+				return fmt.Errorf("line %d, column %d: %w", node.Line, node.Column, err)
+			}
+			node.Tag, node.Value, node.Style = "!!str", plaintext, yamlv3.DoubleQuotedStyle
+			decrypted = true
+			return nil
+		}
+		for _, n := range node.Content {
+			if err := walk(n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(&doc); err != nil {
+		return nil, err
+	}
+	if !decrypted {
+		return src, nil
+	}
+	return yamlv3.Marshal(&doc)
+}
@@ -0,0 +1,168 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	gc "github.com/kayac/go-config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadS3Config(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodHead && r.URL.Path == "/ops-config":
+			w.Header().Set("X-Amz-Bucket-Region", "ap-northeast-1")
+		case r.Method == http.MethodGet && r.URL.Path == "/ops-config/awstee/prod.yaml":
+			w.Write([]byte("s3:\n  url_prefix: s3://awstee-example-com/logs/\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	client := s3.New(s3.Options{
+		EndpointResolver: s3.EndpointResolverFromURL(srv.URL),
+		UsePathStyle:     true,
+		Credentials:      credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	})
+	u, err := url.Parse("s3://ops-config/awstee/prod.yaml")
+	require.NoError(t, err)
+	src, err := readS3Config(context.Background(), client, u)
+	require.NoError(t, err)
+	require.EqualValues(t, "s3:\n  url_prefix: s3://awstee-example-com/logs/\n", string(src))
+
+	u, err = url.Parse("s3://ops-config/awstee/notfound.yaml")
+	require.NoError(t, err)
+	_, err = readS3Config(context.Background(), client, u)
+	require.Error(t, err)
+
+	u, err = url.Parse("s3://ops-config")
+	require.NoError(t, err)
+	_, err = readS3Config(context.Background(), client, u)
+	require.ErrorContains(t, err, "expected s3://bucket/key")
+}
+
+type fakeSSM map[string]string
+
+func (f fakeSSM) GetParameter(_ context.Context, input *ssm.GetParameterInput, _ ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	value, ok := f[*input.Name]
+	if !ok {
+		return nil, errors.New("ParameterNotFound")
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Value: aws.String(value)}}, nil
+}
+
+type fakeSecretsManager map[string]string
+
+func (f fakeSecretsManager) GetSecretValue(_ context.Context, input *secretsmanager.GetSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	value, ok := f[*input.SecretId]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(value)}, nil
+}
+
+type fakeKMS struct{}
+
+func (fakeKMS) Decrypt(_ context.Context, input *kms.DecryptInput, _ ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	return &kms.DecryptOutput{Plaintext: append([]byte("decrypted "), input.CiphertextBlob...)}, nil
+}
+
+func newTestConfigFetcher() *configFetcher {
+	f := &configFetcher{
+		kms: fakeKMS{},
+		ssm: fakeSSM{
+			"/awstee/prod/config":   "s3:\n  url_prefix: s3://awstee-example-com/logs/\n",
+			"/awstee/prod/loggroup": "/awstee/logs",
+		},
+		secretsManager: fakeSecretsManager{
+			"awstee/prod":  "cloudwatch:\n  log_group: /awstee/secret\n",
+			"awstee/token": `{"log_group":"/awstee/json"}`,
+		},
+	}
+	f.once.Do(func() {})
+	return f
+}
+
+func TestConfigFetcherFetch(t *testing.T) {
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{path: "ssm://awstee/prod/config", expected: "s3:\n  url_prefix: s3://awstee-example-com/logs/\n"},
+		{path: "ssm:///awstee/prod/config", expected: "s3:\n  url_prefix: s3://awstee-example-com/logs/\n"},
+		{path: "secretsmanager://awstee/prod", expected: "cloudwatch:\n  log_group: /awstee/secret\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			src, err := newTestConfigFetcher().Fetch(context.Background(), c.path)
+			require.NoError(t, err)
+			require.EqualValues(t, c.expected, string(src))
+		})
+	}
+	_, err := newTestConfigFetcher().Fetch(context.Background(), "ssm://awstee/notfound")
+	require.ErrorContains(t, err, "get parameter /awstee/notfound")
+}
+
+func TestConfigFetcherFuncMap(t *testing.T) {
+	cases := []struct {
+		casename string
+		src      string
+		expected string
+		isErr    bool
+	}{
+		{casename: "ssm", src: `log_group: {{ ssm "/awstee/prod/loggroup" }}`, expected: "/awstee/logs"},
+		{casename: "secretsmanager_key", src: `log_group: {{ secretsmanager "awstee/token" "log_group" }}`, expected: "/awstee/json"},
+		{casename: "secretsmanager_no_key", src: `log_group: {{ secretsmanager "awstee/token" "notfound" }}`, isErr: true},
+		{casename: "ssm_not_found", src: `log_group: {{ ssm "/awstee/notfound" }}`, isErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.casename, func(t *testing.T) {
+			loader := gc.New()
+			loader.Funcs(newTestConfigFetcher().FuncMap(context.Background()))
+			var cfg CloudwatchLogsConfig
+			err := loader.LoadWithEnvBytes(&cfg, []byte(c.src))
+			if c.isErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.EqualValues(t, c.expected, cfg.LogGroup)
+		})
+	}
+}
+
+func TestDecryptKMSValues(t *testing.T) {
+	src := []byte(`s3:
+  url_prefix: s3://awstee-example-com/logs/
+  assume_role_arn: !kms YXJuOmF3czppYW06OjEyMzQ1Njc4OTAxMjpyb2xlL2F3c3RlZQ==
+cloudwatch:
+  log_group: "kms://L2F3c3RlZS9sb2dz"
+`)
+	decrypted, err := decryptKMSValues(context.Background(), newTestConfigFetcher(), src)
+	require.NoError(t, err)
+	var cfg Config
+	require.NoError(t, gc.New().LoadBytes(&cfg, decrypted))
+	require.EqualValues(t, "s3://awstee-example-com/logs/", cfg.S3.URLPrefix)
+	require.EqualValues(t, "decrypted arn:aws:iam::123456789012:role/awstee", cfg.S3.Credentials.AssumeRoleARN)
+	require.EqualValues(t, "decrypted /awstee/logs", cfg.Cloudwatch.LogGroup)
+
+	plain := []byte("s3:\n  url_prefix: s3://awstee-example-com/logs/\n")
+	decrypted, err = decryptKMSValues(context.Background(), newTestConfigFetcher(), plain)
+	require.NoError(t, err)
+	require.Equal(t, plain, decrypted)
+
+	_, err = decryptKMSValues(context.Background(), newTestConfigFetcher(), []byte("aws_region: !kms not-base64\n"))
+	require.ErrorContains(t, err, "line 1, column 13: kms ciphertext is not base64")
+}
@@ -0,0 +1,69 @@
+package awstee
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the buffer size of WriteTo and ReadFrom, larger than the one of io.Copy for multi-GB streams.
+const copyBufferSize = 256 * 1024
+
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// WriteTo writes what is read to w, as well as to the destinations, until EOF.
+// io.Copy uses it instead of its own buffer.
+func (t *AWSTeeReader) WriteTo(w io.Writer) (int64, error) {
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+	buf := *bufp
+	var written int64
+	for {
+		n, err := t.Read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			if m != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// ReadFrom writes what is read from r to the destinations until EOF.
+// io.Copy uses it instead of its own buffer.
+func (t *AWSTeeWriter) ReadFrom(r io.Reader) (int64, error) {
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+	buf := *bufp
+	var read int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			read += int64(n)
+			if _, werr := t.Write(buf[:n]); werr != nil {
+				return read, werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
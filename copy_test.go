@@ -0,0 +1,39 @@
+package awstee
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSTeeReaderWriteTo(t *testing.T) {
+	input := strings.Repeat("hoge\n", copyBufferSize/5+1)
+	dest := &testDestination{}
+	teeReader := newAWSTeeReader(strings.NewReader(input), []io.WriteCloser{dest})
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, teeReader)
+	require.NoError(t, err)
+	require.EqualValues(t, len(input), n)
+	require.NoError(t, teeReader.Close())
+	require.EqualValues(t, input, buf.String())
+	require.EqualValues(t, input, dest.String())
+}
+
+func TestAWSTeeWriterReadFrom(t *testing.T) {
+	input := strings.Repeat("hoge\n", copyBufferSize/5+1)
+	dest := &testDestination{}
+	w := newAWSTeeWriter([]io.WriteCloser{dest})
+	// hide the WriterTo of strings.Reader, so that io.Copy uses ReadFrom
+	n, err := io.Copy(w, struct{ io.Reader }{strings.NewReader(input)})
+	require.NoError(t, err)
+	require.EqualValues(t, len(input), n)
+	require.NoError(t, w.Close())
+	require.EqualValues(t, input, dest.String())
+	require.EqualValues(t, copyBufferSize/5+1, w.Stats().Lines)
+
+	_, err = io.Copy(w, struct{ io.Reader }{strings.NewReader(input)})
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+}
@@ -0,0 +1,301 @@
+package awstee
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc"
+	ssooidctypes "github.com/aws/aws-sdk-go-v2/service/ssooidc/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+const mfaTokenEnv = "AWS_MFA_TOKEN"
+
+// credentialsExpiryWindow is how long before their expiration the credentials are refreshed,
+// so that a call signed just before the expiration, such as a large multipart part, is not rejected on the way.
+const credentialsExpiryWindow = 5 * time.Minute
+
+// expiredCredentialsCodes are the error codes of the calls signed with the expired credentials.
+var expiredCredentialsCodes = map[string]bool{
+	"ExpiredToken":          true,
+	"ExpiredTokenException": true,
+}
+
+// openTerminal opens the controlling terminal for reading.
+// stdin can not be used for prompts, because it is the captured stream.
+func openTerminal() (*os.File, error) {
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CONIN$"
+	}
+	return os.Open(name)
+}
+
+func promptTerminal(prompt string) (string, error) {
+	tty, err := openTerminal()
+	if err != nil {
+		return "", fmt.Errorf("no terminal to prompt: %w", err)
+	}
+	defer tty.Close()
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+var mfaTokenMu sync.Mutex
+
+// mfaTokenProvider returns AWS_MFA_TOKEN if set, otherwise prompts for the MFA code on the terminal.
+func mfaTokenProvider() (string, error) {
+	if token := os.Getenv(mfaTokenEnv); token != "" {
+		return token, nil
+	}
+	mfaTokenMu.Lock()
+	defer mfaTokenMu.Unlock()
+	return promptTerminal("Enter MFA code: ")
+}
+
+func sharedConfigProfile(profile string) string {
+	if profile != "" {
+		return profile
+	}
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+		return profile
+	}
+	return "default"
+}
+
+// ensureSSOLogin checks the credentials of an SSO profile, and if the SSO session has expired,
+// performs the device authorization on the terminal like `aws sso login` and retries.
+// The other errors of the credentials are returned as they are, and nothing is done for the other profiles.
+func ensureSSOLogin(ctx context.Context, logger *slog.Logger, awsCfg aws.Config, profile string) error {
+	sharedCfg, err := awsConfig.LoadSharedConfigProfile(ctx, sharedConfigProfile(profile), func(o *awsConfig.LoadSharedConfigOptions) {
+		// the default files are fixed at the start, AWS_CONFIG_FILE is honored as LoadDefaultConfig does
+		if configFile := os.Getenv("AWS_CONFIG_FILE"); configFile != "" {
+			o.ConfigFiles = []string{configFile}
+		}
+	})
+	if err != nil {
+		logger.Debug("load shared config profile", "error", err)
+		return nil
+	}
+	startURL, region, cacheKey := sharedCfg.SSOStartURL, sharedCfg.SSORegion, sharedCfg.SSOStartURL
+	if sharedCfg.SSOSession != nil {
+		startURL, region, cacheKey = sharedCfg.SSOSession.SSOStartURL, sharedCfg.SSOSession.SSORegion, sharedCfg.SSOSession.Name
+	}
+	if startURL == "" {
+		return nil
+	}
+	if _, err := awsCfg.Credentials.Retrieve(ctx); err == nil {
+		return nil
+	} else if !isSSOTokenExpired(err) {
+		return err
+	} else {
+		logger.Warn("sso credentials", "error", err)
+	}
+	tty, err := openTerminal()
+	if err != nil {
+		return fmt.Errorf("sso session is expired and no terminal to login, run `aws sso login`: %w", err)
+	}
+	tty.Close()
+	cachePath, err := ssocreds.StandardCachedTokenFilepath(cacheKey)
+	if err != nil {
+		return err
+	}
+	oidcCfg := awsCfg.Copy()
+	oidcCfg.Region = region
+	if err := ssoDeviceLogin(ctx, ssooidc.NewFromConfig(oidcCfg), startURL, cachePath); err != nil {
+		return fmt.Errorf("sso login: %w", err)
+	}
+	if _, err := awsCfg.Credentials.Retrieve(ctx); err != nil {
+		return fmt.Errorf("sso credentials after login: %w", err)
+	}
+	return nil
+}
+
+// isSSOTokenExpired reports whether err is of the cached SSO token expired, missing or invalid, which the login renews.
+func isSSOTokenExpired(err error) bool {
+	var invalid *ssocreds.InvalidTokenError
+	return errors.As(err, &invalid)
+}
+
+func ssoDeviceLogin(ctx context.Context, client *ssooidc.Client, startURL string, cachePath string) error {
+	registered, err := client.RegisterClient(ctx, &ssooidc.RegisterClientInput{
+		ClientName: aws.String("awstee"),
+		ClientType: aws.String("public"),
+	})
+	if err != nil {
+		return fmt.Errorf("register client: %w", err)
+	}
+	auth, err := client.StartDeviceAuthorization(ctx, &ssooidc.StartDeviceAuthorizationInput{
+		ClientId:     registered.ClientId,
+		ClientSecret: registered.ClientSecret,
+		StartUrl:     aws.String(startURL),
+	})
+	if err != nil {
+		return fmt.Errorf("start device authorization: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "SSO session is expired. Open the following URL and confirm the code %s to login:\n%s\n", aws.ToString(auth.UserCode), aws.ToString(auth.VerificationUriComplete))
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		token, err := client.CreateToken(ctx, &ssooidc.CreateTokenInput{
+			ClientId:     registered.ClientId,
+			ClientSecret: registered.ClientSecret,
+			DeviceCode:   auth.DeviceCode,
+			GrantType:    aws.String("urn:ietf:params:oauth:grant-type:device_code"),
+		})
+		if err != nil {
+			var pending *ssooidctypes.AuthorizationPendingException
+			if errors.As(err, &pending) {
+				continue
+			}
+			var slowDown *ssooidctypes.SlowDownException
+			if errors.As(err, &slowDown) {
+				interval += 5 * time.Second
+				continue
+			}
+			return fmt.Errorf("create token: %w", err)
+		}
+		return writeSSOTokenCache(cachePath, aws.ToString(token.AccessToken), time.Now().Add(time.Duration(token.ExpiresIn)*time.Second))
+	}
+	return errors.New("device authorization is expired")
+}
+
+func writeSSOTokenCache(cachePath string, accessToken string, expiresAt time.Time) error {
+	bs, err := json.Marshal(map[string]string{
+		"accessToken": accessToken,
+		"expiresAt":   expiresAt.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(cachePath, bs, 0600)
+}
+
+// destinationAWSConfig returns the aws config of a destination with its own profile and/or role.
+// The role is assumed with the credentials of the profile if set, otherwise the default credentials.
+func destinationAWSConfig(ctx context.Context, base aws.Config, loadOpts []func(*awsConfig.LoadOptions) error, cfg *CredentialsConfig) (aws.Config, error) {
+	awsCfg := base.Copy()
+	if cfg.Profile != "" {
+		opts := make([]func(*awsConfig.LoadOptions) error, 0, len(loadOpts)+1)
+		opts = append(opts, loadOpts...)
+		opts = append(opts, awsConfig.WithSharedConfigProfile(cfg.Profile))
+		var err error
+		awsCfg, err = awsConfig.LoadDefaultConfig(ctx, opts...)
+		if err != nil {
+			return aws.Config{}, fmt.Errorf("load profile %s: %w", cfg.Profile, err)
+		}
+	}
+	if cfg.AssumeRoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg), cfg.AssumeRoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "awstee"
+		})
+		awsCfg.Credentials = aws.NewCredentialsCache(provider, withCredentialsExpiryWindow)
+	}
+	return awsCfg, nil
+}
+
+func (app *AWSTee) s3Client(cfg *S3Config) S3Client {
+	if client, ok := app.s3Clients[cfg]; ok {
+		return client
+	}
+	return app.client.S3
+}
+
+func (app *AWSTee) kmsClient(cfg *S3Config) kmsDataKeyAPI {
+	if client, ok := app.kmsClients[cfg]; ok {
+		return client
+	}
+	return app.kms
+}
+
+func (app *AWSTee) cloudwatchClient(cfg *CloudwatchLogsConfig) CloudwatchLogsClient {
+	if client, ok := app.cloudwatchClients[cfg]; ok {
+		return client
+	}
+	return app.client.CloudwatchLogs
+}
+
+func withCredentialsExpiryWindow(o *aws.CredentialsCacheOptions) {
+	o.ExpiryWindow = credentialsExpiryWindow
+}
+
+// expiredCredentialsError is the error of a call rejected by the expired credentials.
+// It is retryable, because the credentials are invalidated and the retry is signed with the refreshed ones.
+type expiredCredentialsError struct {
+	err error
+}
+
+func (e *expiredCredentialsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *expiredCredentialsError) Unwrap() error {
+	return e.err
+}
+
+func (e *expiredCredentialsError) RetryableError() bool {
+	return true
+}
+
+// refreshExpiredCredentials returns the api option invalidating the cached credentials when a call is rejected by their expiration,
+// e.g. the role session expired earlier than expected by the clock skew, so that the retries of the SDK refresh them and sign again.
+// Nothing is added for the credentials that can not be refreshed, such as the static ones.
+func refreshExpiredCredentials(credentials aws.CredentialsProvider) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		cache, ok := credentials.(interface{ Invalidate() })
+		if !ok {
+			return nil
+		}
+		// added after the retry and the signing of the finalize step, so that every attempt is signed again
+		return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("awsteeRefreshExpiredCredentials", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			out, metadata, err := next.HandleFinalize(ctx, in)
+			var apiErr smithy.APIError
+			if err != nil && errors.As(err, &apiErr) && expiredCredentialsCodes[apiErr.ErrorCode()] {
+				cache.Invalidate()
+				err = &expiredCredentialsError{err: err}
+			}
+			return out, metadata, err
+		}), middleware.After)
+	}
+}
+
+func s3RefreshExpiredCredentials(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, refreshExpiredCredentials(o.Credentials))
+}
+
+func cloudwatchLogsRefreshExpiredCredentials(o *cloudwatchlogs.Options) {
+	o.APIOptions = append(o.APIOptions, refreshExpiredCredentials(o.Credentials))
+}
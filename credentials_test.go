@@ -0,0 +1,233 @@
+package awstee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMFATokenProviderFromEnv(t *testing.T) {
+	t.Setenv(mfaTokenEnv, "123456")
+	token, err := mfaTokenProvider()
+	require.NoError(t, err)
+	require.EqualValues(t, "123456", token)
+}
+
+func TestWriteSSOTokenCache(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "sso", "cache", "token.json")
+	expiresAt := time.Date(2022, 6, 3, 17, 28, 48, 0, time.UTC)
+	require.NoError(t, writeSSOTokenCache(cachePath, "access-token", expiresAt))
+	bs, err := os.ReadFile(cachePath)
+	require.NoError(t, err)
+	var actual map[string]string
+	require.NoError(t, json.Unmarshal(bs, &actual))
+	require.EqualValues(t, map[string]string{
+		"accessToken": "access-token",
+		"expiresAt":   "2022-06-03T17:28:48Z",
+	}, actual)
+}
+
+func TestEnsureSSOLoginOtherErrors(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(configFile, []byte(`[profile sso]
+sso_start_url = https://example.awsapps.com/start
+sso_region = us-east-1
+sso_account_id = 123456789012
+sso_role_name = ReadOnly
+`), 0600))
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+
+	retrieveErr := errors.New("connection refused")
+	awsCfg := aws.Config{Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return aws.Credentials{}, retrieveErr
+	})}
+	err := ensureSSOLogin(context.Background(), slog.Default(), awsCfg, "sso")
+	require.ErrorIs(t, err, retrieveErr, "no login for the errors other than the expired token")
+
+	require.True(t, isSSOTokenExpired(fmt.Errorf("retrieve: %w", &ssocreds.InvalidTokenError{})))
+	require.False(t, isSSOTokenExpired(retrieveErr))
+}
+
+func TestDestinationAWSConfig(t *testing.T) {
+	base := aws.Config{Region: "ap-northeast-1"}
+	awsCfg, err := destinationAWSConfig(context.Background(), base, nil, &CredentialsConfig{
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/awstee",
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, "ap-northeast-1", awsCfg.Region)
+	require.IsType(t, &aws.CredentialsCache{}, awsCfg.Credentials)
+	require.Nil(t, base.Credentials)
+}
+
+func TestDestinationClients(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	defaultClient := NewMockS3Client(ctrl)
+	accountBClient := NewMockS3Client(ctrl)
+	cfg := &Config{
+		Targets: map[string]*TargetConfig{
+			"a": {S3: &S3Config{URLPrefix: "s3://a-example-com/logs/"}},
+			"b": {S3: &S3Config{
+				URLPrefix:   "s3://b-example-com/logs/",
+				Credentials: CredentialsConfig{AssumeRoleARN: "arn:aws:iam::123456789012:role/awstee"},
+			}},
+		},
+		Target: "a,b",
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{S3: defaultClient})
+	require.NoError(t, err)
+	app.s3Clients[cfg.Targets["b"].S3] = accountBClient
+	require.Same(t, defaultClient, app.s3Client(cfg.Targets["a"].S3))
+	require.Same(t, accountBClient, app.s3Client(cfg.Targets["b"].S3))
+}
+
+func TestCredentialsRefresh(t *testing.T) {
+	var mu sync.Mutex
+	var sessions int
+	var s3Calls, cloudwatchCalls []string
+	var partRejected, batchRejected bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		io.Copy(io.Discard, r.Body)
+		token := r.Header.Get("X-Amz-Security-Token")
+		switch {
+		case r.Header.Get("X-Amz-Target") != "":
+			operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "Logs_20140328.")
+			cloudwatchCalls = append(cloudwatchCalls, operation+" "+token)
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			if operation == "PutLogEvents" && !batchRejected {
+				batchRejected = true
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"__type":"ExpiredTokenException","message":"The security token included in the request is expired"}`)
+				return
+			}
+			fmt.Fprint(w, `{}`)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasPrefix(r.URL.Path, "/awstee-example-com/"):
+			query := r.URL.Query()
+			operation := "PutObject"
+			switch {
+			case query.Has("uploads"):
+				operation = "CreateMultipartUpload"
+			case query.Has("partNumber"):
+				operation = "UploadPart" + query.Get("partNumber")
+			case query.Has("uploadId"):
+				operation = "CompleteMultipartUpload"
+			}
+			s3Calls = append(s3Calls, operation+" "+token)
+			if operation == "UploadPart2" && !partRejected {
+				partRejected = true
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `<Error><Code>ExpiredToken</Code><Message>The provided token has expired.</Message></Error>`)
+				return
+			}
+			switch operation {
+			case "CreateMultipartUpload":
+				fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>awstee-example-com</Bucket><Key>logs/hoge.log</Key><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+			case "CompleteMultipartUpload":
+				fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>awstee-example-com</Bucket><Key>logs/hoge.log</Key></CompleteMultipartUploadResult>`)
+			default:
+				w.Header().Set("ETag", `"etag"`)
+			}
+		default:
+			// sts AssumeRole, the short-lived session of 15 minutes
+			sessions++
+			fmt.Fprintf(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials><AccessKeyId>ASIA%[1]d</AccessKeyId><SecretAccessKey>SECRET</SecretAccessKey><SessionToken>token-%[1]d</SessionToken><Expiration>%[2]s</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`,
+				sessions, time.Now().Add(15*time.Minute).UTC().Format(time.RFC3339))
+		}
+	}))
+	defer srv.Close()
+
+	role := CredentialsConfig{AssumeRoleARN: "arn:aws:iam::123456789012:role/awstee"}
+	cfg := &Config{
+		S3: &S3Config{
+			URLPrefix:   "s3://awstee-example-com/logs/",
+			Credentials: role,
+		},
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup:    "/awstee/logs",
+			Credentials: role,
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	awsCfg := aws.Config{
+		Region:      "ap-northeast-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		EndpointResolverWithOptions: aws.EndpointResolverWithOptionsFunc(func(string, string, ...interface{}) (aws.Endpoint, error) {
+			return aws.Endpoint{URL: srv.URL, HostnameImmutable: true}, nil
+		}),
+		Retryer: func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+			})
+		},
+	}
+	app, err := NewWithAWSConfig(context.Background(), cfg, awsCfg, WithS3Options(func(o *s3.Options) {
+		o.UsePathStyle = true
+	}))
+	require.NoError(t, err)
+	w, err := app.Writer(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	line := strings.Repeat("a", 1023) + "\n"
+	for i := 0; i < 6*1024; i++ {
+		_, err := io.WriteString(w, line)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 4, sessions, "the role of each destination is assumed again after the rejection")
+	s3Token, refreshed := strings.Fields(s3Calls[0])[1], strings.Fields(s3Calls[len(s3Calls)-1])[1]
+	require.NotEqual(t, s3Token, refreshed)
+	require.Contains(t, s3Calls, "UploadPart2 "+s3Token, "rejected by the expired token")
+	require.Contains(t, s3Calls, "UploadPart2 "+refreshed, "the part is signed again with the refreshed session")
+	require.Equal(t, "CompleteMultipartUpload "+refreshed, s3Calls[len(s3Calls)-1])
+	require.Equal(t, []string{"DescribeLogStreams", "CreateLogStream", "PutLogEvents", "PutLogEvents"}, []string{
+		strings.Fields(cloudwatchCalls[0])[0], strings.Fields(cloudwatchCalls[1])[0], strings.Fields(cloudwatchCalls[2])[0], strings.Fields(cloudwatchCalls[3])[0],
+	})
+	cloudwatchToken, refreshed := strings.Fields(cloudwatchCalls[2])[1], strings.Fields(cloudwatchCalls[3])[1]
+	require.NotEqual(t, cloudwatchToken, refreshed, "the batch rejected by the expired token is put with the refreshed session")
+	require.Equal(t, "PutLogEvents "+refreshed, cloudwatchCalls[len(cloudwatchCalls)-1])
+}
+
+func TestCredentialsExpiryWindow(t *testing.T) {
+	var retrieved int
+	cache := aws.NewCredentialsCache(aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		retrieved++
+		return aws.Credentials{
+			AccessKeyID:     "ASIA",
+			SecretAccessKey: "SECRET",
+			SessionToken:    "token",
+			CanExpire:       true,
+			Expires:         time.Now().Add(credentialsExpiryWindow - time.Minute),
+		}, nil
+	}), withCredentialsExpiryWindow)
+	for i := 0; i < 2; i++ {
+		_, err := cache.Retrieve(context.Background())
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, retrieved, "refreshed before the expiration")
+}
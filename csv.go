@@ -0,0 +1,82 @@
+package awstee
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// CSVConfig converts the delimited lines written to a destination to JSON objects, whose fields are named by columns or the header line.
+// The values are strings, and the values without a column are named column_N (from 1).
+type CSVConfig struct {
+	Columns []string `yaml:"columns,omitempty"`
+	// Header is the first line of the column names, which is not written. columns win over it.
+	Header    bool   `yaml:"header,omitempty"`
+	Delimiter string `yaml:"delimiter,omitempty"`
+
+	comma rune
+}
+
+func (cfg *CSVConfig) Enabled() bool {
+	return cfg.Header || len(cfg.Columns) > 0
+}
+
+func (cfg *CSVConfig) Restrict() error {
+	cfg.comma = ','
+	if cfg.Delimiter != "" {
+		r, size := utf8.DecodeRuneInString(cfg.Delimiter)
+		if size != len(cfg.Delimiter) || r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+			return fmt.Errorf("csv delimiter must be a character other than a quote or a newline, got %q", cfg.Delimiter)
+		}
+		cfg.comma = r
+	}
+	for _, name := range cfg.Columns {
+		if name == "" {
+			return errors.New("csv columns must not have an empty name")
+		}
+	}
+	return nil
+}
+
+// processor returns the line processor converting the lines. The lines failing to parse, and the empty lines, are written as they are.
+func (cfg *CSVConfig) processor() lineProcessor {
+	columns := cfg.Columns
+	header := cfg.Header
+	return func(line []byte) []byte {
+		if len(line) == 0 {
+			return line
+		}
+		record, err := cfg.parse(line)
+		if err != nil {
+			return line
+		}
+		if header {
+			header = false
+			if len(columns) == 0 {
+				columns = record
+			}
+			return nil
+		}
+		fields := make([]jsonField, 0, len(record))
+		for i, value := range record {
+			name := "column_" + strconv.Itoa(i+1)
+			if i < len(columns) {
+				name = columns[i]
+			}
+			v, _ := json.Marshal(value)
+			fields = append(fields, jsonField{name: name, value: v})
+		}
+		return appendJSONObject(make([]byte, 0, len(line)*2), fields)
+	}
+}
+
+func (cfg *CSVConfig) parse(line []byte) ([]string, error) {
+	r := csv.NewReader(bytes.NewReader(line))
+	r.Comma = cfg.comma
+	r.FieldsPerRecord = -1
+	return r.Read()
+}
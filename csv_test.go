@@ -0,0 +1,66 @@
+package awstee
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSVConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		cfg      CSVConfig
+		input    string
+		expected string
+	}{
+		{
+			name:     "header",
+			cfg:      CSVConfig{Header: true},
+			input:    "time,level,msg\n2022-06-03T17:28:48Z,info,\"hoge, fuga\"\n\n2022-06-03T17:28:49Z,warn,\"say \"\"piyo\"\"\",extra\n",
+			expected: `{"time":"2022-06-03T17:28:48Z","level":"info","msg":"hoge, fuga"}` + "\n\n" + `{"time":"2022-06-03T17:28:49Z","level":"warn","msg":"say \"piyo\"","column_4":"extra"}` + "\n",
+		},
+		{
+			name:     "columns",
+			cfg:      CSVConfig{Columns: []string{"id", "name"}, Delimiter: "\t"},
+			input:    "1\thoge\n2\n",
+			expected: `{"id":"1","name":"hoge"}` + "\n" + `{"id":"2"}` + "\n",
+		},
+		{
+			name:     "columns win over header",
+			cfg:      CSVConfig{Columns: []string{"a", "b"}, Header: true},
+			input:    "x,y\n1,2\n",
+			expected: `{"a":"1","b":"2"}` + "\n",
+		},
+		{
+			name:     "broken",
+			cfg:      CSVConfig{Columns: []string{"msg"}},
+			input:    "\"unterminated\n",
+			expected: "\"unterminated\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.NoError(t, c.cfg.Restrict())
+			var buf bytes.Buffer
+			w := newLineDestination(newTestWriteCloser(&buf, func() error { return nil }), []lineProcessor{c.cfg.processor()}, nil)
+			_, err := io.WriteString(w, c.input)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			require.Equal(t, c.expected, buf.String())
+		})
+	}
+
+	cfg := &CSVConfig{Header: true, Delimiter: ";;"}
+	require.EqualError(t, cfg.Restrict(), `csv delimiter must be a character other than a quote or a newline, got ";;"`)
+
+	lines := &LinesConfig{CSV: CSVConfig{Header: true}, Fields: FieldsConfig{Fields: []string{"msg"}}}
+	require.NoError(t, lines.Restrict())
+	processors, _ := lines.processors(&runMetadata{})
+	var buf bytes.Buffer
+	w := newLineWriter(&buf, processors)
+	_, err := io.WriteString(w, "level,msg\ninfo,hoge\n")
+	require.NoError(t, err)
+	require.Equal(t, `{"msg":"hoge"}`+"\n", buf.String(), "the fields of the lines converted")
+}
@@ -0,0 +1,93 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go/logging"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// debugAWSClientLogMode is the log mode of the aws-sdk-go-v2 clients by debug_aws: the retries with their reasons,
+// in addition to the calls logged by debugAWSMiddleware. The requests and the responses are not dumped, not to log the bodies.
+const debugAWSClientLogMode = aws.LogRetries
+
+// slogAWSLogger routes the logs of the aws sdk to the logger of awstee.
+type slogAWSLogger struct {
+	logger *slog.Logger
+}
+
+func (l slogAWSLogger) Logf(classification logging.Classification, format string, v ...interface{}) {
+	level := slog.LevelInfo
+	if classification == logging.Warn {
+		level = slog.LevelWarn
+	}
+	l.logger.Log(context.Background(), level, "aws sdk", "message", fmt.Sprintf(format, v...))
+}
+
+// debugAWSMiddleware logs each aws call by debug_aws, with the request id, the attempts, the status code and the latency of the whole call.
+// It is after the service metadata of the call, and before the retries.
+func debugAWSMiddleware(logger *slog.Logger) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("AWSTeeDebugAWS", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			start := time.Now()
+			out, metadata, err := next.HandleInitialize(ctx, in)
+			call := debugAWSCall{
+				service:   awsmiddleware.GetServiceID(ctx),
+				operation: awsmiddleware.GetOperationName(ctx),
+				latency:   time.Since(start),
+				err:       err,
+			}
+			call.requestID, _ = awsmiddleware.GetRequestIDMetadata(metadata)
+			if results, ok := retry.GetAttemptResults(metadata); ok {
+				call.attempts = len(results.Results)
+			}
+			if resp, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok {
+				call.statusCode = resp.StatusCode
+			}
+			// the failed calls have them in the error
+			var re *awshttp.ResponseError
+			if errors.As(err, &re) {
+				call.requestID = re.ServiceRequestID()
+				call.statusCode = re.HTTPStatusCode()
+			}
+			call.log(logger)
+			return out, metadata, err
+		}), middleware.After)
+	}
+}
+
+// debugAWSCall is an aws call logged by debug_aws.
+type debugAWSCall struct {
+	service    string
+	operation  string
+	requestID  string
+	attempts   int
+	statusCode int
+	latency    time.Duration
+	err        error
+}
+
+func (c debugAWSCall) log(logger *slog.Logger) {
+	attrs := []any{
+		"service", c.service,
+		"operation", c.operation,
+		"request_id", c.requestID,
+		"attempts", c.attempts,
+		"status_code", c.statusCode,
+		"latency", c.latency,
+	}
+	if c.err != nil {
+		// not a warning, some errors are expected such as NotFound of the s3 object checked
+		attrs = append(attrs, "error", c.err)
+	}
+	logger.Info("aws call", attrs...)
+}
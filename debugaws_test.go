@@ -0,0 +1,88 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/logging"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeLogs returns the records of the json logs.
+func decodeLogs(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var record map[string]any
+		require.NoError(t, dec.Decode(&record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestDebugAWS(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Request-Id", "4442587FB7D0A2F9")
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	cfg := &Config{
+		DebugAWS: true,
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	awsCfg := aws.Config{
+		Region:      "ap-northeast-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}
+	var buf bytes.Buffer
+	app, err := NewWithAWSConfig(context.Background(), cfg, awsCfg,
+		WithLogger(slog.New(slog.NewJSONHandler(&buf, nil))),
+		WithS3Options(func(o *s3.Options) {
+			o.EndpointResolver = s3.EndpointResolverFromURL(srv.URL)
+			o.UsePathStyle = true
+		}),
+	)
+	require.NoError(t, err)
+	_, err = app.DryRun(context.Background(), "hoge.log")
+	require.NoError(t, err)
+
+	var calls []map[string]any
+	for _, record := range decodeLogs(t, &buf) {
+		if record["msg"] == "aws call" {
+			calls = append(calls, record)
+		}
+	}
+	require.Len(t, calls, 1)
+	require.Equal(t, "S3", calls[0]["service"])
+	require.Equal(t, "HeadObject", calls[0]["operation"])
+	require.Equal(t, "4442587FB7D0A2F9", calls[0]["request_id"])
+	require.EqualValues(t, 1, calls[0]["attempts"])
+	require.EqualValues(t, http.StatusNotFound, calls[0]["status_code"])
+	require.Contains(t, calls[0], "latency")
+	require.Contains(t, calls[0], "error")
+}
+
+func TestSlogAWSLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slogAWSLogger{logger: slog.New(slog.NewJSONHandler(&buf, nil))}
+	logger.Logf(logging.Debug, "retrying request %s/%s, attempt %d", "S3", "PutObject", 2)
+	logger.Logf(logging.Warn, "response has no request id")
+	records := decodeLogs(t, &buf)
+	require.Len(t, records, 2)
+	require.Equal(t, "INFO", records[0]["level"])
+	require.Equal(t, "retrying request S3/PutObject, attempt 2", records[0]["message"])
+	require.Equal(t, "WARN", records[1]["level"])
+}
@@ -0,0 +1,57 @@
+package awstee
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// gzipMagic is the magic number at the start of a gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// autoDecompressReader decompresses r if it begins with the gzip magic number, otherwise reads r as it is.
+// It is detected by the first Read, not to block before the input comes. The concatenated gzip streams, such as of `cat a.gz b.gz`, are read as one.
+type autoDecompressReader struct {
+	br     *bufio.Reader
+	r      io.Reader
+	logger *slog.Logger
+}
+
+func newAutoDecompressReader(logger *slog.Logger, r io.Reader) *autoDecompressReader {
+	return &autoDecompressReader{
+		br:     bufio.NewReader(r),
+		logger: logger,
+	}
+}
+
+func (r *autoDecompressReader) Read(p []byte) (int, error) {
+	if r.r == nil {
+		if err := r.detect(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.r.Read(p)
+	if _, ok := r.r.(*gzip.Reader); ok && err != nil && err != io.EOF {
+		return n, fmt.Errorf("decompress input: %w", err)
+	}
+	return n, err
+}
+
+// detect sets r.r by the magic number of the input.
+func (r *autoDecompressReader) detect() error {
+	// the error of the peek is returned by the reads of br
+	if magic, _ := r.br.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+		r.r = r.br
+		return nil
+	}
+	gr, err := gzip.NewReader(r.br)
+	if err != nil {
+		return fmt.Errorf("decompress input: %w", err)
+	}
+	r.logger.Info("input is gzip compressed, decompressed before the line processing")
+	r.r = gr
+	return nil
+}
@@ -0,0 +1,77 @@
+package awstee
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func gzipString(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := io.WriteString(gw, s)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestAutoDecompressReader(t *testing.T) {
+	concatenated := append(gzipString(t, "hoge\n"), gzipString(t, "fuga\n")...)
+	cases := []struct {
+		name     string
+		input    []byte
+		expected string
+	}{
+		{name: "gzip", input: gzipString(t, "hoge\nfuga\n"), expected: "hoge\nfuga\n"},
+		{name: "concatenated", input: concatenated, expected: "hoge\nfuga\n"},
+		{name: "plain", input: []byte("hoge\nfuga\n"), expected: "hoge\nfuga\n"},
+		{name: "one byte", input: []byte{0x1f}, expected: "\x1f"},
+		{name: "empty", input: nil, expected: ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b, err := io.ReadAll(newAutoDecompressReader(slog.Default(), bytes.NewReader(c.input)))
+			require.NoError(t, err)
+			require.Equal(t, c.expected, string(b))
+		})
+	}
+
+	broken := gzipString(t, strings.Repeat("hoge\n", 100))
+	_, err := io.ReadAll(newAutoDecompressReader(slog.Default(), bytes.NewReader(broken[:len(broken)-10])))
+	require.ErrorContains(t, err, "decompress input: ")
+}
+
+func TestTeeReaderAutoDecompress(t *testing.T) {
+	for name, c := range map[string]struct {
+		cfg      *Config
+		expected string
+	}{
+		"default":            {cfg: &Config{}, expected: "hoge\nfuga\n"},
+		"no_auto_decompress": {cfg: &Config{NoAutoDecompress: true}, expected: string(gzipString(t, "hoge\nfuga\n"))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, c.cfg.Restrict())
+			var dest bytes.Buffer
+			app, err := NewWithClient(c.cfg, AWSClient{},
+				WithDestination("buf", func(context.Context, string) (io.WriteCloser, error) {
+					return newTestWriteCloser(&dest, func() error { return nil }), nil
+				}),
+			)
+			require.NoError(t, err)
+			r, err := app.TeeReader(context.Background(), bytes.NewReader(gzipString(t, "hoge\nfuga\n")), "hoge.log")
+			require.NoError(t, err)
+			stdout, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, c.expected, string(stdout))
+			require.Equal(t, c.expected, dest.String())
+		})
+	}
+}
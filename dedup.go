@@ -0,0 +1,187 @@
+package awstee
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// batchLedgerSize is the number of the ambiguous batches remembered by a ledger.
+	batchLedgerSize = 1024
+	// defaultDedupRetryAttempts replaces the retries of the AWS SDK, which do not confirm the batches failed ambiguously.
+	defaultDedupRetryAttempts = 3
+)
+
+// cloudwatchBatch is a batch of events put to a log stream, and its deterministic id.
+type cloudwatchBatch struct {
+	id     string
+	events []cwtypes.InputLogEvent
+}
+
+// cloudwatchBatchID returns the id of the batch of events put to the log stream, by their timestamps and messages.
+// The batches replayed from the spill have the same id as their first attempts.
+func cloudwatchBatchID(logGroup, logStream string, events []cwtypes.InputLogEvent) string {
+	h := sha256.New()
+	// the messages are written through buf, not converted to []byte one by one
+	buf := make([]byte, 0, 4096)
+	buf = append(append(append(append(buf, logGroup...), 0), logStream...), 0)
+	for _, event := range events {
+		if len(buf) > cap(buf)-len(aws.ToString(event.Message))-9 {
+			h.Write(buf)
+			buf = buf[:0]
+		}
+		buf = binary.BigEndian.AppendUint64(buf, uint64(aws.ToInt64(event.Timestamp)))
+		buf = append(append(buf, aws.ToString(event.Message)...), 0)
+	}
+	h.Write(buf)
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// batchLedger is the local record of the ambiguous batches of a log stream, failed without knowing whether they were accepted,
+// such as by a timeout or a 5xx error. An ambiguous batch is kept with its events until it is resolved,
+// to be confirmed in the log stream when it is retried or replayed from the spill.
+// The batches accepted are not recorded: the same events can be written again, e.g. the same line at the same millisecond.
+// It is used by the worker of a writer only.
+type batchLedger struct {
+	ambiguous []ambiguousBatch
+}
+
+// ambiguousBatch is a batch failed ambiguously, and confirmed reports whether it is found in the log stream.
+type ambiguousBatch struct {
+	cloudwatchBatch
+	confirmed bool
+}
+
+func newBatchLedger() *batchLedger {
+	return &batchLedger{}
+}
+
+// resolve forgets the ambiguous batches at the head of events, accepted by PutLogEvents or given up.
+func (l *batchLedger) resolve(events []cwtypes.InputLogEvent) {
+	for {
+		ambiguous := l.ambiguousAt(events)
+		if ambiguous == nil {
+			return
+		}
+		events = events[len(ambiguous.events):]
+		l.forget(ambiguous.id)
+	}
+}
+
+// fail records the batch ambiguous if err is ambiguous.
+func (l *batchLedger) fail(batch cloudwatchBatch, err error) {
+	if !isAmbiguousError(err) || l.ambiguousAt(batch.events) != nil {
+		return
+	}
+	l.ambiguous = append(l.ambiguous, ambiguousBatch{cloudwatchBatch: batch})
+	if len(l.ambiguous) > batchLedgerSize {
+		l.ambiguous = l.ambiguous[1:]
+	}
+}
+
+// forget removes the ambiguous batch of id, which is put again.
+func (l *batchLedger) forget(id string) {
+	for i, batch := range l.ambiguous {
+		if batch.id == id {
+			l.ambiguous = append(l.ambiguous[:i], l.ambiguous[i+1:]...)
+			return
+		}
+	}
+}
+
+// ambiguousAt returns the ambiguous batch at the head of events, or nil.
+func (l *batchLedger) ambiguousAt(events []cwtypes.InputLogEvent) *ambiguousBatch {
+	for i := range l.ambiguous {
+		batch := &l.ambiguous[i]
+		if len(batch.events) > 0 && len(batch.events) <= len(events) && sameEvents(batch.events, events[:len(batch.events)]) {
+			return batch
+		}
+	}
+	return nil
+}
+
+func sameEvents(a, b []cwtypes.InputLogEvent) bool {
+	for i := range a {
+		if !sameEvent(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameEvent(a, b cwtypes.InputLogEvent) bool {
+	return aws.ToInt64(a.Timestamp) == aws.ToInt64(b.Timestamp) && aws.ToString(a.Message) == aws.ToString(b.Message)
+}
+
+// isAmbiguousError reports whether the request failed by err may have been processed:
+// the retryable errors without the response after the request is sent, such as a connection reset, or the 5xx errors.
+func isAmbiguousError(err error) bool {
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) {
+		return re.HTTPStatusCode() >= 500
+	}
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		// not sent
+		return false
+	}
+	return isRetryableError(err)
+}
+
+// alreadyAcceptedOutput returns the output of PutLogEvents failed by DataAlreadyAcceptedException,
+// that is the batch was accepted by the former attempt, with the sequence token expected by the log stream.
+func alreadyAcceptedOutput(err error) (*cloudwatchlogs.PutLogEventsOutput, bool) {
+	var accepted *cwtypes.DataAlreadyAcceptedException
+	if !errors.As(err, &accepted) {
+		return nil, false
+	}
+	return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: accepted.ExpectedSequenceToken}, true
+}
+
+// cloudwatchBatchAccepted reports whether all events of the batch are in the log stream in order, by GetLogEvents in the time range of the batch.
+// PutLogEvents accepts a batch as a whole, so a part of the batch in the log stream is the events put by another batch.
+func cloudwatchBatchAccepted(ctx context.Context, client CloudwatchLogsClient, logGroup, logStream string, events []cwtypes.InputLogEvent) (bool, error) {
+	if len(events) == 0 {
+		return true, nil
+	}
+	input := &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(logGroup),
+		LogStreamName: aws.String(logStream),
+		StartTime:     events[0].Timestamp,
+		EndTime:       aws.Int64(aws.ToInt64(events[len(events)-1].Timestamp) + 1),
+		StartFromHead: aws.Bool(true),
+	}
+	matched := 0
+	for {
+		output, err := client.GetLogEvents(ctx, input)
+		if err != nil {
+			return false, err
+		}
+		for _, event := range output.Events {
+			if matched < len(events) && sameEvent(cwtypes.InputLogEvent{Timestamp: event.Timestamp, Message: event.Message}, events[matched]) {
+				matched++
+			}
+		}
+		if matched == len(events) {
+			return true, nil
+		}
+		if len(output.Events) == 0 || aws.ToString(output.NextForwardToken) == aws.ToString(input.NextToken) {
+			return false, nil
+		}
+		input.NextToken = output.NextForwardToken
+	}
+}
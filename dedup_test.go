@@ -0,0 +1,198 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsAmbiguousError(t *testing.T) {
+	cases := []struct {
+		name      string
+		err       error
+		ambiguous bool
+	}{
+		{name: "connection reset", err: errors.New("read tcp 10.0.0.1:443: read: connection reset by peer"), ambiguous: true},
+		{name: "service unavailable", err: &awshttp.ResponseError{ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}},
+			Err:      &smithy.GenericAPIError{Code: "ServiceUnavailableException"},
+		}}, ambiguous: true},
+		{name: "throttled", err: &smithy.GenericAPIError{Code: "ThrottlingException"}},
+		{name: "not sent", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}},
+		{name: "canceled", err: context.Canceled},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.ambiguous, isAmbiguousError(c.err))
+		})
+	}
+}
+
+func TestCloudwatchLogsWriterDedup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	connectionReset := errors.New("read tcp 10.0.0.1:443: read: connection reset by peer")
+	var batches [][]string
+	var stream []types.OutputLogEvent
+	put := func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		var o cloudwatchlogs.Options
+		for _, fn := range optFns {
+			fn(&o)
+		}
+		require.Equal(t, 1, o.RetryMaxAttempts, "retried by awstee, not by the SDK")
+		var batch []string
+		for _, event := range input.LogEvents {
+			batch = append(batch, *event.Message)
+			stream = append(stream, types.OutputLogEvent{Timestamp: event.Timestamp, Message: event.Message})
+		}
+		batches = append(batches, batch)
+		return &cloudwatchlogs.PutLogEventsOutput{}, nil
+	}
+	gomock.InOrder(
+		// accepted, but the response is lost
+		client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, input *cloudwatchlogs.PutLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+				put(ctx, input, optFns...)
+				return nil, connectionReset
+			},
+		).Times(1),
+		client.EXPECT().GetLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, input *cloudwatchlogs.GetLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+				require.Equal(t, "hoge", *input.LogStreamName)
+				return &cloudwatchlogs.GetLogEventsOutput{Events: stream, NextForwardToken: aws.String("f/1")}, nil
+			},
+		).Times(1),
+		// not accepted
+		client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, connectionReset).Times(1),
+		client.EXPECT().GetLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, input *cloudwatchlogs.GetLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+				return &cloudwatchlogs.GetLogEventsOutput{NextForwardToken: input.NextToken}, nil
+			},
+		).Times(1),
+		client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(put).Times(1),
+	)
+	cfg := &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/logs",
+		FlushInterval: "1h",
+		Dedup:         true,
+		Retry:         RetryConfig{Backoff: "1ms"},
+	}
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, defaultDedupRetryAttempts, cfg.Retry.Attempts)
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), client, cfg, "hoge.log", time.Now, &destinationHooks{
+		logger:       slog.Default(),
+		errorHandler: func(string, error) {},
+	})
+	require.NoError(t, err)
+
+	_, err = io.WriteString(w, "hoge\nfuga\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Flush(context.Background()))
+	_, err = io.WriteString(w, "piyo\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, [][]string{{"hoge", "fuga"}, {"piyo"}}, batches, "the accepted batch is not put again")
+	require.EqualValues(t, 2, w.Stats().Deduplicated)
+}
+
+func TestCloudwatchLogsWriterDataAlreadyAccepted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	gomock.InOrder(
+		client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			nil, &types.DataAlreadyAcceptedException{ExpectedSequenceToken: aws.String("2")},
+		).Times(1),
+		client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+				require.Equal(t, "2", aws.ToString(input.SequenceToken), "the sequence token expected by the log stream")
+				return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("3")}, nil
+			},
+		).Times(1),
+	)
+	w := newTestCloudwatchLogsWriter(t, client, &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/logs",
+		FlushInterval: "1h",
+	})
+	_, err := io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Flush(context.Background()))
+	_, err = io.WriteString(w, "fuga\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.EqualValues(t, 1, w.Stats().Deduplicated)
+}
+
+func TestCloudwatchLogsWriterDedupSpill(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	var stream []types.OutputLogEvent
+	var batches [][]string
+	gomock.InOrder(
+		client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+				for _, event := range input.LogEvents {
+					stream = append(stream, types.OutputLogEvent{Timestamp: event.Timestamp, Message: event.Message})
+				}
+				return nil, errors.New("read tcp 10.0.0.1:443: read: connection reset by peer")
+			},
+		).Times(1),
+		client.EXPECT().GetLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, input *cloudwatchlogs.GetLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+				return &cloudwatchlogs.GetLogEventsOutput{Events: stream, NextForwardToken: aws.String("f/1")}, nil
+			},
+		).Times(1),
+		client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+				var batch []string
+				for _, event := range input.LogEvents {
+					batch = append(batch, *event.Message)
+				}
+				batches = append(batches, batch)
+				return &cloudwatchlogs.PutLogEventsOutput{}, nil
+			},
+		).Times(1),
+	)
+	cfg := &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/logs",
+		FlushInterval: "1h",
+		Dedup:         true,
+		Retry:         RetryConfig{Attempts: 1},
+		Spill:         SpillConfig{Dir: t.TempDir(), MaxBytes: 1024},
+	}
+	require.NoError(t, cfg.Restrict())
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), client, cfg, "hoge.log", time.Now, &destinationHooks{
+		logger:       slog.Default(),
+		errorHandler: func(string, error) {},
+	})
+	require.NoError(t, err)
+
+	_, err = io.WriteString(w, "hoge\nfuga\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Flush(context.Background()), "spilled")
+	_, err = io.WriteString(w, "piyo\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, [][]string{{"piyo"}}, batches, "the spilled batch accepted by the failed attempt is not replayed")
+	require.EqualValues(t, 2, w.Stats().Deduplicated)
+	require.EqualValues(t, 0, w.Stats().Spilled)
+}
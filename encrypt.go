@@ -0,0 +1,316 @@
+package awstee
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+const (
+	// encryptMagic is the first line of an object encrypted by awstee, followed by the line of the JSON encryptHeader and the frames.
+	encryptMagic = "awstee-kms-v1\n"
+	// encryptFrameBytes is the plaintext bytes of a frame. A frame is the flag, the bytes of the ciphertext (uint32) and the ciphertext of AES-256-GCM.
+	encryptFrameBytes = 64 * 1024
+
+	encryptFrameFlagNext  = 0
+	encryptFrameFlagFinal = 1
+)
+
+// kmsDataKeyAPI is the KMS API of the envelope encryption.
+type kmsDataKeyAPI interface {
+	GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// EncryptConfig encrypts the stream written to a destination on the host, by the data key generated by the KMS key for each object (the envelope encryption).
+type EncryptConfig struct {
+	KMSKeyID string `yaml:"kms_key_id,omitempty"`
+	// EncryptionContext is bound to the data key, and required to decrypt it.
+	EncryptionContext map[string]string `yaml:"encryption_context,omitempty"`
+}
+
+func (cfg *EncryptConfig) Enabled() bool {
+	return cfg.KMSKeyID != ""
+}
+
+func (cfg *EncryptConfig) Restrict() error {
+	if len(cfg.EncryptionContext) > 0 && cfg.KMSKeyID == "" {
+		return errors.New("encrypt encryption_context requires kms_key_id")
+	}
+	return nil
+}
+
+// encryptHeader is the data key of an object, encrypted by the KMS key.
+type encryptHeader struct {
+	KeyID             string            `json:"key_id"`
+	EncryptedDataKey  []byte            `json:"encrypted_data_key"`
+	EncryptionContext map[string]string `json:"encryption_context,omitempty"`
+}
+
+// newFrameCipher returns AES-256-GCM of the data key, and clears the data key.
+func newFrameCipher(dataKey []byte) (cipher.AEAD, error) {
+	defer clear(dataKey)
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// frameNonce is the nonce of the seq-th frame, the frames can not be reordered.
+func frameNonce(nonce []byte, seq uint64) []byte {
+	clear(nonce[:4])
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// dataKey is the data key of an object, and the header of the object.
+type dataKey struct {
+	aead   cipher.AEAD
+	header []byte
+}
+
+// generateDataKey generates the data key of an object by the KMS key.
+func generateDataKey(ctx context.Context, client kmsDataKeyAPI, cfg *EncryptConfig) (*dataKey, error) {
+	if client == nil {
+		return nil, errors.New("encrypt requires a kms client")
+	}
+	input := &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(cfg.KMSKeyID),
+		KeySpec: types.DataKeySpecAes256,
+	}
+	if len(cfg.EncryptionContext) > 0 {
+		input.EncryptionContext = cfg.EncryptionContext
+	}
+	output, err := client.GenerateDataKey(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("kms generate data key %s: %w", cfg.KMSKeyID, err)
+	}
+	aead, err := newFrameCipher(output.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("data key: %w", err)
+	}
+	header, err := json.Marshal(encryptHeader{
+		KeyID:             aws.ToString(output.KeyId),
+		EncryptedDataKey:  output.CiphertextBlob,
+		EncryptionContext: cfg.EncryptionContext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{
+		aead:   aead,
+		header: append(append([]byte(encryptMagic), header...), '\n'),
+	}, nil
+}
+
+// encryptWriter encrypts the writes to a destination in frames after the header. The last frame is flagged final by Close,
+// so that a truncated object fails to decrypt. Flush writes the frame of the writes so far.
+type encryptWriter struct {
+	io.WriteCloser
+	key   *dataKey
+	seq   uint64
+	buf   []byte
+	frame []byte
+	nonce []byte
+}
+
+func newEncryptWriter(w io.WriteCloser, key *dataKey) *encryptWriter {
+	return &encryptWriter{
+		WriteCloser: w,
+		key:         key,
+		buf:         make([]byte, 0, encryptFrameBytes),
+		nonce:       make([]byte, key.aead.NonceSize()),
+	}
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		c := min(len(p), encryptFrameBytes-len(w.buf))
+		w.buf = append(w.buf, p[:c]...)
+		p = p[c:]
+		if len(w.buf) == encryptFrameBytes {
+			if err := w.writeFrame(encryptFrameFlagNext); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *encryptWriter) writeFrame(flag byte) error {
+	if len(w.buf) == 0 && flag == encryptFrameFlagNext {
+		return nil
+	}
+	w.frame = w.frame[:0]
+	if w.seq == 0 {
+		w.frame = append(w.frame, w.key.header...)
+	}
+	aead := w.key.aead
+	w.frame = append(w.frame, flag)
+	w.frame = binary.BigEndian.AppendUint32(w.frame, uint32(len(w.buf)+aead.Overhead()))
+	w.frame = aead.Seal(w.frame, frameNonce(w.nonce, w.seq), w.buf, []byte{flag})
+	w.seq++
+	w.buf = w.buf[:0]
+	_, err := w.WriteCloser.Write(w.frame)
+	return err
+}
+
+// Flush writes the frame of the writes so far, and flushes the destination.
+func (w *encryptWriter) Flush(ctx context.Context) error {
+	if err := w.writeFrame(encryptFrameFlagNext); err != nil {
+		return err
+	}
+	if f, ok := w.WriteCloser.(flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+func (w *encryptWriter) Close() error {
+	err := w.writeFrame(encryptFrameFlagFinal)
+	if cerr := w.WriteCloser.Close(); cerr != nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *encryptWriter) String() string {
+	return fmt.Sprint(w.WriteCloser)
+}
+
+func (w *encryptWriter) Stats() DestinationStats {
+	if r, ok := w.WriteCloser.(statsReporter); ok {
+		return r.Stats()
+	}
+	return DestinationStats{Name: w.String()}
+}
+
+func (w *encryptWriter) results() []DestinationResult {
+	if r, ok := w.WriteCloser.(resultReporter); ok {
+		return r.results()
+	}
+	return []DestinationResult{{Name: w.String()}}
+}
+
+// isEncrypted reports whether the object is encrypted by awstee, by the magic line.
+func isEncrypted(br *bufio.Reader) bool {
+	magic, err := br.Peek(len(encryptMagic))
+	return err == nil && string(magic) == encryptMagic
+}
+
+// decryptReader reads the plaintext of an object encrypted by awstee.
+type decryptReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	seq   uint64
+	buf   []byte
+	frame []byte
+	nonce []byte
+	final bool
+}
+
+// newDecryptReader decrypts the data key of the object br by KMS, br must be encrypted.
+func newDecryptReader(ctx context.Context, client kmsDataKeyAPI, br *bufio.Reader) (*decryptReader, error) {
+	if client == nil {
+		return nil, errors.New("decrypt requires a kms client")
+	}
+	if _, err := br.Discard(len(encryptMagic)); err != nil {
+		return nil, err
+	}
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("read encryption header: %w", err)
+	}
+	var header encryptHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, fmt.Errorf("parse encryption header: %w", err)
+	}
+	input := &kms.DecryptInput{
+		KeyId:          aws.String(header.KeyID),
+		CiphertextBlob: header.EncryptedDataKey,
+	}
+	if len(header.EncryptionContext) > 0 {
+		input.EncryptionContext = header.EncryptionContext
+	}
+	output, err := client.Decrypt(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("kms decrypt data key %s: %w", header.KeyID, err)
+	}
+	aead, err := newFrameCipher(output.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt data key: %w", err)
+	}
+	return &decryptReader{r: br, aead: aead, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.final {
+			return 0, io.EOF
+		}
+		if err := r.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *decryptReader) readFrame() error {
+	var head [5]byte
+	if _, err := io.ReadFull(r.r, head[:]); err != nil {
+		if err == io.EOF {
+			return errors.New("encrypted object is truncated, the final frame is missing")
+		}
+		return fmt.Errorf("read encrypted frame: %w", err)
+	}
+	flag := head[0]
+	if flag != encryptFrameFlagNext && flag != encryptFrameFlagFinal {
+		return fmt.Errorf("encrypted frame %d has an unknown flag %d", r.seq, flag)
+	}
+	size := binary.BigEndian.Uint32(head[1:])
+	if size < uint32(r.aead.Overhead()) || size > encryptFrameBytes+uint32(r.aead.Overhead()) {
+		return fmt.Errorf("encrypted frame %d has an invalid size %d", r.seq, size)
+	}
+	if cap(r.frame) < int(size) {
+		r.frame = make([]byte, size)
+	}
+	r.frame = r.frame[:size]
+	if _, err := io.ReadFull(r.r, r.frame); err != nil {
+		return fmt.Errorf("read encrypted frame: %w", err)
+	}
+	plain, err := r.aead.Open(r.frame[:0], frameNonce(r.nonce, r.seq), r.frame, []byte{flag})
+	if err != nil {
+		return fmt.Errorf("decrypt frame %d: %w", r.seq, err)
+	}
+	r.seq++
+	r.buf = plain
+	if flag == encryptFrameFlagFinal {
+		r.final = true
+		if _, err := r.r.Peek(1); err != io.EOF {
+			return errors.New("encrypted object has the data after the final frame")
+		}
+	}
+	return nil
+}
+
+// decryptedReader returns the plaintext of br if it is encrypted by awstee, otherwise br as is.
+func decryptedReader(ctx context.Context, client kmsDataKeyAPI, br *bufio.Reader) (io.Reader, error) {
+	if !isEncrypted(br) {
+		return br, nil
+	}
+	return newDecryptReader(ctx, client, br)
+}
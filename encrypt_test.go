@@ -0,0 +1,139 @@
+package awstee
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDataKeyKMS wraps the data keys by xor, and checks the encryption context.
+type fakeDataKeyKMS struct {
+	t       *testing.T
+	context map[string]string
+}
+
+func (k fakeDataKeyKMS) wrap(key []byte) []byte {
+	wrapped := make([]byte, len(key))
+	for i := range key {
+		wrapped[i] = key[i] ^ 0x5a
+	}
+	return wrapped
+}
+
+func (k fakeDataKeyKMS) GenerateDataKey(_ context.Context, input *kms.GenerateDataKeyInput, _ ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	require.Equal(k.t, types.DataKeySpecAes256, input.KeySpec)
+	require.Equal(k.t, k.context, input.EncryptionContext)
+	key := bytes.Repeat([]byte{0x42}, 32)
+	return &kms.GenerateDataKeyOutput{
+		KeyId:          aws.String("arn:aws:kms:ap-northeast-1:123456789012:key/" + aws.ToString(input.KeyId)),
+		Plaintext:      key,
+		CiphertextBlob: k.wrap(key),
+	}, nil
+}
+
+func (k fakeDataKeyKMS) Decrypt(_ context.Context, input *kms.DecryptInput, _ ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	require.Equal(k.t, k.context, input.EncryptionContext)
+	return &kms.DecryptOutput{Plaintext: k.wrap(input.CiphertextBlob)}, nil
+}
+
+func TestEncryptWriter(t *testing.T) {
+	client := fakeDataKeyKMS{t: t, context: map[string]string{"team": "a"}}
+	cfg := &EncryptConfig{KMSKeyID: "hoge", EncryptionContext: map[string]string{"team": "a"}}
+	require.NoError(t, cfg.Restrict())
+	key, err := generateDataKey(context.Background(), client, cfg)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := newEncryptWriter(newTestWriteCloser(&buf, func() error { return nil }), key)
+	input := strings.Repeat("hoge fuga piyo\n", 10000)
+	_, err = io.WriteString(w, input[:1000])
+	require.NoError(t, err)
+	require.NoError(t, w.Flush(context.Background()))
+	_, err = io.WriteString(w, input[1000:])
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	encrypted := buf.Bytes()
+	require.True(t, bytes.HasPrefix(encrypted, []byte(encryptMagic)))
+	require.NotContains(t, string(encrypted), "fuga piyo")
+
+	decrypt := func(b []byte) (string, error) {
+		r, err := decryptedReader(context.Background(), client, bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			return "", err
+		}
+		plain, err := io.ReadAll(r)
+		return string(plain), err
+	}
+	plain, err := decrypt(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, input, plain)
+
+	_, err = decrypt(encrypted[:len(encrypted)-100])
+	require.Error(t, err, "truncated in the final frame")
+	headerEnd := bytes.IndexByte(encrypted[len(encryptMagic):], '\n') + len(encryptMagic) + 1
+	_, err = decrypt(encrypted[:headerEnd+5+1000+16])
+	require.EqualError(t, err, "encrypted object is truncated, the final frame is missing")
+	tampered := bytes.Clone(encrypted)
+	tampered[headerEnd+10] ^= 1
+	_, err = decrypt(tampered)
+	require.ErrorContains(t, err, "decrypt frame 0")
+
+	plain, err = decrypt([]byte("hoge\n"))
+	require.NoError(t, err)
+	require.Equal(t, "hoge\n", plain, "not encrypted")
+
+	cfg = &EncryptConfig{EncryptionContext: map[string]string{"team": "a"}}
+	require.EqualError(t, cfg.Restrict(), "encrypt encryption_context requires kms_key_id")
+}
+
+func TestWriterEncryptS3(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s3Client := NewMockS3Client(ctrl)
+	var object bytes.Buffer
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&s3.HeadObjectOutput{}, &smithy.GenericAPIError{Code: "NotFound"},
+	).Times(1)
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			io.Copy(&object, input.Body)
+			return &s3.PutObjectOutput{}, nil
+		},
+	).Times(1)
+	s3Client.EXPECT().GetObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(object.Bytes()))}, nil
+		},
+	).Times(1)
+	cfg := &Config{
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+			Encrypt:   EncryptConfig{KMSKeyID: "alias/awstee"},
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{S3: s3Client})
+	require.NoError(t, err)
+	app.kms = fakeDataKeyKMS{t: t}
+	w, err := app.Writer(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\nfuga\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.True(t, bytes.HasPrefix(object.Bytes(), []byte(encryptMagic)))
+	require.NotContains(t, object.String(), "hoge")
+
+	var buf bytes.Buffer
+	require.NoError(t, app.Cat(context.Background(), "hoge.log", &buf))
+	require.Equal(t, "hoge\nfuga\n", buf.String())
+}
@@ -0,0 +1,74 @@
+package awstee
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+)
+
+const (
+	// DeliveryStrict fails the writes when all destinations are degraded.
+	DeliveryStrict = "strict"
+	// DeliveryBestEffort never fails the writes by the destinations, so that the standard output is not affected by AWS.
+	DeliveryBestEffort = "best_effort"
+)
+
+// fanoutWriter writes to all destinations, unlike io.MultiWriter not stopping at the first failure.
+// A destination failing a write is degraded: it is not written any more, and the writes go on to the healthy ones.
+// The writes fail only when all destinations are degraded, or never with bestEffort. Write is not safe for concurrent use, AWSTeeWriter serializes it.
+type fanoutWriter struct {
+	writers    []io.Writer
+	degraded   []atomic.Pointer[DestinationError]
+	bestEffort bool
+	logger     *slog.Logger
+}
+
+func newFanoutWriter(logger *slog.Logger, writers []io.Writer) *fanoutWriter {
+	return &fanoutWriter{
+		writers:  writers,
+		degraded: make([]atomic.Pointer[DestinationError], len(writers)),
+		logger:   logger,
+	}
+}
+
+func (f *fanoutWriter) Write(p []byte) (int, error) {
+	healthy := 0
+	for i, w := range f.writers {
+		if f.degraded[i].Load() != nil {
+			continue
+		}
+		n, err := w.Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			name := fmt.Sprint(w)
+			f.degraded[i].Store(&DestinationError{Destination: name, Err: err})
+			f.logger.Error("destination is degraded, the capture goes on without it", "destination", name, "error", err)
+			continue
+		}
+		healthy++
+	}
+	if healthy == 0 && !f.bestEffort {
+		return 0, f.err()
+	}
+	return len(p), nil
+}
+
+// err returns the errors of the degraded destinations.
+func (f *fanoutWriter) err() error {
+	var errs []error
+	for i := range f.degraded {
+		if err := f.degraded[i].Load(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isDegraded reports whether the i-th destination is degraded.
+func (f *fanoutWriter) isDegraded(i int) bool {
+	return f.degraded[i].Load() != nil
+}
@@ -0,0 +1,85 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	w.n--
+	return len(p), nil
+}
+
+func TestAWSTeeReaderErrorIsolation(t *testing.T) {
+	cfg := &Config{}
+	require.NoError(t, cfg.Restrict())
+	var healthy bytes.Buffer
+	app, err := NewWithClient(cfg, AWSClient{},
+		WithDestination("broken", func(context.Context, string) (io.WriteCloser, error) {
+			return newTestWriteCloser(&failingWriter{n: 1}, func() error { return nil }), nil
+		}),
+		WithDestination("healthy", func(context.Context, string) (io.WriteCloser, error) {
+			return newTestWriteCloser(&healthy, func() error { return nil }), nil
+		}),
+	)
+	require.NoError(t, err)
+	input := strings.Repeat("hoge\n", 10000)
+	r, err := app.TeeReader(context.Background(), iotest.OneByteReader(strings.NewReader(input)), "hoge.log")
+	require.NoError(t, err)
+	var stdout bytes.Buffer
+	_, err = io.Copy(&stdout, r)
+	require.NoError(t, err, "the read path is not poisoned by the broken destination")
+	require.Equal(t, input, stdout.String())
+	require.True(t, r.w.fanout.isDegraded(0))
+	require.False(t, r.w.fanout.isDegraded(1))
+
+	err = r.Close()
+	require.EqualError(t, err, "broken: connection reset", "the degraded destination is reported on close")
+	require.Equal(t, input, healthy.String())
+
+	t.Run("all degraded", func(t *testing.T) {
+		app, err := NewWithClient(cfg, AWSClient{},
+			WithDestination("broken", func(context.Context, string) (io.WriteCloser, error) {
+				return newTestWriteCloser(&failingWriter{}, func() error { return nil }), nil
+			}),
+		)
+		require.NoError(t, err)
+		w, err := app.Writer(context.Background(), "hoge.log")
+		require.NoError(t, err)
+		_, err = io.WriteString(w, "hoge\n")
+		require.EqualError(t, err, "broken: connection reset")
+		require.Error(t, w.Close())
+	})
+
+	t.Run("best effort", func(t *testing.T) {
+		cfg := &Config{Delivery: DeliveryBestEffort}
+		require.NoError(t, cfg.Restrict())
+		app, err := NewWithClient(cfg, AWSClient{},
+			WithDestination("broken", func(context.Context, string) (io.WriteCloser, error) {
+				return newTestWriteCloser(&failingWriter{}, func() error { return nil }), nil
+			}),
+		)
+		require.NoError(t, err)
+		r, err := app.TeeReader(context.Background(), iotest.OneByteReader(strings.NewReader(input)), "hoge.log")
+		require.NoError(t, err)
+		var stdout bytes.Buffer
+		_, err = io.Copy(&stdout, r)
+		require.NoError(t, err, "the failures of all destinations never surface from Read")
+		require.Equal(t, input, stdout.String())
+		require.EqualError(t, r.Close(), "broken: connection reset", "but they are returned by Close")
+	})
+}
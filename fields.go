@@ -0,0 +1,130 @@
+package awstee
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// FieldsConfig reshapes the JSON lines written to a destination by their top level fields.
+// fields selects the fields in its order, drop_fields drops the fields, and rename_fields renames the fields after them.
+// The lines not of a JSON object are written as they are.
+type FieldsConfig struct {
+	Fields       []string          `yaml:"fields,omitempty"`
+	DropFields   []string          `yaml:"drop_fields,omitempty"`
+	RenameFields map[string]string `yaml:"rename_fields,omitempty"`
+
+	drop map[string]bool
+}
+
+func (cfg *FieldsConfig) Enabled() bool {
+	return len(cfg.Fields) > 0 || len(cfg.DropFields) > 0 || len(cfg.RenameFields) > 0
+}
+
+func (cfg *FieldsConfig) Restrict() error {
+	if len(cfg.Fields) > 0 && len(cfg.DropFields) > 0 {
+		return errors.New("fields and drop_fields are exclusive")
+	}
+	for from, to := range cfg.RenameFields {
+		if from == "" || to == "" {
+			return fmt.Errorf("rename_fields must not have an empty name: %q: %q", from, to)
+		}
+	}
+	cfg.drop = make(map[string]bool, len(cfg.DropFields))
+	for _, name := range cfg.DropFields {
+		cfg.drop[name] = true
+	}
+	return nil
+}
+
+// jsonField is a top level field of a JSON object, whose value is kept as it is.
+type jsonField struct {
+	name  string
+	value json.RawMessage
+}
+
+// parseJSONObject returns the top level fields of the JSON object in line in order, or false if line is not a JSON object.
+func parseJSONObject(line []byte) ([]jsonField, bool) {
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	if _, err := dec.Token(); err != nil {
+		return nil, false
+	}
+	var fields []jsonField
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		name, ok := token.(string)
+		if !ok {
+			return nil, false
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, false
+		}
+		fields = append(fields, jsonField{name: name, value: value})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, false
+	}
+	if dec.InputOffset() != int64(len(trimmed)) {
+		// trailing data after the object
+		return nil, false
+	}
+	return fields, true
+}
+
+// appendJSONObject appends the JSON object of fields to dst.
+func appendJSONObject(dst []byte, fields []jsonField) []byte {
+	dst = append(dst, '{')
+	for i, f := range fields {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		name, _ := json.Marshal(f.name)
+		dst = append(dst, name...)
+		dst = append(dst, ':')
+		dst = append(dst, f.value...)
+	}
+	return append(dst, '}')
+}
+
+func (cfg *FieldsConfig) process(line []byte) []byte {
+	fields, ok := parseJSONObject(line)
+	if !ok {
+		return line
+	}
+	if len(cfg.Fields) > 0 {
+		selected := make([]jsonField, 0, len(cfg.Fields))
+		for _, name := range cfg.Fields {
+			for _, f := range fields {
+				if f.name == name {
+					selected = append(selected, f)
+					break
+				}
+			}
+		}
+		fields = selected
+	}
+	if len(cfg.drop) > 0 {
+		kept := fields[:0]
+		for _, f := range fields {
+			if !cfg.drop[f.name] {
+				kept = append(kept, f)
+			}
+		}
+		fields = kept
+	}
+	for i, f := range fields {
+		if to, ok := cfg.RenameFields[f.name]; ok {
+			fields[i].name = to
+		}
+	}
+	return appendJSONObject(make([]byte, 0, len(line)), fields)
+}
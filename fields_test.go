@@ -0,0 +1,56 @@
+package awstee
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFieldsConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		cfg      FieldsConfig
+		line     string
+		expected string
+	}{
+		{
+			name:     "select",
+			cfg:      FieldsConfig{Fields: []string{"time", "level", "msg"}},
+			line:     `{"msg":"hoge","level":"info","stack":["a","b"],"time":"2022-06-03T17:28:48Z","user":{"id":1}}`,
+			expected: `{"time":"2022-06-03T17:28:48Z","level":"info","msg":"hoge"}`,
+		},
+		{
+			name:     "drop and rename",
+			cfg:      FieldsConfig{DropFields: []string{"stack"}, RenameFields: map[string]string{"msg": "message"}},
+			line:     `{"msg": "hoge", "stack": ["a", "b"], "user": {"id": 1}}`,
+			expected: `{"message":"hoge","user":{"id": 1}}`,
+		},
+		{
+			name:     "escaped name",
+			cfg:      FieldsConfig{RenameFields: map[string]string{"msg": "the \"message\""}},
+			line:     `{"msg":"hoge"}`,
+			expected: `{"the \"message\"":"hoge"}`,
+		},
+		{
+			name:     "not json",
+			cfg:      FieldsConfig{Fields: []string{"msg"}},
+			line:     `INFO {"msg":"hoge"}`,
+			expected: `INFO {"msg":"hoge"}`,
+		},
+		{
+			name:     "broken json",
+			cfg:      FieldsConfig{Fields: []string{"msg"}},
+			line:     `{"msg":"hoge"} trailing`,
+			expected: `{"msg":"hoge"} trailing`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.NoError(t, c.cfg.Restrict())
+			require.Equal(t, c.expected, string(c.cfg.process([]byte(c.line))))
+		})
+	}
+
+	cfg := &FieldsConfig{Fields: []string{"msg"}, DropFields: []string{"stack"}}
+	require.EqualError(t, cfg.Restrict(), "fields and drop_fields are exclusive")
+}
@@ -0,0 +1,277 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// LinesConfig is the processing of the lines for a destination only, after the ones for all destinations such as line_prefix.
+// The standard output is never processed.
+type LinesConfig struct {
+	CSV       CSVConfig       `yaml:"csv,omitempty"`
+	Filters   FilterConfig    `yaml:"filters,omitempty"`
+	Sample    SampleConfig    `yaml:",inline"`
+	Fields    FieldsConfig    `yaml:",inline"`
+	Transform TransformConfig `yaml:",inline"`
+	// DedupRepeats collapses the runs of the same lines into the first one and a marker of the number of the repeats.
+	DedupRepeats bool          `yaml:"dedup_repeats,omitempty"`
+	Capture      CaptureConfig `yaml:"capture,omitempty"`
+	// Binary is the policy of the binary lines, such as of a NUL: base64, marker or raw. They are written as they are without it.
+	Binary string `yaml:"binary,omitempty"`
+}
+
+func (cfg *LinesConfig) Enabled() bool {
+	return len(cfg.settings()) > 0
+}
+
+// settings returns the names of the settings enabled, for the errors.
+func (cfg *LinesConfig) settings() []string {
+	var names []string
+	if cfg.Binary != "" {
+		names = append(names, "binary")
+	}
+	if cfg.CSV.Enabled() {
+		names = append(names, "csv")
+	}
+	if cfg.Filters.Enabled() {
+		names = append(names, "filters")
+	}
+	if cfg.Sample.Enabled() {
+		names = append(names, "sample_rate")
+	}
+	if cfg.Fields.Enabled() {
+		names = append(names, "fields")
+	}
+	if cfg.Transform.Enabled() {
+		names = append(names, "transform")
+	}
+	if cfg.DedupRepeats {
+		names = append(names, "dedup_repeats")
+	}
+	if cfg.Capture.Enabled() {
+		names = append(names, "capture")
+	}
+	return names
+}
+
+func (cfg *LinesConfig) Restrict() error {
+	if err := restrictBinary(cfg.Binary); err != nil {
+		return err
+	}
+	if err := cfg.CSV.Restrict(); err != nil {
+		return err
+	}
+	if err := cfg.Filters.Restrict(); err != nil {
+		return err
+	}
+	if err := cfg.Sample.Restrict(); err != nil {
+		return err
+	}
+	if err := cfg.Fields.Restrict(); err != nil {
+		return err
+	}
+	if err := cfg.Transform.Restrict(); err != nil {
+		return err
+	}
+	if err := cfg.Capture.Restrict(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// processors returns the line processors of the destination in order, and the finish of them returning the lines written by Close, or nil.
+// The binary lines are encoded or replaced first, or with binary: raw all the processors are skipped from the first one.
+// The delimited lines are converted to JSON next. The filters and the sampler select the lines by the whole of them, before the fields are reshaped and the transform rewrites them.
+// The repeats are collapsed by the lines as written, and the capture keeps the head and the tail of them.
+func (cfg *LinesConfig) processors(meta *runMetadata) ([]lineProcessor, func() []byte) {
+	processors := make([]lineProcessor, 0)
+	if cfg.Binary == BinaryBase64 || cfg.Binary == BinaryMarker {
+		processors = append(processors, binaryProcessor(cfg.Binary))
+	}
+	if cfg.CSV.Enabled() {
+		processors = append(processors, cfg.CSV.processor())
+	}
+	if cfg.Filters.Enabled() {
+		processors = append(processors, cfg.Filters.process)
+	}
+	if cfg.Sample.Enabled() {
+		processors = append(processors, cfg.Sample.processor(newSampleRandom()))
+	}
+	if cfg.Fields.Enabled() {
+		processors = append(processors, cfg.Fields.process)
+	}
+	if cfg.Transform.Enabled() {
+		processors = append(processors, cfg.Transform.processor(meta))
+	}
+	var finishers []lineFinisher
+	if cfg.DedupRepeats {
+		c := &repeatCollapser{}
+		processors = append(processors, c.process)
+		finishers = append(finishers, lineFinisher{stage: len(processors) - 1, finish: c.finish})
+	}
+	if cfg.Capture.Enabled() {
+		c := cfg.Capture.newCapturer()
+		processors = append(processors, c.process)
+		finishers = append(finishers, lineFinisher{stage: len(processors) - 1, finish: c.finish})
+	}
+	finish := finishLines(processors, finishers)
+	if cfg.Binary == BinaryRaw {
+		// the lines held by the finishers are the ones before the switch
+		processors = []lineProcessor{binaryRawProcessor(processors)}
+	}
+	return processors, finish
+}
+
+// lineFinisher is the finish of the processor of stage holding the lines, which returns them with their newlines.
+type lineFinisher struct {
+	stage  int
+	finish func() []byte
+}
+
+// finishLines returns the finish of the processors, or nil without the finishers.
+// The lines returned by a finisher are passed through the processors after its stage, before the next finisher.
+func finishLines(processors []lineProcessor, finishers []lineFinisher) func() []byte {
+	if len(finishers) == 0 {
+		return nil
+	}
+	return func() []byte {
+		var out []byte
+		for _, f := range finishers {
+			lw := newLineWriter(nil, processors[f.stage+1:])
+			lines := f.finish()
+			for len(lines) > 0 {
+				i := bytes.IndexByte(lines, '\n')
+				if i < 0 {
+					i = len(lines)
+				}
+				if line := lw.process(lines[:i]); line != nil {
+					out = append(out, line...)
+					out = append(out, '\n')
+				}
+				lines = lines[min(i+1, len(lines)):]
+			}
+		}
+		return out
+	}
+}
+
+// FilterConfig selects the lines written to a destination by regular expressions.
+// A line is written if it matches any of include, or include is empty, and none of exclude.
+type FilterConfig struct {
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func (cfg *FilterConfig) Enabled() bool {
+	return len(cfg.Include) > 0 || len(cfg.Exclude) > 0
+}
+
+func (cfg *FilterConfig) Restrict() error {
+	compile := func(name string, exprs []string) ([]*regexp.Regexp, error) {
+		res := make([]*regexp.Regexp, 0, len(exprs))
+		for _, expr := range exprs {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("filters %s %s is invalid: %w", name, expr, err)
+			}
+			res = append(res, re)
+		}
+		return res, nil
+	}
+	var err error
+	if cfg.include, err = compile("include", cfg.Include); err != nil {
+		return err
+	}
+	if cfg.exclude, err = compile("exclude", cfg.Exclude); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (cfg *FilterConfig) process(line []byte) []byte {
+	if len(cfg.include) > 0 && !matchAny(cfg.include, line) {
+		return nil
+	}
+	if matchAny(cfg.exclude, line) {
+		return nil
+	}
+	return line
+}
+
+func matchAny(res []*regexp.Regexp, line []byte) bool {
+	for _, re := range res {
+		if re.Match(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// lineDestination processes the lines written to a destination by the processors of it.
+// The last partial line is written by Close, Flush keeps it not to split the line.
+type lineDestination struct {
+	io.WriteCloser
+	lw *lineWriter
+	// finish returns the lines held by the processors, written by Close after the last line
+	finish func() []byte
+}
+
+// newLineDestination wraps w by the processors and their finish, or returns w as is without them. finish may be nil.
+func newLineDestination(w io.WriteCloser, processors []lineProcessor, finish func() []byte) io.WriteCloser {
+	if len(processors) == 0 {
+		return w
+	}
+	return &lineDestination{
+		WriteCloser: w,
+		lw:          newLineWriter(w, processors),
+		finish:      finish,
+	}
+}
+
+func (w *lineDestination) Write(p []byte) (int, error) {
+	return w.lw.Write(p)
+}
+
+func (w *lineDestination) Flush(ctx context.Context) error {
+	if f, ok := w.WriteCloser.(flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+func (w *lineDestination) Close() error {
+	err := w.lw.Flush()
+	if w.finish != nil && err == nil {
+		if lines := w.finish(); lines != nil {
+			_, err = w.WriteCloser.Write(lines)
+		}
+	}
+	if cerr := w.WriteCloser.Close(); cerr != nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *lineDestination) String() string {
+	return fmt.Sprint(w.WriteCloser)
+}
+
+func (w *lineDestination) Stats() DestinationStats {
+	if r, ok := w.WriteCloser.(statsReporter); ok {
+		return r.Stats()
+	}
+	return DestinationStats{Name: w.String()}
+}
+
+func (w *lineDestination) results() []DestinationResult {
+	if r, ok := w.WriteCloser.(resultReporter); ok {
+		return r.results()
+	}
+	return []DestinationResult{{Name: w.String()}}
+}
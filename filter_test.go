@@ -0,0 +1,45 @@
+package awstee
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterConfig(t *testing.T) {
+	cfg := &FilterConfig{
+		Include: []string{"WARN", "ERROR"},
+		Exclude: []string{"healthcheck"},
+	}
+	require.NoError(t, cfg.Restrict())
+	var buf bytes.Buffer
+	w := newLineDestination(newTestWriteCloser(&buf, func() error { return nil }), []lineProcessor{cfg.process}, nil)
+	_, err := io.WriteString(w, "INFO started\nWARN slow\nERROR healthcheck failed\nERR")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "OR broken")
+	require.NoError(t, err)
+	require.Equal(t, "WARN slow\n", buf.String())
+	require.NoError(t, w.Close())
+	require.Equal(t, "WARN slow\nERROR broken", buf.String(), "the last partial line is filtered by Close")
+
+	cfg = &FilterConfig{Exclude: []string{"^DEBUG"}}
+	require.NoError(t, cfg.Restrict())
+	require.Nil(t, cfg.process([]byte("DEBUG hoge")))
+	require.Equal(t, []byte("INFO hoge"), cfg.process([]byte("INFO hoge")), "all lines without include")
+}
+
+func TestConfigFiltersRaw(t *testing.T) {
+	cfg := &Config{
+		Raw: true,
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+			Lines: LinesConfig{
+				Filters: FilterConfig{Include: []string{"ERROR"}},
+				Fields:  FieldsConfig{Fields: []string{"msg"}},
+			},
+		},
+	}
+	require.EqualError(t, cfg.Restrict(), "raw can not be used with filters, fields of s3 s3://awstee-example-com/logs/, which select or rewrite the lines")
+}
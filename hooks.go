@@ -0,0 +1,66 @@
+package awstee
+
+import (
+	"log/slog"
+	"time"
+)
+
+// MetricsHook is notified of the throughput of the destinations, to wire it into the metrics of the application.
+// dest is the destination such as s3://bucket/key. The methods are called from the goroutines of the destinations,
+// so they must be safe for concurrent use and must not block.
+type MetricsHook interface {
+	// OnBytesWritten is called when n bytes are written to dest.
+	OnBytesWritten(dest string, n int)
+	// OnBatchSent is called when a batch of events is put to cloudwatch logs,
+	// or an object upload to s3 is completed (events is 1 and latency is from the start of the upload).
+	OnBatchSent(dest string, events int, latency time.Duration)
+	// OnError is called when a write or a batch of dest fails.
+	OnError(dest string)
+}
+
+// destinationHooks notifies the events of the destinations to the handlers set by the options.
+// The nil destinationHooks notifies nothing.
+type destinationHooks struct {
+	logger       *slog.Logger
+	errorHandler func(dest string, err error)
+	metrics      MetricsHook
+	tracer       Tracer
+}
+
+func (app *AWSTee) destinationHooks() *destinationHooks {
+	return &destinationHooks{
+		logger:       app.logger,
+		errorHandler: app.errorHandler,
+		metrics:      app.metrics,
+		tracer:       app.tracer,
+	}
+}
+
+func (h *destinationHooks) onBytesWritten(dest string, n int) {
+	if h == nil || h.metrics == nil || n == 0 {
+		return
+	}
+	h.metrics.OnBytesWritten(dest, n)
+}
+
+func (h *destinationHooks) onBatchSent(dest string, events int, latency time.Duration) {
+	if h == nil || h.metrics == nil {
+		return
+	}
+	h.metrics.OnBatchSent(dest, events, latency)
+}
+
+// onError notifies the error to the handler of WithErrorHandler, or logs it.
+func (h *destinationHooks) onError(dest string, err error) {
+	if h == nil {
+		return
+	}
+	if h.metrics != nil {
+		h.metrics.OnError(dest)
+	}
+	if h.errorHandler != nil {
+		h.errorHandler(dest, err)
+		return
+	}
+	h.logger.Error("destination error", "destination", dest, "error", err)
+}
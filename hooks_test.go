@@ -0,0 +1,98 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+type testMetricsHook struct {
+	mu      sync.Mutex
+	bytes   map[string]int
+	batches map[string][]int
+	errors  map[string]int
+}
+
+func newTestMetricsHook() *testMetricsHook {
+	return &testMetricsHook{
+		bytes:   make(map[string]int),
+		batches: make(map[string][]int),
+		errors:  make(map[string]int),
+	}
+}
+
+func (h *testMetricsHook) OnBytesWritten(dest string, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bytes[dest] += n
+}
+
+func (h *testMetricsHook) OnBatchSent(dest string, events int, _ time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.batches[dest] = append(h.batches[dest], events)
+}
+
+func (h *testMetricsHook) OnError(dest string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.errors[dest]++
+}
+
+func TestMetricsHook(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("hoge")}},
+		}, nil,
+	).Times(1)
+	gomock.InOrder(
+		cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			&cloudwatchlogs.PutLogEventsOutput{}, nil,
+		).Times(1),
+		cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			nil, errors.New("throttled"),
+		).Times(1),
+	)
+	cfg := &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/logs",
+		FlushInterval: "1h",
+	}
+	require.NoError(t, cfg.Restrict())
+	hook := newTestMetricsHook()
+	hooks := &destinationHooks{
+		logger:       slog.Default(),
+		errorHandler: func(string, error) {},
+		metrics:      hook,
+	}
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), cloudwatchLogsClient, cfg, "hoge.log", time.Now, hooks)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\nfuga\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return w.Stats().Buffered == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, w.Flush(context.Background()))
+	_, err = io.WriteString(w, "piyo\n")
+	require.NoError(t, err)
+	require.Error(t, w.Close())
+
+	dest := "LogGroup=/awstee/logs, LogStream=hoge"
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	require.EqualValues(t, 16, hook.bytes[dest], "including the newline written by Close")
+	require.EqualValues(t, []int{2}, hook.batches[dest])
+	require.EqualValues(t, 1, hook.errors[dest])
+}
@@ -0,0 +1,112 @@
+package awstee
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// HTTPConfig is the http client of the aws api calls, e.g. for a corporate proxy or a test endpoint with a self-signed certificate.
+// Without proxy, the proxy of the environment variables HTTPS_PROXY and NO_PROXY is used.
+type HTTPConfig struct {
+	Proxy              string `yaml:"proxy,omitempty"`
+	CABundle           string `yaml:"ca_bundle,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+	ConnectTimeout     string `yaml:"connect_timeout,omitempty"`
+	RequestTimeout     string `yaml:"request_timeout,omitempty"`
+
+	proxyURL       *url.URL
+	connectTimeout time.Duration
+	requestTimeout time.Duration
+}
+
+func (cfg *HTTPConfig) Enabled() bool {
+	return cfg != nil && (cfg.Proxy != "" || cfg.CABundle != "" || cfg.InsecureSkipVerify || cfg.ConnectTimeout != "" || cfg.RequestTimeout != "")
+}
+
+func (cfg *HTTPConfig) Restrict() error {
+	cfg.proxyURL = nil
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return fmt.Errorf("http proxy is invalid format: %w", err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("http proxy must be a url such as http://proxy.example.com:8080")
+		}
+		cfg.proxyURL = u
+	}
+	var err error
+	if cfg.connectTimeout, err = parseOptionalDuration(cfg.ConnectTimeout); err != nil {
+		return fmt.Errorf("http connect_timeout is invalid format: %w", err)
+	}
+	if cfg.requestTimeout, err = parseOptionalDuration(cfg.RequestTimeout); err != nil {
+		return fmt.Errorf("http request_timeout is invalid format: %w", err)
+	}
+	return nil
+}
+
+func (cfg *HTTPConfig) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Proxy, "http-proxy", cfg.Proxy, "proxy url of the aws api calls (default: HTTPS_PROXY)")
+	f.StringVar(&cfg.CABundle, "ca-bundle", cfg.CABundle, "PEM file of the additional CA certificates of the aws api calls")
+}
+
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s must not be negative", s)
+	}
+	return d, nil
+}
+
+// newClient returns the http client of the config. The request timeout covers each request, such as a part of an s3 upload.
+func (cfg *HTTPConfig) newClient() (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.proxyURL != nil {
+		tr.Proxy = http.ProxyURL(cfg.proxyURL)
+	}
+	if cfg.connectTimeout > 0 {
+		tr.DialContext = (&net.Dialer{
+			Timeout:   cfg.connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		tr.TLSHandshakeTimeout = cfg.connectTimeout
+	}
+	if cfg.CABundle != "" || cfg.InsecureSkipVerify {
+		tlsCfg := &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+		}
+		if cfg.CABundle != "" {
+			pem, err := os.ReadFile(cfg.CABundle)
+			if err != nil {
+				return nil, fmt.Errorf("read ca_bundle: %w", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("ca_bundle %s has no PEM certificate", cfg.CABundle)
+			}
+			tlsCfg.RootCAs = pool
+		}
+		tr.TLSClientConfig = tlsCfg
+	}
+	return &http.Client{
+		Transport: tr,
+		Timeout:   cfg.requestTimeout,
+	}, nil
+}
@@ -0,0 +1,77 @@
+package awstee
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPConfigRestrict(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  HTTPConfig
+		err  string
+	}{
+		{name: "empty"},
+		{name: "valid", cfg: HTTPConfig{Proxy: "http://proxy.example.com:8080", ConnectTimeout: "5s", RequestTimeout: "1m"}},
+		{name: "proxy without scheme", cfg: HTTPConfig{Proxy: "proxy.example.com:8080"}, err: "http proxy must be a url such as http://proxy.example.com:8080"},
+		{name: "invalid timeout", cfg: HTTPConfig{ConnectTimeout: "5"}, err: `http connect_timeout is invalid format: time: missing unit in duration "5"`},
+		{name: "negative timeout", cfg: HTTPConfig{RequestTimeout: "-1s"}, err: "http request_timeout is invalid format: -1s must not be negative"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.cfg.Restrict()
+			if c.err != "" {
+				require.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestHTTPConfigNewClient(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: srv.Certificate().Raw,
+	}), 0600))
+
+	get := func(cfg *HTTPConfig) error {
+		require.NoError(t, cfg.Restrict())
+		client, err := cfg.newClient()
+		require.NoError(t, err)
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	require.Error(t, get(&HTTPConfig{RequestTimeout: "10s"}), "the certificate of the test server is not trusted")
+	require.NoError(t, get(&HTTPConfig{CABundle: caBundle}))
+	require.NoError(t, get(&HTTPConfig{InsecureSkipVerify: true}))
+
+	cfg := &HTTPConfig{Proxy: "http://proxy.example.com:8080", RequestTimeout: "10s"}
+	require.NoError(t, cfg.Restrict())
+	client, err := cfg.newClient()
+	require.NoError(t, err)
+	require.EqualValues(t, 10*time.Second, client.Timeout)
+	req, err := http.NewRequest(http.MethodGet, "https://s3.amazonaws.com/", nil)
+	require.NoError(t, err)
+	proxyURL, err := client.Transport.(*http.Transport).Proxy(req)
+	require.NoError(t, err)
+	require.EqualValues(t, "http://proxy.example.com:8080", proxyURL.String())
+
+	_, err = (&HTTPConfig{CABundle: filepath.Join(t.TempDir(), "notfound.pem")}).newClient()
+	require.Error(t, err)
+}
@@ -0,0 +1,160 @@
+package awstee
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// IAMPolicy is an IAM policy document.
+type IAMPolicy struct {
+	Version   string          `json:"Version"`
+	Statement []*IAMStatement `json:"Statement"`
+}
+
+// IAMStatement is a statement of IAMPolicy.
+type IAMStatement struct {
+	Sid      string   `json:"Sid"`
+	Effect   string   `json:"Effect"`
+	Action   []string `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+// IAMPolicy returns the minimal IAM policy to write to the destinations of the config, including the ones of routes.
+// The statements of a destination with assume_role_arn are for the role, and sts:AssumeRole is for the default credentials.
+// Restrict must be called before.
+func (cfg *Config) IAMPolicy() *IAMPolicy {
+	partition := awsPartition(cfg.AWSRegion)
+	region := cfg.AWSRegion
+	if region == "" {
+		region = "*"
+	}
+	policy := &IAMPolicy{Version: "2012-10-17"}
+	var roles []string
+	for i, s3Cfg := range cfg.allS3Configs() {
+		bucket, prefix := s3Cfg.urlPrefix.Host, strings.TrimLeft(s3Cfg.urlPrefix.Path, "/")
+		actions := []string{"s3:PutObject", "s3:AbortMultipartUpload"}
+		if !s3Cfg.AllowOverwrite {
+			// HeadObject to check the object does not exist
+			actions = append(actions, "s3:GetObject")
+		}
+		if cfg.Lock {
+			actions = append(actions, "s3:GetObject", "s3:DeleteObject")
+		}
+		if cfg.Manifest && i == 0 {
+			// GetObject for the manifest of the output name
+			actions = append(actions, "s3:GetObject")
+		}
+		policy.Statement = append(policy.Statement, &IAMStatement{
+			Sid:      fmt.Sprintf("S3Write%d", i+1),
+			Effect:   "Allow",
+			Action:   lo.Uniq(actions),
+			Resource: []string{fmt.Sprintf("arn:%s:s3:::%s/%s*", partition, bucket, prefix)},
+		})
+		if !s3Cfg.AllowOverwrite || (cfg.Manifest && i == 0) {
+			// HeadObject and GetObject return 404 instead of 403 for a missing object only with s3:ListBucket
+			policy.Statement = append(policy.Statement, &IAMStatement{
+				Sid:      fmt.Sprintf("S3List%d", i+1),
+				Effect:   "Allow",
+				Action:   []string{"s3:ListBucket"},
+				Resource: []string{fmt.Sprintf("arn:%s:s3:::%s", partition, bucket)},
+			})
+		}
+		if s3Cfg.Encrypt.Enabled() {
+			policy.Statement = append(policy.Statement, &IAMStatement{
+				Sid:      fmt.Sprintf("KMSGenerateDataKey%d", i+1),
+				Effect:   "Allow",
+				Action:   []string{"kms:GenerateDataKey"},
+				Resource: []string{kmsKeyResource(partition, region, s3Cfg.Encrypt.KMSKeyID)},
+			})
+		}
+		if s3Cfg.Credentials.AssumeRoleARN != "" {
+			roles = append(roles, s3Cfg.Credentials.AssumeRoleARN)
+		}
+	}
+	for i, cwCfg := range cfg.allCloudwatchConfigs() {
+		actions := []string{"logs:DescribeLogStreams", "logs:CreateLogStream", "logs:PutLogEvents"}
+		if cwCfg.CreateLogGroup {
+			actions = append(actions, "logs:CreateLogGroup")
+		}
+		if cwCfg.Dedup {
+			actions = append(actions, "logs:GetLogEvents")
+		}
+		logGroup := fmt.Sprintf("arn:%s:logs:%s:*:log-group:%s", partition, region, cwCfg.LogGroup)
+		policy.Statement = append(policy.Statement, &IAMStatement{
+			Sid:      fmt.Sprintf("CloudwatchLogsWrite%d", i+1),
+			Effect:   "Allow",
+			Action:   actions,
+			Resource: []string{logGroup, logGroup + ":*"},
+		})
+		if cwCfg.Credentials.AssumeRoleARN != "" {
+			roles = append(roles, cwCfg.Credentials.AssumeRoleARN)
+		}
+	}
+	if cfg.SelfMetrics.Enabled() {
+		// PutMetricData has no resource, the namespace is of the condition
+		policy.Statement = append(policy.Statement, &IAMStatement{
+			Sid:      "CloudwatchPutSelfMetrics",
+			Effect:   "Allow",
+			Action:   []string{"cloudwatch:PutMetricData"},
+			Resource: []string{"*"},
+		})
+	}
+	if cfg.Notify.SNSTopicARN != "" {
+		policy.Statement = append(policy.Statement, &IAMStatement{
+			Sid:      "SNSPublishRunEvent",
+			Effect:   "Allow",
+			Action:   []string{"sns:Publish"},
+			Resource: []string{cfg.Notify.SNSTopicARN},
+		})
+	}
+	if cfg.Notify.EventBusName != "" {
+		eventBus := cfg.Notify.EventBusName
+		if !strings.HasPrefix(eventBus, "arn:") {
+			eventBus = fmt.Sprintf("arn:%s:events:%s:*:event-bus/%s", partition, region, eventBus)
+		}
+		policy.Statement = append(policy.Statement, &IAMStatement{
+			Sid:      "EventBridgePutRunEvent",
+			Effect:   "Allow",
+			Action:   []string{"events:PutEvents"},
+			Resource: []string{eventBus},
+		})
+	}
+	if len(roles) > 0 {
+		policy.Statement = append(policy.Statement, &IAMStatement{
+			Sid:      "AssumeDestinationRole",
+			Effect:   "Allow",
+			Action:   []string{"sts:AssumeRole"},
+			Resource: lo.Uniq(roles),
+		})
+	}
+	return policy
+}
+
+// kmsKeyResource returns the resource of the key of keyID, the keys of any ID for an alias, which is not the resource of the permissions of the key.
+func kmsKeyResource(partition, region, keyID string) string {
+	switch {
+	case strings.HasPrefix(keyID, "arn:"):
+		return keyID
+	case strings.HasPrefix(keyID, "alias/"):
+		return fmt.Sprintf("arn:%s:kms:%s:*:key/*", partition, region)
+	default:
+		return fmt.Sprintf("arn:%s:kms:%s:*:key/%s", partition, region, keyID)
+	}
+}
+
+func awsPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	case strings.HasPrefix(region, "us-isob-"):
+		return "aws-iso-b"
+	case strings.HasPrefix(region, "us-iso-"):
+		return "aws-iso"
+	default:
+		return "aws"
+	}
+}
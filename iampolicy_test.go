@@ -0,0 +1,113 @@
+package awstee
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigIAMPolicy(t *testing.T) {
+	cfg := &Config{
+		AWSRegion: "cn-north-1",
+		Lock:      true,
+		S3: &S3Config{
+			URLPrefix:      "s3://awstee-example-com/logs/",
+			AllowOverwrite: true,
+		},
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup:       "/awstee/logs",
+			CreateLogGroup: true,
+			Dedup:          true,
+			Credentials: CredentialsConfig{
+				AssumeRoleARN: "arn:aws-cn:iam::123456789012:role/awstee",
+			},
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	expected := &IAMPolicy{
+		Version: "2012-10-17",
+		Statement: []*IAMStatement{
+			{
+				Sid:      "S3Write1",
+				Effect:   "Allow",
+				Action:   []string{"s3:PutObject", "s3:AbortMultipartUpload", "s3:GetObject", "s3:DeleteObject"},
+				Resource: []string{"arn:aws-cn:s3:::awstee-example-com/logs/*"},
+			},
+			{
+				Sid:      "CloudwatchLogsWrite1",
+				Effect:   "Allow",
+				Action:   []string{"logs:DescribeLogStreams", "logs:CreateLogStream", "logs:PutLogEvents", "logs:CreateLogGroup", "logs:GetLogEvents"},
+				Resource: []string{"arn:aws-cn:logs:cn-north-1:*:log-group:/awstee/logs", "arn:aws-cn:logs:cn-north-1:*:log-group:/awstee/logs:*"},
+			},
+			{
+				Sid:      "AssumeDestinationRole",
+				Effect:   "Allow",
+				Action:   []string{"sts:AssumeRole"},
+				Resource: []string{"arn:aws-cn:iam::123456789012:role/awstee"},
+			},
+		},
+	}
+	require.EqualValues(t, expected, cfg.IAMPolicy())
+
+	cfg = &Config{
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	policy := cfg.IAMPolicy()
+	require.Len(t, policy.Statement, 2)
+	require.EqualValues(t, []string{"s3:PutObject", "s3:AbortMultipartUpload", "s3:GetObject"}, policy.Statement[0].Action)
+	require.EqualValues(t, []string{"arn:aws:s3:::awstee-example-com"}, policy.Statement[1].Resource)
+
+	cfg = &Config{
+		AWSRegion: "ap-northeast-1",
+		S3: &S3Config{
+			URLPrefix:      "s3://awstee-example-com/logs/",
+			AllowOverwrite: true,
+			Encrypt:        EncryptConfig{KMSKeyID: "1234abcd-12ab-34cd-56ef-1234567890ab"},
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	policy = cfg.IAMPolicy()
+	require.Len(t, policy.Statement, 2)
+	require.EqualValues(t, &IAMStatement{
+		Sid:      "KMSGenerateDataKey1",
+		Effect:   "Allow",
+		Action:   []string{"kms:GenerateDataKey"},
+		Resource: []string{"arn:aws:kms:ap-northeast-1:*:key/1234abcd-12ab-34cd-56ef-1234567890ab"},
+	}, policy.Statement[1])
+
+	cfg = &Config{
+		Cloudwatch:  &CloudwatchLogsConfig{LogGroup: "/awstee/logs"},
+		SelfMetrics: SelfMetricsConfig{Namespace: "awstee"},
+	}
+	require.NoError(t, cfg.Restrict())
+	policy = cfg.IAMPolicy()
+	require.Len(t, policy.Statement, 2)
+	require.EqualValues(t, []string{"cloudwatch:PutMetricData"}, policy.Statement[1].Action)
+
+	cfg = &Config{
+		AWSRegion:  "ap-northeast-1",
+		Cloudwatch: &CloudwatchLogsConfig{LogGroup: "/awstee/logs"},
+		Notify: NotifyConfig{
+			SNSTopicARN:  "arn:aws:sns:ap-northeast-1:123456789012:awstee",
+			EventBusName: "default",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	policy = cfg.IAMPolicy()
+	require.Len(t, policy.Statement, 3)
+	require.EqualValues(t, &IAMStatement{
+		Sid:      "SNSPublishRunEvent",
+		Effect:   "Allow",
+		Action:   []string{"sns:Publish"},
+		Resource: []string{"arn:aws:sns:ap-northeast-1:123456789012:awstee"},
+	}, policy.Statement[1])
+	require.EqualValues(t, &IAMStatement{
+		Sid:      "EventBridgePutRunEvent",
+		Effect:   "Allow",
+		Action:   []string{"events:PutEvents"},
+		Resource: []string{"arn:aws:events:ap-northeast-1:*:event-bus/default"},
+	}, policy.Statement[2])
+}
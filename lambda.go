@@ -0,0 +1,49 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// DefaultLambdaOutputName is the default template of the output name of an invocation of Lambda, when output_name is not set.
+const DefaultLambdaOutputName = `{{ .Lambda.FunctionName }}/{{ .Now.Format "2006/01/02" }}/{{ .Lambda.RequestID }}.log`
+
+// LambdaContext is the context of an invocation of a Lambda function, passed to the output_name template as .Lambda.
+type LambdaContext struct {
+	FunctionName    string
+	FunctionVersion string
+	LogStreamName   string
+	RequestID       string
+}
+
+// NewLambdaContext returns the LambdaContext of the invocation of requestID, with the function of the environment variables of Lambda.
+// The function is empty out of the execution environment of Lambda.
+func NewLambdaContext(requestID string) LambdaContext {
+	return LambdaContext{
+		FunctionName:    os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
+		FunctionVersion: os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
+		LogStreamName:   os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME"),
+		RequestID:       requestID,
+	}
+}
+
+// GenerateLambdaOutputName returns the output name of the invocation of lc by the output_name template, or by DefaultLambdaOutputName if it is not set.
+// Restrict must be called before.
+func (cfg *Config) GenerateLambdaOutputName(lc LambdaContext) (string, error) {
+	if cfg.lambdaOutputName == nil {
+		return "", errors.New("output_name is not restricted")
+	}
+	return executeOutputName(cfg.lambdaOutputName, lc)
+}
+
+// LambdaWriter returns an AWSTeeWriter for the invocation of lc, whose output name is of GenerateLambdaOutputName,
+// for a function writing its output directly. Close it before the handler returns, not to leave the uploads to the frozen execution environment.
+func (app *AWSTee) LambdaWriter(ctx context.Context, lc LambdaContext, opts ...Option) (*AWSTeeWriter, error) {
+	outputName, err := app.cfg.GenerateLambdaOutputName(lc)
+	if err != nil {
+		return nil, fmt.Errorf("generate output name: %w", err)
+	}
+	return app.Writer(ctx, outputName, opts...)
+}
@@ -0,0 +1,281 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateLambdaOutputName(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-function")
+	t.Setenv("AWS_LAMBDA_FUNCTION_VERSION", "$LATEST")
+	cfg := &Config{}
+	require.NoError(t, cfg.Restrict())
+	outputName, err := cfg.GenerateLambdaOutputName(NewLambdaContext("8476a536-e9f4-11e8-9739-2dfe598c3fcd"))
+	require.NoError(t, err)
+	require.Equal(t, "my-function/"+time.Now().Format("2006/01/02")+"/8476a536-e9f4-11e8-9739-2dfe598c3fcd.log", outputName)
+
+	cfg = &Config{OutputName: "lambda/{{ .Lambda.FunctionName }}/{{ .Lambda.FunctionVersion }}/{{ .Lambda.RequestID }}.log"}
+	require.NoError(t, cfg.Restrict())
+	outputName, err = cfg.GenerateLambdaOutputName(NewLambdaContext("8476a536-e9f4-11e8-9739-2dfe598c3fcd"))
+	require.NoError(t, err)
+	require.Equal(t, "lambda/my-function/$LATEST/8476a536-e9f4-11e8-9739-2dfe598c3fcd.log", outputName)
+	outputName, err = cfg.GenerateOutputName()
+	require.NoError(t, err)
+	require.Equal(t, "lambda/my-function/$LATEST/.log", outputName, "the function out of the invocations")
+}
+
+// fakeLambdaRuntimeAPI is the Extensions API and the Telemetry API, sending the telemetry of each invocation of requestIDs.
+type fakeLambdaRuntimeAPI struct {
+	t          *testing.T
+	requestIDs []string
+	telemetry  func(requestID string) []map[string]any
+	posted     func(requestID string)
+	mu         sync.Mutex
+	uri        string
+	nexts      int
+}
+
+func (f *fakeLambdaRuntimeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/2020-01-01/extension/register":
+		require.Equal(f.t, LambdaExtensionName, r.Header.Get("Lambda-Extension-Name"))
+		w.Header().Set("Lambda-Extension-Identifier", "ext-1")
+		fmt.Fprint(w, `{"functionName":"my-function"}`)
+	case "/2022-07-01/telemetry":
+		require.Equal(f.t, "ext-1", r.Header.Get("Lambda-Extension-Identifier"))
+		var body struct {
+			Destination struct {
+				URI string `json:"URI"`
+			} `json:"destination"`
+		}
+		require.NoError(f.t, json.NewDecoder(r.Body).Decode(&body))
+		f.mu.Lock()
+		f.uri = body.Destination.URI
+		f.mu.Unlock()
+		fmt.Fprint(w, "OK")
+	case "/2020-01-01/extension/event/next":
+		f.mu.Lock()
+		n := f.nexts
+		f.nexts++
+		uri := f.uri
+		f.mu.Unlock()
+		deadline := time.Now().Add(5 * time.Second).UnixMilli()
+		if n >= len(f.requestIDs) {
+			fmt.Fprintf(w, `{"eventType":"SHUTDOWN","shutdownReason":"spindown","deadlineMs":%d}`, deadline)
+			return
+		}
+		requestID := f.requestIDs[n]
+		// the telemetry of the invocation is sent after the event, while the extension waits for it
+		go func() {
+			body, err := json.Marshal(f.telemetry(requestID))
+			require.NoError(f.t, err)
+			resp, err := http.Post(uri, "application/json", bytes.NewReader(body))
+			require.NoError(f.t, err)
+			resp.Body.Close()
+			if f.posted != nil {
+				f.posted(requestID)
+			}
+		}()
+		fmt.Fprintf(w, `{"eventType":"INVOKE","requestId":%q,"deadlineMs":%d}`, requestID, deadline)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestLambdaExtension(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-function")
+	var mu sync.Mutex
+	outputs := make(map[string]*bytes.Buffer)
+	cfg := &Config{OutputName: "{{ .Lambda.FunctionName }}/{{ .Lambda.RequestID }}.log"}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{},
+		WithDestination("buffer", func(_ context.Context, outputName string) (io.WriteCloser, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			var buf bytes.Buffer
+			outputs[outputName] = &buf
+			closed := false
+			return newTestWriteCloser(&buf, func() error {
+				require.False(t, closed)
+				closed = true
+				return nil
+			}), nil
+		}),
+	)
+	require.NoError(t, err)
+
+	runtimeAPI := &fakeLambdaRuntimeAPI{
+		t:          t,
+		requestIDs: []string{"req-1", "req-2"},
+		telemetry: func(requestID string) []map[string]any {
+			events := []map[string]any{}
+			if requestID == "req-1" {
+				events = append(events, map[string]any{"type": "function", "record": "init log"})
+			}
+			return append(events,
+				map[string]any{"type": "platform.start", "record": map[string]any{"requestId": requestID}},
+				map[string]any{"type": "function", "record": "hello " + requestID + "\n"},
+				map[string]any{"type": "function", "record": map[string]any{"level": "INFO", "message": "json log"}},
+				map[string]any{"type": "platform.runtimeDone", "record": map[string]any{"requestId": requestID, "status": "success"}},
+			)
+		},
+	}
+	srv := httptest.NewServer(runtimeAPI)
+	defer srv.Close()
+	ext := &lambdaExtension{
+		app:        app,
+		client:     &lambdaExtensionClient{runtimeAPI: strings.TrimPrefix(srv.URL, "http://"), client: srv.Client()},
+		listenHost: "127.0.0.1",
+		logger:     app.logger,
+	}
+	require.NoError(t, ext.run(context.Background()))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, outputs, 3)
+	require.Equal(t, "init log\n", outputs["my-function/init.log"].String())
+	for _, requestID := range runtimeAPI.requestIDs {
+		require.Equal(t, "hello "+requestID+"\n"+`{"level":"INFO","message":"json log"}`+"\n", outputs["my-function/"+requestID+".log"].String())
+	}
+	require.Empty(t, ext.invocations, "the invocations waited are removed")
+}
+
+func TestLambdaExtensionOrdering(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-function")
+	var mu sync.Mutex
+	outputs := make(map[string]*bytes.Buffer)
+	var opened []string
+	// the writers are opened after the telemetry of the invocation is received, so the receiving never waits for the destinations
+	posted := make(chan struct{})
+	cfg := &Config{OutputName: "{{ .Lambda.FunctionName }}/{{ .Lambda.RequestID }}.log"}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{},
+		WithDestination("buffer", func(_ context.Context, outputName string) (io.WriteCloser, error) {
+			<-posted
+			mu.Lock()
+			defer mu.Unlock()
+			var buf bytes.Buffer
+			outputs[outputName] = &buf
+			opened = append(opened, outputName)
+			return newTestWriteCloser(&buf, func() error { return nil }), nil
+		}),
+	)
+	require.NoError(t, err)
+
+	runtimeAPI := &fakeLambdaRuntimeAPI{
+		t:          t,
+		requestIDs: []string{"req-1", "req-2"},
+		telemetry: func(requestID string) []map[string]any {
+			events := []map[string]any{}
+			if requestID == "req-1" {
+				events = append(events, map[string]any{"type": "function", "record": "init log"})
+			}
+			return append(events,
+				map[string]any{"type": "platform.start", "record": map[string]any{"requestId": requestID}},
+				map[string]any{"type": "function", "record": "first " + requestID},
+				map[string]any{"type": "function", "record": "second " + requestID},
+				map[string]any{"type": "platform.runtimeDone", "record": map[string]any{"requestId": requestID, "status": "success"}},
+				map[string]any{"type": "function", "record": "late " + requestID},
+			)
+		},
+		posted: func(requestID string) {
+			if requestID == "req-1" {
+				close(posted)
+			}
+		},
+	}
+	srv := httptest.NewServer(runtimeAPI)
+	defer srv.Close()
+	ext := &lambdaExtension{
+		app:        app,
+		client:     &lambdaExtensionClient{runtimeAPI: strings.TrimPrefix(srv.URL, "http://"), client: srv.Client()},
+		listenHost: "127.0.0.1",
+		logger:     app.logger,
+	}
+	require.NoError(t, ext.run(context.Background()))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"my-function/init.log", "my-function/req-1.log", "my-function/req-2.log"}, opened, "the late logs do not open the init writer again")
+	require.Equal(t, "init log\n", outputs["my-function/init.log"].String())
+	for _, requestID := range runtimeAPI.requestIDs {
+		require.Equal(t, "first "+requestID+"\nsecond "+requestID+"\n", outputs["my-function/"+requestID+".log"].String())
+	}
+}
+
+func TestLambdaExtensionReload(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-function")
+	var mu sync.Mutex
+	outputs := make(map[string]*bytes.Buffer)
+	var ext *lambdaExtension
+	newApp := func(outputName string, opened func(outputName string)) *AWSTee {
+		cfg := &Config{OutputName: outputName}
+		require.NoError(t, cfg.Restrict())
+		app, err := NewWithClient(cfg, AWSClient{},
+			WithDestination("buffer", func(_ context.Context, outputName string) (io.WriteCloser, error) {
+				mu.Lock()
+				var buf bytes.Buffer
+				outputs[outputName] = &buf
+				mu.Unlock()
+				opened(outputName)
+				return newTestWriteCloser(&buf, func() error { return nil }), nil
+			}),
+		)
+		require.NoError(t, err)
+		return app
+	}
+	reloaded := newApp("reloaded/{{ .Lambda.RequestID }}.log", func(string) {})
+	// reloaded while the writer of req-1 is opened, it is kept until the end of req-1
+	app := newApp("{{ .Lambda.FunctionName }}/{{ .Lambda.RequestID }}.log", func(outputName string) {
+		if outputName == "my-function/req-1.log" {
+			ext.reload(reloaded)
+		}
+	})
+
+	runtimeAPI := &fakeLambdaRuntimeAPI{
+		t:          t,
+		requestIDs: []string{"req-1", "req-2"},
+		telemetry: func(requestID string) []map[string]any {
+			return []map[string]any{
+				{"type": "platform.start", "record": map[string]any{"requestId": requestID}},
+				{"type": "function", "record": "hello " + requestID},
+				{"type": "platform.runtimeDone", "record": map[string]any{"requestId": requestID, "status": "success"}},
+			}
+		},
+	}
+	srv := httptest.NewServer(runtimeAPI)
+	defer srv.Close()
+	ext = &lambdaExtension{
+		app:        app,
+		client:     &lambdaExtensionClient{runtimeAPI: strings.TrimPrefix(srv.URL, "http://"), client: srv.Client()},
+		listenHost: "127.0.0.1",
+		logger:     app.logger,
+	}
+	require.NoError(t, ext.run(context.Background()))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, outputs, 2)
+	require.Equal(t, "hello req-1\n", outputs["my-function/req-1.log"].String())
+	require.Equal(t, "hello req-2\n", outputs["reloaded/req-2.log"].String())
+}
+
+func TestRunLambdaExtensionOutOfLambda(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_RUNTIME_API", "")
+	cfg := &Config{}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{})
+	require.NoError(t, err)
+	require.EqualError(t, app.RunLambdaExtension(context.Background()), "AWS_LAMBDA_RUNTIME_API is not set, the extension runs in the execution environment of Lambda")
+}
@@ -0,0 +1,456 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// LambdaExtensionName is the name of the extension registered, which must be the file name of the extension in /opt/extensions.
+	LambdaExtensionName = "awstee"
+	// lambdaInitRequestID is the request id of the output name of the logs of the init phase, before the first invocation.
+	lambdaInitRequestID = "init"
+	// lambdaTelemetryHost is the host of the telemetry listener, which Lambda sends the logs of the function to.
+	lambdaTelemetryHost = "sandbox.localdomain"
+	// lambdaShutdownGrace is the time waiting for the last logs at the shutdown, longer than the buffering of the telemetry.
+	lambdaShutdownGrace = 100 * time.Millisecond
+	// lambdaTelemetryQueue is the events of the Telemetry API received and not yet handled, the maxItems of a batch.
+	lambdaTelemetryQueue = 1000
+)
+
+// lambdaEvent is the event of the Extensions API.
+type lambdaEvent struct {
+	EventType      string `json:"eventType"`
+	RequestID      string `json:"requestId"`
+	DeadlineMs     int64  `json:"deadlineMs"`
+	ShutdownReason string `json:"shutdownReason"`
+}
+
+// deadline returns the time of DeadlineMs.
+func (e *lambdaEvent) deadline() time.Time {
+	return time.UnixMilli(e.DeadlineMs)
+}
+
+// lambdaTelemetry is an event of the Telemetry API.
+type lambdaTelemetry struct {
+	Type   string          `json:"type"`
+	Record json.RawMessage `json:"record"`
+}
+
+// lambdaExtensionClient calls the Extensions API and the Telemetry API of the runtime api.
+type lambdaExtensionClient struct {
+	runtimeAPI string
+	client     *http.Client
+	id         string
+}
+
+func (c *lambdaExtensionClient) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+c.runtimeAPI+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if c.id != "" {
+		req.Header.Set("Lambda-Extension-Identifier", c.id)
+	} else {
+		req.Header.Set("Lambda-Extension-Name", LambdaExtensionName)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// register registers the extension for the invocations and the shutdown.
+func (c *lambdaExtensionClient) register(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodPost, "/2020-01-01/extension/register", map[string]any{
+		"events": []string{"INVOKE", "SHUTDOWN"},
+	})
+	if err != nil {
+		return fmt.Errorf("register extension: %w", err)
+	}
+	defer resp.Body.Close()
+	c.id = resp.Header.Get("Lambda-Extension-Identifier")
+	if c.id == "" {
+		return errors.New("register extension: no extension identifier")
+	}
+	return nil
+}
+
+// subscribe subscribes the logs of the function and the platform events of the invocations, sent to uri.
+func (c *lambdaExtensionClient) subscribe(ctx context.Context, uri string) error {
+	resp, err := c.do(ctx, http.MethodPut, "/2022-07-01/telemetry", map[string]any{
+		"schemaVersion": "2022-12-13",
+		"types":         []string{"platform", "function"},
+		"buffering": map[string]any{
+			"maxItems":  1000,
+			"maxBytes":  256 * 1024,
+			"timeoutMs": 25,
+		},
+		"destination": map[string]any{
+			"protocol": "HTTP",
+			"URI":      uri,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("subscribe telemetry: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// next waits for the next event.
+func (c *lambdaExtensionClient) next(ctx context.Context) (*lambdaEvent, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/2020-01-01/extension/event/next", nil)
+	if err != nil {
+		return nil, fmt.Errorf("next event: %w", err)
+	}
+	defer resp.Body.Close()
+	var event lambdaEvent
+	if err := json.NewDecoder(resp.Body).Decode(&event); err != nil {
+		return nil, fmt.Errorf("next event: %w", err)
+	}
+	return &event, nil
+}
+
+// lambdaInvocation is the writer of the logs of an invocation, done when its runtime is done and the writer is closed.
+type lambdaInvocation struct {
+	w    *AWSTeeWriter
+	done chan struct{}
+}
+
+func (inv *lambdaInvocation) finished() bool {
+	select {
+	case <-inv.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// lambdaExtension writes the logs of each invocation of the function to the destinations of the output name of the invocation.
+// The events of the Telemetry API are queued by ServeHTTP and handled in order by handleEvents, which opens and closes the writers,
+// so that the calls of AWS do not hold the telemetry requests nor mu.
+type lambdaExtension struct {
+	app        *AWSTee
+	client     *lambdaExtensionClient
+	listenHost string
+	logger     *slog.Logger
+	events     chan lambdaTelemetry
+
+	// owned by handleEvents
+	current   *lambdaInvocation
+	currentID string
+	lastID    string
+
+	// mu guards app, invocations and their writers
+	mu          sync.Mutex
+	invocations map[string]*lambdaInvocation
+}
+
+// RunLambdaExtension runs awstee as an external extension of Lambda, until the execution environment shuts down.
+// It subscribes the logs of the function by the Telemetry API, and writes the logs of each invocation to the destinations of
+// the output name of GenerateLambdaOutputName. The next invocation waits for the logs of the former one to be delivered,
+// not to leave the uploads to the frozen execution environment. The logs before the first invocation are of the request id "init".
+func (app *AWSTee) RunLambdaExtension(ctx context.Context) error {
+	return app.RunLambdaExtensionWithReload(ctx, nil)
+}
+
+// RunLambdaExtensionWithReload is RunLambdaExtension, reloaded by the AWSTee received from reload, such as the one of the config loaded again:
+// the invocations started after it are written by it, and the ones in flight keep their writers.
+func (app *AWSTee) RunLambdaExtensionWithReload(ctx context.Context, reload <-chan *AWSTee) error {
+	runtimeAPI := os.Getenv("AWS_LAMBDA_RUNTIME_API")
+	if runtimeAPI == "" {
+		return errors.New("AWS_LAMBDA_RUNTIME_API is not set, the extension runs in the execution environment of Lambda")
+	}
+	ext := &lambdaExtension{
+		app:        app,
+		client:     &lambdaExtensionClient{runtimeAPI: runtimeAPI, client: &http.Client{}},
+		listenHost: lambdaTelemetryHost,
+		logger:     app.logger,
+	}
+	if reload != nil {
+		go func() {
+			for {
+				select {
+				case app, ok := <-reload:
+					if !ok {
+						return
+					}
+					ext.reload(app)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return ext.run(ctx)
+}
+
+// reload makes app write the invocations started after it.
+func (e *lambdaExtension) reload(app *AWSTee) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.app = app
+	e.logger.Info("lambda extension reloaded, the next invocations are written by it")
+}
+
+func (e *lambdaExtension) run(ctx context.Context) error {
+	e.invocations = make(map[string]*lambdaInvocation)
+	e.events = make(chan lambdaTelemetry, lambdaTelemetryQueue)
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		e.handleEvents()
+	}()
+	if err := e.client.register(ctx); err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(e.listenHost, "0"))
+	if err != nil {
+		return fmt.Errorf("listen telemetry: %w", err)
+	}
+	server := &http.Server{Handler: e, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.logger.Error("serve telemetry", "error", err)
+		}
+	}()
+	defer server.Close()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	if err := e.client.subscribe(ctx, "http://"+net.JoinHostPort(e.listenHost, port)); err != nil {
+		return err
+	}
+	e.logger.Info("lambda extension registered", "extension_id", e.client.id)
+	for {
+		event, err := e.client.next(ctx)
+		if err != nil {
+			return err
+		}
+		switch event.EventType {
+		case "INVOKE":
+			e.logger.Debug("lambda invoke", "request_id", event.RequestID)
+			e.wait(ctx, event.RequestID, event.deadline())
+		case "SHUTDOWN":
+			e.logger.Info("lambda shutdown", "reason", event.ShutdownReason)
+			// the telemetry is sent until the deadline of the shutdown
+			shutdownCtx, cancel := context.WithDeadline(context.Background(), event.deadline())
+			defer cancel()
+			select {
+			case <-time.After(lambdaShutdownGrace):
+			case <-shutdownCtx.Done():
+			}
+			server.Shutdown(shutdownCtx)
+			// no event is queued after the shutdown of the server
+			close(e.events)
+			select {
+			case <-handled:
+			case <-shutdownCtx.Done():
+			}
+			return e.closeAll(shutdownCtx)
+		}
+	}
+}
+
+// invocation returns the invocation of requestID, created if it is not yet. e.mu must be held.
+func (e *lambdaExtension) invocation(requestID string) *lambdaInvocation {
+	inv, ok := e.invocations[requestID]
+	if !ok {
+		inv = &lambdaInvocation{done: make(chan struct{})}
+		e.invocations[requestID] = inv
+	}
+	return inv
+}
+
+// wait waits for the invocation of requestID to be done, until deadline.
+func (e *lambdaExtension) wait(ctx context.Context, requestID string, deadline time.Time) {
+	e.mu.Lock()
+	inv := e.invocation(requestID)
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if inv.finished() {
+			delete(e.invocations, requestID)
+		}
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-inv.done:
+	case <-timer.C:
+		e.logger.Warn("the logs of the invocation are not delivered until the deadline, they are delivered by the next invocation", "request_id", requestID)
+	case <-ctx.Done():
+	}
+}
+
+// ServeHTTP receives the events of the Telemetry API, and queues them for handleEvents.
+func (e *lambdaExtension) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var events []lambdaTelemetry
+	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+		e.logger.Warn("decode telemetry", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, event := range events {
+		e.events <- event
+	}
+}
+
+// handleEvents handles the events queued in order, until the queue is closed.
+func (e *lambdaExtension) handleEvents() {
+	for event := range e.events {
+		e.handle(&event)
+	}
+}
+
+// handle writes a log of the function to the writer of the current invocation, or starts and finishes the invocations.
+// The logs out of the invocations are of "init" before the first invocation, and are dropped after it,
+// such as the ones received after the runtime of the invocation is done.
+func (e *lambdaExtension) handle(event *lambdaTelemetry) {
+	switch event.Type {
+	case "platform.start":
+		var record struct {
+			RequestID string `json:"requestId"`
+		}
+		if err := json.Unmarshal(event.Record, &record); err != nil {
+			e.logger.Warn("decode telemetry", "type", event.Type, "error", err)
+			return
+		}
+		if e.currentID == lambdaInitRequestID {
+			e.finish(lambdaInitRequestID)
+		}
+		e.start(record.RequestID)
+	case "platform.runtimeDone":
+		var record struct {
+			RequestID string `json:"requestId"`
+		}
+		if err := json.Unmarshal(event.Record, &record); err != nil {
+			e.logger.Warn("decode telemetry", "type", event.Type, "error", err)
+			return
+		}
+		e.finish(record.RequestID)
+	case "function":
+		if e.current == nil {
+			if e.lastID != "" {
+				e.logger.Warn("drop the log of the function out of the invocations", "last_request_id", e.lastID)
+				return
+			}
+			e.start(lambdaInitRequestID)
+		}
+		w := e.writer(e.current)
+		if w == nil {
+			return
+		}
+		// the record of the text format is a string, and of the json format is an object
+		line := []byte(event.Record)
+		var text string
+		if err := json.Unmarshal(event.Record, &text); err == nil {
+			line = []byte(text)
+		}
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			line = append(line, '\n')
+		}
+		if _, err := w.Write(line); err != nil {
+			e.logger.Warn("write the log of the function", "request_id", e.currentID, "error", err)
+		}
+	}
+}
+
+// writer returns the writer of inv, nil if it is not opened or already closed.
+func (e *lambdaExtension) writer(inv *lambdaInvocation) *AWSTeeWriter {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return inv.w
+}
+
+// start opens the writer of the invocation of requestID as the current one.
+func (e *lambdaExtension) start(requestID string) {
+	e.mu.Lock()
+	inv := e.invocation(requestID)
+	app := e.app
+	e.mu.Unlock()
+	e.current, e.currentID = inv, requestID
+	if requestID != lambdaInitRequestID {
+		e.lastID = requestID
+	}
+	w, err := app.LambdaWriter(context.Background(), NewLambdaContext(requestID))
+	if err != nil {
+		// the logs of the invocation are lost, the next ones may succeed
+		e.logger.Error("create writer of the invocation", "request_id", requestID, "error", err)
+		return
+	}
+	e.mu.Lock()
+	inv.w = w
+	e.mu.Unlock()
+}
+
+// finish closes the writer of the invocation of requestID, and makes it done. It is removed by wait, or at once if nothing waits for it.
+func (e *lambdaExtension) finish(requestID string) {
+	e.mu.Lock()
+	inv := e.invocation(requestID)
+	w := inv.w
+	inv.w = nil
+	e.mu.Unlock()
+	if inv.finished() {
+		return
+	}
+	if e.current == inv {
+		e.current, e.currentID = nil, ""
+	}
+	if w != nil {
+		if err := w.Close(); err != nil {
+			e.logger.Error("close writer of the invocation", "request_id", requestID, "error", err)
+		}
+	}
+	close(inv.done)
+	if requestID == lambdaInitRequestID {
+		e.mu.Lock()
+		delete(e.invocations, requestID)
+		e.mu.Unlock()
+	}
+}
+
+// closeAll closes the writers of the invocations not finished, by ctx.
+func (e *lambdaExtension) closeAll(ctx context.Context) error {
+	e.mu.Lock()
+	writers := make(map[string]*AWSTeeWriter)
+	for requestID, inv := range e.invocations {
+		if inv.w != nil {
+			writers[requestID] = inv.w
+			inv.w = nil
+		}
+	}
+	e.mu.Unlock()
+	var errs []error
+	for requestID, w := range writers {
+		if err := w.CloseWithContext(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("close writer of the invocation %s: %w", requestID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,272 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	LimitPolicyTruncate = "truncate"
+	LimitPolicyRotate   = "rotate"
+	LimitPolicyAbort    = "abort"
+)
+
+// ErrLimitExceeded is returned from Write when the capture size limit is exceeded with on_limit: abort.
+var ErrLimitExceeded = errors.New("capture size limit exceeded")
+
+// LimitConfig is the capture size guard of a destination.
+type LimitConfig struct {
+	MaxBytes int64  `yaml:"max_bytes,omitempty"`
+	MaxLines int64  `yaml:"max_lines,omitempty"`
+	OnLimit  string `yaml:"on_limit,omitempty"`
+
+	// onLongLine is the policy of the lines longer than MaxBytes with on_limit: rotate, overridden by on_long_line of Config
+	onLongLine string
+}
+
+func (cfg *LimitConfig) Enabled() bool {
+	return cfg.MaxBytes > 0 || cfg.MaxLines > 0
+}
+
+func (cfg *LimitConfig) Restrict() error {
+	if cfg.MaxBytes < 0 {
+		return errors.New("max_bytes must not be negative")
+	}
+	if cfg.MaxLines < 0 {
+		return errors.New("max_lines must not be negative")
+	}
+	switch cfg.OnLimit {
+	case "":
+		cfg.OnLimit = LimitPolicyTruncate
+	case LimitPolicyTruncate, LimitPolicyRotate, LimitPolicyAbort:
+	default:
+		return fmt.Errorf("on_limit must be one of %s, %s, %s", LimitPolicyTruncate, LimitPolicyRotate, LimitPolicyAbort)
+	}
+	return nil
+}
+
+// rotatedOutputName returns the output name of the seq-th rotation, e.g. hoge.log => hoge.1.log
+func rotatedOutputName(outputName string, seq int) string {
+	if seq == 0 {
+		return outputName
+	}
+	ext := filepath.Ext(outputName)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(outputName, ext), seq, ext)
+}
+
+// limitWriter counts the lines and bytes written to a destination and applies the on_limit policy when they exceed the limit.
+type limitWriter struct {
+	cfg        *LimitConfig
+	outputName string
+	open       func(outputName string) (io.WriteCloser, error)
+	logger     *slog.Logger
+
+	mu        sync.Mutex
+	current   io.WriteCloser
+	seq       int
+	bytes     int64
+	lines     int64
+	truncated bool
+	buf       []byte
+	rotated   []DestinationResult
+}
+
+// newLimitedDestination opens a destination, guarded by limitWriter if the limit is configured.
+func newLimitedDestination(logger *slog.Logger, cfg *LimitConfig, outputName string, open func(outputName string) (io.WriteCloser, error)) (io.WriteCloser, error) {
+	if !cfg.Enabled() {
+		return open(outputName)
+	}
+	return newLimitWriter(logger, cfg, outputName, open)
+}
+
+func newLimitWriter(logger *slog.Logger, cfg *LimitConfig, outputName string, open func(outputName string) (io.WriteCloser, error)) (*limitWriter, error) {
+	current, err := open(outputName)
+	if err != nil {
+		return nil, err
+	}
+	return &limitWriter{
+		cfg:        cfg,
+		outputName: outputName,
+		open:       open,
+		logger:     logger,
+		current:    current,
+	}, nil
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	rest := w.buf
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		if err := w.writeLine(rest[:i+1]); err != nil {
+			return 0, err
+		}
+		rest = rest[i+1:]
+	}
+	w.buf = w.buf[:copy(w.buf, rest)]
+	return len(p), nil
+}
+
+func (w *limitWriter) writeLine(line []byte) error {
+	if w.truncated {
+		return nil
+	}
+	if w.exceeded(line) {
+		switch w.cfg.OnLimit {
+		case LimitPolicyAbort:
+			return fmt.Errorf("%s: %w", w.current, ErrLimitExceeded)
+		case LimitPolicyRotate:
+			if w.lines > 0 {
+				w.logger.Info("capture size limit exceeded", "destination", fmt.Sprint(w.current))
+				if err := w.rotate(); err != nil {
+					return err
+				}
+			}
+			if w.cfg.MaxBytes > 0 && int64(len(line)) > w.cfg.MaxBytes {
+				return w.writeLongLine(line)
+			}
+		default:
+			w.logger.Warn("capture size limit exceeded, the rest is truncated", "destination", fmt.Sprint(w.current))
+			w.truncated = true
+			_, err := fmt.Fprintf(w.current, "[awstee] output truncated: %s\n", w.limitString())
+			return err
+		}
+	}
+	return w.write(line)
+}
+
+func (w *limitWriter) write(line []byte) error {
+	w.bytes += int64(len(line))
+	w.lines++
+	_, err := w.current.Write(line)
+	return err
+}
+
+// writeLongLine writes the line longer than max_bytes to the new destination rotated, by on_long_line as the events of CloudWatch Logs:
+// truncated with longLineMarker, split into the destinations rotated in order, or dropped. No destination exceeds max_bytes.
+func (w *limitWriter) writeLongLine(line []byte) error {
+	w.logger.Warn("line is longer than max_bytes", "destination", fmt.Sprint(w.current), "max_bytes", w.cfg.MaxBytes, "on_long_line", w.cfg.onLongLine)
+	switch w.cfg.onLongLine {
+	case LongLineDrop:
+		return nil
+	case LongLineSplit:
+		s := &lineSplitter{max: int(w.cfg.MaxBytes)}
+		for len(line) > s.max {
+			n := s.cut(line, s.max)
+			if err := w.write(line[:n]); err != nil {
+				return err
+			}
+			if err := w.rotate(); err != nil {
+				return err
+			}
+			line = line[n:]
+		}
+		return w.write(line)
+	}
+	var newline []byte
+	if line[len(line)-1] == '\n' {
+		line, newline = line[:len(line)-1], line[len(line)-1:]
+	}
+	s := &lineSplitter{max: int(w.cfg.MaxBytes) - len(newline), policy: LongLineTruncate}
+	truncated := append([]byte(nil), s.truncate(line)...)
+	return w.write(append(truncated, newline...))
+}
+
+func (w *limitWriter) exceeded(line []byte) bool {
+	if w.cfg.MaxBytes > 0 && w.bytes+int64(len(line)) > w.cfg.MaxBytes {
+		return true
+	}
+	return w.cfg.MaxLines > 0 && w.lines+1 > w.cfg.MaxLines
+}
+
+func (w *limitWriter) limitString() string {
+	parts := make([]string, 0, 2)
+	if w.cfg.MaxBytes > 0 {
+		parts = append(parts, fmt.Sprintf("max_bytes=%d", w.cfg.MaxBytes))
+	}
+	if w.cfg.MaxLines > 0 {
+		parts = append(parts, fmt.Sprintf("max_lines=%d", w.cfg.MaxLines))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (w *limitWriter) rotate() error {
+	w.logger.Info("rotate", "destination", fmt.Sprint(w.current))
+	err := w.current.Close()
+	if r, ok := w.current.(resultReporter); ok {
+		w.rotated = append(w.rotated, r.results()...)
+	} else {
+		w.rotated = append(w.rotated, DestinationResult{Name: fmt.Sprint(w.current), Err: err})
+	}
+	if err != nil {
+		return err
+	}
+	w.seq++
+	next, err := w.open(rotatedOutputName(w.outputName, w.seq))
+	if err != nil {
+		return fmt.Errorf("rotate: %w", err)
+	}
+	w.logger.Info("rotated destination", "destination", fmt.Sprint(next))
+	w.current = next
+	w.bytes = 0
+	w.lines = 0
+	return nil
+}
+
+// Flush rotates to the next destination with on_limit: rotate, so that the captured data so far is completed.
+// Otherwise it flushes the current destination.
+func (w *limitWriter) Flush(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cfg.OnLimit == LimitPolicyRotate {
+		if w.lines == 0 {
+			return nil
+		}
+		return w.rotate()
+	}
+	if f, ok := w.current.(flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+func (w *limitWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		line := w.buf
+		w.buf = nil
+		if err := w.writeLine(line); err != nil {
+			w.current.Close()
+			return err
+		}
+	}
+	return w.current.Close()
+}
+
+func (w *limitWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return fmt.Sprint(w.current)
+}
+
+func (w *limitWriter) Stats() DestinationStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if r, ok := w.current.(statsReporter); ok {
+		return r.Stats()
+	}
+	return DestinationStats{Name: fmt.Sprint(w.current)}
+}
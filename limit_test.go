@@ -0,0 +1,143 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitWriter(t *testing.T) {
+	cases := []struct {
+		casename string
+		cfg      LimitConfig
+		input    string
+		expected map[string]string
+		err      error
+	}{
+		{
+			casename: "truncate",
+			cfg:      LimitConfig{MaxLines: 2},
+			input:    "hoge\nfuga\npiyo\ntara",
+			expected: map[string]string{
+				"hoge.log": "hoge\nfuga\n[awstee] output truncated: max_lines=2\n",
+			},
+		},
+		{
+			casename: "rotate",
+			cfg:      LimitConfig{MaxBytes: 10, OnLimit: LimitPolicyRotate},
+			input:    "hoge\nfuga\npiyo\ntara",
+			expected: map[string]string{
+				"hoge.log":   "hoge\nfuga\n",
+				"hoge.1.log": "piyo\ntara",
+			},
+		},
+		{
+			casename: "rotate long line truncate",
+			cfg:      LimitConfig{MaxBytes: 24, OnLimit: LimitPolicyRotate, onLongLine: LongLineTruncate},
+			input:    "hoge\n" + strings.Repeat("x", 30) + "\nfuga\n",
+			expected: map[string]string{
+				"hoge.log":   "hoge\n",
+				"hoge.1.log": "xxxx" + longLineMarker + "\n",
+				"hoge.2.log": "fuga\n",
+			},
+		},
+		{
+			casename: "rotate long line split",
+			cfg:      LimitConfig{MaxBytes: 10, OnLimit: LimitPolicyRotate, onLongLine: LongLineSplit},
+			input:    "hoge\n" + strings.Repeat("x", 24) + "\nfuga\n",
+			expected: map[string]string{
+				"hoge.log":   "hoge\n",
+				"hoge.1.log": "xxxxxxxxxx",
+				"hoge.2.log": "xxxxxxxxxx",
+				"hoge.3.log": "xxxx\nfuga\n",
+			},
+		},
+		{
+			casename: "rotate long line split utf8",
+			cfg:      LimitConfig{MaxBytes: 4, OnLimit: LimitPolicyRotate, onLongLine: LongLineSplit},
+			input:    "あい",
+			expected: map[string]string{
+				"hoge.log":   "あ",
+				"hoge.1.log": "い",
+			},
+		},
+		{
+			casename: "rotate long line drop",
+			cfg:      LimitConfig{MaxBytes: 10, OnLimit: LimitPolicyRotate, onLongLine: LongLineDrop},
+			input:    "hoge\n" + strings.Repeat("x", 24) + "\nfuga\n",
+			expected: map[string]string{
+				"hoge.log":   "hoge\n",
+				"hoge.1.log": "fuga\n",
+			},
+		},
+		{
+			casename: "abort",
+			cfg:      LimitConfig{MaxBytes: 10, OnLimit: LimitPolicyAbort},
+			input:    "hoge\nfuga\npiyo\ntara",
+			expected: map[string]string{
+				"hoge.log": "hoge\nfuga\n",
+			},
+			err: ErrLimitExceeded,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.casename, func(t *testing.T) {
+			require.NoError(t, c.cfg.Restrict())
+			bufs := make(map[string]*bytes.Buffer)
+			w, err := newLimitWriter(slog.Default(), &c.cfg, "hoge.log", func(outputName string) (io.WriteCloser, error) {
+				var buf bytes.Buffer
+				bufs[outputName] = &buf
+				return newTestWriteCloser(&buf, func() error { return nil }), nil
+			})
+			require.NoError(t, err)
+			_, err = io.WriteString(w, c.input)
+			if err == nil {
+				err = w.Close()
+			}
+			if c.err != nil {
+				require.True(t, errors.Is(err, c.err))
+			} else {
+				require.NoError(t, err)
+			}
+			actual := make(map[string]string, len(bufs))
+			for name, buf := range bufs {
+				actual[name] = buf.String()
+			}
+			require.EqualValues(t, c.expected, actual)
+		})
+	}
+}
+
+func TestRotatedOutputName(t *testing.T) {
+	require.EqualValues(t, "hoge.log", rotatedOutputName("hoge.log", 0))
+	require.EqualValues(t, "test/hoge.2.log", rotatedOutputName("test/hoge.log", 2))
+	require.EqualValues(t, "hoge.1", rotatedOutputName("hoge", 1))
+}
+
+func TestLimitWriterFlushRotate(t *testing.T) {
+	cfg := &LimitConfig{MaxBytes: 1024, OnLimit: LimitPolicyRotate}
+	require.NoError(t, cfg.Restrict())
+	bufs := make(map[string]*bytes.Buffer)
+	w, err := newLimitWriter(slog.Default(), cfg, "hoge.log", func(outputName string) (io.WriteCloser, error) {
+		var buf bytes.Buffer
+		bufs[outputName] = &buf
+		return newTestWriteCloser(&buf, func() error { return nil }), nil
+	})
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Flush(context.Background()))
+	require.NoError(t, w.Flush(context.Background()))
+	_, err = io.WriteString(w, "fuga\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Len(t, bufs, 2)
+	require.EqualValues(t, "hoge\n", bufs["hoge.log"].String())
+	require.EqualValues(t, "fuga\n", bufs["hoge.1.log"].String())
+}
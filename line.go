@@ -0,0 +1,218 @@
+package awstee
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// lineProcessor rewrites one line (without the trailing newline) before it is written to destinations.
+// Returning nil drops the line.
+type lineProcessor func(line []byte) []byte
+
+// lineWriter splits writes into lines and passes each line through the processors.
+// A trailing partial line is held until the next newline or Flush.
+type lineWriter struct {
+	w          io.Writer
+	processors []lineProcessor
+	buf        []byte
+	// out is reused by the writes, the destinations do not retain it
+	out []byte
+}
+
+func newLineWriter(w io.Writer, processors []lineProcessor) *lineWriter {
+	return &lineWriter{
+		w:          w,
+		processors: processors,
+	}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	out := w.out[:0]
+	rest := w.buf
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		if line := w.process(rest[:i]); line != nil {
+			out = append(out, line...)
+			out = append(out, '\n')
+		}
+		rest = rest[i+1:]
+	}
+	w.buf = w.buf[:copy(w.buf, rest)]
+	w.out = out
+	if len(out) > 0 {
+		if _, err := w.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes the held partial line, without adding a newline.
+func (w *lineWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := w.process(w.buf)
+	w.buf = w.buf[:0]
+	if line == nil {
+		return nil
+	}
+	_, err := w.w.Write(line)
+	return err
+}
+
+func (w *lineWriter) process(line []byte) []byte {
+	for _, processor := range w.processors {
+		line = processor(line)
+		if line == nil {
+			return nil
+		}
+	}
+	return line
+}
+
+func newTimestampProcessor(layout string, now func() time.Time) lineProcessor {
+	return func(line []byte) []byte {
+		if len(line) == 0 {
+			return line
+		}
+		ts := now().Format(layout)
+		out := make([]byte, 0, len(ts)+1+len(line))
+		out = append(out, ts...)
+		out = append(out, ' ')
+		return append(out, line...)
+	}
+}
+
+// ansiEscapeRegexp matches CSI sequences (colors, cursor movements), OSC sequences (titles, hyperlinks) and other two byte escapes.
+var ansiEscapeRegexp = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[@-Z\\-_])`)
+
+func stripANSIProcessor(line []byte) []byte {
+	if bytes.IndexByte(line, 0x1b) < 0 {
+		return line
+	}
+	return ansiEscapeRegexp.ReplaceAll(line, nil)
+}
+
+func newPrefixProcessor(prefix string) lineProcessor {
+	return func(line []byte) []byte {
+		if len(line) == 0 {
+			return line
+		}
+		out := make([]byte, 0, len(prefix)+len(line))
+		out = append(out, prefix...)
+		return append(out, line...)
+	}
+}
+
+// runMetadata is the data passed to templates in the config.
+type runMetadata struct {
+	Hostname   string
+	OutputName string
+	PID        int
+}
+
+func newRunMetadata(outputName string) *runMetadata {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return &runMetadata{
+		Hostname:   hostname,
+		OutputName: outputName,
+		PID:        os.Getpid(),
+	}
+}
+
+// DefaultOutputName is the default template of the output name.
+const DefaultOutputName = `{{ .Hostname }}/{{ .Now.Format "2006/01/02" }}/{{ .UUID }}.log`
+
+// outputNameData is the data passed to the output_name template.
+type outputNameData struct {
+	Hostname string
+	PID      int
+	Now      time.Time
+	UUID     string
+	// Lambda is of the function in the execution environment of Lambda, and of the invocation by LambdaWriter.
+	Lambda LambdaContext
+}
+
+// GenerateOutputName returns an output name by the output_name template, for when it is not given.
+// Restrict must be called before.
+func (cfg *Config) GenerateOutputName() (string, error) {
+	if cfg.outputName == nil {
+		return "", errors.New("output_name is not restricted")
+	}
+	return executeOutputName(cfg.outputName, NewLambdaContext(""))
+}
+
+// executeOutputName returns the output name by tmpl of the output_name template.
+func executeOutputName(tmpl *template.Template, lc LambdaContext) (string, error) {
+	meta := newRunMetadata("")
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, outputNameData{
+		Hostname: meta.Hostname,
+		PID:      meta.PID,
+		Now:      time.Now(),
+		UUID:     id,
+		Lambda:   lc,
+	}); err != nil {
+		return "", fmt.Errorf("output_name execute: %w", err)
+	}
+	if b.Len() == 0 {
+		return "", errors.New("output_name is empty")
+	}
+	return b.String(), nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
+
+// lineProcessors returns the processors of the lines for all destinations. sanitizer may be nil.
+func (app *AWSTee) lineProcessors(outputName string, sanitizer *lineSanitizer) ([]lineProcessor, error) {
+	processors := make([]lineProcessor, 0)
+	if sanitizer != nil {
+		processors = append(processors, sanitizer.process)
+	}
+	if app.cfg.StripANSI {
+		processors = append(processors, stripANSIProcessor)
+	}
+	if app.cfg.NormalizeTimestamp.Enabled() {
+		processors = append(processors, app.cfg.NormalizeTimestamp.processor(app.now))
+	}
+	if app.cfg.linePrefix != nil {
+		var b strings.Builder
+		if err := app.cfg.linePrefix.Execute(&b, newRunMetadata(outputName)); err != nil {
+			return nil, fmt.Errorf("line_prefix execute: %w", err)
+		}
+		processors = append(processors, newPrefixProcessor(b.String()))
+	}
+	if app.cfg.timestampLayout != "" {
+		processors = append(processors, newTimestampProcessor(app.cfg.timestampLayout, app.now))
+	}
+	return processors, nil
+}
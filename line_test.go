@@ -0,0 +1,97 @@
+package awstee
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineWriter(t *testing.T) {
+	now := func() time.Time {
+		return time.Date(2022, 6, 3, 17, 28, 48, 0, time.UTC)
+	}
+	var buf bytes.Buffer
+	w := newLineWriter(&buf, []lineProcessor{
+		func(line []byte) []byte {
+			if bytes.Equal(line, []byte("drop")) {
+				return nil
+			}
+			return line
+		},
+		newTimestampProcessor(time.RFC3339, now),
+	})
+	for _, p := range []string{"hoge\nfu", "ga\n", "\ndrop\npi", "yo"} {
+		n, err := io.WriteString(w, p)
+		require.NoError(t, err)
+		require.EqualValues(t, len(p), n)
+	}
+	require.EqualValues(t, "2022-06-03T17:28:48Z hoge\n2022-06-03T17:28:48Z fuga\n\n", buf.String())
+	require.NoError(t, w.Flush())
+	require.EqualValues(t, "2022-06-03T17:28:48Z hoge\n2022-06-03T17:28:48Z fuga\n\n2022-06-03T17:28:48Z piyo", buf.String())
+}
+
+func TestLineProcessorsLinePrefix(t *testing.T) {
+	cfg := &Config{
+		LinePrefix: "[{{ .OutputName }}] ",
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{})
+	require.NoError(t, err)
+	processors, err := app.lineProcessors("hoge.log", nil)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := newLineWriter(&buf, processors)
+	_, err = io.WriteString(w, "hoge\n\nfuga\n")
+	require.NoError(t, err)
+	require.EqualValues(t, "[hoge.log] hoge\n\n[hoge.log] fuga\n", buf.String())
+}
+
+func TestStripANSIProcessor(t *testing.T) {
+	cases := []struct {
+		line     string
+		expected string
+	}{
+		{line: "hoge", expected: "hoge"},
+		{line: "\x1b[31mred\x1b[0m text", expected: "red text"},
+		{line: "\x1b[1;32mbold green\x1b[m", expected: "bold green"},
+		{line: "\x1b[2K\x1b[1Gprogress", expected: "progress"},
+		{line: "\x1b]0;title\x07body", expected: "body"},
+		{line: "\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\", expected: "link"},
+	}
+	for _, c := range cases {
+		require.EqualValues(t, c.expected, string(stripANSIProcessor([]byte(c.line))))
+	}
+}
+
+func TestGenerateOutputName(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	cfg := newConfig()
+	require.NoError(t, cfg.Restrict())
+	outputName, err := cfg.GenerateOutputName()
+	require.NoError(t, err)
+	require.Regexp(t, `^`+regexp.QuoteMeta(hostname)+`/\d{4}/\d{2}/\d{2}/[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}\.log$`, outputName)
+	another, err := cfg.GenerateOutputName()
+	require.NoError(t, err)
+	require.NotEqual(t, outputName, another)
+
+	cfg.OutputName = `adhoc/{{ .PID }}.log`
+	require.NoError(t, cfg.Restrict())
+	outputName, err = cfg.GenerateOutputName()
+	require.NoError(t, err)
+	require.EqualValues(t, fmt.Sprintf("adhoc/%d.log", os.Getpid()), outputName)
+
+	cfg.OutputName = `{{ .Unknown }}`
+	require.NoError(t, cfg.Restrict())
+	_, err = cfg.GenerateOutputName()
+	require.Error(t, err)
+
+	cfg.OutputName = `{{ .Hostname`
+	require.Error(t, cfg.Restrict())
+}
@@ -0,0 +1,119 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const lockSuffix = ".lock"
+
+// ErrLocked is returned when the output name is locked by another awstee.
+var ErrLocked = errors.New("output name is locked")
+
+// lockInfo is the body of the lock object.
+type lockInfo struct {
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// outputLock is the lock of an output name. It is the `.lock` object next to the first s3 object of the output name,
+// put with `If-None-Match: *` so that only one awstee can create it.
+type outputLock struct {
+	client S3Client
+	bucket string
+	key    string
+	logger *slog.Logger
+}
+
+func (app *AWSTee) acquireLock(ctx context.Context, cfg *S3Config, outputName string) (*outputLock, error) {
+	bucket, key := s3ObjectLocation(cfg, outputName)
+	l := &outputLock{
+		client: app.s3Client(cfg),
+		bucket: bucket,
+		key:    key + lockSuffix,
+		logger: app.logger,
+	}
+	meta := newRunMetadata(outputName)
+	body, err := json.Marshal(lockInfo{
+		Hostname:  meta.Hostname,
+		PID:       meta.PID,
+		StartedAt: app.now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = l.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(l.bucket),
+		Key:         aws.String(l.key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}, s3.WithAPIOptions(smithyhttp.SetHeaderValue("If-None-Match", "*")))
+	if err != nil {
+		if isLockConflict(err) {
+			return nil, fmt.Errorf("%s: %w", l, l.lockedBy(ctx))
+		}
+		return nil, fmt.Errorf("acquire lock %s: %w", l, err)
+	}
+	l.logger.Info("lock acquired", "lock", l.String())
+	return l, nil
+}
+
+func isLockConflict(err error) bool {
+	var ae smithy.APIError
+	if !errors.As(err, &ae) {
+		return false
+	}
+	switch ae.ErrorCode() {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return true
+	}
+	return false
+}
+
+// lockedBy returns ErrLocked with the owner of the lock.
+func (l *outputLock) lockedBy(ctx context.Context) error {
+	output, err := l.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(l.bucket),
+		Key:    aws.String(l.key),
+	})
+	if err != nil {
+		l.logger.Debug("get lock object", "error", err)
+		return ErrLocked
+	}
+	defer output.Body.Close()
+	var info lockInfo
+	if err := json.NewDecoder(io.LimitReader(output.Body, 4096)).Decode(&info); err != nil {
+		l.logger.Debug("decode lock object", "error", err)
+		return ErrLocked
+	}
+	return fmt.Errorf("%w by %s (pid %d) since %s", ErrLocked, info.Hostname, info.PID, info.StartedAt.Format(time.RFC3339))
+}
+
+// Release deletes the lock object.
+func (l *outputLock) Release(ctx context.Context) error {
+	_, err := l.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(l.bucket),
+		Key:    aws.String(l.key),
+	})
+	if err != nil {
+		return fmt.Errorf("release lock %s: %w", l, err)
+	}
+	l.logger.Info("lock released", "lock", l.String())
+	return nil
+}
+
+func (l *outputLock) String() string {
+	return fmt.Sprintf("s3://%s/%s", l.bucket, l.key)
+}
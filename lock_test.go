@@ -0,0 +1,60 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputLock(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s3Client := NewMockS3Client(ctrl)
+	cfg := &Config{
+		Lock: true,
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{S3: s3Client})
+	require.NoError(t, err)
+
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			require.EqualValues(t, "logs/hoge.log.lock", *input.Key)
+			require.Len(t, optFns, 1)
+			return &s3.PutObjectOutput{}, nil
+		},
+	).Times(1)
+	lock, err := app.acquireLock(context.Background(), cfg.S3, "hoge.log")
+	require.NoError(t, err)
+	require.EqualValues(t, "s3://awstee-example-com/logs/hoge.log.lock", lock.String())
+
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{Code: "PreconditionFailed"},
+	).Times(1)
+	s3Client.EXPECT().GetObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&s3.GetObjectOutput{
+			Body: io.NopCloser(strings.NewReader(`{"hostname":"host-a","pid":1234,"started_at":"2022-06-03T17:28:48Z"}`)),
+		}, nil,
+	).Times(1)
+	_, err = app.acquireLock(context.Background(), cfg.S3, "hoge.log")
+	require.True(t, errors.Is(err, ErrLocked))
+	require.EqualError(t, err, "s3://awstee-example-com/logs/hoge.log.lock: output name is locked by host-a (pid 1234) since 2022-06-03T17:28:48Z")
+
+	s3Client.EXPECT().DeleteObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+			require.EqualValues(t, "logs/hoge.log.lock", *input.Key)
+			return &s3.DeleteObjectOutput{}, nil
+		},
+	).Times(1)
+	require.NoError(t, lock.Release(context.Background()))
+}
@@ -0,0 +1,314 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	manifestSuffix      = ".manifest.json"
+	manifestPattern     = "awstee-manifest-*"
+	manifestPrefixBytes = 64 * 1024
+)
+
+// runManifest is the record of a run delivered to all destinations, the `.manifest.json` object next to the first s3 object of the output name.
+// The input is identified by the sha256 of the whole of it, and of its prefix to tell a different input early.
+type runManifest struct {
+	RunID        string    `json:"run_id"`
+	OutputName   string    `json:"output_name"`
+	PrefixBytes  int64     `json:"prefix_bytes"`
+	PrefixSHA256 string    `json:"prefix_sha256"`
+	InputSHA256  string    `json:"input_sha256"`
+	Bytes        int64     `json:"bytes"`
+	Lines        int64     `json:"lines"`
+	Destinations []string  `json:"destinations"`
+	Hostname     string    `json:"hostname"`
+	CompletedAt  time.Time `json:"completed_at"`
+}
+
+// manifestStore gets and puts the manifest of an output name.
+type manifestStore struct {
+	client S3Client
+	bucket string
+	key    string
+}
+
+func newManifestStore(client S3Client, cfg *S3Config, outputName string) *manifestStore {
+	bucket, key := s3ObjectLocation(cfg, outputName)
+	return &manifestStore{
+		client: client,
+		bucket: bucket,
+		key:    key + manifestSuffix,
+	}
+}
+
+// get returns the manifest, or nil if the output name has not been delivered.
+func (s *manifestStore) get(ctx context.Context) (*runManifest, error) {
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	})
+	if err != nil {
+		var ae smithy.APIError
+		if errors.As(err, &ae) && (ae.ErrorCode() == "NoSuchKey" || ae.ErrorCode() == "NotFound") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get manifest %s: %w", s, withRequiredPermission(err, "s3:GetObject"))
+	}
+	defer output.Body.Close()
+	var m runManifest
+	if err := json.NewDecoder(io.LimitReader(output.Body, 1024*1024)).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decode manifest %s: %w", s, err)
+	}
+	return &m, nil
+}
+
+func (s *manifestStore) put(ctx context.Context, m *runManifest) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("put manifest %s: %w", s, err)
+	}
+	return nil
+}
+
+func (s *manifestStore) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.key)
+}
+
+// manifestWriter identifies the input written to the destinations by its hashes, for the manifest of the run.
+// For a re-run of a delivered output name, it holds the writes back in a temporary file while they are the same as the delivered input:
+// it releases them to next as soon as they differ, or skips them at finish if the whole input is the same.
+// Write is not safe for concurrent use, AWSTeeWriter serializes it.
+type manifestWriter struct {
+	next      io.Writer
+	store     *manifestStore
+	delivered *runManifest
+	logger    *slog.Logger
+
+	prefix  hash.Hash
+	hash    hash.Hash
+	bytes   int64
+	lines   int64
+	held    *os.File
+	skipped bool
+	// err is the error of releasing the held writes, the run is not recorded with it.
+	err error
+}
+
+func newManifestWriter(logger *slog.Logger, store *manifestStore, delivered *runManifest) (*manifestWriter, error) {
+	w := &manifestWriter{
+		store:     store,
+		delivered: delivered,
+		logger:    logger.With("manifest", store.String()),
+		prefix:    sha256.New(),
+		hash:      sha256.New(),
+	}
+	if delivered != nil {
+		f, err := os.CreateTemp("", manifestPattern)
+		if err != nil {
+			return nil, fmt.Errorf("create manifest hold: %w", err)
+		}
+		w.held = f
+		w.logger.Info("output name was delivered, the writes are held back until they differ",
+			"run_id", delivered.RunID, "bytes", delivered.Bytes, "completed_at", delivered.CompletedAt)
+	}
+	return w, nil
+}
+
+func (w *manifestWriter) Write(p []byte) (int, error) {
+	if rest := manifestPrefixBytes - w.bytes; rest > 0 {
+		w.prefix.Write(p[:min(int64(len(p)), rest)])
+	}
+	w.hash.Write(p)
+	w.bytes += int64(len(p))
+	w.lines += int64(bytes.Count(p, []byte("\n")))
+	if w.held == nil {
+		return w.next.Write(p)
+	}
+	if _, err := w.held.Write(p); err != nil {
+		return 0, fmt.Errorf("write manifest hold: %w", err)
+	}
+	if w.differs() {
+		if err := w.release("the input differs from the delivered one"); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// differs reports whether the input written so far can not be the delivered one.
+func (w *manifestWriter) differs() bool {
+	if w.bytes > w.delivered.Bytes {
+		return true
+	}
+	return w.bytes >= manifestPrefixBytes && w.delivered.PrefixBytes == manifestPrefixBytes &&
+		hexSum(w.prefix) != w.delivered.PrefixSHA256
+}
+
+// release writes the held writes to next, and stops holding.
+func (w *manifestWriter) release(reason string) error {
+	w.logger.Info(reason+", the destinations are written", "run_id", w.delivered.RunID, "bytes", w.bytes)
+	f := w.held
+	w.held = nil
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		w.err = fmt.Errorf("read manifest hold: %w", err)
+		return w.err
+	}
+	if _, err := io.Copy(w.next, f); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// finish skips the held writes if the whole input is the same as the delivered one, or releases them.
+func (w *manifestWriter) finish() error {
+	if w.held == nil {
+		return nil
+	}
+	if w.bytes == w.delivered.Bytes && hexSum(w.hash) == w.delivered.InputSHA256 {
+		w.logger.Info("the same input was already delivered, the destinations are skipped",
+			"run_id", w.delivered.RunID, "completed_at", w.delivered.CompletedAt)
+		w.skipped = true
+		w.held.Close()
+		return os.Remove(w.held.Name())
+	}
+	return w.release("the input differs from the delivered one at the end")
+}
+
+// discard removes the held writes, of the writer not created.
+func (w *manifestWriter) discard() {
+	if w == nil || w.held == nil {
+		return
+	}
+	w.held.Close()
+	os.Remove(w.held.Name())
+}
+
+// record puts the manifest of this run delivered to destinations.
+func (w *manifestWriter) record(ctx context.Context, outputName string, destinations []string, now time.Time) error {
+	if w.err != nil {
+		return fmt.Errorf("release the held writes: %w", w.err)
+	}
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	m := &runManifest{
+		RunID:        id,
+		OutputName:   outputName,
+		PrefixBytes:  min(w.bytes, manifestPrefixBytes),
+		PrefixSHA256: hexSum(w.prefix),
+		InputSHA256:  hexSum(w.hash),
+		Bytes:        w.bytes,
+		Lines:        w.lines,
+		Destinations: destinations,
+		Hostname:     newRunMetadata(outputName).Hostname,
+		CompletedAt:  now,
+	}
+	if err := w.store.put(ctx, m); err != nil {
+		return err
+	}
+	w.logger.Info("run manifest recorded", "run_id", m.RunID, "bytes", m.Bytes)
+	return nil
+}
+
+// lazyDestination opens a destination by the first write, so that a destination never written is never created.
+type lazyDestination struct {
+	name string
+	open func() (io.WriteCloser, error)
+
+	mu  sync.Mutex
+	w   io.WriteCloser
+	err error
+}
+
+func (d *lazyDestination) current() (io.WriteCloser, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.w == nil && d.err == nil {
+		d.w, d.err = d.open()
+	}
+	return d.w, d.err
+}
+
+func (d *lazyDestination) opened() io.WriteCloser {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.w
+}
+
+func (d *lazyDestination) Write(p []byte) (int, error) {
+	w, err := d.current()
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(p)
+}
+
+func (d *lazyDestination) Close() error {
+	if w := d.opened(); w != nil {
+		return w.Close()
+	}
+	return nil
+}
+
+func (d *lazyDestination) Flush(ctx context.Context) error {
+	if f, ok := d.opened().(flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+func (d *lazyDestination) String() string {
+	if w := d.opened(); w != nil {
+		return fmt.Sprint(w)
+	}
+	return d.name
+}
+
+func (d *lazyDestination) Stats() DestinationStats {
+	if r, ok := d.opened().(statsReporter); ok {
+		return r.Stats()
+	}
+	return DestinationStats{Name: d.String()}
+}
+
+func (d *lazyDestination) results() []DestinationResult {
+	if r, ok := d.opened().(resultReporter); ok {
+		return r.results()
+	}
+	return []DestinationResult{{Name: d.String()}}
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
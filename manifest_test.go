@@ -0,0 +1,159 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+// deliveredManifest returns the manifest of the run delivered input.
+func deliveredManifest(t *testing.T, input string) *runManifest {
+	t.Helper()
+	w, err := newManifestWriter(slog.Default(), &manifestStore{}, nil)
+	require.NoError(t, err)
+	w.next = io.Discard
+	_, err = io.WriteString(w, input)
+	require.NoError(t, err)
+	return &runManifest{
+		RunID:        "run-1",
+		PrefixBytes:  min(w.bytes, manifestPrefixBytes),
+		PrefixSHA256: hexSum(w.prefix),
+		InputSHA256:  hexSum(w.hash),
+		Bytes:        w.bytes,
+	}
+}
+
+func TestManifestWriter(t *testing.T) {
+	input := strings.Repeat("hoge\n", 20000)
+	delivered := deliveredManifest(t, input)
+	cases := []struct {
+		name    string
+		input   string
+		skipped bool
+		early   bool // released before finish
+	}{
+		{name: "same", input: input, skipped: true},
+		{name: "differs in the prefix", input: "fuga\n" + input[5:], early: true},
+		{name: "differs at the end", input: input[:len(input)-5] + "fuga\n"},
+		{name: "longer", input: input + "fuga\n", early: true},
+		{name: "shorter", input: input[:len(input)-5]},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var next bytes.Buffer
+			w, err := newManifestWriter(slog.Default(), &manifestStore{bucket: "awstee-example-com", key: "logs/hoge.log.manifest.json"}, delivered)
+			require.NoError(t, err)
+			w.next = &next
+			in := strings.NewReader(c.input)
+			buf := make([]byte, manifestPrefixBytes+1)
+			for {
+				n, err := in.Read(buf)
+				if n > 0 {
+					_, werr := w.Write(buf[:n])
+					require.NoError(t, werr)
+				}
+				if err == io.EOF {
+					break
+				}
+			}
+			if c.early {
+				require.Equal(t, len(c.input), next.Len(), "the writes after the release pass through")
+			} else {
+				require.Zero(t, next.Len(), "the writes are held back")
+			}
+			require.NoError(t, w.finish())
+			require.Equal(t, c.skipped, w.skipped)
+			if c.skipped {
+				require.Zero(t, next.Len())
+			} else {
+				require.Equal(t, c.input, next.String())
+			}
+		})
+	}
+}
+
+func TestAWSTeeWriterManifest(t *testing.T) {
+	input := "hoge\nfuga\n"
+	delivered := deliveredManifest(t, input)
+	body, err := json.Marshal(delivered)
+	require.NoError(t, err)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s3Client := NewMockS3Client(ctrl)
+	cfg := &Config{
+		Manifest: true,
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	var opened int
+	var dest bytes.Buffer
+	app, err := NewWithClient(cfg, AWSClient{S3: s3Client},
+		WithDestination("buffer", func(context.Context, string) (io.WriteCloser, error) {
+			opened++
+			return newTestWriteCloser(&dest, func() error { return nil }), nil
+		}),
+	)
+	require.NoError(t, err)
+	app.now = func() time.Time { return time.Date(2022, 6, 3, 17, 28, 48, 0, time.UTC) }
+
+	// the same input is skipped, without opening the destinations
+	s3Client.EXPECT().GetObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			require.EqualValues(t, "logs/hoge.log.manifest.json", *input.Key)
+			return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(body))}, nil
+		},
+	).Times(1)
+	w, err := app.Writer(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, input)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.True(t, w.Result().Skipped)
+	require.Zero(t, opened)
+
+	// the first run is delivered, and recorded
+	s3Client.EXPECT().GetObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{Code: "NoSuchKey"},
+	).Times(1)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{Code: "NotFound"},
+	).Times(1)
+	var recorded runManifest
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			if *input.Key == "logs/fuga.log.manifest.json" {
+				require.NoError(t, json.NewDecoder(input.Body).Decode(&recorded))
+			} else {
+				io.Copy(io.Discard, input.Body)
+			}
+			return &s3.PutObjectOutput{}, nil
+		},
+	).Times(2)
+	w, err = app.Writer(context.Background(), "fuga.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, input)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.False(t, w.Result().Skipped)
+	require.Equal(t, 1, opened)
+	require.Equal(t, input, dest.String())
+	require.Equal(t, delivered.InputSHA256, recorded.InputSHA256)
+	require.EqualValues(t, 2, recorded.Lines)
+	require.Equal(t, "fuga.log", recorded.OutputName)
+	require.Len(t, recorded.Destinations, 2)
+	require.NotEmpty(t, recorded.RunID)
+	require.True(t, app.now().Equal(recorded.CompletedAt))
+}
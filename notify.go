@@ -0,0 +1,222 @@
+package awstee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	eventbridgetypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/samber/lo"
+)
+
+const (
+	// runEventSource is the source of the events of EventBridge.
+	runEventSource = "awstee"
+	// runEventDetailType is the detail type of the events of EventBridge.
+	runEventDetailType = "awstee Run Finished"
+	// notifyTimeout bounds the notification after Close, which is sent even if the context of Close is done.
+	notifyTimeout = 10 * time.Second
+)
+
+// The status of a run notified.
+const (
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	// RunSkipped is of the run whose destinations were not written, because the same input was already delivered, see Config.Manifest.
+	RunSkipped = "skipped"
+)
+
+// snsPublishAPI is the part of the sns api publishing the events of the runs.
+type snsPublishAPI interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// eventBridgePutEventsAPI is the part of the eventbridge api putting the events of the runs.
+type eventBridgePutEventsAPI interface {
+	PutEvents(ctx context.Context, params *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error)
+}
+
+// NotifyConfig sends an event of a run when it finishes, to a topic of SNS or an event bus of EventBridge,
+// so that the downstream automation can be triggered without polling the destinations.
+type NotifyConfig struct {
+	SNSTopicARN string `yaml:"sns_topic_arn,omitempty"`
+	// EventBusName is the name or the ARN of the event bus.
+	EventBusName string `yaml:"event_bus_name,omitempty"`
+}
+
+func (cfg *NotifyConfig) Enabled() bool {
+	return cfg.SNSTopicARN != "" || cfg.EventBusName != ""
+}
+
+func (cfg *NotifyConfig) Restrict() error {
+	if cfg.SNSTopicARN != "" && !strings.HasPrefix(cfg.SNSTopicARN, "arn:") {
+		return fmt.Errorf("notify sns_topic_arn must be an ARN, got %s", cfg.SNSTopicARN)
+	}
+	return nil
+}
+
+// RunEvent is the event of a run notified, in JSON.
+type RunEvent struct {
+	OutputName      string    `json:"output_name"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+	Hostname        string    `json:"hostname"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Lines           int64     `json:"lines"`
+	Bytes           int64     `json:"bytes"`
+	// NormalizedCRLF and SanitizedUTF8 are the lines rewritten by normalize_crlf and sanitize_utf8.
+	NormalizedCRLF int64                 `json:"normalized_crlf"`
+	SanitizedUTF8  int64                 `json:"sanitized_utf8"`
+	Destinations   []RunEventDestination `json:"destinations"`
+}
+
+// RunEventDestination is a destination of RunEvent, of DestinationResult and the last DestinationStats.
+type RunEventDestination struct {
+	Name      string `json:"name"`
+	Location  string `json:"location,omitempty"`
+	VersionID string `json:"version_id,omitempty"`
+	// SHA256 is the hex sha256 of the s3 object, with summary.
+	SHA256  string `json:"sha256,omitempty"`
+	Bytes   int64  `json:"bytes"`
+	Events  int64  `json:"events"`
+	Retries int64  `json:"retries"`
+	// Truncated, Dropped, OverflowDropped and Deduplicated are of DestinationStats.
+	Truncated       int64  `json:"truncated"`
+	Dropped         int64  `json:"dropped"`
+	OverflowDropped int64  `json:"overflow_dropped"`
+	Deduplicated    int64  `json:"deduplicated"`
+	Error           string `json:"error,omitempty"`
+}
+
+// newRunEvent returns the event of the run of result and the last stats, closed with err.
+func newRunEvent(outputName string, result Result, stats Stats, err error, started, finished time.Time) *RunEvent {
+	event := &RunEvent{
+		OutputName:      outputName,
+		Status:          RunSucceeded,
+		Hostname:        newRunMetadata(outputName).Hostname,
+		StartedAt:       started,
+		FinishedAt:      finished,
+		DurationSeconds: finished.Sub(started).Seconds(),
+		Lines:           result.Lines,
+		Bytes:           result.Bytes,
+		NormalizedCRLF:  stats.NormalizedCRLF,
+		SanitizedUTF8:   stats.SanitizedUTF8,
+		Destinations:    make([]RunEventDestination, 0, len(result.Destinations)),
+	}
+	switch {
+	case err != nil:
+		event.Status = RunFailed
+		event.Error = err.Error()
+	case result.Skipped:
+		event.Status = RunSkipped
+	}
+	destStats := lo.KeyBy(stats.Destinations, func(d DestinationStats) string { return d.Name })
+	for _, d := range result.Destinations {
+		dest := RunEventDestination{
+			Name:      d.Name,
+			Location:  d.Location,
+			VersionID: d.VersionID,
+			SHA256:    d.SHA256,
+			Bytes:     d.Bytes,
+			Events:    d.Events,
+			Retries:   d.Retries,
+		}
+		if s, ok := destStats[d.Name]; ok {
+			dest.Truncated = s.Truncated
+			dest.Dropped = s.Dropped
+			dest.OverflowDropped = s.OverflowDropped
+			dest.Deduplicated = s.Deduplicated
+		}
+		if d.Err != nil {
+			dest.Error = d.Err.Error()
+		}
+		event.Destinations = append(event.Destinations, dest)
+	}
+	return event
+}
+
+// runNotifier sends the event of a run by the clients of NotifyConfig.
+type runNotifier struct {
+	cfg         *NotifyConfig
+	sns         snsPublishAPI
+	eventBridge eventBridgePutEventsAPI
+	logger      *slog.Logger
+}
+
+// notify sends event to all of the topic and the event bus. The errors are logged, they never fail the run.
+func (n *runNotifier) notify(event *RunEvent) {
+	// sent even if the context of Close is done, as the run is finished by it
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	detail, err := json.Marshal(event)
+	if err != nil {
+		n.logger.Warn("notify run", "error", err)
+		return
+	}
+	// the clients are nil for the ones not created, such as by NewWithClient
+	if n.cfg.SNSTopicARN != "" && n.sns != nil {
+		if err := n.publish(ctx, event, string(detail)); err != nil {
+			n.logger.Warn("notify run", "sns_topic_arn", n.cfg.SNSTopicARN, "error", err)
+		}
+	}
+	if n.cfg.EventBusName != "" && n.eventBridge != nil {
+		if err := n.putEvent(ctx, event, string(detail)); err != nil {
+			n.logger.Warn("notify run", "event_bus_name", n.cfg.EventBusName, "error", err)
+		}
+	}
+}
+
+func (n *runNotifier) publish(ctx context.Context, event *RunEvent, detail string) error {
+	subject := fmt.Sprintf("awstee run %s: %s", event.Status, event.OutputName)
+	if len(subject) > 100 {
+		// the limit of the subject of sns
+		subject = subject[:97] + "..."
+	}
+	_, err := n.sns.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(n.cfg.SNSTopicARN),
+		Subject:  aws.String(subject),
+		Message:  aws.String(detail),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			// for the filter policies of the subscriptions
+			"status": {DataType: aws.String("String"), StringValue: aws.String(event.Status)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("publish: %w", err)
+	}
+	return nil
+}
+
+func (n *runNotifier) putEvent(ctx context.Context, event *RunEvent, detail string) error {
+	output, err := n.eventBridge.PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: []eventbridgetypes.PutEventsRequestEntry{{
+			EventBusName: aws.String(n.cfg.EventBusName),
+			Source:       aws.String(runEventSource),
+			DetailType:   aws.String(runEventDetailType),
+			Detail:       aws.String(detail),
+			Time:         aws.Time(event.FinishedAt),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("put events: %w", err)
+	}
+	if output.FailedEntryCount > 0 {
+		for _, entry := range output.Entries {
+			if entry.ErrorCode != nil {
+				return fmt.Errorf("put events: %s: %s", aws.ToString(entry.ErrorCode), aws.ToString(entry.ErrorMessage))
+			}
+		}
+		return errors.New("put events: the event failed")
+	}
+	return nil
+}
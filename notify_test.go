@@ -0,0 +1,150 @@
+package awstee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	eventbridgetypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSNS keeps the messages published.
+type fakeSNS struct {
+	inputs []*sns.PublishInput
+}
+
+func (f *fakeSNS) Publish(_ context.Context, input *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	f.inputs = append(f.inputs, input)
+	return &sns.PublishOutput{}, nil
+}
+
+// fakeEventBridge keeps the events put, and fails them by errorCode.
+type fakeEventBridge struct {
+	entries   []eventbridgetypes.PutEventsRequestEntry
+	errorCode string
+}
+
+func (f *fakeEventBridge) PutEvents(_ context.Context, input *eventbridge.PutEventsInput, _ ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error) {
+	f.entries = append(f.entries, input.Entries...)
+	if f.errorCode != "" {
+		return &eventbridge.PutEventsOutput{
+			FailedEntryCount: 1,
+			Entries:          []eventbridgetypes.PutEventsResultEntry{{ErrorCode: aws.String(f.errorCode), ErrorMessage: aws.String("failed")}},
+		}, nil
+	}
+	return &eventbridge.PutEventsOutput{}, nil
+}
+
+func TestNotify(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudwatchlogs.PutLogEventsOutput{}, nil).AnyTimes()
+	cfg := &Config{
+		Cloudwatch: &CloudwatchLogsConfig{LogGroup: "/awstee/logs"},
+		Notify: NotifyConfig{
+			SNSTopicARN:  "arn:aws:sns:ap-northeast-1:123456789012:awstee",
+			EventBusName: "default",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	started := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := started
+	app, err := NewWithClient(cfg, AWSClient{CloudwatchLogs: client}, WithClock(func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}))
+	require.NoError(t, err)
+	topic, bus := &fakeSNS{}, &fakeEventBridge{}
+	app.sns, app.eventBridge = topic, bus
+	w, err := app.Writer(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\nfuga\n")
+	require.NoError(t, err)
+	require.Empty(t, topic.inputs, "not notified until Close")
+	require.NoError(t, w.Close())
+
+	require.Len(t, topic.inputs, 1)
+	require.Equal(t, "arn:aws:sns:ap-northeast-1:123456789012:awstee", aws.ToString(topic.inputs[0].TopicArn))
+	require.Equal(t, "awstee run succeeded: hoge.log", aws.ToString(topic.inputs[0].Subject))
+	require.Equal(t, RunSucceeded, aws.ToString(topic.inputs[0].MessageAttributes["status"].StringValue))
+	require.Len(t, bus.entries, 1)
+	require.Equal(t, "default", aws.ToString(bus.entries[0].EventBusName))
+	require.Equal(t, runEventSource, aws.ToString(bus.entries[0].Source))
+	require.Equal(t, runEventDetailType, aws.ToString(bus.entries[0].DetailType))
+	require.JSONEq(t, aws.ToString(topic.inputs[0].Message), aws.ToString(bus.entries[0].Detail), "the same event")
+
+	var event RunEvent
+	require.NoError(t, json.Unmarshal([]byte(aws.ToString(bus.entries[0].Detail)), &event))
+	require.Equal(t, "hoge.log", event.OutputName)
+	require.Equal(t, RunSucceeded, event.Status)
+	require.Empty(t, event.Error)
+	require.EqualValues(t, 2, event.Lines)
+	require.EqualValues(t, 10, event.Bytes)
+	require.True(t, event.FinishedAt.After(event.StartedAt))
+	require.Equal(t, event.FinishedAt.Sub(event.StartedAt).Seconds(), event.DurationSeconds)
+	require.Equal(t, []RunEventDestination{{
+		Name:   "LogGroup=/awstee/logs, LogStream=hoge",
+		Bytes:  11,
+		Events: 2,
+	}}, event.Destinations)
+}
+
+func TestNotifyFailedEntry(t *testing.T) {
+	bus := &fakeEventBridge{errorCode: "InternalFailure"}
+	n := &runNotifier{cfg: &NotifyConfig{EventBusName: "default"}, eventBridge: bus, logger: slog.Default()}
+	err := n.putEvent(context.Background(), &RunEvent{OutputName: "hoge.log"}, "{}")
+	require.EqualError(t, err, "put events: InternalFailure: failed")
+	require.NotPanics(t, func() {
+		n.notify(&RunEvent{OutputName: "hoge.log"})
+	}, "the errors and the clients not created are logged")
+	require.Len(t, bus.entries, 2)
+}
+
+func TestNewRunEvent(t *testing.T) {
+	started := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	result := Result{
+		Lines: 3,
+		Bytes: 15,
+		Destinations: []DestinationResult{
+			{Name: "s3://example-bucket/hoge.log", Location: "s3://example-bucket/hoge.log", VersionID: "v1", Bytes: 15},
+			{Name: "LogGroup=/awstee/logs, LogStream=hoge", Retries: 2, Err: errors.New("throttled")},
+		},
+	}
+	stats := Stats{
+		NormalizedCRLF: 1,
+		Destinations:   []DestinationStats{{Name: "LogGroup=/awstee/logs, LogStream=hoge", Truncated: 1, Dropped: 2}},
+	}
+	event := newRunEvent("hoge.log", result, stats, errors.New("close failed"), started, started.Add(1500*time.Millisecond))
+	require.Equal(t, RunFailed, event.Status)
+	require.Equal(t, "close failed", event.Error)
+	require.Equal(t, 1.5, event.DurationSeconds)
+	require.Equal(t, []RunEventDestination{
+		{Name: "s3://example-bucket/hoge.log", Location: "s3://example-bucket/hoge.log", VersionID: "v1", Bytes: 15},
+		{Name: "LogGroup=/awstee/logs, LogStream=hoge", Retries: 2, Truncated: 1, Dropped: 2, Error: "throttled"},
+	}, event.Destinations)
+	require.EqualValues(t, 1, event.NormalizedCRLF)
+
+	event = newRunEvent("hoge.log", Result{Skipped: true}, Stats{}, nil, started, started)
+	require.Equal(t, RunSkipped, event.Status)
+	require.NotNil(t, event.Destinations, "the destinations are [] in JSON")
+}
+
+func TestNotifyConfig(t *testing.T) {
+	cfg := &NotifyConfig{}
+	require.False(t, cfg.Enabled())
+	require.NoError(t, cfg.Restrict())
+	cfg.SNSTopicARN = "awstee"
+	require.EqualError(t, cfg.Restrict(), "notify sns_topic_arn must be an ARN, got awstee")
+}
@@ -0,0 +1,168 @@
+package awstee
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Option configures AWSTee. It is passed to New, and also to Writer and TeeReader to override for one output.
+type Option func(*AWSTee)
+
+// WithLogger sets the logger of awstee's own diagnostics. The default is slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(app *AWSTee) {
+		if logger != nil {
+			app.logger = logger
+		}
+	}
+}
+
+// WithS3Client sets the s3 client used for the destinations without their own credentials, instead of the one created from the aws config.
+func WithS3Client(client S3Client) Option {
+	return func(app *AWSTee) {
+		if client != nil {
+			app.client.S3 = client
+		}
+	}
+}
+
+// WithCloudwatchLogsClient sets the cloudwatch logs client used for the destinations without their own credentials, instead of the one created from the aws config.
+func WithCloudwatchLogsClient(client CloudwatchLogsClient) Option {
+	return func(app *AWSTee) {
+		if client != nil {
+			app.client.CloudwatchLogs = client
+		}
+	}
+}
+
+// WithClock sets the clock of the timestamps of lines, cloudwatch logs events and locks. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(app *AWSTee) {
+		if now != nil {
+			app.now = now
+		}
+	}
+}
+
+// WithRetryer sets the retryer of the aws clients created by New, instead of max_attempts and retry_mode.
+// It has no effect on the clients set by WithS3Client and WithCloudwatchLogsClient.
+func WithRetryer(retryer func() aws.Retryer) Option {
+	return func(app *AWSTee) {
+		if retryer != nil {
+			app.retryer = retryer
+		}
+	}
+}
+
+// WithHTTPClient sets the http client of the aws clients created by New and NewWithAWSConfig, instead of the one of http in the config.
+func WithHTTPClient(client aws.HTTPClient) Option {
+	return func(app *AWSTee) {
+		if client != nil {
+			app.httpClient = client
+		}
+	}
+}
+
+// WithS3Options adds the options of the s3 clients created by New and NewWithAWSConfig, such as middlewares and endpoint resolvers.
+// It has no effect on the client set by WithS3Client.
+func WithS3Options(optFns ...func(*s3.Options)) Option {
+	return func(app *AWSTee) {
+		app.s3Options = append(app.s3Options[:len(app.s3Options):len(app.s3Options)], optFns...)
+	}
+}
+
+// WithCloudwatchLogsOptions adds the options of the cloudwatch logs clients created by New and NewWithAWSConfig, such as middlewares and endpoint resolvers.
+// It has no effect on the client set by WithCloudwatchLogsClient.
+func WithCloudwatchLogsOptions(optFns ...func(*cloudwatchlogs.Options)) Option {
+	return func(app *AWSTee) {
+		app.cloudwatchLogsOptions = append(app.cloudwatchLogsOptions[:len(app.cloudwatchLogsOptions):len(app.cloudwatchLogsOptions)], optFns...)
+	}
+}
+
+// WithErrorHandler sets the handler called as soon as a write or a batch of a destination fails in the background,
+// with the destination such as s3://bucket/key. The same error is also returned by the later Write or Close.
+// The default logs the error. The handler must not block, because the destination waits for it.
+func WithErrorHandler(handler func(dest string, err error)) Option {
+	return func(app *AWSTee) {
+		if handler != nil {
+			app.errorHandler = handler
+		}
+	}
+}
+
+// WithMetricsHook sets the hook notified of the written bytes, the sent batches and the errors of the destinations.
+func WithMetricsHook(hook MetricsHook) Option {
+	return func(app *AWSTee) {
+		if hook != nil {
+			app.metrics = hook
+		}
+	}
+}
+
+// WithTracerProvider sets the provider of the tracer of the spans of the writers and the AWS calls:
+// awstee.Writer for the lifecycle of a writer from Writer to Close, s3.Upload with s3.UploadPart and the other calls of the upload,
+// and cloudwatchlogs.PutLogEvents for each batch. The spans are children of the span in the context of Writer.
+// A trace.TracerProvider of OpenTelemetry is set by WithTracerProvider(awsteeotel.TracerProvider(tp)).
+func WithTracerProvider(tp TracerProvider) Option {
+	return func(app *AWSTee) {
+		if tp != nil {
+			app.tracer = tp.Tracer(tracerName)
+		}
+	}
+}
+
+// WithDestination adds a destination opened by open for each output name, in addition to the s3 and cloudwatch logs ones of the config.
+// The destination gets the same lines as the others, and is closed with them by Close.
+// It is flushed by Flush if it has the method Flush(context.Context) error. name is used for the logs and the errors.
+// It is not written concurrently, even if the writer of awstee is.
+func WithDestination(name string, open func(ctx context.Context, outputName string) (io.WriteCloser, error)) Option {
+	return func(app *AWSTee) {
+		if open != nil {
+			// copy not to share the slice with the AWSTee that the options override
+			app.destinations = append(app.destinations[:len(app.destinations):len(app.destinations)], customDestination{
+				name: name,
+				open: open,
+			})
+		}
+	}
+}
+
+type customDestination struct {
+	name string
+	open func(ctx context.Context, outputName string) (io.WriteCloser, error)
+}
+
+// namedDestination names the destination of WithDestination in the errors and the results.
+type namedDestination struct {
+	io.WriteCloser
+	name string
+}
+
+func (d namedDestination) Flush(ctx context.Context) error {
+	if f, ok := d.WriteCloser.(flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+func (d namedDestination) String() string {
+	return d.name
+}
+
+// with returns a shallow copy of app with opts applied.
+func (app *AWSTee) with(opts ...Option) *AWSTee {
+	if len(opts) == 0 {
+		return app
+	}
+	copied := *app
+	for _, opt := range opts {
+		opt(&copied)
+	}
+	return &copied
+}
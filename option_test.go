@@ -0,0 +1,253 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithLogger(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&s3.HeadObjectOutput{}, &smithy.GenericAPIError{Code: "Forbidden"},
+	).Times(1)
+
+	cfg := &Config{
+		S3: &S3Config{
+			URLPrefix:      "s3://awstee-example-com/logs/",
+			AllowOverwrite: true,
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	app, err := NewWithClient(cfg, AWSClient{S3: s3Client}, WithLogger(logger))
+	require.NoError(t, err)
+	_, err = app.DryRun(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), `msg="check s3 object"`)
+}
+
+func TestNewWithOptions(t *testing.T) {
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("hoge")}},
+		}, nil,
+	).Times(1)
+	now := time.Date(2022, 6, 3, 17, 28, 48, 0, time.UTC)
+	var events []types.InputLogEvent
+	cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			events = append(events, input.LogEvents...)
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).AnyTimes()
+
+	cfg := &Config{
+		AWSRegion:       "ap-northeast-1",
+		PrefixTimestamp: "rfc3339",
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup: "/awstee/logs",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := New(context.Background(), cfg,
+		WithS3Client(NewMockS3Client(ctrl)),
+		WithCloudwatchLogsClient(cloudwatchLogsClient),
+		WithClock(func() time.Time { return now }),
+	)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	w, err := app.Writer(context.Background(), "hoge.log", WithLogger(logger))
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Len(t, events, 1)
+	require.EqualValues(t, "2022-06-03T17:28:48Z hoge", *events[0].Message)
+	require.EqualValues(t, now.UnixMilli(), *events[0].Timestamp)
+	require.Contains(t, buf.String(), `msg="cloudwatch logs destination"`)
+	require.Same(t, slog.Default(), app.logger)
+}
+
+func TestWithErrorHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("hoge")}},
+		}, nil,
+	).Times(1)
+	cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, errors.New("throttled"),
+	).Times(1)
+
+	cfg := &Config{
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup:      "/awstee/logs",
+			FlushInterval: "1h",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	var mu sync.Mutex
+	var errs []string
+	app, err := NewWithClient(cfg, AWSClient{CloudwatchLogs: cloudwatchLogsClient}, WithErrorHandler(func(dest string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, dest+": "+err.Error())
+	}))
+	require.NoError(t, err)
+	w, err := app.Writer(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return w.Stats().Destinations[0].Buffered == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Error(t, w.Flush(context.Background()))
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(errs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.EqualValues(t, "LogGroup=/awstee/logs, LogStream=hoge: put log events: throttled", errs[0])
+	_, err = io.WriteString(w, "fuga\n")
+	require.EqualError(t, err, "LogGroup=/awstee/logs, LogStream=hoge: put log events: throttled", "the error is also returned by the later write of the only destination")
+	require.EqualError(t, w.Close(), "LogGroup=/awstee/logs, LogStream=hoge: put log events: throttled")
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, errs, 1)
+}
+
+type testDestination struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (d *testDestination) Close() error {
+	d.closed = true
+	return nil
+}
+
+func TestWithDestination(t *testing.T) {
+	cfg := &Config{
+		LinePrefix: "[app] ",
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{})
+	require.NoError(t, err)
+	_, err = app.Writer(context.Background(), "hoge.log")
+	require.EqualError(t, err, "no destination")
+
+	dests := make(map[string]*testDestination)
+	w, err := app.Writer(context.Background(), "hoge.log", WithDestination("memory", func(_ context.Context, outputName string) (io.WriteCloser, error) {
+		d := &testDestination{}
+		dests[outputName] = d
+		return d, nil
+	}))
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Len(t, dests, 1)
+	require.EqualValues(t, "[app] hoge\n", dests["hoge.log"].String())
+	require.True(t, dests["hoge.log"].closed)
+	require.Empty(t, app.destinations, "the options of Writer do not change app")
+
+	_, err = app.Writer(context.Background(), "hoge.log", WithDestination("broken", func(context.Context, string) (io.WriteCloser, error) {
+		return nil, errors.New("unavailable")
+	}))
+	require.EqualError(t, err, "broken writer: unavailable")
+}
+
+func TestNewWithAWSConfig(t *testing.T) {
+	var requests []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	cfg := &Config{
+		AWSRegion: "us-east-1",
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	awsCfg := aws.Config{
+		Region:      "ap-northeast-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}
+	app, err := NewWithAWSConfig(context.Background(), cfg, awsCfg, WithS3Options(func(o *s3.Options) {
+		o.EndpointResolver = s3.EndpointResolverFromURL(srv.URL)
+		o.UsePathStyle = true
+	}))
+	require.NoError(t, err)
+	destinations, err := app.DryRun(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	require.EqualValues(t, []string{"s3://awstee-example-com/logs/hoge.log"}, destinations)
+	require.EqualValues(t, []string{"HEAD /awstee-example-com/logs/hoge.log"}, requests)
+}
+
+func TestAppIDUserAgent(t *testing.T) {
+	var userAgents []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	cfg := &Config{
+		AppID: "team-a",
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	awsCfg := aws.Config{
+		Region:      "ap-northeast-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}
+	app, err := NewWithAWSConfig(context.Background(), cfg, awsCfg, WithS3Options(func(o *s3.Options) {
+		o.EndpointResolver = s3.EndpointResolverFromURL(srv.URL)
+		o.UsePathStyle = true
+	}))
+	require.NoError(t, err)
+	_, err = app.DryRun(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	require.Len(t, userAgents, 1)
+	require.Contains(t, userAgents[0], "lib/awstee")
+	require.Contains(t, userAgents[0], "app/team-a")
+}
@@ -0,0 +1,400 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// OverflowBlock blocks the writes until the destination takes them, so that a slow destination slows down the producer.
+	OverflowBlock = "block"
+	// OverflowBuffer queues the writes up to max_bytes, and blocks the writes only when the queue is full.
+	OverflowBuffer = "buffer"
+	// OverflowDrop queues the writes up to max_bytes, and drops the lines not fitting in the queue.
+	OverflowDrop = "drop"
+
+	defaultOverflowMaxBytes = 64 * 1024 * 1024
+	overflowPattern         = "awstee-overflow-*"
+	overflowReadSize        = 64 * 1024
+)
+
+// OverflowConfig is what is done with the writes when a destination can not keep up with the input.
+// With policy: block (default), the writes wait for the slowest destination, and so does the producer through the pipe.
+// With buffer or drop, each destination has a queue of max_bytes, in memory or in a file in dir if it is set.
+// A full queue blocks the writes with buffer, and drops the lines with drop, counting and logging the dropped bytes.
+type OverflowConfig struct {
+	Policy   string `yaml:"policy,omitempty"`
+	MaxBytes int64  `yaml:"max_bytes,omitempty"`
+	Dir      string `yaml:"dir,omitempty"`
+
+	// policy and maxBytes are the ones used, resolved by Restrict.
+	// Policy and MaxBytes are kept as set, so that Restrict can be called again after they are changed.
+	policy   string
+	maxBytes int64
+}
+
+func (cfg *OverflowConfig) Enabled() bool {
+	return cfg.policy == OverflowBuffer || cfg.policy == OverflowDrop
+}
+
+func (cfg *OverflowConfig) Restrict() error {
+	return cfg.restrict("")
+}
+
+// restrict resolves the policy used to Policy, or to policy if Policy is not set, or to block.
+func (cfg *OverflowConfig) restrict(policy string) error {
+	cfg.policy = cfg.Policy
+	if cfg.policy == "" {
+		cfg.policy = policy
+	}
+	switch cfg.policy {
+	case "":
+		cfg.policy = OverflowBlock
+	case OverflowBlock, OverflowBuffer, OverflowDrop:
+	default:
+		return fmt.Errorf("overflow policy must be one of %s, %s, %s", OverflowBlock, OverflowBuffer, OverflowDrop)
+	}
+	if cfg.MaxBytes < 0 {
+		return errors.New("overflow max_bytes must not be negative")
+	}
+	cfg.maxBytes = cfg.MaxBytes
+	if cfg.maxBytes == 0 {
+		cfg.maxBytes = defaultOverflowMaxBytes
+	}
+	return nil
+}
+
+// overflowQueue is the queue of an overflowWriter, not safe for concurrent use.
+type overflowQueue interface {
+	push(p []byte) error
+	// pop removes and returns the data from the head, not more than overflowReadSize. It is valid until the next pop.
+	pop() ([]byte, error)
+	Close() error
+}
+
+// ringQueue is the ring buffer of the writes in memory, which grows by doubling as the queue does.
+// The data popped is copied out of the ring, so that the pushes can reuse the space while it is written to the destination.
+type ringQueue struct {
+	buf  []byte
+	head int
+	size int
+	out  []byte
+}
+
+func (q *ringQueue) push(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if q.size+len(p) > len(q.buf) {
+		q.grow(q.size + len(p))
+	}
+	tail := (q.head + q.size) % len(q.buf)
+	n := copy(q.buf[tail:], p)
+	copy(q.buf, p[n:])
+	q.size += len(p)
+	return nil
+}
+
+// grow reallocates the ring to fit n bytes, moving the data to the start.
+func (q *ringQueue) grow(n int) {
+	size := max(len(q.buf)*2, 4096)
+	for size < n {
+		size *= 2
+	}
+	buf := make([]byte, size)
+	if q.size > 0 {
+		m := copy(buf, q.buf[q.head:min(q.head+q.size, len(q.buf))])
+		copy(buf[m:], q.buf[:q.size-m])
+	}
+	q.buf, q.head = buf, 0
+}
+
+func (q *ringQueue) pop() ([]byte, error) {
+	n := min(q.size, overflowReadSize, len(q.buf)-q.head)
+	if cap(q.out) < n {
+		q.out = make([]byte, overflowReadSize)
+	}
+	p := q.out[:n]
+	copy(p, q.buf[q.head:q.head+n])
+	q.head = (q.head + n) % len(q.buf)
+	q.size -= n
+	if q.size == 0 {
+		q.head = 0
+	}
+	return p, nil
+}
+
+func (q *ringQueue) Close() error {
+	q.buf, q.out = nil, nil
+	return nil
+}
+
+// fileQueue appends the writes to a temporary file, and reads them from the head.
+// The file is truncated whenever it is read to the end, and removed by Close.
+type fileQueue struct {
+	f      *os.File
+	size   int64
+	offset int64
+}
+
+func newFileQueue(dir string) (*fileQueue, error) {
+	f, err := os.CreateTemp(dir, overflowPattern)
+	if err != nil {
+		return nil, fmt.Errorf("create overflow queue: %w", err)
+	}
+	return &fileQueue{f: f}, nil
+}
+
+func (q *fileQueue) push(p []byte) error {
+	n, err := q.f.WriteAt(p, q.size)
+	q.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write overflow queue: %w", err)
+	}
+	return nil
+}
+
+func (q *fileQueue) pop() ([]byte, error) {
+	p := make([]byte, min(q.size-q.offset, overflowReadSize))
+	n, err := q.f.ReadAt(p, q.offset)
+	if err != nil && !(err == io.EOF && n == len(p)) {
+		return nil, fmt.Errorf("read overflow queue: %w", err)
+	}
+	q.offset += int64(n)
+	if q.offset >= q.size {
+		q.offset, q.size = 0, 0
+		if err := q.f.Truncate(0); err != nil {
+			return nil, fmt.Errorf("truncate overflow queue: %w", err)
+		}
+	}
+	return p, nil
+}
+
+func (q *fileQueue) Close() error {
+	q.f.Close()
+	return os.Remove(q.f.Name())
+}
+
+// overflowWriter decouples a destination from the writes by a bounded queue, drained by a goroutine.
+// The first error of the destination is latched: the writes after it fail, and Close returns it.
+type overflowWriter struct {
+	io.WriteCloser
+	cfg    *OverflowConfig
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    overflowQueue
+	queued   int64
+	closed   bool
+	draining bool
+	err      error
+	done     chan struct{}
+
+	// dropping is set from a dropped line until the end of it, and last is the last byte queued.
+	// episode is the bytes dropped since the queue is full, and dropped is the bytes dropped in total.
+	dropping bool
+	last     byte
+	episode  int64
+	dropped  int64
+}
+
+func newOverflowWriter(logger *slog.Logger, cfg *OverflowConfig, w io.WriteCloser) (*overflowWriter, error) {
+	var queue overflowQueue = &ringQueue{}
+	if cfg.Dir != "" {
+		var err error
+		if queue, err = newFileQueue(cfg.Dir); err != nil {
+			return nil, err
+		}
+	}
+	o := &overflowWriter{
+		WriteCloser: w,
+		cfg:         cfg,
+		logger:      logger.With("destination", fmt.Sprint(w)),
+		queue:       queue,
+		last:        '\n',
+		done:        make(chan struct{}),
+	}
+	o.cond = sync.NewCond(&o.mu)
+	go o.drain()
+	return o, nil
+}
+
+// Write queues p. When p does not fit in the queue, it waits for the queue with buffer,
+// and drops the lines of p with drop: a line partially queued is terminated, and the rest of a dropped line is dropped too.
+// A write larger than max_bytes is queued alone into the empty queue.
+func (o *overflowWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if n == 0 {
+		return 0, nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.dropping {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			o.drop(p)
+			return n, nil
+		}
+		o.drop(p[:i+1])
+		p = p[i+1:]
+		o.dropping = false
+		if len(p) == 0 {
+			return n, nil
+		}
+	}
+	for {
+		if o.err != nil {
+			return 0, o.err
+		}
+		if o.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if o.fits(len(p)) {
+			if o.episode > 0 {
+				o.logger.Info("destination caught up, the lines are not dropped any more", "dropped_bytes", o.episode)
+				o.episode = 0
+			}
+			if err := o.push(p); err != nil {
+				return 0, err
+			}
+			return n, nil
+		}
+		if o.cfg.policy == OverflowDrop {
+			if o.episode == 0 {
+				o.logger.Warn("destination can not keep up, the lines are dropped", "queued_bytes", o.queued)
+			}
+			if o.last != '\n' {
+				// terminate the line partially queued, not to join it with the next one
+				if err := o.push([]byte("\n")); err != nil {
+					return 0, err
+				}
+			}
+			o.drop(p)
+			o.dropping = p[len(p)-1] != '\n'
+			return n, nil
+		}
+		o.cond.Wait()
+	}
+}
+
+func (o *overflowWriter) fits(n int) bool {
+	return o.queued == 0 || o.queued+int64(n) <= o.cfg.maxBytes
+}
+
+// push queues p. It fails the writes after it if it fails, because the data queued is not complete any more.
+func (o *overflowWriter) push(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if err := o.queue.push(p); err != nil {
+		o.err = err
+		return err
+	}
+	o.queued += int64(len(p))
+	o.last = p[len(p)-1]
+	o.cond.Broadcast()
+	return nil
+}
+
+func (o *overflowWriter) drop(p []byte) {
+	o.episode += int64(len(p))
+	atomic.AddInt64(&o.dropped, int64(len(p)))
+}
+
+// drain writes the queued data to the destination until Close, or until the destination fails.
+func (o *overflowWriter) drain() {
+	defer close(o.done)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for o.err == nil {
+		if o.queued == 0 {
+			if o.closed {
+				return
+			}
+			o.cond.Wait()
+			continue
+		}
+		p, err := o.queue.pop()
+		if err != nil {
+			o.err = err
+			break
+		}
+		o.draining = true
+		o.mu.Unlock()
+		_, err = o.WriteCloser.Write(p)
+		o.mu.Lock()
+		o.draining = false
+		o.queued -= int64(len(p))
+		if err != nil {
+			o.err = err
+		}
+		o.cond.Broadcast()
+	}
+	o.cond.Broadcast()
+}
+
+// Flush waits for the queue to be written to the destination, and flushes the destination.
+func (o *overflowWriter) Flush(ctx context.Context) error {
+	o.mu.Lock()
+	for o.err == nil && (o.queued > 0 || o.draining) {
+		o.cond.Wait()
+	}
+	err := o.err
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if f, ok := o.WriteCloser.(flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+// Close writes the rest of the queue to the destination, and closes it.
+func (o *overflowWriter) Close() error {
+	o.mu.Lock()
+	o.closed = true
+	o.cond.Broadcast()
+	o.mu.Unlock()
+	<-o.done
+	if dropped := atomic.LoadInt64(&o.dropped); dropped > 0 {
+		o.logger.Warn("the lines were dropped by overflow: drop", "dropped_bytes", dropped)
+	}
+	o.queue.Close()
+	err := o.WriteCloser.Close()
+	if err == nil {
+		err = o.err
+	}
+	return err
+}
+
+func (o *overflowWriter) String() string {
+	return fmt.Sprint(o.WriteCloser)
+}
+
+func (o *overflowWriter) Stats() DestinationStats {
+	stats := DestinationStats{Name: o.String()}
+	if r, ok := o.WriteCloser.(statsReporter); ok {
+		stats = r.Stats()
+	}
+	o.mu.Lock()
+	stats.Queued = o.queued
+	o.mu.Unlock()
+	stats.OverflowDropped = atomic.LoadInt64(&o.dropped)
+	return stats
+}
+
+func (o *overflowWriter) results() []DestinationResult {
+	if r, ok := o.WriteCloser.(resultReporter); ok {
+		return r.results()
+	}
+	return []DestinationResult{{Name: o.String()}}
+}
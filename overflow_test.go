@@ -0,0 +1,156 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// gatedWriter blocks the writes until the gate is opened.
+type gatedWriter struct {
+	gate chan struct{}
+	buf  bytes.Buffer
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	return w.buf.Write(p)
+}
+
+func TestOverflowWriterBuffer(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		dest := &gatedWriter{gate: make(chan struct{})}
+		cfg := &OverflowConfig{Policy: OverflowBuffer, MaxBytes: 10, Dir: dir}
+		require.NoError(t, cfg.Restrict())
+		w, err := newOverflowWriter(slog.Default(), cfg, newTestWriteCloser(dest, func() error { return nil }))
+		require.NoError(t, err)
+		// the writes do not wait for the destination until the queue is full
+		for _, s := range []string{"aaaa\n", "bbbb\n"} {
+			_, err := io.WriteString(w, s)
+			require.NoError(t, err)
+		}
+		require.EqualValues(t, 10, w.Stats().Queued)
+
+		written := make(chan struct{})
+		go func() {
+			io.WriteString(w, "cccc\n")
+			close(written)
+		}()
+		select {
+		case <-written:
+			t.Fatal("the write does not wait for the full queue")
+		default:
+		}
+		close(dest.gate)
+		<-written
+		require.NoError(t, w.Close())
+		require.Equal(t, "aaaa\nbbbb\ncccc\n", dest.buf.String())
+		require.Zero(t, w.Stats().OverflowDropped)
+		if dir != "" {
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Empty(t, entries, "the queue file is removed")
+		}
+	}
+}
+
+func TestOverflowWriterDrop(t *testing.T) {
+	dest := &gatedWriter{gate: make(chan struct{})}
+	cfg := &OverflowConfig{Policy: OverflowDrop, MaxBytes: 10}
+	require.NoError(t, cfg.Restrict())
+	w, err := newOverflowWriter(slog.Default(), cfg, newTestWriteCloser(dest, func() error { return nil }))
+	require.NoError(t, err)
+	for _, s := range []string{
+		"aaaa\nbb",   // queued
+		"cccc\n",     // dropped, and the line partially queued is terminated
+		"dddd",       // dropped
+		"dd\neeee\n", // dropped, the rest of the dropped line and the line not fitting
+		"ffff",       // dropped
+	} {
+		n, err := io.WriteString(w, s)
+		require.NoError(t, err)
+		require.Equal(t, len(s), n, "the dropped writes do not fail")
+	}
+	require.EqualValues(t, 21, w.Stats().OverflowDropped)
+
+	close(dest.gate)
+	require.NoError(t, w.Flush(context.Background()))
+	_, err = io.WriteString(w, "ff\ngggg\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, "aaaa\nbb\ngggg\n", dest.buf.String())
+	require.EqualValues(t, 24, w.Stats().OverflowDropped)
+}
+
+func TestOverflowWriterDestinationError(t *testing.T) {
+	cfg := &OverflowConfig{Policy: OverflowBuffer, MaxBytes: 1024}
+	require.NoError(t, cfg.Restrict())
+	w, err := newOverflowWriter(slog.Default(), cfg, newTestWriteCloser(&failingWriter{n: 1}, func() error { return nil }))
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	// the queued writes are written together, flush to write hoge alone
+	require.NoError(t, w.Flush(context.Background()))
+	_, err = io.WriteString(w, "fuga\n")
+	require.NoError(t, err, "the error of the destination is not known yet")
+	require.EqualError(t, w.Flush(context.Background()), "connection reset")
+	_, err = io.WriteString(w, "piyo\n")
+	require.EqualError(t, err, "connection reset", "the writes after the error fail")
+	require.EqualError(t, w.Close(), "connection reset")
+}
+
+func TestAWSTeeWriterOverflow(t *testing.T) {
+	cfg := &Config{Overflow: OverflowConfig{Policy: OverflowDrop, MaxBytes: 5}}
+	require.NoError(t, cfg.Restrict())
+	slow := &gatedWriter{gate: make(chan struct{})}
+	app, err := NewWithClient(cfg, AWSClient{},
+		WithDestination("slow", func(context.Context, string) (io.WriteCloser, error) {
+			return newTestWriteCloser(slow, func() error { return nil }), nil
+		}),
+	)
+	require.NoError(t, err)
+	w, err := app.Writer(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	input := strings.Repeat("hoge\n", 100)
+	_, err = io.WriteString(w, input)
+	require.NoError(t, err, "the slow destination does not block the writes")
+	_, err = io.WriteString(w, input)
+	require.NoError(t, err)
+	stats := w.Stats()
+	require.Equal(t, "slow", stats.Destinations[0].Name)
+	require.EqualValues(t, 500, stats.Destinations[0].OverflowDropped)
+	close(slow.gate)
+	require.NoError(t, w.Close())
+	require.Equal(t, input, slow.buf.String())
+}
+
+func TestRingQueue(t *testing.T) {
+	q := &ringQueue{}
+	var popped bytes.Buffer
+	var pushed bytes.Buffer
+	// the pushes and the pops wrap around the ring, and grow it
+	for i := 0; i < 1000; i++ {
+		p := bytes.Repeat([]byte{byte('a' + i%26)}, 100+i*7)
+		require.NoError(t, q.push(p))
+		pushed.Write(p)
+		if i%3 != 0 {
+			p, err := q.pop()
+			require.NoError(t, err)
+			popped.Write(p)
+		}
+	}
+	for q.size > 0 {
+		p, err := q.pop()
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(p), overflowReadSize)
+		popped.Write(p)
+	}
+	require.Equal(t, pushed.Bytes(), popped.Bytes())
+	require.NoError(t, q.Close())
+}
@@ -0,0 +1,87 @@
+package awstee
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// pipelineDepth is the writes queued for the pipeline, the writes wait for it when it is full.
+const pipelineDepth = 64
+
+var pipelineBufferPool = sync.Pool{
+	New: func() any {
+		return new([]byte)
+	},
+}
+
+// pipelineWriter runs the CPU heavy stages of the writes, such as the line processors, in a dedicated goroutine between the tee and the destinations,
+// so that a write (and the echo of the standard output) returns as soon as it is queued.
+// The first error of next is latched and returned by the writes after it. Write is not safe for concurrent use, AWSTeeWriter serializes it.
+type pipelineWriter struct {
+	next   io.Writer
+	queue  chan *[]byte
+	queued sync.WaitGroup
+	err    atomic.Pointer[error]
+	done   chan struct{}
+}
+
+func newPipelineWriter(next io.Writer) *pipelineWriter {
+	w := &pipelineWriter{
+		next:  next,
+		queue: make(chan *[]byte, pipelineDepth),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *pipelineWriter) run() {
+	defer close(w.done)
+	for bufp := range w.queue {
+		if w.Err() == nil {
+			if _, err := w.next.Write(*bufp); err != nil {
+				w.err.CompareAndSwap(nil, &err)
+			}
+		}
+		*bufp = (*bufp)[:0]
+		pipelineBufferPool.Put(bufp)
+		w.queued.Done()
+	}
+}
+
+// Write queues a copy of p.
+func (w *pipelineWriter) Write(p []byte) (int, error) {
+	if err := w.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	bufp := pipelineBufferPool.Get().(*[]byte)
+	*bufp = append((*bufp)[:0], p...)
+	w.queued.Add(1)
+	w.queue <- bufp
+	return len(p), nil
+}
+
+// Err returns the latched error of next.
+func (w *pipelineWriter) Err() error {
+	if err := w.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// wait waits for the queued writes to be written to next, and returns the latched error.
+func (w *pipelineWriter) wait() error {
+	w.queued.Wait()
+	return w.Err()
+}
+
+// Close writes the queued writes to next, and stops the pipeline.
+func (w *pipelineWriter) Close() error {
+	close(w.queue)
+	<-w.done
+	return w.Err()
+}
@@ -0,0 +1,72 @@
+package awstee
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSTeeWriterPipeline(t *testing.T) {
+	dest := &gatedWriter{gate: make(chan struct{})}
+	w := newAWSTeeWriter(
+		[]io.WriteCloser{newTestWriteCloser(dest, func() error { return nil })},
+		newPrefixProcessor("[app] "),
+	)
+	// the writes do not wait for the line processors and the destination
+	for _, p := range []string{"hoge\nfu", "ga\n", "piyo"} {
+		n, err := io.WriteString(w, p)
+		require.NoError(t, err)
+		require.EqualValues(t, len(p), n)
+	}
+	require.Zero(t, dest.buf.Len())
+	close(dest.gate)
+	require.NoError(t, w.Flush(context.Background()))
+	require.Equal(t, "[app] hoge\n[app] fuga\n", dest.buf.String(), "the writes queued before Flush are written")
+	require.NoError(t, w.Close())
+	require.Equal(t, "[app] hoge\n[app] fuga\n[app] piyo", dest.buf.String())
+}
+
+func TestPipelineWriterError(t *testing.T) {
+	w := newPipelineWriter(&failingWriter{n: 1})
+	for _, p := range []string{"hoge\n", "fuga\n"} {
+		_, err := io.WriteString(w, p)
+		require.NoError(t, err)
+	}
+	require.EqualError(t, w.wait(), "connection reset")
+	_, err := io.WriteString(w, "piyo\n")
+	require.EqualError(t, err, "connection reset", "the error is latched")
+	require.EqualError(t, w.Close(), "connection reset")
+}
+
+func TestAWSTeeWriterCloseWithContextTearsDownPipeline(t *testing.T) {
+	dest := &gatedWriter{gate: make(chan struct{})}
+	w := newAWSTeeWriter(
+		[]io.WriteCloser{newTestWriteCloser(dest, func() error {
+			close(dest.gate)
+			return nil
+		})},
+		newPrefixProcessor("[app] "),
+	)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		// the pipeline is full and the last write is blocked on it
+		for i := 0; i < pipelineDepth+2; i++ {
+			_, _ = io.WriteString(w, "hoge\n")
+		}
+	}()
+	require.Eventually(t, func() bool { return len(w.pipeline.queue) == pipelineDepth }, time.Second, 10*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var abortErr *CloseAbortedError
+	require.ErrorAs(t, w.CloseWithContext(ctx), &abortErr)
+	<-written
+	select {
+	case <-w.pipeline.done:
+	case <-time.After(time.Second):
+		t.Fatal("the pipeline is not torn down after the blocked write returns")
+	}
+}
@@ -0,0 +1,119 @@
+package awstee
+
+import (
+	"sync"
+
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// eventArenaSlabSize is the number of the events whose values are allocated at once by cloudwatchEventArena.
+const eventArenaSlabSize = 256
+
+// eventBatchPool is the pool of the batches of cloudwatch logs events put successfully, to be reused for the next batches.
+var eventBatchPool = sync.Pool{
+	New: func() any {
+		return new([]cwtypes.InputLogEvent)
+	},
+}
+
+// getEventBatch returns an empty batch, whose capacity is at least size.
+func getEventBatch(size int) []cwtypes.InputLogEvent {
+	batch := *eventBatchPool.Get().(*[]cwtypes.InputLogEvent)
+	if cap(batch) < size {
+		return make([]cwtypes.InputLogEvent, 0, size)
+	}
+	return batch
+}
+
+// putEventBatch returns batch to the pool. batch must not be referred any more, its events are cleared not to keep the messages alive.
+func putEventBatch(batch []cwtypes.InputLogEvent) {
+	if cap(batch) == 0 {
+		return
+	}
+	clear(batch[:cap(batch)])
+	batch = batch[:0]
+	eventBatchPool.Put(&batch)
+}
+
+// cloudwatchEventArena allocates the message and the timestamp of the events in slabs, instead of two allocations per line.
+// A slab is kept alive while any event of it is. It is not safe for concurrent use.
+type cloudwatchEventArena struct {
+	messages   []string
+	timestamps []int64
+}
+
+func (a *cloudwatchEventArena) event(message string, timestamp int64) cwtypes.InputLogEvent {
+	if len(a.messages) == cap(a.messages) {
+		// a new slab, the pointers into the former one stay valid
+		a.messages = make([]string, 0, eventArenaSlabSize)
+		a.timestamps = make([]int64, 0, eventArenaSlabSize)
+	}
+	a.messages = append(a.messages, message)
+	a.timestamps = append(a.timestamps, timestamp)
+	return cwtypes.InputLogEvent{
+		Message:   &a.messages[len(a.messages)-1],
+		Timestamp: &a.timestamps[len(a.timestamps)-1],
+	}
+}
+
+// cloudwatchLineChunk is the events of the lines of a read by the scanner, passed to the worker at once instead of one by one.
+type cloudwatchLineChunk struct {
+	events []cwtypes.InputLogEvent
+	// ends is the number of the lines of the chunk up to each event, including the empty lines not sent as events
+	ends []int
+	// starts is the number of the lines of the chunk before each event, which is the one of ends but for the pieces of a line split
+	starts []int
+	// lines is the number of the lines of the chunk
+	lines int
+	// text is the bytes of the messages, converted to a string at once
+	text []byte
+	// offsets is the end of each message in text
+	offsets []int
+}
+
+var lineChunkPool = sync.Pool{
+	New: func() any {
+		return new(cloudwatchLineChunk)
+	},
+}
+
+func getLineChunk() *cloudwatchLineChunk {
+	return lineChunkPool.Get().(*cloudwatchLineChunk)
+}
+
+// putLineChunk returns c to the pool. Its events must have been copied, they are cleared not to keep the messages alive.
+func putLineChunk(c *cloudwatchLineChunk) {
+	clear(c.events)
+	c.events = c.events[:0]
+	c.ends = c.ends[:0]
+	c.starts = c.starts[:0]
+	c.lines = 0
+	c.text = c.text[:0]
+	c.offsets = c.offsets[:0]
+	lineChunkPool.Put(c)
+}
+
+// add adds a token of the lines to the chunk, and counts the line if complete. The empty token is not an event.
+func (c *cloudwatchLineChunk) add(line []byte, complete bool) {
+	start := c.lines
+	if complete {
+		c.lines++
+	}
+	if len(line) == 0 {
+		return
+	}
+	c.text = append(c.text, line...)
+	c.offsets = append(c.offsets, len(c.text))
+	c.starts = append(c.starts, start)
+	c.ends = append(c.ends, c.lines)
+}
+
+// build makes the events of the lines added, whose messages share a string of them, stamped by timestamp.
+func (c *cloudwatchLineChunk) build(arena *cloudwatchEventArena, timestamp int64) {
+	text := string(c.text)
+	start := 0
+	for _, end := range c.offsets {
+		c.events = append(c.events, arena.event(text[start:end], timestamp))
+		start = end
+	}
+}
@@ -0,0 +1,80 @@
+package awstee
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBatchPool(t *testing.T) {
+	batch := getEventBatch(50)
+	require.Empty(t, batch)
+	require.GreaterOrEqual(t, cap(batch), 50)
+	batch = append(batch, cwtypes.InputLogEvent{Message: aws.String("hoge")})
+	putEventBatch(batch)
+
+	reused := getEventBatch(10)
+	require.Empty(t, reused)
+	for _, e := range reused[:cap(reused)] {
+		require.Nil(t, e.Message, "the events are cleared")
+	}
+}
+
+func TestCloudwatchEventArena(t *testing.T) {
+	var arena cloudwatchEventArena
+	events := make([]cwtypes.InputLogEvent, 0, eventArenaSlabSize*2+1)
+	for i := 0; i < cap(events); i++ {
+		events = append(events, arena.event(fmt.Sprintf("line %d", i), int64(i)))
+	}
+	for i, e := range events {
+		require.Equal(t, fmt.Sprintf("line %d", i), *e.Message, "the events of the former slabs are kept")
+		require.EqualValues(t, i, *e.Timestamp)
+	}
+	allocs := testing.AllocsPerRun(1000, func() {
+		arena.event("hoge", 0)
+	})
+	require.Less(t, allocs, 0.1, "the values are allocated by slabs")
+}
+
+func TestLineWriterAllocs(t *testing.T) {
+	w := newLineWriter(io.Discard, []lineProcessor{func(line []byte) []byte { return line }})
+	p := []byte("hoge\nfuga\npiyo\n")
+	allocs := testing.AllocsPerRun(1000, func() {
+		w.Write(p)
+	})
+	require.Zero(t, allocs, "the buffers are reused by the writes")
+}
+
+func TestCloudwatchLineChunk(t *testing.T) {
+	var arena cloudwatchEventArena
+	chunk := getLineChunk()
+	for _, line := range []string{"hoge", "", "fuga", "", ""} {
+		chunk.add([]byte(line), true)
+	}
+	chunk.build(&arena, 1)
+	require.Equal(t, 5, chunk.lines)
+	require.Equal(t, []int{1, 3}, chunk.ends, "the empty lines are counted, not events")
+	require.Equal(t, []int{0, 2}, chunk.starts)
+	require.Len(t, chunk.events, 2)
+	require.Equal(t, "hoge", *chunk.events[0].Message)
+	require.Equal(t, "fuga", *chunk.events[1].Message)
+	putLineChunk(chunk)
+
+	reused := getLineChunk()
+	require.Zero(t, reused.lines)
+	require.Empty(t, reused.events)
+	require.Empty(t, reused.text)
+
+	// a line split is counted by its last piece
+	reused.add([]byte("hoge"), false)
+	reused.add([]byte("fuga"), true)
+	reused.add([]byte("piyo"), true)
+	require.Equal(t, 2, reused.lines)
+	require.Equal(t, []int{0, 0, 1}, reused.starts)
+	require.Equal(t, []int{0, 1, 2}, reused.ends)
+	putLineChunk(reused)
+}
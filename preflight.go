@@ -0,0 +1,105 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Preflight probes the permissions of the destinations of outputName with cheap calls, before the capture writes anything.
+// For s3, HeadObject checks the object does not exist (unless allow_overwrite), and a multipart upload of the object is created and aborted,
+// so that nothing is left in the bucket. For cloudwatch logs, DescribeLogStreams checks the log group and the log stream.
+// Nothing is created nor written, so CreateLogStream and PutLogEvents are not probed.
+// Each failed result names the missing permission, e.g. "(s3:PutObject permission is required)".
+func (app *AWSTee) Preflight(ctx context.Context, outputName string) []*ValidationResult {
+	app.logger.Debug("try preflight")
+	results := make([]*ValidationResult, 0)
+	add := func(check string, err error) {
+		results = append(results, &ValidationResult{Check: check, Err: err})
+	}
+	s3Configs, cloudwatchConfigs := app.cfg.destinations(outputName)
+	if len(s3Configs) == 0 && len(cloudwatchConfigs) == 0 {
+		add("destination is configured", errors.New("no destination"))
+	}
+	for _, cfg := range s3Configs {
+		client := app.s3Client(cfg)
+		bucket, key := s3ObjectLocation(cfg, outputName)
+		location := fmt.Sprintf("s3://%s/%s", bucket, key)
+		if !cfg.AllowOverwrite {
+			exists, err := s3ObjectAlreadyExists(ctx, client, bucket, key)
+			if err == nil && exists {
+				err = fmt.Errorf("%s is already exists, not allow overwrite", location)
+			}
+			add(fmt.Sprintf("s3 object %s does not exist", location), preflightPermission(err, &cfg.Credentials, "s3:GetObject", "s3:ListBucket"))
+		}
+		probeS3Upload(ctx, client, cfg, bucket, key, add)
+	}
+	for _, cfg := range cloudwatchConfigs {
+		logStream := cloudwatchLogStreamName(outputName)
+		output, err := app.cloudwatchClient(cfg).DescribeLogStreams(ctx, &cloudwatchlogs.DescribeLogStreamsInput{
+			LogGroupName:        aws.String(cfg.LogGroup),
+			LogStreamNamePrefix: aws.String(logStream),
+		})
+		switch {
+		case err == nil:
+			add(fmt.Sprintf("cloudwatch log group %s exists", cfg.LogGroup), nil)
+		case isLogGroupNotFound(err) && cfg.CreateLogGroup:
+			// the log group and the log stream are created by the capture, creating them here is not a probe any more
+			add(fmt.Sprintf("cloudwatch log group %s does not exist, but create_log_group is enabled (logs:CreateLogGroup is not probed)", cfg.LogGroup), nil)
+			continue
+		default:
+			add(fmt.Sprintf("cloudwatch log group %s exists", cfg.LogGroup), preflightPermission(err, &cfg.Credentials, "logs:DescribeLogStreams"))
+			continue
+		}
+		if hasLogStream(output.LogStreams, logStream) {
+			add(fmt.Sprintf("cloudwatch log stream %s exists in %s", logStream, cfg.LogGroup), nil)
+		} else {
+			// creating the log stream would not be a probe, it is left to the capture
+			add(fmt.Sprintf("cloudwatch log stream %s does not exist in %s, but it is created by the capture (logs:CreateLogStream is not probed)", logStream, cfg.LogGroup), nil)
+		}
+	}
+	return results
+}
+
+// probeS3Upload creates and aborts a multipart upload of the object, so that the permissions of the upload are probed and nothing is left in the bucket.
+func probeS3Upload(ctx context.Context, client S3Client, cfg *S3Config, bucket string, key string, add func(check string, err error)) {
+	location := fmt.Sprintf("s3://%s/%s", bucket, key)
+	output, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	add(fmt.Sprintf("s3 object %s can be uploaded", location), preflightPermission(err, &cfg.Credentials, "s3:PutObject"))
+	if err != nil {
+		return
+	}
+	_, err = client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: output.UploadId,
+	})
+	add(fmt.Sprintf("s3 upload of %s can be aborted", location), preflightPermission(err, &cfg.Credentials, "s3:AbortMultipartUpload"))
+}
+
+// preflightPermission names the missing permission of err, which is sts:AssumeRole if the role of the destination can not be assumed.
+func preflightPermission(err error, creds *CredentialsConfig, actions ...string) error {
+	var signingErr *v4.SigningError
+	if errors.As(err, &signingErr) && creds.AssumeRoleARN != "" {
+		return withRequiredPermission(err, "sts:AssumeRole on "+creds.AssumeRoleARN)
+	}
+	return withRequiredPermission(err, actions...)
+}
+
+func hasLogStream(logStreams []cwtypes.LogStream, name string) bool {
+	for _, logStream := range logStreams {
+		if aws.ToString(logStream.LogStreamName) == name {
+			return true
+		}
+	}
+	return false
+}
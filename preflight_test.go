@@ -0,0 +1,121 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreflight(t *testing.T) {
+	cases := []struct {
+		name        string
+		credentials CredentialsConfig
+		expect      func(s3Client *MockS3Client, cloudwatchLogsClient *MockCloudwatchLogsClient)
+		results     []string
+	}{
+		{
+			name: "ok",
+			expect: func(s3Client *MockS3Client, cloudwatchLogsClient *MockCloudwatchLogsClient) {
+				s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+					nil, &smithy.GenericAPIError{Code: "NotFound"},
+				).Times(1)
+				s3Client.EXPECT().CreateMultipartUpload(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+					&s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil,
+				).Times(1)
+				s3Client.EXPECT().AbortMultipartUpload(gomock.Any(), &s3.AbortMultipartUploadInput{
+					Bucket:   aws.String("awstee-example-com"),
+					Key:      aws.String("logs/hoge.log"),
+					UploadId: aws.String("upload-1"),
+				}, gomock.Any()).Return(&s3.AbortMultipartUploadOutput{}, nil).Times(1)
+				cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), &cloudwatchlogs.DescribeLogStreamsInput{
+					LogGroupName:        aws.String("/awstee/logs"),
+					LogStreamNamePrefix: aws.String("hoge"),
+				}, gomock.Any()).Return(
+					&cloudwatchlogs.DescribeLogStreamsOutput{LogStreams: []cwtypes.LogStream{
+						{LogStreamName: aws.String("hoge")},
+						{LogStreamName: aws.String("hoge2")},
+					}}, nil,
+				).Times(1)
+			},
+			results: []string{
+				"[OK] s3 object s3://awstee-example-com/logs/hoge.log does not exist",
+				"[OK] s3 object s3://awstee-example-com/logs/hoge.log can be uploaded",
+				"[OK] s3 upload of s3://awstee-example-com/logs/hoge.log can be aborted",
+				"[OK] cloudwatch log group /awstee/logs exists",
+				"[OK] cloudwatch log stream hoge exists in /awstee/logs",
+			},
+		},
+		{
+			name: "access denied",
+			expect: func(s3Client *MockS3Client, cloudwatchLogsClient *MockCloudwatchLogsClient) {
+				s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+					nil, &smithy.GenericAPIError{Code: "Forbidden"},
+				).Times(1)
+				s3Client.EXPECT().CreateMultipartUpload(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+					nil, &smithy.GenericAPIError{Code: "AccessDenied"},
+				).Times(1)
+				// the log stream is not created by the preflight
+				cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+					&cloudwatchlogs.DescribeLogStreamsOutput{LogStreams: []cwtypes.LogStream{{LogStreamName: aws.String("hoge2")}}}, nil,
+				).Times(1)
+			},
+			results: []string{
+				"[NG] s3 object s3://awstee-example-com/logs/hoge.log does not exist: api error Forbidden:  (s3:GetObject and s3:ListBucket permissions are required)",
+				"[NG] s3 object s3://awstee-example-com/logs/hoge.log can be uploaded: api error AccessDenied:  (s3:PutObject permission is required)",
+				"[OK] cloudwatch log group /awstee/logs exists",
+				"[OK] cloudwatch log stream hoge does not exist in /awstee/logs, but it is created by the capture (logs:CreateLogStream is not probed)",
+			},
+		},
+		{
+			name:        "role can not be assumed",
+			credentials: CredentialsConfig{AssumeRoleARN: "arn:aws:iam::123456789012:role/awstee"},
+			expect: func(s3Client *MockS3Client, cloudwatchLogsClient *MockCloudwatchLogsClient) {
+				assumeRoleErr := &v4.SigningError{Err: &smithy.GenericAPIError{Code: "AccessDenied"}}
+				s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, assumeRoleErr).Times(1)
+				s3Client.EXPECT().CreateMultipartUpload(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, assumeRoleErr).Times(1)
+				cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, errors.New("connection refused")).Times(1)
+			},
+			results: []string{
+				"[NG] s3 object s3://awstee-example-com/logs/hoge.log does not exist: failed to sign request: api error AccessDenied:  (sts:AssumeRole on arn:aws:iam::123456789012:role/awstee permission is required)",
+				"[NG] s3 object s3://awstee-example-com/logs/hoge.log can be uploaded: failed to sign request: api error AccessDenied:  (sts:AssumeRole on arn:aws:iam::123456789012:role/awstee permission is required)",
+				"[NG] cloudwatch log group /awstee/logs exists: connection refused",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			s3Client := NewMockS3Client(ctrl)
+			cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+			c.expect(s3Client, cloudwatchLogsClient)
+			cfg := &Config{
+				S3: &S3Config{
+					URLPrefix:   "s3://awstee-example-com/logs/",
+					Credentials: c.credentials,
+				},
+				Cloudwatch: &CloudwatchLogsConfig{
+					LogGroup: "/awstee/logs",
+				},
+			}
+			require.NoError(t, cfg.Restrict())
+			app, err := NewWithClient(cfg, AWSClient{S3: s3Client, CloudwatchLogs: cloudwatchLogsClient})
+			require.NoError(t, err)
+			results := app.Preflight(context.Background(), "hoge.log")
+			actual := make([]string, 0, len(results))
+			for _, result := range results {
+				actual = append(actual, result.String())
+			}
+			require.Equal(t, c.results, actual)
+		})
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package awstee
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// processAlive reports whether the process of pid is running on this host.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package awstee
+
+import "os"
+
+// processAlive reports whether the process of pid is running on this host.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
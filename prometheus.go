@@ -0,0 +1,186 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prometheusLatencyBuckets is the upper bounds of the histogram of the batch latency, in seconds.
+var prometheusLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// prometheusDestination is the counters of a destination notified to the hooks.
+type prometheusDestination struct {
+	bytes   int64
+	batches int64
+	events  int64
+	errors  int64
+	// latency is the counts of each bucket of prometheusLatencyBuckets, and the last one is of +Inf
+	latency    []int64
+	latencySum float64
+}
+
+// prometheusMetrics exposes the metrics of a writer in the text format of Prometheus on /metrics, while it is running.
+// The counters of the destinations are notified by the hooks, and the gauges are of Stats. It notifies the hooks to next too.
+type prometheusMetrics struct {
+	next         MetricsHook
+	outputName   string
+	stats        func() Stats
+	mu           sync.Mutex
+	destinations map[string]*prometheusDestination
+	server       *http.Server
+	logger       *slog.Logger
+}
+
+func newPrometheusMetrics(next MetricsHook, outputName string) *prometheusMetrics {
+	return &prometheusMetrics{
+		next:         next,
+		outputName:   outputName,
+		destinations: make(map[string]*prometheusDestination),
+	}
+}
+
+func (m *prometheusMetrics) destination(dest string, fn func(*prometheusDestination)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.destinations[dest]
+	if !ok {
+		d = &prometheusDestination{latency: make([]int64, len(prometheusLatencyBuckets)+1)}
+		m.destinations[dest] = d
+	}
+	fn(d)
+}
+
+func (m *prometheusMetrics) OnBytesWritten(dest string, n int) {
+	m.destination(dest, func(d *prometheusDestination) { d.bytes += int64(n) })
+	if m.next != nil {
+		m.next.OnBytesWritten(dest, n)
+	}
+}
+
+func (m *prometheusMetrics) OnBatchSent(dest string, events int, latency time.Duration) {
+	m.destination(dest, func(d *prometheusDestination) {
+		d.batches++
+		d.events += int64(events)
+		d.latency[sort.SearchFloat64s(prometheusLatencyBuckets, latency.Seconds())]++
+		d.latencySum += latency.Seconds()
+	})
+	if m.next != nil {
+		m.next.OnBatchSent(dest, events, latency)
+	}
+}
+
+func (m *prometheusMetrics) OnError(dest string) {
+	m.destination(dest, func(d *prometheusDestination) { d.errors++ })
+	if m.next != nil {
+		m.next.OnError(dest)
+	}
+}
+
+// listen listens on addr, before the destinations are created not to leave them by the error.
+func (m *prometheusMetrics) listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics listen %s: %w", addr, err)
+	}
+	return ln, nil
+}
+
+// serve starts serving /metrics on ln in the background, the metrics of stats.
+func (m *prometheusMetrics) serve(logger *slog.Logger, ln net.Listener, stats func() Stats) {
+	m.stats = stats
+	m.logger = logger
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	m.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	logger.Info("serve metrics", "address", ln.Addr().String())
+	go func() {
+		if err := m.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Warn("serve metrics", "error", err)
+		}
+	}()
+}
+
+// shutdown stops serving /metrics.
+func (m *prometheusMetrics) shutdown(ctx context.Context) {
+	if err := m.server.Shutdown(ctx); err != nil {
+		m.logger.Warn("shutdown metrics", "error", err)
+	}
+}
+
+func (m *prometheusMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.writeTo(w, m.stats())
+}
+
+// writeTo writes the metrics of stats and of the destinations notified to w.
+func (m *prometheusMetrics) writeTo(w io.Writer, stats Stats) {
+	output := `output_name="` + prometheusLabelValue(m.outputName) + `"`
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("awstee_input_lines_total", "counter", "The lines read.")
+	fmt.Fprintf(w, "awstee_input_lines_total{%s} %d\n", output, stats.Lines)
+	metric("awstee_input_bytes_total", "counter", "The bytes read.")
+	fmt.Fprintf(w, "awstee_input_bytes_total{%s} %d\n", output, stats.Bytes)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.destinations))
+	for name := range m.destinations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	labels := func(dest string) string {
+		return output + `,destination="` + prometheusLabelValue(dest) + `"`
+	}
+	counter := func(name, help string, value func(*prometheusDestination) int64) {
+		metric(name, "counter", help)
+		for _, dest := range names {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, labels(dest), value(m.destinations[dest]))
+		}
+	}
+	counter("awstee_destination_bytes_total", "The bytes written to the destination.", func(d *prometheusDestination) int64 { return d.bytes })
+	counter("awstee_destination_batches_total", "The batches put to cloudwatch logs, or the objects uploaded to s3.", func(d *prometheusDestination) int64 { return d.batches })
+	counter("awstee_destination_events_total", "The events put to cloudwatch logs, or the objects uploaded to s3.", func(d *prometheusDestination) int64 { return d.events })
+	counter("awstee_destination_errors_total", "The errors of the destination.", func(d *prometheusDestination) int64 { return d.errors })
+
+	metric("awstee_destination_batch_latency_seconds", "histogram", "The latency of the batches put to cloudwatch logs, or of the objects uploaded to s3.")
+	for _, dest := range names {
+		d := m.destinations[dest]
+		var count int64
+		for i, n := range d.latency {
+			count += n
+			le := "+Inf"
+			if i < len(prometheusLatencyBuckets) {
+				le = strconv.FormatFloat(prometheusLatencyBuckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "awstee_destination_batch_latency_seconds_bucket{%s,le=\"%s\"} %d\n", labels(dest), le, count)
+		}
+		fmt.Fprintf(w, "awstee_destination_batch_latency_seconds_sum{%s} %s\n", labels(dest), strconv.FormatFloat(d.latencySum, 'g', -1, 64))
+		fmt.Fprintf(w, "awstee_destination_batch_latency_seconds_count{%s} %d\n", labels(dest), count)
+	}
+
+	metric("awstee_destination_retries_total", "counter", "The retried AWS calls of the destination.")
+	for _, d := range stats.Destinations {
+		fmt.Fprintf(w, "awstee_destination_retries_total{%s} %d\n", labels(d.Name), d.Retries)
+	}
+	metric("awstee_destination_buffered", "gauge", "The events buffered by the destination.")
+	for _, d := range stats.Destinations {
+		fmt.Fprintf(w, "awstee_destination_buffered{%s} %d\n", labels(d.Name), d.Buffered)
+	}
+}
+
+// prometheusLabelValue escapes the label value of the text format.
+func prometheusLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,72 @@
+package awstee
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudwatchlogs.PutLogEventsOutput{}, nil).AnyTimes()
+	cfg := &Config{
+		Cloudwatch:    &CloudwatchLogsConfig{LogGroup: "/awstee/logs", FlushInterval: "1h"},
+		MetricsListen: "127.0.0.1:0",
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{CloudwatchLogs: client})
+	require.NoError(t, err)
+	w, err := app.Writer(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\nfuga\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Flush(context.Background()))
+
+	rec := httptest.NewRecorder()
+	w.prometheus.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	labels := `output_name="hoge.log",destination="LogGroup=/awstee/logs, LogStream=hoge"`
+	require.Contains(t, body, "# TYPE awstee_input_lines_total counter\nawstee_input_lines_total{output_name=\"hoge.log\"} 2\n")
+	require.Contains(t, body, "awstee_destination_bytes_total{"+labels+"} 10\n")
+	require.Contains(t, body, "awstee_destination_events_total{"+labels+"} 2\n")
+	require.Contains(t, body, "awstee_destination_errors_total{"+labels+"} 0\n")
+	require.Contains(t, body, "awstee_destination_batch_latency_seconds_bucket{"+labels+",le=\"+Inf\"} 1\n")
+	require.Contains(t, body, "awstee_destination_batch_latency_seconds_count{"+labels+"} 1\n")
+	require.Contains(t, body, "awstee_destination_retries_total{"+labels+"} 0\n")
+	require.Contains(t, body, "awstee_destination_buffered{"+labels+"} 0\n")
+	require.NoError(t, w.Close())
+}
+
+func TestPrometheusMetricsLatency(t *testing.T) {
+	m := newPrometheusMetrics(nil, "hoge.log")
+	m.OnBatchSent("hoge", 1, 70*time.Millisecond)
+	m.OnBatchSent("hoge", 1, time.Second)
+	m.OnBatchSent("hoge", 1, time.Minute)
+	require.Equal(t, []int64{0, 1, 0, 0, 1, 0, 0, 0, 0, 1}, m.destinations["hoge"].latency, "a latency is of the bucket of the least bound not less than it")
+	require.Equal(t, `a\"b\\c\nd`, prometheusLabelValue("a\"b\\c\nd"))
+}
+
+func TestPrometheusMetricsListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	cfg := &Config{MetricsListen: ln.Addr().String()}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{})
+	require.NoError(t, err)
+	_, err = app.Writer(context.Background(), "hoge.log")
+	require.ErrorContains(t, err, "metrics listen "+ln.Addr().String())
+
+	cfg = &Config{MetricsListen: "9100"}
+	require.ErrorContains(t, cfg.Restrict(), "metrics_listen is invalid")
+}
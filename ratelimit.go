@@ -0,0 +1,104 @@
+package awstee
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateLimit is a parsed max_rate, e.g. `5MB/s` or `1000lines/s`.
+type rateLimit struct {
+	perSecond float64
+	lines     bool
+}
+
+var rateLimitRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([a-zA-Z]*)/s$`)
+
+var byteUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kb":  1 << 10,
+	"kib": 1 << 10,
+	"mb":  1 << 20,
+	"mib": 1 << 20,
+	"gb":  1 << 30,
+	"gib": 1 << 30,
+}
+
+func parseRateLimit(str string) (*rateLimit, error) {
+	m := rateLimitRegexp.FindStringSubmatch(strings.TrimSpace(str))
+	if m == nil {
+		return nil, fmt.Errorf("`%s` is not <number><unit>/s format", str)
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return nil, err
+	}
+	if value <= 0 {
+		return nil, fmt.Errorf("`%s` must be positive", str)
+	}
+	unit := strings.ToLower(m[2])
+	if unit == "lines" || unit == "line" {
+		return &rateLimit{perSecond: value, lines: true}, nil
+	}
+	scale, ok := byteUnits[unit]
+	if !ok {
+		return nil, fmt.Errorf("`%s` has unknown unit `%s`", str, m[2])
+	}
+	return &rateLimit{perSecond: value * scale}, nil
+}
+
+func (l *rateLimit) String() string {
+	if l.lines {
+		return fmt.Sprintf("%glines/s", l.perSecond)
+	}
+	return fmt.Sprintf("%gB/s", l.perSecond)
+}
+
+// rateLimitedReader delays reads so that the average rate since the first read does not exceed the limit.
+// Because awstee reads from a pipe, delaying reads applies backpressure to the producing process.
+type rateLimitedReader struct {
+	r     io.Reader
+	limit *rateLimit
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	start time.Time
+	total float64
+}
+
+func newRateLimitedReader(r io.Reader, limit *rateLimit) *rateLimitedReader {
+	return &rateLimitedReader{
+		r:     r,
+		limit: limit,
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if r.start.IsZero() {
+		r.start = r.now()
+	}
+	if !r.limit.lines {
+		// keep each read within a tenth of a second worth of bytes, so that the output stays smooth.
+		if chunk := int(r.limit.perSecond / 10); chunk > 0 && len(p) > chunk {
+			p = p[:chunk]
+		}
+	}
+	n, err := r.r.Read(p)
+	if r.limit.lines {
+		r.total += float64(bytes.Count(p[:n], []byte("\n")))
+	} else {
+		r.total += float64(n)
+	}
+	expected := time.Duration(r.total / r.limit.perSecond * float64(time.Second))
+	if wait := expected - r.now().Sub(r.start); wait > 0 {
+		r.sleep(wait)
+	}
+	return n, err
+}
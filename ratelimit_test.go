@@ -0,0 +1,65 @@
+package awstee
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	cases := []struct {
+		str      string
+		expected string
+		err      bool
+	}{
+		{str: "5MB/s", expected: "5.24288e+06B/s"},
+		{str: "100KiB/s", expected: "102400B/s"},
+		{str: "1.5kb/s", expected: "1536B/s"},
+		{str: "1000lines/s", expected: "1000lines/s"},
+		{str: "200/s", expected: "200B/s"},
+		{str: "5MB", err: true},
+		{str: "0MB/s", err: true},
+		{str: "5XB/s", err: true},
+	}
+	for _, c := range cases {
+		t.Run(c.str, func(t *testing.T) {
+			l, err := parseRateLimit(c.str)
+			if c.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.EqualValues(t, c.expected, l.String())
+		})
+	}
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	now := time.Date(2022, 6, 3, 17, 28, 48, 0, time.UTC)
+	var slept time.Duration
+	r := newRateLimitedReader(strings.NewReader(strings.Repeat("hoge\n", 10)), &rateLimit{perSecond: 5, lines: true})
+	r.now = func() time.Time { return now }
+	r.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	bs, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.EqualValues(t, 50, len(bs))
+	require.EqualValues(t, 2*time.Second, slept)
+
+	slept = 0
+	r = newRateLimitedReader(strings.NewReader(strings.Repeat("x", 100)), &rateLimit{perSecond: 50})
+	r.now = func() time.Time { return now }
+	r.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	bs, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.EqualValues(t, 100, len(bs))
+	require.EqualValues(t, 2*time.Second, slept)
+}
@@ -0,0 +1,101 @@
+package awstee
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+const (
+	// RawCloudwatchSkip skips the cloudwatch logs destinations with raw, because a binary stream is not line oriented.
+	RawCloudwatchSkip = "skip"
+	// RawCloudwatchBase64 writes a binary stream to the cloudwatch logs destinations as the base64 lines, each of which is rawBase64ChunkBytes of the stream.
+	RawCloudwatchBase64 = "base64"
+
+	// rawBase64ChunkBytes is the bytes of a base64 line, encoded to 64KiB.
+	rawBase64ChunkBytes = 48 * 1024
+)
+
+// base64LineWriter writes the base64 lines of the writes to a line oriented destination.
+// The last chunk shorter than rawBase64ChunkBytes is written by Flush or Close.
+type base64LineWriter struct {
+	io.WriteCloser
+	buf  []byte
+	line []byte
+}
+
+func newBase64LineWriter(w io.WriteCloser) *base64LineWriter {
+	return &base64LineWriter{
+		WriteCloser: w,
+		buf:         make([]byte, 0, rawBase64ChunkBytes),
+	}
+}
+
+func (w *base64LineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		c := min(len(p), rawBase64ChunkBytes-len(w.buf))
+		w.buf = append(w.buf, p[:c]...)
+		p = p[c:]
+		if len(w.buf) == rawBase64ChunkBytes {
+			if err := w.writeLine(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *base64LineWriter) writeLine() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	n := base64.StdEncoding.EncodedLen(len(w.buf))
+	if cap(w.line) < n+1 {
+		w.line = make([]byte, n+1)
+	}
+	w.line = w.line[:n+1]
+	base64.StdEncoding.Encode(w.line, w.buf)
+	w.line[n] = '\n'
+	w.buf = w.buf[:0]
+	_, err := w.WriteCloser.Write(w.line)
+	return err
+}
+
+// Flush writes the last chunk, and flushes the destination.
+func (w *base64LineWriter) Flush(ctx context.Context) error {
+	if err := w.writeLine(); err != nil {
+		return err
+	}
+	if f, ok := w.WriteCloser.(flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+func (w *base64LineWriter) Close() error {
+	err := w.writeLine()
+	if cerr := w.WriteCloser.Close(); cerr != nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *base64LineWriter) String() string {
+	return fmt.Sprint(w.WriteCloser)
+}
+
+func (w *base64LineWriter) Stats() DestinationStats {
+	if r, ok := w.WriteCloser.(statsReporter); ok {
+		return r.Stats()
+	}
+	return DestinationStats{Name: w.String()}
+}
+
+func (w *base64LineWriter) results() []DestinationResult {
+	if r, ok := w.WriteCloser.(resultReporter); ok {
+		return r.results()
+	}
+	return []DestinationResult{{Name: w.String()}}
+}
@@ -0,0 +1,79 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBase64LineWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := newBase64LineWriter(newTestWriteCloser(&buf, func() error { return nil }))
+	input := bytes.Repeat([]byte{0x00, 0xff, '\n', 0x1f}, rawBase64ChunkBytes/2)
+	_, err := w.Write(input[:10])
+	require.NoError(t, err)
+	_, err = w.Write(input[10:])
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(buf.String(), "\n"), "the full chunks are written")
+	require.NoError(t, w.Flush(context.Background()))
+	require.NoError(t, w.Close())
+
+	var decoded []byte
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		b, err := base64.StdEncoding.DecodeString(line)
+		require.NoError(t, err)
+		decoded = append(decoded, b...)
+	}
+	require.Equal(t, input, decoded)
+}
+
+func TestAWSTeeWriterRaw(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cfg := &Config{
+		Raw: true,
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup: "/awstee/logs",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	var dest bytes.Buffer
+	// the cloudwatch logs destination is skipped, no call of the client
+	app, err := NewWithClient(cfg, AWSClient{CloudwatchLogs: NewMockCloudwatchLogsClient(ctrl)},
+		WithDestination("buffer", func(context.Context, string) (io.WriteCloser, error) {
+			return newTestWriteCloser(&dest, func() error { return nil }), nil
+		}),
+	)
+	require.NoError(t, err)
+	w, err := app.Writer(context.Background(), "hoge.tar")
+	require.NoError(t, err)
+	input := []byte("\x1f\x8b\x08\x00hoge\r\nfuga\x00\xff")
+	_, err = w.Write(input)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, input, dest.Bytes())
+	require.Len(t, w.Result().Destinations, 1)
+}
+
+func TestConfigRaw(t *testing.T) {
+	cfg := &Config{Raw: true, StripANSI: true}
+	require.EqualError(t, cfg.Restrict(), "raw can not be used with prefix_timestamp, line_prefix or strip_ansi, which rewrite the lines")
+
+	cfg = &Config{Raw: true, NormalizeTimestamp: TimestampConfig{Format: "rfc3339"}}
+	require.EqualError(t, cfg.Restrict(), "raw can not be used with normalize_timestamp, which rewrites the lines")
+
+	cfg = &Config{Raw: true, RawCloudwatch: "hex"}
+	require.EqualError(t, cfg.Restrict(), "raw_cloudwatch must be one of skip, base64")
+
+	cfg = &Config{Raw: true}
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, RawCloudwatchSkip, cfg.RawCloudwatch)
+}
@@ -0,0 +1,49 @@
+package awstee
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// repeatCollapser collapses the runs of the same lines written to a destination with dedup_repeats,
+// into the first line and the marker of the number of the lines collapsed, written before the next line or by Close.
+// It is not safe for concurrent use.
+type repeatCollapser struct {
+	last    []byte
+	seen    bool
+	repeats int
+	// buf is reused by the lines returned, the line writer does not retain them
+	buf []byte
+}
+
+func (c *repeatCollapser) process(line []byte) []byte {
+	if c.seen && bytes.Equal(line, c.last) {
+		c.repeats++
+		return nil
+	}
+	c.last = append(c.last[:0], line...)
+	c.seen = true
+	if c.repeats == 0 {
+		return line
+	}
+	c.buf = append(c.appendMarker(c.buf[:0]), '\n')
+	c.buf = append(c.buf, line...)
+	c.repeats = 0
+	return c.buf
+}
+
+// finish returns the marker line of the last run, or nil if it was not collapsed.
+func (c *repeatCollapser) finish() []byte {
+	if c.repeats == 0 {
+		return nil
+	}
+	marker := append(c.appendMarker(nil), '\n')
+	c.repeats = 0
+	return marker
+}
+
+func (c *repeatCollapser) appendMarker(dst []byte) []byte {
+	dst = append(dst, "last message repeated "...)
+	dst = strconv.AppendInt(dst, int64(c.repeats), 10)
+	return append(dst, " times"...)
+}
@@ -0,0 +1,49 @@
+package awstee
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepeatCollapser(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "runs",
+			input:    "retry\nretry\nretry\nok\nok\nretry\n",
+			expected: "retry\nlast message repeated 2 times\nok\nlast message repeated 1 times\nretry\n",
+		},
+		{
+			name:     "last run",
+			input:    "hoge\nretry\nretry\nretry",
+			expected: "hoge\nretry\nlast message repeated 2 times\n",
+		},
+		{
+			name:     "no repeats",
+			input:    "hoge\nfuga\n\npiyo",
+			expected: "hoge\nfuga\n\npiyo",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &LinesConfig{DedupRepeats: true}
+			require.NoError(t, cfg.Restrict())
+			processors, finish := cfg.processors(&runMetadata{})
+			var buf bytes.Buffer
+			w := newLineDestination(newTestWriteCloser(&buf, func() error { return nil }), processors, finish)
+			// split not to depend on the writes
+			for i := 0; i < len(c.input); i += 7 {
+				_, err := io.WriteString(w, c.input[i:min(i+7, len(c.input))])
+				require.NoError(t, err)
+			}
+			require.NoError(t, w.Close())
+			require.Equal(t, c.expected, buf.String())
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package awstee
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// Result tells where the data of an AWSTeeWriter (or AWSTeeReader) went, after Close.
+type Result struct {
+	Lines        int64
+	Bytes        int64
+	Destinations []DestinationResult
+	// Skipped reports whether the destinations were not written, because the same input was already delivered, see Config.Manifest.
+	Skipped bool
+}
+
+// DestinationResult is the result of one destination. A destination rotated by on_limit: rotate has one for each object.
+type DestinationResult struct {
+	// Name is the name of the destination, the same as the one of DestinationStats.
+	Name string
+	// Location is the s3 url of the object, or the ARN of the log stream of cloudwatch logs.
+	// It is empty if unknown, such as for the log stream created by awstee and the destinations of WithDestination.
+	Location string
+	// VersionID is the version id of the s3 object, if the bucket is versioned.
+	VersionID string
+	// SHA256 is the hex sha256 of the s3 object as uploaded, with summary.
+	SHA256 string
+	Bytes  int64
+	// Events is the number of the events put to cloudwatch logs.
+	Events int64
+	// Retries is the number of the retried AWS calls.
+	Retries int64
+	// Err is the error of the destination, or nil if it is completed.
+	Err error
+}
+
+func (r Result) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "lines=%d bytes=%d", r.Lines, r.Bytes)
+	for _, d := range r.Destinations {
+		fmt.Fprintf(&b, ", [%s] %s", d.Name, d)
+	}
+	return b.String()
+}
+
+func (r DestinationResult) String() string {
+	s := fmt.Sprintf("bytes=%d events=%d retries=%d", r.Bytes, r.Events, r.Retries)
+	if r.VersionID != "" {
+		s += " version_id=" + r.VersionID
+	}
+	if r.SHA256 != "" {
+		s += " sha256=" + r.SHA256
+	}
+	if r.Err != nil {
+		s += fmt.Sprintf(" error=%q", r.Err)
+	}
+	return s
+}
+
+type resultReporter interface {
+	results() []DestinationResult
+}
+
+// Result returns the result of the destinations, after Close. It returns the zero Result before Close.
+func (t *AWSTeeWriter) Result() Result {
+	t.resultMu.Lock()
+	defer t.resultMu.Unlock()
+	return t.result
+}
+
+// Result returns the result of the destinations after Close, see AWSTeeWriter.Result.
+func (t *AWSTeeReader) Result() Result {
+	return t.w.Result()
+}
+
+// closeResult returns the result of the destinations closed with errs.
+// The destinations not completed have the error of ctx, their results are not read because they may be still running.
+func (t *AWSTeeWriter) closeResult(ctx context.Context, names []string, completed []bool, errs []error) Result {
+	result := Result{
+		Lines:        atomic.LoadInt64(&t.lines),
+		Bytes:        atomic.LoadInt64(&t.bytes),
+		Destinations: make([]DestinationResult, 0, len(t.writeClosers)),
+	}
+	for i, w := range t.writeClosers {
+		if !completed[i] {
+			result.Destinations = append(result.Destinations, DestinationResult{Name: names[i], Err: ctx.Err()})
+			continue
+		}
+		results := []DestinationResult{{Name: names[i]}}
+		if r, ok := w.(resultReporter); ok {
+			results = r.results()
+		}
+		if last := &results[len(results)-1]; last.Err == nil {
+			last.Err = errs[i]
+		}
+		result.Destinations = append(result.Destinations, results...)
+	}
+	return result
+}
+
+func (w *S3Writer) results() []DestinationResult {
+	result := DestinationResult{
+		Name:     w.String(),
+		Location: w.String(),
+		Bytes:    atomic.LoadInt64(&w.bytes),
+		Retries:  atomic.LoadInt64(&w.retries),
+		Err:      w.backgroundWriter.err(),
+	}
+	if versionID := w.versionID.Load(); versionID != nil {
+		result.VersionID = *versionID
+	}
+	if w.checksum != nil {
+		w.checksumMu.Lock()
+		result.SHA256 = hexSum(w.checksum)
+		w.checksumMu.Unlock()
+	}
+	return []DestinationResult{result}
+}
+
+func (w *CloudWatchLogsWriter) results() []DestinationResult {
+	return []DestinationResult{{
+		Name:     w.String(),
+		Location: w.arn,
+		Bytes:    atomic.LoadInt64(&w.bytes),
+		Events:   atomic.LoadInt64(&w.sent),
+		Retries:  atomic.LoadInt64(&w.retries),
+		Err:      w.backgroundWriter.err(),
+	}}
+}
+
+func (w *limitWriter) results() []DestinationResult {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	results := append([]DestinationResult{}, w.rotated...)
+	if r, ok := w.current.(resultReporter); ok {
+		return append(results, r.results()...)
+	}
+	return append(results, DestinationResult{Name: fmt.Sprint(w.current)})
+}
+
+// countRetries adds the number of the retries of the call to retries.
+func countRetries(retries *int64, metadata middleware.Metadata) {
+	if attempts, ok := retry.GetAttemptResults(metadata); ok && len(attempts.Results) > 1 {
+		atomic.AddInt64(retries, int64(len(attempts.Results)-1))
+	}
+}
+
+// retryCountingUploadClient counts the retries of the calls of the uploader.
+type retryCountingUploadClient struct {
+	manager.UploadAPIClient
+	retries *int64
+}
+
+func (c *retryCountingUploadClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	output, err := c.UploadAPIClient.PutObject(ctx, params, optFns...)
+	if output != nil {
+		countRetries(c.retries, output.ResultMetadata)
+	}
+	return output, err
+}
+
+func (c *retryCountingUploadClient) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	output, err := c.UploadAPIClient.UploadPart(ctx, params, optFns...)
+	if output != nil {
+		countRetries(c.retries, output.ResultMetadata)
+	}
+	return output, err
+}
+
+func (c *retryCountingUploadClient) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	output, err := c.UploadAPIClient.CreateMultipartUpload(ctx, params, optFns...)
+	if output != nil {
+		countRetries(c.retries, output.ResultMetadata)
+	}
+	return output, err
+}
+
+func (c *retryCountingUploadClient) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	output, err := c.UploadAPIClient.CompleteMultipartUpload(ctx, params, optFns...)
+	if output != nil {
+		countRetries(c.retries, output.ResultMetadata)
+	}
+	return output, err
+}
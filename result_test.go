@@ -0,0 +1,85 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSTeeWriterResult(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{Code: "NotFound"},
+	).Times(2)
+	gomock.InOrder(
+		s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			&s3.PutObjectOutput{VersionId: aws.String("v1")}, nil,
+		).Times(1),
+		s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			nil, errors.New("access denied"),
+		).Times(1),
+	)
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	arn := "arn:aws:logs:ap-northeast-1:123456789012:log-group:/awstee/logs:log-stream:hoge"
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("hoge"), Arn: aws.String(arn)}},
+		}, nil,
+	).Times(1)
+	cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.PutLogEventsOutput{}, nil,
+	).Times(1)
+
+	cfg := &Config{
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+			Limit: LimitConfig{
+				MaxLines: 2,
+				OnLimit:  LimitPolicyRotate,
+			},
+		},
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup:      "/awstee/logs",
+			FlushInterval: "1h",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{S3: s3Client, CloudwatchLogs: cloudwatchLogsClient})
+	require.NoError(t, err)
+	w, err := app.Writer(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	require.Empty(t, w.Result().Destinations, "before close")
+	_, err = io.WriteString(w, "hoge\nfuga\npiyo\n")
+	require.NoError(t, err)
+	require.Error(t, w.Close())
+
+	result := w.Result()
+	require.EqualValues(t, 3, result.Lines)
+	require.EqualValues(t, 15, result.Bytes)
+	require.Len(t, result.Destinations, 3)
+	require.Equal(t, DestinationResult{
+		Name:      "s3://awstee-example-com/logs/hoge.log",
+		Location:  "s3://awstee-example-com/logs/hoge.log",
+		VersionID: "v1",
+		Bytes:     10,
+	}, result.Destinations[0])
+	require.Equal(t, "s3://awstee-example-com/logs/hoge.1.log", result.Destinations[1].Location)
+	require.ErrorContains(t, result.Destinations[1].Err, "access denied")
+	require.Equal(t, DestinationResult{
+		Name:     "LogGroup=/awstee/logs, LogStream=hoge",
+		Location: arn,
+		Bytes:    16,
+		Events:   3,
+	}, result.Destinations[2])
+}
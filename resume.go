@@ -0,0 +1,285 @@
+package awstee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// LeftoverSpill is a spill left by an interrupted run, not delivered to its destination yet.
+type LeftoverSpill struct {
+	Path        string
+	Destination string
+	OutputName  string
+	Bytes       int64
+	Hostname    string
+	PID         int
+	StartedAt   time.Time
+
+	journal spillJournal
+}
+
+func (s LeftoverSpill) String() string {
+	return fmt.Sprintf("%s: %s (%d bytes, pid %d on %s since %s)", s.Path, s.Destination, s.Bytes, s.PID, s.Hostname, s.StartedAt.Format(time.RFC3339))
+}
+
+// spillDirs returns the directories of the spills of all destinations.
+func (cfg *Config) spillDirs() []string {
+	var dirs []string
+	add := func(spill *SpillConfig) {
+		dir := spill.Dir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, s3Cfg := range cfg.allS3Configs() {
+		add(&s3Cfg.Spill)
+	}
+	for _, cwCfg := range cfg.allCloudwatchConfigs() {
+		add(&cwCfg.Spill)
+	}
+	if len(dirs) == 0 {
+		add(&SpillConfig{})
+	}
+	return dirs
+}
+
+// LeftoverSpills returns the spills in the spill directories of the destinations, whose awstee is not running any more.
+// The spills of the awstee running on the same host are skipped, by the pid in the journal.
+func (app *AWSTee) LeftoverSpills() ([]LeftoverSpill, error) {
+	hostname := newRunMetadata("").Hostname
+	var spills []LeftoverSpill
+	for _, dir := range app.cfg.spillDirs() {
+		journals, err := filepath.Glob(filepath.Join(dir, spillPattern+spillJournalSuffix))
+		if err != nil {
+			return nil, err
+		}
+		for _, journalPath := range journals {
+			b, err := os.ReadFile(journalPath)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					// removed by the running awstee after the glob
+					continue
+				}
+				return nil, fmt.Errorf("read spill journal: %w", err)
+			}
+			var journal spillJournal
+			if err := json.Unmarshal(b, &journal); err != nil {
+				app.logger.Warn("spill journal is broken, skipped", "journal", journalPath, "error", err)
+				continue
+			}
+			if journal.Hostname == hostname && processAlive(journal.PID) {
+				app.logger.Debug("spill is in use", "journal", journalPath, "pid", journal.PID)
+				continue
+			}
+			path := strings.TrimSuffix(journalPath, spillJournalSuffix)
+			info, err := os.Stat(path)
+			if err != nil {
+				app.logger.Warn("spill of the journal is not found, skipped", "journal", journalPath, "error", err)
+				continue
+			}
+			spills = append(spills, LeftoverSpill{
+				Path:        path,
+				Destination: journal.destination(),
+				OutputName:  journal.OutputName,
+				Bytes:       info.Size(),
+				Hostname:    journal.Hostname,
+				PID:         journal.PID,
+				StartedAt:   journal.StartedAt,
+				journal:     journal,
+			})
+		}
+	}
+	return spills, nil
+}
+
+func (j *spillJournal) destination() string {
+	if j.Kind == spillKindS3 {
+		return fmt.Sprintf("s3://%s/%s", j.Bucket, j.Key)
+	}
+	return fmt.Sprintf("LogGroup=%s, LogStream=%s", j.LogGroup, j.LogStream)
+}
+
+// Resume delivers the leftover spills of interrupted runs to their destinations, and removes the delivered ones.
+// The s3 object is uploaded again from the copy in the spill, and the spilled events are put to the cloudwatch logs stream.
+// The clients and the settings are the ones of the destination of the configuration at the same location, if any.
+// The delivery is at least once: the events replayed before the interruption are put again.
+// It returns the result of each spill, and the *DestinationError of the failed ones joined.
+func (app *AWSTee) Resume(ctx context.Context) ([]DestinationResult, error) {
+	spills, err := app.LeftoverSpills()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]DestinationResult, 0, len(spills))
+	var errs []error
+	for _, spill := range spills {
+		result := app.resume(ctx, spill)
+		results = append(results, result)
+		if result.Err != nil {
+			app.logger.Error("resume failed", "spill", spill.Path, "destination", spill.Destination, "error", result.Err)
+			errs = append(errs, &DestinationError{Destination: spill.Destination, Err: result.Err})
+			continue
+		}
+		app.logger.Info("resumed", "spill", spill.Path, "destination", spill.Destination, "bytes", result.Bytes)
+	}
+	return results, errors.Join(errs...)
+}
+
+func (app *AWSTee) resume(ctx context.Context, spill LeftoverSpill) DestinationResult {
+	result := DestinationResult{Name: spill.Destination, Location: spill.Destination}
+	f, err := os.OpenFile(spill.Path, os.O_RDWR, 0)
+	if err != nil {
+		result.Err = fmt.Errorf("open spill: %w", err)
+		return result
+	}
+	s := &spillFile{
+		f:        f,
+		journal:  spill.Path + spillJournalSuffix,
+		size:     spill.Bytes,
+		pending:  spill.Bytes,
+		maxBytes: spill.Bytes,
+		logger:   app.logger.With("spill", spill.Path, "destination", spill.Destination),
+	}
+	switch spill.journal.Kind {
+	case spillKindS3:
+		err = app.resumeS3(ctx, spill, s, &result)
+	case spillKindCloudwatch:
+		err = app.resumeCloudwatchLogs(ctx, spill, s, &result)
+	default:
+		err = fmt.Errorf("unknown kind of spill %q", spill.journal.Kind)
+	}
+	if err != nil {
+		f.Close()
+		result.Err = err
+		return result
+	}
+	if err := s.Close(); err != nil {
+		app.logger.Warn("remove spill", "spill", spill.Path, "error", err)
+	}
+	return result
+}
+
+func (app *AWSTee) resumeS3(ctx context.Context, spill LeftoverSpill, s *spillFile, result *DestinationResult) error {
+	var cfg *S3Config
+	for _, s3Cfg := range app.cfg.allS3Configs() {
+		if bucket, key := s3ObjectLocation(s3Cfg, spill.OutputName); bucket == spill.journal.Bucket && key == spill.journal.Key {
+			cfg = s3Cfg
+			break
+		}
+	}
+	var retries int64
+	var uploadClient manager.UploadAPIClient = app.s3Client(cfg)
+	if cfg != nil && cfg.Retry.Enabled() {
+		uploadClient = &retryingUploadClient{
+			UploadAPIClient: uploadClient,
+			cfg:             &cfg.Retry,
+			logger:          s.logger,
+			retries:         &retries,
+		}
+	}
+	var uploaderOptions []func(*manager.Uploader)
+	if cfg != nil {
+		uploaderOptions = append(uploaderOptions, cfg.uploaderOptions)
+	}
+	uploader := manager.NewUploader(&retryCountingUploadClient{
+		UploadAPIClient: uploadClient,
+		retries:         &retries,
+	}, uploaderOptions...)
+	output, err := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(spill.journal.Bucket),
+		Key:    aws.String(spill.journal.Key),
+		Body:   s.reader(),
+	})
+	result.Retries = retries
+	if err != nil {
+		return err
+	}
+	result.Bytes = spill.Bytes
+	result.VersionID = aws.ToString(output.VersionID)
+	return nil
+}
+
+func (app *AWSTee) resumeCloudwatchLogs(ctx context.Context, spill LeftoverSpill, s *spillFile, result *DestinationResult) error {
+	var cfg *CloudwatchLogsConfig
+	for _, cwCfg := range app.cfg.allCloudwatchConfigs() {
+		if cwCfg.LogGroup == spill.journal.LogGroup {
+			cfg = cwCfg
+			break
+		}
+	}
+	if s.Pending() == 0 {
+		return nil
+	}
+	client := app.cloudwatchClient(cfg)
+	batchSize, createLogGroup, retryCfg := 50, false, &RetryConfig{}
+	if cfg != nil {
+		batchSize, createLogGroup, retryCfg = cfg.BufferLines, cfg.CreateLogGroup, &cfg.Retry
+	}
+	sequenceToken, arn, err := prepareCloudwatchLogs(ctx, s.logger, client, spill.journal.LogGroup, spill.journal.LogStream, createLogGroup)
+	if err != nil {
+		return fmt.Errorf("cloudwatch logs destination initialize: %w", err)
+	}
+	if arn != "" {
+		result.Location = arn
+	}
+	for s.Pending() > 0 {
+		batch, n, err := s.peekEvents(batchSize)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if len(batch) == 0 {
+			// the empty lines of the wal
+			if err := s.consume(n); err != nil {
+				return err
+			}
+			continue
+		}
+		var output *cloudwatchlogs.PutLogEventsOutput
+		err = retryCfg.do(ctx, s.logger, "cloudwatch put log events", &result.Retries, func() error {
+			var err error
+			output, err = client.PutLogEvents(ctx, &cloudwatchlogs.PutLogEventsInput{
+				LogGroupName:  aws.String(spill.journal.LogGroup),
+				LogStreamName: aws.String(spill.journal.LogStream),
+				LogEvents:     batch,
+				SequenceToken: sequenceToken,
+			})
+			if accepted, ok := alreadyAcceptedOutput(err); ok {
+				output, err = accepted, nil
+			}
+			if err == nil {
+				countRetries(&result.Retries, output.ResultMetadata)
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("put log events: %w", err)
+		}
+		sequenceToken = output.NextSequenceToken
+		result.Events += int64(len(batch))
+		for _, event := range batch {
+			// the lines written, with the newline
+			result.Bytes += int64(len(aws.ToString(event.Message))) + 1
+		}
+		if err := s.consume(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package awstee
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestSpill(t *testing.T, dir string, name string, journal spillJournal, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, "awstee-spill-"+name)
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	b, err := json.Marshal(journal)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path+spillJournalSuffix, b, 0o600))
+	return path
+}
+
+func TestResume(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	dir := t.TempDir()
+	startedAt := time.Date(2022, 6, 3, 17, 20, 0, 0, time.UTC)
+	writeTestSpill(t, dir, "1", spillJournal{
+		Kind:       spillKindS3,
+		Bucket:     "awstee-example-com",
+		Key:        "logs/hoge.log",
+		OutputName: "hoge.log",
+		Hostname:   "host-a",
+		PID:        1234,
+		StartedAt:  startedAt,
+	}, "hoge\nfuga\n")
+	writeTestSpill(t, dir, "2", spillJournal{
+		Kind:       spillKindCloudwatch,
+		LogGroup:   "/awstee/logs",
+		LogStream:  "hoge",
+		OutputName: "hoge.log",
+		Hostname:   "host-a",
+		PID:        1234,
+		StartedAt:  startedAt,
+	}, `{"timestamp":1654244400000,"message":"hoge"}`+"\n"+`{"timestamp":1654244401000,"message":"fuga"}`+"\n")
+	running := writeTestSpill(t, dir, "3", spillJournal{
+		Kind:       spillKindS3,
+		Bucket:     "awstee-example-com",
+		Key:        "logs/piyo.log",
+		OutputName: "piyo.log",
+		Hostname:   newRunMetadata("").Hostname,
+		PID:        os.Getpid(),
+		StartedAt:  startedAt,
+	}, "piyo\n")
+
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			require.Equal(t, "logs/hoge.log", *input.Key)
+			body, err := io.ReadAll(input.Body)
+			require.NoError(t, err)
+			require.Equal(t, "hoge\nfuga\n", string(body))
+			return &s3.PutObjectOutput{VersionId: aws.String("v1")}, nil
+		},
+	).Times(1)
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("hoge")}},
+		}, nil,
+	).Times(1)
+	cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			require.Equal(t, []types.InputLogEvent{
+				{Timestamp: aws.Int64(1654244400000), Message: aws.String("hoge")},
+				{Timestamp: aws.Int64(1654244401000), Message: aws.String("fuga")},
+			}, input.LogEvents)
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).Times(1)
+
+	cfg := &Config{
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+			Spill:     SpillConfig{Dir: dir, MaxBytes: 1024},
+		},
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup: "/awstee/logs",
+			Spill:    SpillConfig{Dir: dir, MaxBytes: 1024},
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{S3: s3Client, CloudwatchLogs: cloudwatchLogsClient})
+	require.NoError(t, err)
+
+	spills, err := app.LeftoverSpills()
+	require.NoError(t, err)
+	require.Len(t, spills, 2, "the spill of the running awstee is skipped")
+	require.Equal(t, "s3://awstee-example-com/logs/hoge.log", spills[0].Destination)
+	require.Equal(t, "LogGroup=/awstee/logs, LogStream=hoge", spills[1].Destination)
+	require.EqualValues(t, 10, spills[0].Bytes)
+	require.Equal(t, startedAt, spills[0].StartedAt)
+
+	results, err := app.Resume(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []DestinationResult{
+		{
+			Name:      "s3://awstee-example-com/logs/hoge.log",
+			Location:  "s3://awstee-example-com/logs/hoge.log",
+			VersionID: "v1",
+			Bytes:     10,
+		},
+		{
+			Name:     "LogGroup=/awstee/logs, LogStream=hoge",
+			Location: "LogGroup=/awstee/logs, LogStream=hoge",
+			Bytes:    10,
+			Events:   2,
+		},
+	}, results)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.ElementsMatch(t, []string{filepath.Base(running), filepath.Base(running) + spillJournalSuffix}, names, "the resumed spills are removed")
+}
+
+func TestSpillJournal(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newSpillFile(slog.Default(), &SpillConfig{Dir: dir, MaxBytes: 4}, spillJournal{
+		Kind:       spillKindS3,
+		Bucket:     "awstee-example-com",
+		Key:        "logs/hoge.log",
+		OutputName: "hoge.log",
+	})
+	require.NoError(t, err)
+	b, err := os.ReadFile(s.journal)
+	require.NoError(t, err)
+	var journal spillJournal
+	require.NoError(t, json.Unmarshal(b, &journal))
+	require.Equal(t, os.Getpid(), journal.PID)
+	require.Equal(t, "logs/hoge.log", journal.Key)
+
+	spillCopy{s}.Write([]byte("hoge\nfuga\n"))
+	require.NoFileExists(t, s.journal, "the spill exceeding max_bytes can not be resumed")
+	require.NoError(t, s.Close())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
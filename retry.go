@@ -0,0 +1,155 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	defaultRetryBackoff    = time.Second
+	defaultRetryMaxBackoff = 30 * time.Second
+)
+
+// RetryConfig is the retry policy of the operations of a destination whose failure loses the captured data:
+// the batches of PutLogEvents and the completion of the s3 upload.
+// They are retried in addition to the retries of the AWS SDK, with the exponential backoff from backoff up to max_backoff.
+type RetryConfig struct {
+	Attempts   int    `yaml:"attempts,omitempty"`
+	Backoff    string `yaml:"backoff,omitempty"`
+	MaxBackoff string `yaml:"max_backoff,omitempty"`
+	MaxElapsed string `yaml:"max_elapsed,omitempty"`
+
+	backoff    time.Duration
+	maxBackoff time.Duration
+	maxElapsed time.Duration
+}
+
+func (cfg *RetryConfig) Enabled() bool {
+	return cfg.Attempts > 1
+}
+
+func (cfg *RetryConfig) Restrict() error {
+	if cfg.Attempts < 0 {
+		return errors.New("retry attempts must not be negative")
+	}
+	var err error
+	if cfg.backoff, err = parseOptionalDuration(cfg.Backoff); err != nil {
+		return fmt.Errorf("retry backoff is invalid format: %w", err)
+	}
+	if cfg.backoff == 0 {
+		cfg.backoff = defaultRetryBackoff
+	}
+	if cfg.maxBackoff, err = parseOptionalDuration(cfg.MaxBackoff); err != nil {
+		return fmt.Errorf("retry max_backoff is invalid format: %w", err)
+	}
+	if cfg.maxBackoff == 0 {
+		cfg.maxBackoff = max(defaultRetryMaxBackoff, cfg.backoff)
+	}
+	if cfg.maxBackoff < cfg.backoff {
+		return errors.New("retry max_backoff must not be less than backoff")
+	}
+	if cfg.maxElapsed, err = parseOptionalDuration(cfg.MaxElapsed); err != nil {
+		return fmt.Errorf("retry max_elapsed is invalid format: %w", err)
+	}
+	return nil
+}
+
+// delay returns the backoff before the n-th retry, with the jitter of the latter half.
+func (cfg *RetryConfig) delay(n int) time.Duration {
+	d := cfg.backoff
+	for i := 1; i < n && d < cfg.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, cfg.maxBackoff)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// do calls fn until it succeeds, the error is not retryable, the attempts or max_elapsed are exhausted, or ctx is done.
+// The retries are logged and counted to retries.
+func (cfg *RetryConfig) do(ctx context.Context, logger *slog.Logger, operation string, retries *int64, fn func() error) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= cfg.Attempts || !isRetryableError(err) || ctx.Err() != nil {
+			return err
+		}
+		d := cfg.delay(attempt)
+		if cfg.maxElapsed > 0 && time.Since(start)+d > cfg.maxElapsed {
+			logger.Warn("retry gave up, max_elapsed exceeded", "operation", operation, "attempt", attempt, "error", err)
+			return err
+		}
+		logger.Warn("retry", "operation", operation, "attempt", attempt, "backoff", d, "error", err)
+		atomic.AddInt64(retries, 1)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// isRetryableError reports whether err is transient, by the classification of the retries of the AWS SDK.
+func isRetryableError(err error) bool {
+	var stalled *StalledError
+	if errors.As(err, &stalled) {
+		// canceled by the watchdog, not by the caller
+		return true
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary {
+		return true
+	}
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// retryingUploadClient retries the completion of the upload by the retry policy,
+// that is CompleteMultipartUpload, or PutObject of an object smaller than a part.
+type retryingUploadClient struct {
+	manager.UploadAPIClient
+	cfg     *RetryConfig
+	logger  *slog.Logger
+	retries *int64
+}
+
+func (c *retryingUploadClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (output *s3.PutObjectOutput, err error) {
+	seeker, ok := params.Body.(io.Seeker)
+	if !ok {
+		// the body can not be read again
+		return c.UploadAPIClient.PutObject(ctx, params, optFns...)
+	}
+	first := true
+	err = c.cfg.do(ctx, c.logger, "s3 put object", c.retries, func() error {
+		if !first {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		first = false
+		var err error
+		output, err = c.UploadAPIClient.PutObject(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
+
+func (c *retryingUploadClient) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (output *s3.CompleteMultipartUploadOutput, err error) {
+	err = c.cfg.do(ctx, c.logger, "s3 complete multipart upload", c.retries, func() error {
+		var err error
+		output, err = c.UploadAPIClient.CompleteMultipartUpload(ctx, params, optFns...)
+		return err
+	})
+	return output, err
+}
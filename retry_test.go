@@ -0,0 +1,114 @@
+package awstee
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryConfigRestrict(t *testing.T) {
+	cfg := &RetryConfig{Attempts: 5}
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, time.Second, cfg.backoff)
+	require.Equal(t, 30*time.Second, cfg.maxBackoff)
+	for n := 1; n <= 10; n++ {
+		d := cfg.delay(n)
+		require.LessOrEqual(t, d, 30*time.Second)
+		require.GreaterOrEqual(t, d, min(time.Second<<(n-1), 30*time.Second)/2)
+	}
+
+	require.EqualError(t, (&RetryConfig{Attempts: -1}).Restrict(), "retry attempts must not be negative")
+	require.Error(t, (&RetryConfig{Backoff: "soon"}).Restrict())
+	require.EqualError(t, (&RetryConfig{Backoff: "1m", MaxBackoff: "1s"}).Restrict(), "retry max_backoff must not be less than backoff")
+}
+
+func TestCloudwatchLogsWriterRetry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("hoge")}},
+		}, nil,
+	).Times(1)
+	gomock.InOrder(
+		cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			nil, &smithy.GenericAPIError{Code: "ThrottlingException"},
+		).Times(2),
+		cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			&cloudwatchlogs.PutLogEventsOutput{}, nil,
+		).Times(1),
+		cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			nil, &smithy.GenericAPIError{Code: "AccessDeniedException"},
+		).Times(1),
+	)
+	cfg := &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/logs",
+		FlushInterval: "1h",
+		Retry: RetryConfig{
+			Attempts: 3,
+			Backoff:  "1ms",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), cloudwatchLogsClient, cfg, "hoge.log", time.Now, &destinationHooks{
+		logger:       slog.Default(),
+		errorHandler: func(string, error) {},
+	})
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Flush(context.Background()), "the throttled batch is retried")
+	_, err = io.WriteString(w, "fuga\n")
+	require.NoError(t, err)
+	require.Error(t, w.Close(), "the error not retryable is not retried")
+	result := w.results()[0]
+	require.EqualValues(t, 2, result.Retries)
+	require.EqualValues(t, 1, result.Events)
+}
+
+func TestS3WriterRetry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{Code: "NotFound"},
+	).Times(1)
+	var bodies []string
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			body, err := io.ReadAll(input.Body)
+			require.NoError(t, err)
+			bodies = append(bodies, string(body))
+			if len(bodies) == 1 {
+				return nil, &smithy.GenericAPIError{Code: "SlowDown"}
+			}
+			return &s3.PutObjectOutput{}, nil
+		},
+	).Times(2)
+	cfg := &S3Config{
+		URLPrefix: "s3://awstee-example-com/logs/",
+		Retry: RetryConfig{
+			Attempts: 3,
+			Backoff:  "1ms",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	w, err := newS3Writer(context.Background(), slog.Default(), s3Client, cfg, "hoge.log", nil)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.EqualValues(t, []string{"hoge\n", "hoge\n"}, bodies, "the body is read again")
+	require.EqualValues(t, 1, w.results()[0].Retries)
+}
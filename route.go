@@ -0,0 +1,160 @@
+package awstee
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// RouteConfig selects destinations by the output name.
+// If the output name matches, the destinations of the route are added to the default ones
+// (and the ones of the former routes), or replace them with replace.
+type RouteConfig struct {
+	Match      string                `yaml:"match,omitempty"`
+	Regexp     string                `yaml:"regexp,omitempty"`
+	Targets    []string              `yaml:"targets,omitempty"`
+	S3         *S3Config             `yaml:"s3,omitempty"`
+	Cloudwatch *CloudwatchLogsConfig `yaml:"cloudwatch,omitempty"`
+	Replace    bool                  `yaml:"replace,omitempty"`
+
+	//private field
+	regexp            *regexp.Regexp
+	s3Configs         []*S3Config
+	cloudwatchConfigs []*CloudwatchLogsConfig
+}
+
+// Restrict restricts the route, and resolves its destinations with the targets of cfg.
+func (route *RouteConfig) Restrict(cfg *Config) error {
+	route.regexp = nil
+	switch {
+	case route.Match != "" && route.Regexp != "":
+		return fmt.Errorf("match and regexp are exclusive")
+	case route.Match != "":
+		if _, err := path.Match(route.Match, ""); err != nil {
+			return fmt.Errorf("match %s is invalid: %w", route.Match, err)
+		}
+	case route.Regexp != "":
+		re, err := regexp.Compile(route.Regexp)
+		if err != nil {
+			return fmt.Errorf("regexp %s is invalid: %w", route.Regexp, err)
+		}
+		route.regexp = re
+	default:
+		return fmt.Errorf("match or regexp is required")
+	}
+	var err error
+	route.s3Configs, route.cloudwatchConfigs, err = cfg.resolveRouteDestinations(route.Targets, &TargetConfig{S3: route.S3, Cloudwatch: route.Cloudwatch})
+	return err
+}
+
+// resolveRouteDestinations restricts and returns the destinations of the targets and of own, which has the s3 and cloudwatch of a route.
+func (cfg *Config) resolveRouteDestinations(targets []string, own *TargetConfig) ([]*S3Config, []*CloudwatchLogsConfig, error) {
+	var s3Configs []*S3Config
+	var cloudwatchConfigs []*CloudwatchLogsConfig
+	add := func(errPrefix string, target *TargetConfig) error {
+		if target.S3 != nil && target.S3.URLPrefix != "" {
+			if err := target.S3.Restrict(); err != nil {
+				return fmt.Errorf("%s%w", errPrefix, err)
+			}
+			s3Configs = append(s3Configs, target.S3)
+		}
+		if target.Cloudwatch != nil && target.Cloudwatch.LogGroup != "" {
+			if err := target.Cloudwatch.Restrict(); err != nil {
+				return fmt.Errorf("%s%w", errPrefix, err)
+			}
+			cloudwatchConfigs = append(cloudwatchConfigs, target.Cloudwatch)
+		}
+		return nil
+	}
+	for _, name := range targets {
+		target, ok := cfg.Targets[name]
+		if !ok || target == nil {
+			return nil, nil, fmt.Errorf("target %s is not defined", name)
+		}
+		if err := add(fmt.Sprintf("target %s: ", name), target); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := add("", own); err != nil {
+		return nil, nil, err
+	}
+	if len(s3Configs) == 0 && len(cloudwatchConfigs) == 0 {
+		return nil, nil, fmt.Errorf("no destination")
+	}
+	return s3Configs, cloudwatchConfigs, nil
+}
+
+// Matches reports whether the route applies to outputName.
+// match is a glob pattern of path.Match, and `*` also matches `/` if the pattern has no `/`.
+func (route *RouteConfig) Matches(outputName string) bool {
+	if route.regexp != nil {
+		return route.regexp.MatchString(outputName)
+	}
+	name := outputName
+	if !strings.Contains(route.Match, "/") {
+		name = path.Base(outputName)
+	}
+	ok, _ := path.Match(route.Match, name)
+	return ok
+}
+
+func (cfg *Config) restrictRoutes() error {
+	for i, route := range cfg.Routes {
+		if route == nil {
+			return fmt.Errorf("routes[%d] is empty", i)
+		}
+		if err := route.Restrict(cfg); err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// destinations returns the destinations of outputName, the default ones and the ones of the matched routes.
+func (cfg *Config) destinations(outputName string) ([]*S3Config, []*CloudwatchLogsConfig) {
+	s3Configs := append([]*S3Config{}, cfg.s3Configs...)
+	cloudwatchConfigs := append([]*CloudwatchLogsConfig{}, cfg.cloudwatchConfigs...)
+	for _, route := range cfg.Routes {
+		if !route.Matches(outputName) {
+			continue
+		}
+		if route.Replace {
+			s3Configs, cloudwatchConfigs = nil, nil
+		}
+		s3Configs = lo.Uniq(append(s3Configs, route.s3Configs...))
+		cloudwatchConfigs = lo.Uniq(append(cloudwatchConfigs, route.cloudwatchConfigs...))
+	}
+	// the destinations of severity_routes receive the lines of their severity only
+	for _, route := range cfg.SeverityRoutes {
+		s3Configs = lo.Uniq(append(s3Configs, route.s3Configs...))
+		cloudwatchConfigs = lo.Uniq(append(cloudwatchConfigs, route.cloudwatchConfigs...))
+	}
+	return s3Configs, cloudwatchConfigs
+}
+
+// allS3Configs returns the s3 destinations of any output name.
+func (cfg *Config) allS3Configs() []*S3Config {
+	s3Configs := append([]*S3Config{}, cfg.s3Configs...)
+	for _, route := range cfg.Routes {
+		s3Configs = lo.Uniq(append(s3Configs, route.s3Configs...))
+	}
+	for _, route := range cfg.SeverityRoutes {
+		s3Configs = lo.Uniq(append(s3Configs, route.s3Configs...))
+	}
+	return s3Configs
+}
+
+// allCloudwatchConfigs returns the cloudwatch logs destinations of any output name.
+func (cfg *Config) allCloudwatchConfigs() []*CloudwatchLogsConfig {
+	cloudwatchConfigs := append([]*CloudwatchLogsConfig{}, cfg.cloudwatchConfigs...)
+	for _, route := range cfg.Routes {
+		cloudwatchConfigs = lo.Uniq(append(cloudwatchConfigs, route.cloudwatchConfigs...))
+	}
+	for _, route := range cfg.SeverityRoutes {
+		cloudwatchConfigs = lo.Uniq(append(cloudwatchConfigs, route.cloudwatchConfigs...))
+	}
+	return cloudwatchConfigs
+}
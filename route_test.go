@@ -0,0 +1,71 @@
+package awstee
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigRoutes(t *testing.T) {
+	cfg := newConfig()
+	require.NoError(t, cfg.Load("testdata/routes.yaml"))
+	cases := []struct {
+		outputName string
+		s3         []string
+		cloudwatch []string
+	}{
+		{
+			outputName: "hoge.log",
+			s3:         []string{"s3://example-com/logs/"},
+		},
+		{
+			outputName: "app/hoge.audit.log",
+			s3:         []string{"s3://example-com/logs/", "s3://audit-example-com/logs/"},
+		},
+		{
+			outputName: "batch/hoge.audit.log",
+			s3:         []string{"s3://example-com/logs/", "s3://audit-example-com/logs/"},
+			cloudwatch: []string{"/batch/logs"},
+		},
+		{
+			outputName: "secret/hoge.log",
+			s3:         []string{"s3://secret-example-com/logs/"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.outputName, func(t *testing.T) {
+			s3Configs, cloudwatchConfigs := cfg.destinations(c.outputName)
+			var s3, cloudwatch []string
+			for _, s3Cfg := range s3Configs {
+				s3 = append(s3, s3Cfg.URLPrefix)
+			}
+			for _, cwCfg := range cloudwatchConfigs {
+				cloudwatch = append(cloudwatch, cwCfg.LogGroup)
+			}
+			require.EqualValues(t, c.s3, s3)
+			require.EqualValues(t, c.cloudwatch, cloudwatch)
+		})
+	}
+	require.Len(t, cfg.allS3Configs(), 3)
+	require.Len(t, cfg.allCloudwatchConfigs(), 1)
+	require.True(t, cfg.EnableCloudwatchLogs())
+}
+
+func TestRouteConfigRestrict(t *testing.T) {
+	cfg := newConfig()
+	require.EqualError(t, cfg.Load("testdata/invalid_route.yaml"), "routes[0]: target audit is not defined")
+
+	cases := []struct {
+		route *RouteConfig
+		err   string
+	}{
+		{route: &RouteConfig{Targets: []string{"audit"}}, err: "match or regexp is required"},
+		{route: &RouteConfig{Match: "*.log", Regexp: ".*"}, err: "match and regexp are exclusive"},
+		{route: &RouteConfig{Match: "[.log"}, err: "match [.log is invalid: syntax error in pattern"},
+		{route: &RouteConfig{Regexp: "("}, err: "regexp ( is invalid: error parsing regexp: missing closing ): `(`"},
+		{route: &RouteConfig{Match: "*.log"}, err: "no destination"},
+	}
+	for _, c := range cases {
+		require.EqualError(t, c.route.Restrict(newConfig()), c.err)
+	}
+}
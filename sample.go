@@ -0,0 +1,56 @@
+package awstee
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"time"
+)
+
+// SampleConfig writes a fraction of the lines to a destination, for a verbose stream.
+// The lines matching any of always_keep, such as the errors, are always written.
+type SampleConfig struct {
+	SampleRate float64  `yaml:"sample_rate,omitempty"`
+	AlwaysKeep []string `yaml:"always_keep,omitempty"`
+
+	alwaysKeep []*regexp.Regexp
+}
+
+func (cfg *SampleConfig) Enabled() bool {
+	return cfg.SampleRate > 0 && cfg.SampleRate < 1
+}
+
+func (cfg *SampleConfig) Restrict() error {
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1, got %g", cfg.SampleRate)
+	}
+	if len(cfg.AlwaysKeep) > 0 && cfg.SampleRate == 0 {
+		return errors.New("always_keep requires sample_rate")
+	}
+	cfg.alwaysKeep = make([]*regexp.Regexp, 0, len(cfg.AlwaysKeep))
+	for _, expr := range cfg.AlwaysKeep {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("always_keep %s is invalid: %w", expr, err)
+		}
+		cfg.alwaysKeep = append(cfg.alwaysKeep, re)
+	}
+	return nil
+}
+
+// processor returns the sampler of a destination, random is the uniform random number in [0, 1).
+// It is not safe for concurrent use, the lines of a destination are processed in order.
+func (cfg *SampleConfig) processor(random func() float64) lineProcessor {
+	return func(line []byte) []byte {
+		if matchAny(cfg.alwaysKeep, line) || random() < cfg.SampleRate {
+			return line
+		}
+		return nil
+	}
+}
+
+// newSampleRandom returns the random numbers of a sampler.
+func newSampleRandom() func() float64 {
+	return rand.New(rand.NewSource(time.Now().UnixNano())).Float64
+}
@@ -0,0 +1,46 @@
+package awstee
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampleConfig(t *testing.T) {
+	cfg := &SampleConfig{SampleRate: 0.5, AlwaysKeep: []string{"ERROR"}}
+	require.NoError(t, cfg.Restrict())
+	require.True(t, cfg.Enabled())
+	randoms := []float64{0.1, 0.9, 0.9, 0.4}
+	p := cfg.processor(func() float64 {
+		r := randoms[0]
+		randoms = randoms[1:]
+		return r
+	})
+	var kept []string
+	for _, line := range []string{"hoge", "fuga", "ERROR piyo", "foo", "bar"} {
+		if out := p([]byte(line)); out != nil {
+			kept = append(kept, string(out))
+		}
+	}
+	require.Equal(t, []string{"hoge", "ERROR piyo", "bar"}, kept, "always_keep does not draw a random number")
+
+	cfg = &SampleConfig{SampleRate: 0.1}
+	require.NoError(t, cfg.Restrict())
+	p = cfg.processor(newSampleRandom())
+	kept = nil
+	for i := 0; i < 10000; i++ {
+		if out := p([]byte(fmt.Sprint(i))); out != nil {
+			kept = append(kept, string(out))
+		}
+	}
+	require.InDelta(t, 1000, len(kept), 200)
+
+	cfg = &SampleConfig{SampleRate: 1.5}
+	require.EqualError(t, cfg.Restrict(), "sample_rate must be between 0 and 1, got 1.5")
+	cfg = &SampleConfig{AlwaysKeep: []string{"ERROR"}}
+	require.EqualError(t, cfg.Restrict(), "always_keep requires sample_rate")
+	cfg = &SampleConfig{SampleRate: 1}
+	require.NoError(t, cfg.Restrict())
+	require.False(t, cfg.Enabled(), "all lines")
+}
@@ -0,0 +1,43 @@
+package awstee
+
+import (
+	"bytes"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// utf8Replacement replaces the invalid UTF-8 sequences of the lines, which CloudWatch Logs may reject.
+var utf8Replacement = []byte(string(utf8.RuneError))
+
+// lineSanitizer normalizes the line endings of CRLF to LF and replaces the invalid UTF-8 of the lines written to destinations,
+// counting the lines rewritten for the stats.
+type lineSanitizer struct {
+	crlf bool
+	utf8 bool
+
+	normalizedCRLF int64
+	sanitizedUTF8  int64
+}
+
+// newLineSanitizer returns the sanitizer of normalize_crlf and sanitize_utf8, or nil without them.
+func (cfg *Config) newLineSanitizer() *lineSanitizer {
+	if !cfg.NormalizeCRLF && !cfg.SanitizeUTF8 {
+		return nil
+	}
+	return &lineSanitizer{
+		crlf: cfg.NormalizeCRLF,
+		utf8: cfg.SanitizeUTF8,
+	}
+}
+
+func (s *lineSanitizer) process(line []byte) []byte {
+	if s.crlf && len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+		atomic.AddInt64(&s.normalizedCRLF, 1)
+	}
+	if s.utf8 && !utf8.Valid(line) {
+		line = bytes.ToValidUTF8(line, utf8Replacement)
+		atomic.AddInt64(&s.sanitizedUTF8, 1)
+	}
+	return line
+}
@@ -0,0 +1,58 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineSanitizer(t *testing.T) {
+	cases := []struct {
+		name     string
+		crlf     bool
+		utf8     bool
+		line     string
+		expected string
+	}{
+		{name: "crlf", crlf: true, line: "hoge\r", expected: "hoge"},
+		{name: "cr in the middle", crlf: true, line: "ho\rge", expected: "ho\rge"},
+		{name: "crlf disabled", utf8: true, line: "hoge\r", expected: "hoge\r"},
+		{name: "invalid utf8", utf8: true, line: "ho\xffge\xe3\x81", expected: "ho�ge�"},
+		{name: "valid utf8", utf8: true, line: "ほげ", expected: "ほげ"},
+		{name: "both", crlf: true, utf8: true, line: "\xc0hoge\r", expected: "�hoge"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &lineSanitizer{crlf: c.crlf, utf8: c.utf8}
+			require.Equal(t, c.expected, string(s.process([]byte(c.line))))
+		})
+	}
+}
+
+func TestAWSTeeWriterSanitize(t *testing.T) {
+	cfg := &Config{NormalizeCRLF: true, SanitizeUTF8: true}
+	require.NoError(t, cfg.Restrict())
+	var buf bytes.Buffer
+	app, err := NewWithClient(cfg, AWSClient{},
+		WithDestination("buf", func(context.Context, string) (io.WriteCloser, error) {
+			return newTestWriteCloser(&buf, func() error { return nil }), nil
+		}),
+	)
+	require.NoError(t, err)
+	w, err := app.Writer(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\r\nfu\xffga\r\npiyo\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, "hoge\nfu�ga\npiyo\n", buf.String())
+	stats := w.Stats()
+	require.EqualValues(t, 2, stats.NormalizedCRLF)
+	require.EqualValues(t, 1, stats.SanitizedUTF8)
+	require.Contains(t, stats.String(), "lines=3 bytes=18 normalized_crlf=2 sanitized_utf8=1")
+
+	cfg = &Config{Raw: true, SanitizeUTF8: true}
+	require.EqualError(t, cfg.Restrict(), "raw can not be used with normalize_crlf or sanitize_utf8, which rewrite the lines")
+}
@@ -0,0 +1,217 @@
+package awstee
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"unicode/utf8"
+)
+
+// DefaultMaxLineBytes is the default of max_line_bytes, the maximum size of an event of CloudWatch Logs.
+const DefaultMaxLineBytes = 256 * 1024
+
+// scanInitialBufferSize is the initial buffer of a line scanner, which grows up to max_line_bytes.
+const scanInitialBufferSize = 64 * 1024
+
+// NewLineScanner returns a bufio.Scanner of the lines of r like bufio.ScanLines, whose buffer grows up to maxLineBytes instead of 64KiB.
+// A line longer than maxLineBytes does not stop the scanner with bufio.ErrTooLong: it is truncated to maxLineBytes, and the rest of it is dropped.
+// truncated is called for each truncated line, if not nil. maxLineBytes is DefaultMaxLineBytes if it is not positive.
+func NewLineScanner(r io.Reader, maxLineBytes int, truncated func()) *bufio.Scanner {
+	if maxLineBytes <= 0 {
+		maxLineBytes = DefaultMaxLineBytes
+	}
+	s := bufio.NewScanner(r)
+	// the line of maxLineBytes fits with "\r\n"
+	s.Buffer(make([]byte, 0, min(scanInitialBufferSize, maxLineBytes+2)), maxLineBytes+2)
+	splitter := &lineSplitter{max: maxLineBytes, truncated: truncated}
+	s.Split(splitter.split)
+	return s
+}
+
+// The policies of on_long_line, for the lines longer than max_line_bytes.
+const (
+	// LongLineTruncate truncates the line with longLineMarker, and drops the rest of it.
+	LongLineTruncate = "truncate"
+	// LongLineSplit splits the line into the events of max_line_bytes.
+	LongLineSplit = "split"
+	// LongLineDrop drops the whole line.
+	LongLineDrop = "drop"
+)
+
+// longLineMarker ends a line truncated by LongLineTruncate.
+const longLineMarker = " [awstee] truncated"
+
+// lineSplitter is the bufio.SplitFunc of the lines, which applies policy to the long lines.
+// Without policy, a long line is truncated to max without the marker, as NewLineScanner.
+type lineSplitter struct {
+	max       int
+	policy    string
+	truncated func()
+	// dropping drops the rest of a long line until the newline
+	dropping bool
+	// splitting is in a long line split, which is counted once
+	splitting bool
+	scratch   []byte
+}
+
+func (s *lineSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, _ := s.next(data, atEOF)
+	return advance, token, nil
+}
+
+// next returns the advance of data and the token of the next event, or nil, and whether the token completes a line.
+// A line dropped completes with the nil token, and a line split completes with its last piece. advance is 0 if more data is needed.
+// token is valid until the next call.
+func (s *lineSplitter) next(data []byte, atEOF bool) (advance int, token []byte, complete bool) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, false
+	}
+	i := bytes.IndexByte(data, '\n')
+	if s.dropping {
+		if i < 0 {
+			return len(data), nil, false
+		}
+		s.dropping = false
+		return i + 1, nil, true
+	}
+	if i >= 0 {
+		return s.line(dropCR(data[:i]), i+1)
+	}
+	if atEOF {
+		return s.line(dropCR(data), len(data))
+	}
+	if len(data) > s.max+1 {
+		// the buffer is full without the newline
+		s.count()
+		switch s.policy {
+		case LongLineSplit:
+			s.splitting = true
+			n := s.cut(data, s.max)
+			return n, data[:n], false
+		case LongLineDrop:
+			s.dropping = true
+			return len(data), nil, false
+		}
+		s.dropping = true
+		return s.max, s.truncate(data), false
+	}
+	return 0, nil, false
+}
+
+// line returns the token of the line found, which is advance bytes of the data with its newline.
+func (s *lineSplitter) line(line []byte, advance int) (int, []byte, bool) {
+	if len(line) <= s.max {
+		s.splitting = false
+		return advance, line, true
+	}
+	s.count()
+	switch s.policy {
+	case LongLineSplit:
+		// the rest is the next tokens
+		s.splitting = true
+		n := s.cut(line, s.max)
+		return n, line[:n], false
+	case LongLineDrop:
+		return advance, nil, true
+	}
+	return advance, s.truncate(line), true
+}
+
+// count counts a long line once, not for each piece of it split.
+func (s *lineSplitter) count() {
+	if !s.splitting && s.truncated != nil {
+		s.truncated()
+	}
+}
+
+// truncate returns the line longer than max truncated to max, with the marker by LongLineTruncate.
+func (s *lineSplitter) truncate(line []byte) []byte {
+	if s.policy != LongLineTruncate || s.max <= len(longLineMarker) {
+		return line[:s.cut(line, s.max)]
+	}
+	s.scratch = append(s.scratch[:0], line[:s.cut(line, s.max-len(longLineMarker))]...)
+	s.scratch = append(s.scratch, longLineMarker...)
+	return s.scratch
+}
+
+// cut returns the bytes of line up to n not splitting a UTF-8 character, or n if it is not UTF-8. line is longer than n.
+func (s *lineSplitter) cut(line []byte, n int) int {
+	for i := n; i > n-utf8.UTFMax && i > 0; i-- {
+		if utf8.RuneStart(line[i]) {
+			return i
+		}
+	}
+	return n
+}
+
+// dropCR drops a terminal \r from the line, the same as bufio.ScanLines.
+func dropCR(data []byte) []byte {
+	if len(data) > 0 && data[len(data)-1] == '\r' {
+		return data[:len(data)-1]
+	}
+	return data
+}
+
+// lineReader reads the lines of r split as NewLineScanner, by the chunks of the reads from r instead of one by one.
+// It is not safe for concurrent use.
+type lineReader struct {
+	r        io.Reader
+	splitter lineSplitter
+	buf      []byte
+	start    int
+	end      int
+	err      error
+}
+
+// policy is the one of on_long_line, or empty to truncate the long lines as NewLineScanner.
+func newLineReader(r io.Reader, maxLineBytes int, policy string, truncated func()) *lineReader {
+	if maxLineBytes <= 0 {
+		maxLineBytes = DefaultMaxLineBytes
+	}
+	return &lineReader{
+		r:        r,
+		splitter: lineSplitter{max: maxLineBytes, policy: policy, truncated: truncated},
+		buf:      make([]byte, min(scanInitialBufferSize, maxLineBytes+2)),
+	}
+}
+
+// readLines calls fn for each token of the lines by the next reads from r, until at least one is, and returns the number of them.
+// complete is whether the token completes a line, and the line dropped by the splitter is the nil token completing it. line is valid only during fn. The error of r, io.EOF at the end, is returned after all the lines are.
+func (r *lineReader) readLines(fn func(line []byte, complete bool)) (int, error) {
+	n := 0
+	for {
+		for r.start < r.end || r.err != nil {
+			advance, line, complete := r.splitter.next(r.buf[r.start:r.end], r.err != nil)
+			if advance == 0 && line == nil {
+				// more data is needed, or the end
+				break
+			}
+			r.start += advance
+			if line != nil || complete {
+				fn(line, complete)
+				n++
+			}
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.start > 0 {
+			r.end = copy(r.buf, r.buf[r.start:r.end])
+			r.start = 0
+		}
+		if r.end == len(r.buf) {
+			// the line of max fits with "\r\n", the splitter truncates it when the buffer of max+2 is full
+			buf := make([]byte, min(len(r.buf)*2, r.splitter.max+2))
+			copy(buf, r.buf[:r.end])
+			r.buf = buf
+		}
+		m, err := r.r.Read(r.buf[r.end:])
+		r.end += m
+		if err != nil {
+			r.err = err
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package awstee
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineScanner(t *testing.T) {
+	cases := []struct {
+		name      string
+		input     string
+		lines     []string
+		truncated int
+	}{
+		{name: "short", input: "hoge\r\nfuga\npiyo", lines: []string{"hoge", "fuga", "piyo"}},
+		{name: "max with crlf", input: "12345678\r\nfuga\n", lines: []string{"12345678", "fuga"}},
+		{name: "long", input: "123456789\nfuga\n", lines: []string{"12345678", "fuga"}, truncated: 1},
+		{name: "very long", input: strings.Repeat("1234", 100) + "\nfuga\n" + strings.Repeat("5678", 100), lines: []string{"12341234", "fuga", "56785678"}, truncated: 2},
+		{name: "empty lines", input: "\n\n123456789", lines: []string{"", "", "12345678"}, truncated: 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			truncated := 0
+			s := NewLineScanner(strings.NewReader(c.input), 8, func() { truncated++ })
+			var lines []string
+			for s.Scan() {
+				lines = append(lines, s.Text())
+			}
+			require.NoError(t, s.Err())
+			require.Equal(t, c.lines, lines)
+			require.Equal(t, c.truncated, truncated)
+		})
+	}
+}
+
+func TestLineScannerDefault(t *testing.T) {
+	long := strings.Repeat("a", 100*1024)
+	s := NewLineScanner(strings.NewReader(long+"\n"+long+strings.Repeat("b", DefaultMaxLineBytes)+"\n"), 0, nil)
+	require.True(t, s.Scan())
+	require.Equal(t, long, s.Text(), "longer than the 64KiB of bufio.Scanner")
+	require.True(t, s.Scan())
+	require.Len(t, s.Text(), DefaultMaxLineBytes)
+	require.False(t, s.Scan())
+	require.NoError(t, s.Err())
+}
+
+func TestLineReader(t *testing.T) {
+	input := "hoge\r\nfuga\n" + strings.Repeat("1234", 100) + "\n\npiyo"
+	expected := []string{"hoge", "fuga", "12341234", "", "piyo"}
+	for name, r := range map[string]func() io.Reader{
+		"chunk":    func() io.Reader { return strings.NewReader(input) },
+		"one byte": func() io.Reader { return iotest.OneByteReader(strings.NewReader(input)) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			truncated := 0
+			lr := newLineReader(r(), 8, "", func() { truncated++ })
+			var lines []string
+			for {
+				_, err := lr.readLines(func(line []byte, _ bool) {
+					if line != nil {
+						// not the rest of the truncated line dropped
+						lines = append(lines, string(line))
+					}
+				})
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+			}
+			require.Equal(t, expected, lines)
+			require.Equal(t, 1, truncated)
+		})
+	}
+
+	lr := newLineReader(strings.NewReader("hoge\nfuga\npiyo\n"), 0, "", nil)
+	n, err := lr.readLines(func([]byte, bool) {})
+	require.NoError(t, err)
+	require.Equal(t, 3, n, "the lines of a read are returned at once")
+}
+
+func TestLineReaderOnLongLine(t *testing.T) {
+	input := "hoge\n" + strings.Repeat("1234", 10) + "\r\nfuga\n" + strings.Repeat("あ", 12) + "\npiyo"
+	cases := []struct {
+		policy string
+		lines  []string
+		ends   []bool
+	}{
+		{
+			// the rest of a line longer than the buffer is dropped until the newline completing it
+			policy: LongLineTruncate,
+			lines:  []string{"hoge", "1234" + longLineMarker, "", "fuga", "あ" + longLineMarker, "", "piyo"},
+			ends:   []bool{true, false, true, true, false, true, true},
+		},
+		{
+			policy: LongLineSplit,
+			lines:  []string{"hoge", "12341234123412341234123", "41234123412341234", "fuga", "あああああああ", "あああああ", "piyo"},
+			ends:   []bool{true, false, true, true, false, true, true},
+		},
+		{
+			policy: LongLineDrop,
+			lines:  []string{"hoge", "", "fuga", "", "piyo"},
+			ends:   []bool{true, true, true, true, true},
+		},
+	}
+	for _, c := range cases {
+		for name, r := range map[string]func() io.Reader{
+			"chunk":    func() io.Reader { return strings.NewReader(input) },
+			"one byte": func() io.Reader { return iotest.OneByteReader(strings.NewReader(input)) },
+		} {
+			t.Run(c.policy+" "+name, func(t *testing.T) {
+				truncated := 0
+				lr := newLineReader(r(), 23, c.policy, func() { truncated++ })
+				var lines []string
+				var ends []bool
+				for {
+					_, err := lr.readLines(func(line []byte, complete bool) {
+						lines = append(lines, string(line))
+						ends = append(ends, complete)
+					})
+					if err == io.EOF {
+						break
+					}
+					require.NoError(t, err)
+				}
+				require.Equal(t, c.lines, lines)
+				require.Equal(t, c.ends, ends)
+				require.Equal(t, 2, truncated, "a long line is counted once")
+			})
+		}
+	}
+}
+
+func TestCloudwatchLogsWriterMaxLineBytes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	var messages []string
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			for _, e := range input.LogEvents {
+				messages = append(messages, *e.Message)
+			}
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).AnyTimes()
+	cfg := &Config{
+		MaxLineBytes: 10,
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup:      "/awstee/logs",
+			FlushInterval: "1h",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), client, cfg.Cloudwatch, "hoge.log", time.Now, nil)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\n"+strings.Repeat("fuga", 10)+"\npiyo\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, []string{"hoge", "fugafugafu", "piyo"}, messages)
+	require.EqualValues(t, 1, w.Stats().Truncated)
+	require.Contains(t, w.Stats().String(), "truncated=1")
+}
+
+func TestCloudwatchLogsWriterOnLongLineSplit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	var messages []string
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			for _, e := range input.LogEvents {
+				messages = append(messages, *e.Message)
+			}
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).AnyTimes()
+	cfg := &Config{
+		MaxLineBytes: 10,
+		OnLongLine:   LongLineSplit,
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup:      "/awstee/logs",
+			FlushInterval: "1h",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), client, cfg.Cloudwatch, "hoge.log", time.Now, nil)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\n"+strings.Repeat("fuga", 6)+"\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Flush(context.Background()), "the line split is counted once for Flush")
+	require.Equal(t, []string{"hoge", "fugafugafu", "gafugafuga", "fuga"}, messages)
+	_, err = io.WriteString(w, "piyo\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, "piyo", messages[len(messages)-1])
+	require.EqualValues(t, 1, w.Stats().Truncated)
+
+	cfg.OnLongLine = "hoge"
+	require.EqualError(t, cfg.Restrict(), "on_long_line must be one of truncate, split, drop")
+}
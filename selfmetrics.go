@@ -0,0 +1,219 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// maxPutMetricDataCount is the metrics accepted by cloudwatch PutMetricData at once.
+const maxPutMetricDataCount = 1000
+
+// cloudwatchMetricsAPI is the part of the cloudwatch api putting the self metrics.
+type cloudwatchMetricsAPI interface {
+	PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+// SelfMetricsConfig puts the metrics of awstee itself to CloudWatch periodically, for the alarms of the capture health of a fleet.
+// The metrics of each destination have the dimensions of the host, the output name and the destination.
+type SelfMetricsConfig struct {
+	Namespace string `yaml:"namespace,omitempty"`
+	Interval  string `yaml:"interval,omitempty"`
+
+	interval time.Duration
+}
+
+func (cfg *SelfMetricsConfig) Enabled() bool {
+	return cfg.Namespace != ""
+}
+
+func (cfg *SelfMetricsConfig) Restrict() error {
+	if cfg.Interval == "" {
+		cfg.interval = time.Minute
+		return nil
+	}
+	d, err := time.ParseDuration(cfg.Interval)
+	if err != nil {
+		return fmt.Errorf("self_metrics interval is invalid format: %w", err)
+	}
+	if d < time.Second {
+		return errors.New("self_metrics interval must be 1s or longer")
+	}
+	cfg.interval = d
+	return nil
+}
+
+// selfMetricsCounts is the counts of a destination since the last put.
+type selfMetricsCounts struct {
+	bytes  int64
+	events int64
+	errors int64
+}
+
+// selfMetricsCounter counts the bytes, the events and the errors of the destinations notified to the hooks, and notifies them to next too.
+type selfMetricsCounter struct {
+	next   MetricsHook
+	mu     sync.Mutex
+	counts map[string]*selfMetricsCounts
+}
+
+func newSelfMetricsCounter(next MetricsHook) *selfMetricsCounter {
+	return &selfMetricsCounter{
+		next:   next,
+		counts: make(map[string]*selfMetricsCounts),
+	}
+}
+
+func (c *selfMetricsCounter) add(dest string, fn func(*selfMetricsCounts)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts, ok := c.counts[dest]
+	if !ok {
+		counts = &selfMetricsCounts{}
+		c.counts[dest] = counts
+	}
+	fn(counts)
+}
+
+func (c *selfMetricsCounter) OnBytesWritten(dest string, n int) {
+	c.add(dest, func(counts *selfMetricsCounts) { counts.bytes += int64(n) })
+	if c.next != nil {
+		c.next.OnBytesWritten(dest, n)
+	}
+}
+
+func (c *selfMetricsCounter) OnBatchSent(dest string, events int, latency time.Duration) {
+	c.add(dest, func(counts *selfMetricsCounts) { counts.events += int64(events) })
+	if c.next != nil {
+		c.next.OnBatchSent(dest, events, latency)
+	}
+}
+
+func (c *selfMetricsCounter) OnError(dest string) {
+	c.add(dest, func(counts *selfMetricsCounts) { counts.errors++ })
+	if c.next != nil {
+		c.next.OnError(dest)
+	}
+}
+
+// take returns the counts of dest since the last take.
+func (c *selfMetricsCounter) take(dest string) selfMetricsCounts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts, ok := c.counts[dest]
+	if !ok {
+		return selfMetricsCounts{}
+	}
+	taken := *counts
+	*counts = selfMetricsCounts{}
+	return taken
+}
+
+// selfMetricsPublisher puts the self metrics of a writer every interval until stop, which puts the last ones.
+type selfMetricsPublisher struct {
+	client    cloudwatchMetricsAPI
+	cfg       *SelfMetricsConfig
+	counter   *selfMetricsCounter
+	stats     func() Stats
+	hostname  string
+	output    string
+	now       func() time.Time
+	logger    *slog.Logger
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+func newSelfMetricsPublisher(logger *slog.Logger, client cloudwatchMetricsAPI, cfg *SelfMetricsConfig, counter *selfMetricsCounter, outputName string, now func() time.Time) *selfMetricsPublisher {
+	return &selfMetricsPublisher{
+		client:   client,
+		cfg:      cfg,
+		counter:  counter,
+		hostname: newRunMetadata(outputName).Hostname,
+		output:   outputName,
+		now:      now,
+		logger:   logger,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// start puts the metrics of stats every interval in the background.
+func (p *selfMetricsPublisher) start(ctx context.Context, stats func() Stats) {
+	p.stats = stats
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(p.cfg.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.publish(ctx); err != nil {
+					p.logger.Warn("put self metrics", "error", err)
+				}
+			case <-p.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stop stops the background, and puts the last metrics by ctx.
+func (p *selfMetricsPublisher) stop(ctx context.Context) {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		<-p.stopped
+		if err := p.publish(ctx); err != nil {
+			p.logger.Warn("put self metrics", "error", err)
+		}
+	})
+}
+
+// publish puts the metrics of the destinations since the last put.
+func (p *selfMetricsPublisher) publish(ctx context.Context) error {
+	timestamp := p.now()
+	var data []types.MetricDatum
+	for _, d := range p.stats().Destinations {
+		counts := p.counter.take(d.Name)
+		dimensions := []types.Dimension{
+			{Name: aws.String("Host"), Value: aws.String(p.hostname)},
+			{Name: aws.String("OutputName"), Value: aws.String(p.output)},
+			{Name: aws.String("Destination"), Value: aws.String(d.Name)},
+		}
+		datum := func(name string, value int64, unit types.StandardUnit) types.MetricDatum {
+			return types.MetricDatum{
+				MetricName: aws.String(name),
+				Dimensions: dimensions,
+				Timestamp:  aws.Time(timestamp),
+				Value:      aws.Float64(float64(value)),
+				Unit:       unit,
+			}
+		}
+		data = append(data,
+			datum("BytesUploaded", counts.bytes, types.StandardUnitBytes),
+			datum("EventsDelivered", counts.events, types.StandardUnitCount),
+			datum("DeliveryErrors", counts.errors, types.StandardUnitCount),
+			datum("BufferDepth", d.Buffered, types.StandardUnitCount),
+		)
+	}
+	for len(data) > 0 {
+		n := min(len(data), maxPutMetricDataCount)
+		if _, err := p.client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(p.cfg.Namespace),
+			MetricData: data[:n],
+		}); err != nil {
+			return fmt.Errorf("put metric data to %s: %w", p.cfg.Namespace, err)
+		}
+		data = data[n:]
+	}
+	return nil
+}
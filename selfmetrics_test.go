@@ -0,0 +1,99 @@
+package awstee
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCloudwatchMetrics keeps the metrics put, by the name and the destination.
+type fakeCloudwatchMetrics struct {
+	mu      sync.Mutex
+	puts    int
+	metrics map[string]float64
+}
+
+func (f *fakeCloudwatchMetrics) PutMetricData(_ context.Context, input *cloudwatch.PutMetricDataInput, _ ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.metrics == nil {
+		f.metrics = make(map[string]float64)
+	}
+	f.puts++
+	for _, d := range input.MetricData {
+		key := aws.ToString(input.Namespace) + " " + aws.ToString(d.MetricName)
+		for _, dim := range d.Dimensions {
+			if aws.ToString(dim.Name) != "Host" {
+				key += " " + aws.ToString(dim.Name) + "=" + aws.ToString(dim.Value)
+			}
+		}
+		f.metrics[key] += aws.ToFloat64(d.Value)
+	}
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestSelfMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudwatchlogs.PutLogEventsOutput{}, nil).AnyTimes()
+	cfg := &Config{
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup:      "/awstee/logs",
+			FlushInterval: "1h",
+		},
+		SelfMetrics: SelfMetricsConfig{
+			Namespace: "awstee",
+			Interval:  "1h",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{CloudwatchLogs: client})
+	require.NoError(t, err)
+	metrics := &fakeCloudwatchMetrics{}
+	app.cloudwatchMetrics = metrics
+	w, err := app.Writer(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\nfuga\npiyo\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	dest := " OutputName=hoge.log Destination=LogGroup=/awstee/logs, LogStream=hoge"
+	require.Equal(t, 1, metrics.puts, "the last metrics are put by Close")
+	require.Equal(t, map[string]float64{
+		// with the newline of Close ending the last line
+		"awstee BytesUploaded" + dest:   16,
+		"awstee EventsDelivered" + dest: 3,
+		"awstee DeliveryErrors" + dest:  0,
+		"awstee BufferDepth" + dest:     0,
+	}, metrics.metrics)
+}
+
+func TestSelfMetricsCounter(t *testing.T) {
+	c := newSelfMetricsCounter(nil)
+	c.OnBytesWritten("hoge", 10)
+	c.OnBatchSent("hoge", 2, time.Second)
+	c.OnError("hoge")
+	c.OnBytesWritten("fuga", 5)
+	require.Equal(t, selfMetricsCounts{bytes: 10, events: 2, errors: 1}, c.take("hoge"))
+	require.Equal(t, selfMetricsCounts{}, c.take("hoge"), "the counts are since the last take")
+	require.Equal(t, selfMetricsCounts{bytes: 5}, c.take("fuga"))
+	require.Equal(t, selfMetricsCounts{}, c.take("piyo"))
+}
+
+func TestSelfMetricsConfig(t *testing.T) {
+	cfg := &SelfMetricsConfig{Namespace: "awstee"}
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, time.Minute, cfg.interval)
+	cfg.Interval = "100ms"
+	require.EqualError(t, cfg.Restrict(), "self_metrics interval must be 1s or longer")
+}
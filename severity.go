@@ -0,0 +1,115 @@
+package awstee
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/samber/lo"
+)
+
+// SeverityRouteConfig sends the lines of a severity to its destinations, in addition to the destinations of all lines.
+// A line is of the severity of the first route whose match matches it, and the lines matching none are of no route.
+type SeverityRouteConfig struct {
+	Severity   string                `yaml:"severity,omitempty"`
+	Match      string                `yaml:"match,omitempty"`
+	Targets    []string              `yaml:"targets,omitempty"`
+	S3         *S3Config             `yaml:"s3,omitempty"`
+	Cloudwatch *CloudwatchLogsConfig `yaml:"cloudwatch,omitempty"`
+
+	//private field
+	regexp            *regexp.Regexp
+	s3Configs         []*S3Config
+	cloudwatchConfigs []*CloudwatchLogsConfig
+}
+
+// Restrict restricts the route, and resolves its destinations with the targets of cfg.
+func (route *SeverityRouteConfig) Restrict(cfg *Config) error {
+	if route.Severity == "" {
+		return fmt.Errorf("severity is required")
+	}
+	if route.Match == "" {
+		return fmt.Errorf("match is required")
+	}
+	re, err := regexp.Compile(route.Match)
+	if err != nil {
+		return fmt.Errorf("match %s is invalid: %w", route.Match, err)
+	}
+	route.regexp = re
+	route.s3Configs, route.cloudwatchConfigs, err = cfg.resolveRouteDestinations(route.Targets, &TargetConfig{S3: route.S3, Cloudwatch: route.Cloudwatch})
+	return err
+}
+
+// restrictSeverityRoutes restricts severity_routes after routes.
+// The destinations of a severity must not be the ones of all lines or of another severity, the lines of which would be mixed in the same object or log stream.
+func (cfg *Config) restrictSeverityRoutes() error {
+	for _, route := range cfg.SeverityRoutes {
+		if route != nil {
+			// not the destinations of all lines
+			route.s3Configs, route.cloudwatchConfigs = nil, nil
+		}
+	}
+	s3Owners := make(map[string]string)
+	cloudwatchOwners := make(map[string]string)
+	for _, s3Cfg := range cfg.allS3Configs() {
+		s3Owners[s3Cfg.URLPrefix] = "all lines"
+	}
+	for _, cwCfg := range cfg.allCloudwatchConfigs() {
+		cloudwatchOwners[cwCfg.LogGroup] = "all lines"
+	}
+	for i, route := range cfg.SeverityRoutes {
+		if route == nil {
+			return fmt.Errorf("severity_routes[%d] is empty", i)
+		}
+		if err := route.Restrict(cfg); err != nil {
+			return fmt.Errorf("severity_routes[%d]: %w", i, err)
+		}
+		owner := "severity " + route.Severity
+		for _, s3Cfg := range route.s3Configs {
+			if other, ok := s3Owners[s3Cfg.URLPrefix]; ok {
+				return fmt.Errorf("severity_routes[%d]: s3 %s is already a destination of %s", i, s3Cfg.URLPrefix, other)
+			}
+			s3Owners[s3Cfg.URLPrefix] = owner
+		}
+		for _, cwCfg := range route.cloudwatchConfigs {
+			if other, ok := cloudwatchOwners[cwCfg.LogGroup]; ok {
+				return fmt.Errorf("severity_routes[%d]: cloudwatch %s is already a destination of %s", i, cwCfg.LogGroup, other)
+			}
+			cloudwatchOwners[cwCfg.LogGroup] = owner
+		}
+	}
+	return nil
+}
+
+// severity returns the index of the severity route of line, or -1 if line is of no route.
+func (cfg *Config) severity(line []byte) int {
+	for i, route := range cfg.SeverityRoutes {
+		if route.regexp.Match(line) {
+			return i
+		}
+	}
+	return -1
+}
+
+// severityProcessors returns the processor selecting the lines of the severity of a destination, or nil if it is a destination of all lines.
+// dest is an *S3Config or a *CloudwatchLogsConfig.
+func (cfg *Config) severityProcessors(dest any) []lineProcessor {
+	for i, route := range cfg.SeverityRoutes {
+		owned := false
+		switch dest := dest.(type) {
+		case *S3Config:
+			owned = lo.Contains(route.s3Configs, dest)
+		case *CloudwatchLogsConfig:
+			owned = lo.Contains(route.cloudwatchConfigs, dest)
+		}
+		if owned {
+			i := i
+			return []lineProcessor{func(line []byte) []byte {
+				if cfg.severity(line) != i {
+					return nil
+				}
+				return line
+			}}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package awstee
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigSeverityRoutes(t *testing.T) {
+	cases := []struct {
+		routes []*SeverityRouteConfig
+		err    string
+	}{
+		{
+			routes: []*SeverityRouteConfig{{Match: "ERROR", Targets: []string{"errors"}}},
+			err:    "severity_routes[0]: severity is required",
+		},
+		{
+			routes: []*SeverityRouteConfig{{Severity: "error", Match: "(", Targets: []string{"errors"}}},
+			err:    "severity_routes[0]: match ( is invalid: error parsing regexp: missing closing ): `(`",
+		},
+		{
+			routes: []*SeverityRouteConfig{{Severity: "error", Match: "ERROR"}},
+			err:    "severity_routes[0]: no destination",
+		},
+		{
+			routes: []*SeverityRouteConfig{{Severity: "error", Match: "ERROR", Cloudwatch: &CloudwatchLogsConfig{LogGroup: "/awstee/logs"}}},
+			err:    "severity_routes[0]: cloudwatch /awstee/logs is already a destination of all lines",
+		},
+		{
+			routes: []*SeverityRouteConfig{
+				{Severity: "error", Match: "ERROR", Targets: []string{"errors"}},
+				{Severity: "warn", Match: "WARN", Targets: []string{"errors"}},
+			},
+			err: "severity_routes[1]: cloudwatch /awstee/errors is already a destination of severity error",
+		},
+	}
+	for _, c := range cases {
+		cfg := &Config{
+			Cloudwatch: &CloudwatchLogsConfig{LogGroup: "/awstee/logs"},
+			Targets: map[string]*TargetConfig{
+				"errors": {Cloudwatch: &CloudwatchLogsConfig{LogGroup: "/awstee/errors"}},
+			},
+			SeverityRoutes: c.routes,
+		}
+		require.EqualError(t, cfg.Restrict(), c.err)
+	}
+}
+
+func TestAWSTeeSeverityRoutes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	client.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("app")}},
+		}, nil,
+	).AnyTimes()
+	var mu sync.Mutex
+	messages := make(map[string][]string)
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, e := range input.LogEvents {
+				messages[*input.LogGroupName] = append(messages[*input.LogGroupName], *e.Message)
+			}
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).AnyTimes()
+	cfg := &Config{
+		Cloudwatch: &CloudwatchLogsConfig{LogGroup: "/awstee/logs"},
+		Targets: map[string]*TargetConfig{
+			"errors": {Cloudwatch: &CloudwatchLogsConfig{LogGroup: "/awstee/errors"}},
+		},
+		SeverityRoutes: []*SeverityRouteConfig{
+			{Severity: "error", Match: "ERROR", Targets: []string{"errors"}},
+			{Severity: "warn", Match: "WARN|ERROR", Cloudwatch: &CloudwatchLogsConfig{LogGroup: "/awstee/warnings"}},
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{CloudwatchLogs: client})
+	require.NoError(t, err)
+	w, err := app.Writer(context.Background(), "app.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "INFO hoge\nERROR fuga\nWARN piyo\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, map[string][]string{
+		"/awstee/logs":     {"INFO hoge", "ERROR fuga", "WARN piyo"},
+		"/awstee/errors":   {"ERROR fuga"},
+		"/awstee/warnings": {"WARN piyo"},
+	}, messages, "a line is of the first severity matching it")
+}
@@ -0,0 +1,385 @@
+package awstee
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// errSpillFull is returned when the spill exceeds max_bytes.
+var errSpillFull = errors.New("spill max_bytes exceeded")
+
+const (
+	// SpillOnFullAbort fails the destination when the spill is full.
+	SpillOnFullAbort = "abort"
+	// SpillOnFullDrop stops the spill when it is full, and the destination goes on without it.
+	SpillOnFullDrop = "drop"
+)
+
+const (
+	spillPattern       = "awstee-spill-*"
+	spillJournalSuffix = ".json"
+)
+
+// SpillConfig is the on-disk buffer of a destination. While the destination is unreachable,
+// the data is spilled to a file in dir up to max_bytes, and replayed once the destination is reachable again.
+// With wal, the file is the write-ahead log: each write is synced to it before it is written to the destination,
+// and it is trimmed only after the destination acknowledges the data. The write fails if it does not fit in max_bytes (0 is unlimited).
+// The data not acknowledged is kept in it for Resume.
+// The spill is full when it exceeds max_bytes, or when the disk of dir has no space left (or the quota is exceeded).
+// Then on_full: abort (default) fails the destination, and drop stops the spill: the batches failed after it are dropped
+// and counted, and the wal stops keeping the writes.
+type SpillConfig struct {
+	Dir      string `yaml:"dir,omitempty"`
+	MaxBytes int64  `yaml:"max_bytes,omitempty"`
+	WAL      bool   `yaml:"wal,omitempty"`
+	OnFull   string `yaml:"on_full,omitempty"`
+}
+
+func (cfg *SpillConfig) Enabled() bool {
+	return cfg.MaxBytes > 0 || cfg.WAL
+}
+
+func (cfg *SpillConfig) Restrict() error {
+	if cfg.MaxBytes < 0 {
+		return errors.New("spill max_bytes must not be negative")
+	}
+	switch cfg.OnFull {
+	case "":
+		cfg.OnFull = SpillOnFullAbort
+	case SpillOnFullAbort, SpillOnFullDrop:
+	default:
+		return fmt.Errorf("spill on_full must be one of %s, %s", SpillOnFullAbort, SpillOnFullDrop)
+	}
+	return nil
+}
+
+// SpillFullError is the error of a write not fitting in the spill, telling how to make room for it.
+type SpillFullError struct {
+	// Path is the file of the spill.
+	Path     string
+	MaxBytes int64
+	// Err is errSpillFull for max_bytes, or the error of the disk.
+	Err error
+}
+
+func (e *SpillFullError) Error() string {
+	if errors.Is(e.Err, errSpillFull) {
+		return fmt.Sprintf("%v (%d bytes): raise spill max_bytes, or set spill on_full: drop to go on without the spill", e.Err, e.MaxBytes)
+	}
+	return fmt.Sprintf("no space left for the spill %s: free the disk, move spill dir to a larger disk or set spill max_bytes below the free space, "+
+		"or set spill on_full: drop to go on without the spill: %v", e.Path, e.Err)
+}
+
+func (e *SpillFullError) Unwrap() error {
+	return e.Err
+}
+
+// spillJournal describes the destination of a spill. It is written next to the spill,
+// so that the spill left by an interrupted run can be delivered by Resume.
+type spillJournal struct {
+	Kind       string    `json:"kind"`
+	Bucket     string    `json:"bucket,omitempty"`
+	Key        string    `json:"key,omitempty"`
+	LogGroup   string    `json:"log_group,omitempty"`
+	LogStream  string    `json:"log_stream,omitempty"`
+	OutputName string    `json:"output_name"`
+	Hostname   string    `json:"hostname"`
+	PID        int       `json:"pid"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+const (
+	spillKindS3         = "s3"
+	spillKindCloudwatch = "cloudwatch"
+)
+
+// spillFile is a temporary file of a destination, removed by Close with its journal.
+// The data is appended at the end, and the replayed data is consumed from the head.
+type spillFile struct {
+	mu       sync.Mutex
+	f        *os.File
+	journal  string
+	wal      bool
+	maxBytes int64
+	size     int64
+	offset   int64
+	pending  int64
+	disabled bool
+	onFull   string
+	fullErr  error
+	logger   *slog.Logger
+}
+
+func newSpillFile(logger *slog.Logger, cfg *SpillConfig, journal spillJournal) (*spillFile, error) {
+	f, err := os.CreateTemp(cfg.Dir, spillPattern)
+	if err != nil {
+		return nil, fmt.Errorf("create spill: %w", err)
+	}
+	meta := newRunMetadata(journal.OutputName)
+	journal.Hostname, journal.PID, journal.StartedAt = meta.Hostname, meta.PID, time.Now()
+	s := &spillFile{
+		f:        f,
+		journal:  f.Name() + spillJournalSuffix,
+		wal:      cfg.WAL,
+		maxBytes: cfg.MaxBytes,
+		onFull:   cfg.OnFull,
+		logger:   logger.With("spill", f.Name()),
+	}
+	b, err := json.Marshal(journal)
+	if err == nil {
+		err = os.WriteFile(s.journal, b, 0o600)
+	}
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("create spill journal: %w", err)
+	}
+	return s, nil
+}
+
+// Write appends p, or fails with SpillFullError if p does not fit in max_bytes or in the disk. The wal is synced.
+// A failed write is rolled back, not to leave a partial record. With on_full: drop, the spill is disabled when it is full.
+func (s *spillFile) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disabled {
+		if s.fullErr != nil {
+			return 0, s.fullErr
+		}
+		return 0, s.fullError(errSpillFull)
+	}
+	if s.maxBytes > 0 && s.size+int64(len(p)) > s.maxBytes {
+		return 0, s.full(errSpillFull)
+	}
+	n, err := s.f.WriteAt(p, s.size)
+	if err == nil && s.wal {
+		err = s.f.Sync()
+	}
+	if err != nil {
+		if n > 0 {
+			s.f.Truncate(s.size)
+		}
+		if isNoSpaceError(err) {
+			return 0, s.full(err)
+		}
+		return 0, fmt.Errorf("write spill: %w", err)
+	}
+	s.size += int64(n)
+	atomic.StoreInt64(&s.pending, s.size-s.offset)
+	return n, nil
+}
+
+func (s *spillFile) fullError(err error) error {
+	return &SpillFullError{Path: s.f.Name(), MaxBytes: s.maxBytes, Err: err}
+}
+
+// full returns the error of the full spill, and disables the spill with on_full: drop.
+func (s *spillFile) full(err error) error {
+	err = s.fullError(err)
+	if s.onFull == SpillOnFullDrop && !s.disabled {
+		s.logger.Error("spill is full and stopped, the destination goes on without it", "error", err)
+		s.disabled = true
+		s.fullErr = err
+		os.Remove(s.journal)
+	}
+	return err
+}
+
+// dropsOnFull reports whether err is the one of the spill stopped by on_full: drop.
+func (s *spillFile) dropsOnFull(err error) bool {
+	var fullErr *SpillFullError
+	return s.onFull == SpillOnFullDrop && errors.As(err, &fullErr)
+}
+
+// Full reports whether the spill is stopped by on_full: drop.
+func (s *spillFile) Full() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fullErr != nil
+}
+
+// Pending returns the bytes spilled and not replayed yet.
+func (s *spillFile) Pending() int64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&s.pending)
+}
+
+// consume marks n bytes from the head as replayed, and truncates the file when all are replayed.
+func (s *spillFile) consume(n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset += n
+	if s.offset >= s.size {
+		s.offset, s.size = 0, 0
+		if err := s.f.Truncate(0); err != nil {
+			return fmt.Errorf("truncate spill: %w", err)
+		}
+	}
+	atomic.StoreInt64(&s.pending, s.size-s.offset)
+	return nil
+}
+
+// reader returns the reader of the data not replayed yet.
+func (s *spillFile) reader() *io.SectionReader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return io.NewSectionReader(s.f, s.offset, s.size-s.offset)
+}
+
+// disable stops spilling. The spill is not resumable any more, because it misses the data after it.
+func (s *spillFile) disable() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disabled = true
+	os.Remove(s.journal)
+}
+
+// finish removes the spill, or keeps the wal with its journal for Resume if it has the data not acknowledged.
+func (s *spillFile) finish() {
+	if pending := s.Pending(); s.wal && pending > 0 && !s.isDisabled() {
+		s.f.Close()
+		s.logger.Warn("wal has the data not delivered, deliver it by awstee resume", "bytes", pending)
+		return
+	}
+	s.Close()
+}
+
+func (s *spillFile) Close() error {
+	s.f.Close()
+	os.Remove(s.journal)
+	return os.Remove(s.f.Name())
+}
+
+// spillCopy keeps a copy of what passes through it in the spill, for replaying the whole of it.
+// When the spill is full or fails, the copy is disabled without failing the writes, and replayable reports false.
+type spillCopy struct {
+	spill *spillFile
+}
+
+func (c spillCopy) Write(p []byte) (int, error) {
+	if _, err := c.spill.Write(p); err != nil && c.replayable() {
+		c.spill.logger.Warn("spill is disabled, the data can not be replayed", "error", err)
+		c.spill.disable()
+	}
+	return len(p), nil
+}
+
+func (c spillCopy) replayable() bool {
+	return !c.spill.isDisabled()
+}
+
+func (s *spillFile) isDisabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.disabled
+}
+
+// spilledEvent is a cloudwatch logs event in the spill, a JSON line.
+type spilledEvent struct {
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// spillEvents appends events to the spill. It fails if all of them do not fit in max_bytes.
+func (s *spillFile) spillEvents(events []cwtypes.InputLogEvent) error {
+	var buf []byte
+	for _, event := range events {
+		b, err := json.Marshal(spilledEvent{
+			Timestamp: aws.ToInt64(event.Timestamp),
+			Message:   aws.ToString(event.Message),
+		})
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	_, err := s.Write(buf)
+	return err
+}
+
+// walEvents appends the complete lines of p to the wal as events at now, and returns the incomplete rest of p.
+func (s *spillFile) walEvents(p []byte, now time.Time) ([]byte, error) {
+	i := bytes.LastIndexByte(p, '\n')
+	if i < 0 {
+		return p, nil
+	}
+	var events []cwtypes.InputLogEvent
+	for _, line := range bytes.SplitAfter(p[:i+1], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		// the same as the lines of bufio.ScanLines
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		events = append(events, cwtypes.InputLogEvent{
+			Timestamp: aws.Int64(now.UnixMilli()),
+			Message:   aws.String(string(line)),
+		})
+	}
+	if err := s.spillEvents(events); err != nil {
+		return nil, err
+	}
+	return p[i+1:], nil
+}
+
+// consumeEvents consumes n events from the head of the spill.
+func (s *spillFile) consumeEvents(n int64) error {
+	r := bufio.NewReader(s.reader())
+	var consumed int64
+	for ; n > 0; n-- {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read spill: %w", err)
+		}
+		consumed += int64(len(line))
+	}
+	return s.consume(consumed)
+}
+
+// peekEvents returns up to max events from the head of the spill, and the bytes of them to consume after they are replayed.
+// The events of the empty lines in the wal are consumed without returning them.
+func (s *spillFile) peekEvents(max int) ([]cwtypes.InputLogEvent, int64, error) {
+	r := bufio.NewReader(s.reader())
+	var events []cwtypes.InputLogEvent
+	var n int64
+	for len(events) < max {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("read spill: %w", err)
+		}
+		var event spilledEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, 0, fmt.Errorf("read spill: %w", err)
+		}
+		n += int64(len(line))
+		if event.Message == "" {
+			continue
+		}
+		events = append(events, cwtypes.InputLogEvent{
+			Timestamp: aws.Int64(event.Timestamp),
+			Message:   aws.String(event.Message),
+		})
+	}
+	return events, n, nil
+}
@@ -0,0 +1,335 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func expectDescribeLogStreams(client *MockCloudwatchLogsClient) {
+	client.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("hoge")}},
+		}, nil,
+	).Times(1)
+}
+
+func TestCloudwatchLogsWriterSpill(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	var batches [][]string
+	unreachable := true
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			if unreachable {
+				return nil, &smithy.GenericAPIError{Code: "ThrottlingException"}
+			}
+			var batch []string
+			for _, event := range input.LogEvents {
+				batch = append(batch, *event.Message)
+			}
+			batches = append(batches, batch)
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).AnyTimes()
+
+	dir := t.TempDir()
+	w := newTestCloudwatchLogsWriter(t, client, &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/logs",
+		FlushInterval: "1h",
+		Spill:         SpillConfig{Dir: dir, MaxBytes: 1024},
+	})
+	_, err := io.WriteString(w, "hoge\nfuga\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Flush(context.Background()), "spilled")
+	_, err = io.WriteString(w, "piyo\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Flush(context.Background()), "spilled after the former ones")
+	require.Greater(t, w.Stats().Spilled, int64(0))
+	require.Empty(t, batches)
+
+	unreachable = false
+	_, err = io.WriteString(w, "tail\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.EqualValues(t, [][]string{{"hoge", "fuga", "piyo"}, {"tail"}}, batches, "replayed in order")
+	require.EqualValues(t, 0, w.Stats().Spilled)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "the spill is removed")
+}
+
+func TestCloudwatchLogsWriterSpillFailure(t *testing.T) {
+	t.Run("full", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		client := NewMockCloudwatchLogsClient(ctrl)
+		expectDescribeLogStreams(client)
+		client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			nil, &smithy.GenericAPIError{Code: "ThrottlingException"},
+		).Times(1)
+		w := newTestCloudwatchLogsWriter(t, client, &CloudwatchLogsConfig{
+			LogGroup:      "/awstee/logs",
+			FlushInterval: "1h",
+			Spill:         SpillConfig{Dir: t.TempDir(), MaxBytes: 10},
+		})
+		_, err := io.WriteString(w, "hoge\nfuga\n")
+		require.NoError(t, err)
+		require.ErrorContains(t, w.Flush(context.Background()), "spill max_bytes exceeded")
+		w.Close()
+	})
+	t.Run("unreachable on close", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		client := NewMockCloudwatchLogsClient(ctrl)
+		expectDescribeLogStreams(client)
+		client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			nil, &smithy.GenericAPIError{Code: "ThrottlingException"},
+		).Times(1)
+		w := newTestCloudwatchLogsWriter(t, client, &CloudwatchLogsConfig{
+			LogGroup:      "/awstee/logs",
+			FlushInterval: "1h",
+			Spill:         SpillConfig{Dir: t.TempDir(), MaxBytes: 1024},
+		})
+		_, err := io.WriteString(w, "hoge\nfuga\n")
+		require.NoError(t, err)
+		require.ErrorContains(t, w.Close(), "bytes of the spill are not replayed: api error ThrottlingException")
+	})
+}
+
+func TestS3WriterSpill(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{Code: "NotFound"},
+	).Times(1)
+	var bodies []string
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			body, err := io.ReadAll(input.Body)
+			require.NoError(t, err)
+			bodies = append(bodies, string(body))
+			if len(bodies) == 1 {
+				return nil, &smithy.GenericAPIError{Code: "SlowDown"}
+			}
+			return &s3.PutObjectOutput{}, nil
+		},
+	).Times(2)
+	dir := t.TempDir()
+	cfg := &S3Config{
+		URLPrefix: "s3://awstee-example-com/logs/",
+		Spill:     SpillConfig{Dir: dir, MaxBytes: 1024},
+	}
+	require.NoError(t, cfg.Restrict())
+	w, err := newS3Writer(context.Background(), slog.Default(), s3Client, cfg, "hoge.log", nil)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\nfuga\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.EqualValues(t, []string{"hoge\nfuga\n", "hoge\nfuga\n"}, bodies, "uploaded again from the spill")
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "the spill is removed")
+}
+
+func TestCloudwatchLogsWriterWAL(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	gomock.InOrder(
+		client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			&cloudwatchlogs.PutLogEventsOutput{}, nil,
+		).Times(1),
+		client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			nil, &smithy.GenericAPIError{Code: "AccessDeniedException"},
+		).Times(1),
+	)
+	dir := t.TempDir()
+	w := newTestCloudwatchLogsWriter(t, client, &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/logs",
+		FlushInterval: "1h",
+		Spill:         SpillConfig{Dir: dir, WAL: true},
+	})
+	_, err := io.WriteString(w, "hoge\n\n")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "fu")
+	require.NoError(t, err)
+	require.NotZero(t, w.wal.Pending(), "synced before written")
+	require.NoError(t, w.Flush(context.Background()))
+	require.Zero(t, w.wal.Pending(), "trimmed after acknowledged")
+
+	_, err = io.WriteString(w, "ga\npiyo")
+	require.NoError(t, err)
+	require.Error(t, w.Close())
+	kept, err := os.ReadFile(w.wal.f.Name())
+	require.NoError(t, err)
+	var messages []string
+	for _, line := range bytes.Split(bytes.TrimSpace(kept), []byte("\n")) {
+		var event spilledEvent
+		require.NoError(t, json.Unmarshal(line, &event))
+		messages = append(messages, event.Message)
+	}
+	require.Equal(t, []string{"fuga", "piyo"}, messages, "the events not acknowledged are kept")
+	require.FileExists(t, w.wal.journal)
+}
+
+func TestS3WriterWAL(t *testing.T) {
+	for _, uploadErr := range []error{nil, &smithy.GenericAPIError{Code: "AccessDenied"}} {
+		uploadErr := uploadErr
+		t.Run(fmt.Sprint(uploadErr), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			s3Client := NewMockS3Client(ctrl)
+			s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+				nil, &smithy.GenericAPIError{Code: "NotFound"},
+			).Times(1)
+			s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+				&s3.PutObjectOutput{}, uploadErr,
+			).Times(1)
+			dir := t.TempDir()
+			cfg := &S3Config{
+				URLPrefix: "s3://awstee-example-com/logs/",
+				Spill:     SpillConfig{Dir: dir, WAL: true, MaxBytes: 16},
+			}
+			require.NoError(t, cfg.Restrict())
+			w, err := newS3Writer(context.Background(), slog.Default(), s3Client, cfg, "hoge.log", nil)
+			require.NoError(t, err)
+			_, err = io.WriteString(w, "hoge\nfuga\n")
+			require.NoError(t, err)
+			_, err = io.WriteString(w, "piyopiyo\n")
+			require.ErrorIs(t, err, errSpillFull, "the write not in the wal fails")
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			if uploadErr == nil {
+				require.NoError(t, w.Close())
+				entries, err = os.ReadDir(dir)
+				require.NoError(t, err)
+				require.Empty(t, entries, "the wal is removed")
+				return
+			}
+			require.Error(t, w.Close())
+			kept, err := os.ReadFile(w.spill.f.Name())
+			require.NoError(t, err)
+			require.Equal(t, "hoge\nfuga\n", string(kept))
+			require.FileExists(t, w.spill.journal)
+			require.Len(t, entries, 2)
+		})
+	}
+}
+
+func TestSpillFileNoSpace(t *testing.T) {
+	devFull, err := os.OpenFile("/dev/full", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip("no /dev/full:", err)
+	}
+	defer devFull.Close()
+	for _, onFull := range []string{SpillOnFullAbort, SpillOnFullDrop} {
+		t.Run(onFull, func(t *testing.T) {
+			cfg := &SpillConfig{Dir: t.TempDir(), MaxBytes: 1024, OnFull: onFull}
+			require.NoError(t, cfg.Restrict())
+			s, err := newSpillFile(slog.Default(), cfg, spillJournal{Kind: spillKindS3, OutputName: "hoge.log"})
+			require.NoError(t, err)
+			f := s.f
+			defer func() {
+				// never remove /dev/full by Close
+				s.f = f
+				s.Close()
+			}()
+			_, err = s.Write([]byte("hoge\n"))
+			require.NoError(t, err)
+			s.f = devFull
+			_, err = s.Write([]byte("fuga\n"))
+			var fullErr *SpillFullError
+			require.ErrorAs(t, err, &fullErr)
+			require.True(t, isNoSpaceError(err))
+			require.ErrorContains(t, err, "no space left for the spill /dev/full: free the disk")
+			require.EqualValues(t, 5, s.Pending(), "the failed write is not counted")
+			require.Equal(t, onFull == SpillOnFullDrop, s.Full())
+			if onFull == SpillOnFullAbort {
+				require.FileExists(t, s.journal)
+				return
+			}
+			require.NoFileExists(t, s.journal, "the spill is not resumable any more")
+			s.f = f
+			_, err = s.Write([]byte("piyo\n"))
+			require.ErrorContains(t, err, "no space left for the spill", "the spill is stopped")
+		})
+	}
+}
+
+func TestCloudwatchLogsWriterSpillFullDrop(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{Code: "ThrottlingException"},
+	).Times(2)
+	w := newTestCloudwatchLogsWriter(t, client, &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/logs",
+		FlushInterval: "1h",
+		Spill:         SpillConfig{Dir: t.TempDir(), MaxBytes: 10, OnFull: SpillOnFullDrop},
+	})
+	_, err := io.WriteString(w, "hoge\nfuga\n")
+	require.NoError(t, err)
+	require.ErrorContains(t, w.Flush(context.Background()), "spill max_bytes exceeded (10 bytes): raise spill max_bytes")
+	_, err = io.WriteString(w, "piyo")
+	require.NoError(t, err, "the writes go on")
+	stats := w.Stats()
+	require.True(t, stats.SpillFull)
+	require.EqualValues(t, 2, stats.Dropped)
+	require.Contains(t, stats.String(), "spill=full dropped=2")
+	require.ErrorContains(t, w.Close(), "put log events: 3 events are dropped by the full spill: api error ThrottlingException")
+}
+
+func TestS3WriterWALFullDrop(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{Code: "NotFound"},
+	).Times(1)
+	var body []byte
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			var err error
+			body, err = io.ReadAll(input.Body)
+			return &s3.PutObjectOutput{}, err
+		},
+	).Times(1)
+	dir := t.TempDir()
+	cfg := &S3Config{
+		URLPrefix: "s3://awstee-example-com/logs/",
+		Spill:     SpillConfig{Dir: dir, WAL: true, MaxBytes: 16, OnFull: SpillOnFullDrop},
+	}
+	require.NoError(t, cfg.Restrict())
+	w, err := newS3Writer(context.Background(), slog.Default(), s3Client, cfg, "hoge.log", nil)
+	require.NoError(t, err)
+	for _, s := range []string{"hoge\nfuga\n", "piyopiyo\n", "tail\n"} {
+		_, err = io.WriteString(w, s)
+		require.NoError(t, err, "the writes go on without the wal")
+	}
+	require.True(t, w.Stats().SpillFull)
+	require.NoError(t, w.Close())
+	require.Equal(t, "hoge\nfuga\npiyopiyo\ntail\n", string(body))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "the stopped wal is removed")
+}
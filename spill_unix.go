@@ -0,0 +1,13 @@
+//go:build !windows
+
+package awstee
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isNoSpaceError reports whether err is the one of the disk full, or of the disk quota exceeded.
+func isNoSpaceError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package awstee
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	errorHandleDiskFull syscall.Errno = 39
+	errorDiskFull       syscall.Errno = 112
+)
+
+// isNoSpaceError reports whether err is the one of the disk full, or of the disk quota exceeded.
+func isNoSpaceError(err error) bool {
+	return errors.Is(err, errorDiskFull) || errors.Is(err, errorHandleDiskFull) || errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,171 @@
+package awstee
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the runtime statistics of an AWSTeeWriter (or AWSTeeReader).
+type Stats struct {
+	Lines int64
+	Bytes int64
+	// NormalizedCRLF is the lines whose CRLF was normalized by normalize_crlf, and SanitizedUTF8 is the lines whose invalid UTF-8 was replaced by sanitize_utf8.
+	NormalizedCRLF int64
+	SanitizedUTF8  int64
+	Destinations   []DestinationStats
+}
+
+// DestinationStats is a snapshot of the runtime statistics of one destination.
+type DestinationStats struct {
+	Name     string
+	Bytes    int64
+	Buffered int64
+	Errors   int64
+	// Retries is the retried AWS calls.
+	Retries int64
+	// Spilled is the bytes in the spill to replay, and SpillFull reports whether the spill is stopped by on_full: drop, see SpillConfig.
+	Spilled   int64
+	SpillFull bool
+	// Dropped is the events dropped by the circuit breaker or by the full spill, and CircuitOpen reports whether it is open, see CircuitBreakerConfig.
+	Dropped     int64
+	CircuitOpen bool
+	// Truncated is the lines longer than max_line_bytes, truncated, split or dropped by on_long_line.
+	Truncated int64
+	// Deduplicated is the events of the batches accepted by the former attempts, not put again.
+	Deduplicated int64
+	// Queued is the bytes in the overflow queue, and OverflowDropped is the bytes dropped by overflow: drop, see OverflowConfig.
+	Queued          int64
+	OverflowDropped int64
+	// Stalled reports whether the destination is stalled now, and Stalls is the number of the stalls detected, see WatchdogConfig.
+	Stalled bool
+	Stalls  int64
+	// Degraded reports whether the destination has failed a write and is not written any more.
+	Degraded bool
+}
+
+type statsReporter interface {
+	Stats() DestinationStats
+}
+
+// Stats returns the current runtime statistics.
+func (t *AWSTeeReader) Stats() Stats {
+	return t.w.Stats()
+}
+
+// Stats returns the current runtime statistics.
+// Destinations that do not report statistics are omitted.
+func (t *AWSTeeWriter) Stats() Stats {
+	stats := Stats{
+		Lines:        atomic.LoadInt64(&t.lines),
+		Bytes:        atomic.LoadInt64(&t.bytes),
+		Destinations: make([]DestinationStats, 0, len(t.writeClosers)),
+	}
+	if t.sanitizer != nil {
+		stats.NormalizedCRLF = atomic.LoadInt64(&t.sanitizer.normalizedCRLF)
+		stats.SanitizedUTF8 = atomic.LoadInt64(&t.sanitizer.sanitizedUTF8)
+	}
+	for i, w := range t.writeClosers {
+		if r, ok := w.(statsReporter); ok {
+			d := r.Stats()
+			d.Degraded = t.fanout.isDegraded(i)
+			stats.Destinations = append(stats.Destinations, d)
+		}
+	}
+	return stats
+}
+
+func (s Stats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "lines=%d bytes=%d", s.Lines, s.Bytes)
+	if s.NormalizedCRLF > 0 {
+		fmt.Fprintf(&b, " normalized_crlf=%d", s.NormalizedCRLF)
+	}
+	if s.SanitizedUTF8 > 0 {
+		fmt.Fprintf(&b, " sanitized_utf8=%d", s.SanitizedUTF8)
+	}
+	for _, d := range s.Destinations {
+		fmt.Fprintf(&b, ", [%s] %s", d.Name, d)
+	}
+	return b.String()
+}
+
+func (s DestinationStats) String() string {
+	str := fmt.Sprintf("bytes=%d buffered=%d errors=%d", s.Bytes, s.Buffered, s.Errors)
+	if s.Retries > 0 {
+		str += fmt.Sprintf(" retries=%d", s.Retries)
+	}
+	if s.Spilled > 0 {
+		str += fmt.Sprintf(" spilled=%d", s.Spilled)
+	}
+	if s.SpillFull {
+		str += " spill=full"
+	}
+	if s.Dropped > 0 {
+		str += fmt.Sprintf(" dropped=%d", s.Dropped)
+	}
+	if s.CircuitOpen {
+		str += " circuit=open"
+	}
+	if s.Truncated > 0 {
+		str += fmt.Sprintf(" truncated=%d", s.Truncated)
+	}
+	if s.Deduplicated > 0 {
+		str += fmt.Sprintf(" deduplicated=%d", s.Deduplicated)
+	}
+	if s.Queued > 0 {
+		str += fmt.Sprintf(" queued=%d", s.Queued)
+	}
+	if s.OverflowDropped > 0 {
+		str += fmt.Sprintf(" overflow_dropped=%d", s.OverflowDropped)
+	}
+	if s.Stalled {
+		str += " stalled"
+	}
+	if s.Stalls > 0 {
+		str += fmt.Sprintf(" stalls=%d", s.Stalls)
+	}
+	if s.Degraded {
+		str += " degraded"
+	}
+	return str
+}
+
+func (w *backgroundWriter) stats(name string) DestinationStats {
+	return DestinationStats{
+		Name:   name,
+		Bytes:  atomic.LoadInt64(&w.bytes),
+		Errors: atomic.LoadInt64(&w.errors),
+	}
+}
+
+// Stats returns the current runtime statistics.
+func (w *S3Writer) Stats() DestinationStats {
+	stats := w.backgroundWriter.stats(w.String())
+	if w.spilling.Load() {
+		// the spill keeps a copy of the whole object until the upload fails
+		stats.Spilled = w.spill.Pending()
+	}
+	stats.Retries = atomic.LoadInt64(&w.retries)
+	stats.SpillFull = w.spill.Full()
+	stats.Stalled = w.watchdog.Stalled()
+	stats.Stalls = w.watchdog.Stalls()
+	return stats
+}
+
+// Stats returns the current runtime statistics.
+func (w *CloudWatchLogsWriter) Stats() DestinationStats {
+	stats := w.backgroundWriter.stats(w.String())
+	// the events queued for the sender with in_flight_batches are buffered as well
+	stats.Buffered = atomic.LoadInt64(&w.buffered) + atomic.LoadInt64(&w.inFlight)
+	stats.Spilled = w.spill.Pending()
+	stats.SpillFull = w.spill.Full() || w.wal.Full()
+	stats.Retries = atomic.LoadInt64(&w.retries)
+	stats.Dropped = atomic.LoadInt64(&w.dropped)
+	stats.CircuitOpen = w.breaker.Open()
+	stats.Truncated = atomic.LoadInt64(&w.truncated)
+	stats.Deduplicated = atomic.LoadInt64(&w.deduped)
+	stats.Stalled = w.watchdog.Stalled()
+	stats.Stalls = w.watchdog.Stalls()
+	return stats
+}
@@ -0,0 +1,46 @@
+package awstee
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testStatsWriteCloser struct {
+	io.WriteCloser
+	stats DestinationStats
+}
+
+func (w testStatsWriteCloser) Stats() DestinationStats {
+	return w.stats
+}
+
+func TestAWSTeeReaderStats(t *testing.T) {
+	var buf1, buf2 bytes.Buffer
+	teeReader := newAWSTeeReader(
+		strings.NewReader("hoge\nfuga\n\npiyo"),
+		[]io.WriteCloser{
+			newTestWriteCloser(&buf1, func() error { return nil }),
+			testStatsWriteCloser{
+				WriteCloser: newTestWriteCloser(&buf2, func() error { return nil }),
+				stats: DestinationStats{
+					Name:     "test",
+					Bytes:    10,
+					Buffered: 2,
+					Errors:   1,
+				},
+			},
+		},
+	)
+	_, err := io.ReadAll(teeReader)
+	require.NoError(t, err)
+	stats := teeReader.Stats()
+	require.EqualValues(t, 3, stats.Lines)
+	require.EqualValues(t, 15, stats.Bytes)
+	require.Len(t, stats.Destinations, 1)
+	require.EqualValues(t, "lines=3 bytes=15, [test] bytes=10 buffered=2 errors=1", stats.String())
+	require.NoError(t, teeReader.Close())
+}
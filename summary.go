@@ -0,0 +1,93 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	// summaryObjectSuffix is appended to the key of an s3 object for the key of its summary.
+	summaryObjectSuffix = ".summary.json"
+	// summaryTimeout bounds the puts of the summaries after Close, which are put even if the context of Close is done.
+	summaryTimeout = 30 * time.Second
+)
+
+// runSummary is the summary object of an s3 object: the event of the run, and the destination of the object itself.
+type runSummary struct {
+	*RunEvent
+	Object RunEventDestination `json:"object"`
+}
+
+// summaryObject is an s3 object of a run, whose summary is put next to it.
+type summaryObject struct {
+	client S3Client
+	w      *S3Writer
+}
+
+// summaryWriter puts `<key>.summary.json` of each s3 object of a run at Close,
+// the machine-readable statement of what was captured and what was lost.
+type summaryWriter struct {
+	mu      sync.Mutex
+	objects []summaryObject
+	logger  *slog.Logger
+}
+
+func newSummaryWriter(logger *slog.Logger) *summaryWriter {
+	return &summaryWriter{logger: logger}
+}
+
+// add makes w keep the sha256 of the object, and its summary is put by put.
+// It is called for each object opened, the objects rotated and the ones opened lazily too.
+func (s *summaryWriter) add(client S3Client, w *S3Writer) {
+	w.checksum = sha256.New()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects = append(s.objects, summaryObject{client: client, w: w})
+}
+
+// put puts the summaries of the objects of the run of event. The errors are logged, the objects are delivered regardless.
+func (s *summaryWriter) put(event *RunEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// put even if the context of Close is done, as the summary reports what was lost by it
+	ctx, cancel := context.WithTimeout(context.Background(), summaryTimeout)
+	defer cancel()
+	for _, o := range s.objects {
+		summary := runSummary{RunEvent: event, Object: RunEventDestination{Name: o.w.String()}}
+		for _, d := range event.Destinations {
+			// the destinations aborted have no location
+			if d.Location == o.w.String() || (d.Location == "" && d.Name == o.w.String()) {
+				summary.Object = d
+			}
+		}
+		if err := s.putObject(ctx, o, &summary); err != nil {
+			s.logger.Warn("put summary", "error", err)
+		}
+	}
+}
+
+func (s *summaryWriter) putObject(ctx context.Context, o summaryObject, summary *runSummary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	_, err = o.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(o.w.bucket),
+		Key:         aws.String(o.w.key + summaryObjectSuffix),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("put summary s3://%s/%s: %w", o.w.bucket, o.w.key+summaryObjectSuffix, err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package awstee
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSTeeWriterSummary(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s3Client := NewMockS3Client(ctrl)
+	cfg := &Config{
+		Summary:      true,
+		SanitizeUTF8: true,
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+			Limit:     LimitConfig{MaxLines: 2, OnLimit: LimitPolicyRotate},
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{S3: s3Client})
+	require.NoError(t, err)
+	app.now = func() time.Time { return time.Date(2022, 6, 3, 17, 28, 48, 0, time.UTC) }
+
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{Code: "NotFound"},
+	).AnyTimes()
+	var mu sync.Mutex
+	objects := make(map[string]string)
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			body, err := io.ReadAll(input.Body)
+			require.NoError(t, err)
+			mu.Lock()
+			defer mu.Unlock()
+			objects[*input.Key] = string(body)
+			return &s3.PutObjectOutput{}, nil
+		},
+	).Times(4)
+	w, err := app.Writer(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\nfuga\npiyo\xff\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	keys := []string{"logs/hoge.log", "logs/hoge.1.log"}
+	for _, key := range keys {
+		require.Contains(t, objects, key)
+		require.Contains(t, objects, key+summaryObjectSuffix)
+		var summary runSummary
+		require.NoError(t, json.Unmarshal([]byte(objects[key+summaryObjectSuffix]), &summary))
+		require.Equal(t, "hoge.log", summary.OutputName)
+		require.Equal(t, RunSucceeded, summary.Status)
+		require.EqualValues(t, 3, summary.Lines)
+		require.EqualValues(t, 1, summary.SanitizedUTF8)
+		require.Len(t, summary.Destinations, 2, "all of the objects of the run")
+		sum := sha256.Sum256([]byte(objects[key]))
+		require.Equal(t, RunEventDestination{
+			Name:     "s3://awstee-example-com/" + key,
+			Location: "s3://awstee-example-com/" + key,
+			SHA256:   hex.EncodeToString(sum[:]),
+			Bytes:    int64(len(objects[key])),
+		}, summary.Object)
+	}
+	require.Equal(t, "hoge\nfuga\n", objects[keys[0]])
+	require.True(t, strings.HasPrefix(objects[keys[1]], "piyo"))
+}
+
+func TestSummaryWriterAborted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s3Client := NewMockS3Client(ctrl)
+	var summary runSummary
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			require.Equal(t, "logs/hoge.log.summary.json", *input.Key)
+			require.NoError(t, json.NewDecoder(input.Body).Decode(&summary))
+			return &s3.PutObjectOutput{}, nil
+		},
+	).Times(1)
+	s := newSummaryWriter(slog.Default())
+	s.add(s3Client, &S3Writer{bucket: "awstee-example-com", key: "logs/hoge.log"})
+	s.put(&RunEvent{
+		OutputName: "hoge.log",
+		Status:     RunFailed,
+		Error:      "context deadline exceeded",
+		Destinations: []RunEventDestination{
+			{Name: "s3://awstee-example-com/logs/hoge.log", Error: "context deadline exceeded"},
+		},
+	})
+	require.Equal(t, RunFailed, summary.Status)
+	require.Equal(t, "context deadline exceeded", summary.Object.Error, "the destination aborted has no location")
+}
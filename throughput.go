@@ -0,0 +1,80 @@
+package awstee
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+const (
+	// ThroughputLow keeps the memory small: one part of s3 uploaded at a time, and the writes wait for the destinations.
+	ThroughputLow = "low"
+	// ThroughputDefault is the defaults of the SDK and awstee.
+	ThroughputDefault = "default"
+	// ThroughputHigh keeps up with a firehose: the parts of s3 and the batches of cloudwatch logs in parallel, and the writes queued.
+	ThroughputHigh = "high"
+)
+
+// throughputPreset is the knobs of the parallelism set by throughput, unless they are set explicitly.
+type throughputPreset struct {
+	s3Concurrency   int
+	s3PartSize      int64
+	inFlightBatches int
+	overflowPolicy  string
+}
+
+var throughputPresets = map[string]throughputPreset{
+	ThroughputLow: {
+		s3Concurrency:   1,
+		s3PartSize:      manager.MinUploadPartSize,
+		inFlightBatches: 1,
+		overflowPolicy:  OverflowBlock,
+	},
+	ThroughputDefault: {},
+	ThroughputHigh: {
+		s3Concurrency:   16,
+		s3PartSize:      16 * 1024 * 1024,
+		inFlightBatches: 4,
+		overflowPolicy:  OverflowBuffer,
+	},
+}
+
+// throughputPreset returns the preset of throughput.
+func (cfg *Config) throughputPreset() (throughputPreset, error) {
+	if cfg.Throughput == "" {
+		cfg.Throughput = ThroughputDefault
+	}
+	preset, ok := throughputPresets[cfg.Throughput]
+	if !ok {
+		return throughputPreset{}, fmt.Errorf("throughput must be one of %s, %s, %s", ThroughputLow, ThroughputDefault, ThroughputHigh)
+	}
+	return preset, nil
+}
+
+// applyThroughput sets the knobs of the parallelism used by the destinations to preset, unless they are set explicitly.
+// It is called after the destinations are restricted. Only the knobs used are set, so that another preset can be applied by Restrict again.
+func (cfg *Config) applyThroughput(preset throughputPreset) {
+	for _, s3Cfg := range cfg.allS3Configs() {
+		if s3Cfg.Concurrency == 0 && preset.s3Concurrency > 0 {
+			s3Cfg.concurrency = preset.s3Concurrency
+		}
+		if s3Cfg.PartSize == 0 && preset.s3PartSize > 0 {
+			s3Cfg.partSize = preset.s3PartSize
+		}
+	}
+	for _, cwCfg := range cfg.allCloudwatchConfigs() {
+		if cwCfg.InFlightBatches == 0 && preset.inFlightBatches > 0 {
+			cwCfg.inFlightBatches = preset.inFlightBatches
+		}
+	}
+}
+
+// uploaderOptions sets concurrency and part_size to the uploader of s3.
+func (cfg *S3Config) uploaderOptions(u *manager.Uploader) {
+	if cfg.concurrency > 0 {
+		u.Concurrency = cfg.concurrency
+	}
+	if cfg.partSize > 0 {
+		u.PartSize = cfg.partSize
+	}
+}
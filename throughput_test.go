@@ -0,0 +1,138 @@
+package awstee
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigThroughput(t *testing.T) {
+	cfg := &Config{
+		Throughput: ThroughputHigh,
+		S3: &S3Config{
+			URLPrefix:   "s3://awstee-example-com/logs/",
+			Concurrency: 8,
+		},
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup: "/awstee/logs",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, 8, cfg.S3.concurrency, "the knob set explicitly wins")
+	require.EqualValues(t, 16*1024*1024, cfg.S3.partSize)
+	require.Equal(t, 4, cfg.Cloudwatch.inFlightBatches)
+	require.Equal(t, OverflowBuffer, cfg.Overflow.policy)
+	require.Zero(t, cfg.S3.PartSize, "the knobs set are kept as they are")
+
+	// another preset set after the restrict, as the flags over the config files
+	cfg.Throughput = ThroughputLow
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, 8, cfg.S3.concurrency)
+	require.EqualValues(t, manager.MinUploadPartSize, cfg.S3.partSize)
+	require.Equal(t, 1, cfg.Cloudwatch.inFlightBatches)
+	require.Equal(t, OverflowBlock, cfg.Overflow.policy)
+
+	cfg = &Config{
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup: "/awstee/logs",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, ThroughputDefault, cfg.Throughput)
+	require.Equal(t, 1, cfg.Cloudwatch.inFlightBatches)
+	require.Equal(t, OverflowBlock, cfg.Overflow.policy)
+	cfg.Throughput = ThroughputHigh
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, 4, cfg.Cloudwatch.inFlightBatches)
+	require.Equal(t, OverflowBuffer, cfg.Overflow.policy)
+
+	cfg = &Config{Throughput: "max"}
+	require.EqualError(t, cfg.Restrict(), "throughput must be one of low, default, high")
+
+	cfg = &Config{
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+			PartSize:  1024,
+		},
+	}
+	require.EqualError(t, cfg.Restrict(), "s3 part_size must be at least 5242880 bytes")
+}
+
+func TestCloudwatchLogsWriterInFlightBatches(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var messages []string
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			<-release
+			mu.Lock()
+			defer mu.Unlock()
+			for _, e := range input.LogEvents {
+				messages = append(messages, *e.Message)
+			}
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).AnyTimes()
+	cfg := &CloudwatchLogsConfig{
+		LogGroup:        "/awstee/logs",
+		FlushInterval:   "1h",
+		BufferLines:     1,
+		InFlightBatches: 3,
+	}
+	require.NoError(t, cfg.Restrict())
+	w, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), client, cfg, "hoge.log", time.Now, nil)
+	require.NoError(t, err)
+	// the lines keep being buffered while the first batch is put
+	for _, line := range []string{"hoge\n", "fuga\n", "piyo\n"} {
+		_, err := io.WriteString(w, line)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return w.Stats().Buffered == 3 }, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	require.NoError(t, w.Flush(context.Background()))
+	require.Zero(t, w.Stats().Buffered)
+	require.NoError(t, w.Close())
+	require.Equal(t, []string{"hoge", "fuga", "piyo"}, messages)
+}
+
+func TestConfigAsync(t *testing.T) {
+	cfg := &Config{Async: true, Throughput: ThroughputLow}
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, OverflowDrop, cfg.Overflow.policy, "async wins over the preset")
+	require.EqualValues(t, defaultOverflowMaxBytes, cfg.Overflow.maxBytes)
+
+	cfg = &Config{Async: true, Overflow: OverflowConfig{Policy: OverflowBuffer, MaxBytes: 1024}}
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, OverflowBuffer, cfg.Overflow.policy)
+	require.EqualValues(t, 1024, cfg.Overflow.maxBytes)
+
+	cfg = &Config{Async: true, Overflow: OverflowConfig{Policy: OverflowBlock}}
+	require.EqualError(t, cfg.Restrict(), "async requires overflow policy buffer or drop")
+}
+
+func TestConfigAsyncAfterLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "awstee.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("cloudwatch:\n  log_group: /awstee/logs\n"), 0600))
+	cfg := &Config{}
+	require.NoError(t, cfg.Load(path))
+	require.Equal(t, OverflowBlock, cfg.Overflow.policy)
+	// set by the env or the flags after the config files
+	cfg.Async = true
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, OverflowDrop, cfg.Overflow.policy)
+	require.True(t, cfg.Overflow.Enabled())
+}
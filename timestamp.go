@@ -0,0 +1,201 @@
+package awstee
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// maxTimestampAge is how old a timestamp of a line can be to stamp the cloudwatch logs event, a batch of PutLogEvents must not span more than 24 hours.
+const maxTimestampAge = 23 * time.Hour
+
+// timestampLayout returns the Go time layout of the format name of prefix_timestamp and normalize_timestamp.
+func timestampLayout(format string) string {
+	switch strings.ToLower(format) {
+	case "":
+		return ""
+	case "rfc3339":
+		return time.RFC3339
+	case "rfc3339nano":
+		return time.RFC3339Nano
+	default:
+		// any other value is used as a Go time layout
+		return format
+	}
+}
+
+// TimestampConfig rewrites the timestamps at the start of the lines in the common formats to format in zone,
+// and the cloudwatch logs events are stamped by them instead of the time awstee read the lines.
+type TimestampConfig struct {
+	Format string `yaml:"format,omitempty"`
+	// Zone is the zone of the timestamps rewritten, UTC by default.
+	Zone string `yaml:"zone,omitempty"`
+	// SourceZone is the zone of the timestamps without their zone, Local by default.
+	SourceZone string `yaml:"source_zone,omitempty"`
+
+	layout     string
+	zone       *time.Location
+	sourceZone *time.Location
+}
+
+func (cfg *TimestampConfig) Enabled() bool {
+	return cfg.Format != ""
+}
+
+func (cfg *TimestampConfig) Restrict() error {
+	cfg.layout = timestampLayout(cfg.Format)
+	var err error
+	if cfg.zone, err = loadZone(cfg.Zone, time.UTC); err != nil {
+		return fmt.Errorf("normalize_timestamp zone %w", err)
+	}
+	if cfg.sourceZone, err = loadZone(cfg.SourceZone, time.Local); err != nil {
+		return fmt.Errorf("normalize_timestamp source_zone %w", err)
+	}
+	return nil
+}
+
+func loadZone(name string, def *time.Location) (*time.Location, error) {
+	if name == "" {
+		return def, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s is invalid: %w", name, err)
+	}
+	return loc, nil
+}
+
+// timestampFormat is a format of the timestamps detected at the start of the lines, the first submatch of re.
+type timestampFormat struct {
+	re      *regexp.Regexp
+	layouts []string
+	// noYear is the format without the year, which is the one of the last year not in the future
+	noYear bool
+}
+
+const (
+	monthNames = `(?:Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)`
+	dayNames   = `(?:Mon|Tue|Wed|Thu|Fri|Sat|Sun)`
+)
+
+// timestampFormats is the formats detected, in order. The fractional seconds are parsed without the layouts.
+var timestampFormats = []timestampFormat{
+	{
+		// ISO 8601 such as RFC3339, and with a space such as python logging
+		re: regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?)`),
+		layouts: []string{
+			"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05Z0700", "2006-01-02T15:04:05",
+			"2006-01-02 15:04:05Z07:00", "2006-01-02 15:04:05Z0700", "2006-01-02 15:04:05",
+		},
+	},
+	{
+		// the standard log of Go
+		re:      regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?)`),
+		layouts: []string{"2006/01/02 15:04:05"},
+	},
+	{
+		// the common log format of apache and nginx
+		re:      regexp.MustCompile(`^\[(\d{2}/` + monthNames + `/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4})\]`),
+		layouts: []string{"02/Jan/2006:15:04:05 -0700"},
+	},
+	{
+		// ANSI C asctime
+		re:      regexp.MustCompile(`^(` + dayNames + ` ` + monthNames + ` [ \d]\d \d{2}:\d{2}:\d{2} \d{4})`),
+		layouts: []string{time.ANSIC},
+	},
+	{
+		// syslog (RFC 3164)
+		re:      regexp.MustCompile(`^(` + monthNames + ` [ \d]\d \d{2}:\d{2}:\d{2})`),
+		layouts: []string{time.Stamp},
+		noYear:  true,
+	},
+}
+
+// detectTimestamp returns the timestamp at the start of line and its position, or false if line does not start with one.
+func (cfg *TimestampConfig) detectTimestamp(line []byte, now time.Time) (time.Time, int, int, bool) {
+	if len(line) == 0 {
+		return time.Time{}, 0, 0, false
+	}
+	if c := line[0]; !('0' <= c && c <= '9') && c != '[' && !('A' <= c && c <= 'Z') {
+		return time.Time{}, 0, 0, false
+	}
+	for _, f := range timestampFormats {
+		m := f.re.FindSubmatchIndex(line)
+		if m == nil {
+			continue
+		}
+		value := string(line[m[2]:m[3]])
+		for _, layout := range f.layouts {
+			t, err := time.ParseInLocation(layout, value, cfg.sourceZone)
+			if err != nil {
+				continue
+			}
+			if f.noYear {
+				local := now.In(cfg.sourceZone)
+				t = t.AddDate(local.Year(), 0, 0)
+				if t.After(local.Add(24 * time.Hour)) {
+					t = t.AddDate(-1, 0, 0)
+				}
+			}
+			return t, m[2], m[3], true
+		}
+	}
+	return time.Time{}, 0, 0, false
+}
+
+// processor returns the line processor rewriting the timestamps, now is for the year of the timestamps without it.
+func (cfg *TimestampConfig) processor(now func() time.Time) lineProcessor {
+	return func(line []byte) []byte {
+		t, start, end, ok := cfg.detectTimestamp(line, now())
+		if !ok {
+			return line
+		}
+		out := make([]byte, 0, len(line)+len(cfg.layout))
+		out = append(out, line[:start]...)
+		out = t.In(cfg.zone).AppendFormat(out, cfg.layout)
+		return append(out, line[end:]...)
+	}
+}
+
+// parse returns the timestamp rewritten at the start of message.
+func (cfg *TimestampConfig) parse(message string) (time.Time, bool) {
+	// the timestamp is the words as many as the ones of the layout
+	end := -1
+	for words := strings.Count(cfg.layout, " ") + 1; words > 0; words-- {
+		i := strings.IndexByte(message[end+1:], ' ')
+		if i < 0 {
+			end = len(message)
+			break
+		}
+		end += 1 + i
+	}
+	t, err := time.ParseInLocation(cfg.layout, message[:end], cfg.zone)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// eventStamper stamps the cloudwatch logs events by the timestamps of their messages. It is used by the worker of a writer only.
+type eventStamper struct {
+	cfg  *TimestampConfig
+	last int64
+}
+
+// stamp sets the timestamps of events read at arrival to the ones at the start of their messages.
+// The events without a timestamp, or with the one in the future or older than maxTimestampAge, keep arrival.
+// The timestamps never go back, the events of a batch must be in order.
+func (s *eventStamper) stamp(events []cwtypes.InputLogEvent, arrival time.Time) {
+	for _, e := range events {
+		ts := arrival.UnixMilli()
+		if t, ok := s.cfg.parse(*e.Message); ok && !t.After(arrival) && arrival.Sub(t) < maxTimestampAge {
+			ts = t.UnixMilli()
+		}
+		ts = max(ts, s.last)
+		s.last = ts
+		*e.Timestamp = ts
+	}
+}
@@ -0,0 +1,126 @@
+package awstee
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestampConfigProcessor(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+	now := func() time.Time {
+		return time.Date(2022, 6, 3, 17, 30, 0, 0, jst)
+	}
+	cfg := &TimestampConfig{Format: "rfc3339nano", SourceZone: "Asia/Tokyo"}
+	require.NoError(t, cfg.Restrict())
+	process := cfg.processor(now)
+	cases := []struct {
+		line     string
+		expected string
+	}{
+		{line: "2022-06-03T17:28:48+09:00 hoge", expected: "2022-06-03T08:28:48Z hoge"},
+		{line: "2022-06-03T08:28:48.123456Z hoge", expected: "2022-06-03T08:28:48.123456Z hoge"},
+		{line: "2022-06-03 17:28:48,123 INFO hoge", expected: "2022-06-03T08:28:48.123Z INFO hoge"},
+		{line: "2022-06-03 17:28:48+0900 hoge", expected: "2022-06-03T08:28:48Z hoge"},
+		{line: "2022/06/03 17:28:48 hoge", expected: "2022-06-03T08:28:48Z hoge"},
+		{line: "[03/Jun/2022:17:28:48 +0900] hoge", expected: "[2022-06-03T08:28:48Z] hoge"},
+		{line: "Fri Jun  3 17:28:48 2022 hoge", expected: "2022-06-03T08:28:48Z hoge"},
+		{line: "Jun  3 17:28:48 localhost hoge", expected: "2022-06-03T08:28:48Z localhost hoge"},
+		{line: "Dec 31 23:59:59 localhost hoge", expected: "2021-12-31T14:59:59Z localhost hoge"},
+		{line: "INFO 2022-06-03T17:28:48+09:00 hoge", expected: "INFO 2022-06-03T17:28:48+09:00 hoge"},
+		{line: "2022-13-03T17:28:48Z hoge", expected: "2022-13-03T17:28:48Z hoge"},
+		{line: "", expected: ""},
+	}
+	for _, c := range cases {
+		t.Run(c.line, func(t *testing.T) {
+			require.Equal(t, c.expected, string(process([]byte(c.line))))
+		})
+	}
+
+	cfg = &TimestampConfig{Format: "2006-01-02 15:04:05.000", Zone: "Asia/Tokyo"}
+	require.NoError(t, cfg.Restrict())
+	require.Equal(t, "2022-06-03 17:28:48.000 hoge", string(cfg.processor(now)([]byte("2022-06-03T08:28:48Z hoge"))))
+
+	cfg = &TimestampConfig{Format: "rfc3339", Zone: "Mars/Olympus"}
+	require.ErrorContains(t, cfg.Restrict(), "normalize_timestamp zone Mars/Olympus is invalid")
+}
+
+func TestEventStamper(t *testing.T) {
+	cfg := &TimestampConfig{Format: "2006-01-02 15:04:05.000"}
+	require.NoError(t, cfg.Restrict())
+	arrival := time.Date(2022, 6, 3, 8, 30, 0, 0, time.UTC)
+	messages := []string{
+		"2022-06-03 08:28:48.123 hoge",
+		"fuga",
+		"2022-06-03 08:29:00.000 piyo",
+		"2022-06-03 08:28:00.000 went back",
+		"2022-06-03 09:00:00.000 future",
+		"2022-06-01 08:00:00.000 too old",
+	}
+	events := make([]cwtypes.InputLogEvent, 0, len(messages))
+	for _, m := range messages {
+		events = append(events, cwtypes.InputLogEvent{Message: aws.String(m), Timestamp: aws.Int64(0)})
+	}
+	s := &eventStamper{cfg: cfg}
+	s.stamp(events[:1], arrival)
+	s.stamp(events[1:], arrival)
+	var timestamps []time.Time
+	for _, e := range events {
+		timestamps = append(timestamps, time.UnixMilli(*e.Timestamp).UTC())
+	}
+	require.Equal(t, []time.Time{
+		time.Date(2022, 6, 3, 8, 28, 48, 123000000, time.UTC),
+		arrival,
+		arrival,
+		arrival,
+		arrival,
+		arrival,
+	}, timestamps, "never go back")
+
+	s = &eventStamper{cfg: cfg}
+	s.stamp(events[:1], arrival)
+	s.stamp(events[2:3], arrival)
+	require.Equal(t, time.Date(2022, 6, 3, 8, 29, 0, 0, time.UTC), time.UnixMilli(*events[2].Timestamp).UTC())
+}
+
+func TestCloudwatchLogsWriterNormalizeTimestamp(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	now := time.Now().Truncate(time.Millisecond)
+	old := now.Add(-time.Hour).UTC()
+	var events []cwtypes.InputLogEvent
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			events = append(events, input.LogEvents...)
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).Times(1)
+	cfg := &Config{
+		Cloudwatch:         &CloudwatchLogsConfig{LogGroup: "/awstee/logs"},
+		NormalizeTimestamp: TimestampConfig{Format: "rfc3339nano"},
+	}
+	require.NoError(t, cfg.Restrict())
+	var buf bytes.Buffer
+	w := newLineWriter(&buf, []lineProcessor{cfg.NormalizeTimestamp.processor(time.Now)})
+	_, err := io.WriteString(w, old.Format(time.RFC3339Nano)+" hoge\nfuga\n")
+	require.NoError(t, err)
+	cw, err := newCloudWatchLogsWriter(context.Background(), slog.Default(), client, cfg.Cloudwatch, "hoge.log", func() time.Time { return now }, nil)
+	require.NoError(t, err)
+	_, err = cw.Write(buf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, cw.Close())
+	require.Len(t, events, 2)
+	require.Equal(t, old.UnixMilli(), *events[0].Timestamp)
+	require.Equal(t, now.UnixMilli(), *events[1].Timestamp)
+}
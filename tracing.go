@@ -0,0 +1,106 @@
+package awstee
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// tracerName is the instrumentation name of the tracer of awstee.
+const tracerName = "github.com/mashiike/awstee"
+
+// TracerProvider provides the tracer of the spans of awstee.
+// It is the subset of the OpenTelemetry trace API that awstee uses, not to depend on the OpenTelemetry module:
+// awsteeotel.TracerProvider adapts a trace.TracerProvider of go.opentelemetry.io/otel.
+type TracerProvider interface {
+	Tracer(name string) Tracer
+}
+
+// Tracer starts the spans. The span is a child of the span in ctx, and the returned context contains the span.
+type Tracer interface {
+	Start(ctx context.Context, spanName string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a span started by Tracer. The methods are called from the goroutines of the destinations.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	// RecordError records err and marks the span as failed.
+	RecordError(err error)
+	End()
+}
+
+// Attribute is an attribute of a span. Value is a string, an int64 or a bool.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+// startSpan starts a span by the tracer of WithTracerProvider, or a span doing nothing.
+func (h *destinationHooks) startSpan(ctx context.Context, spanName string, attrs ...Attribute) (context.Context, Span) {
+	if h == nil || h.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return h.tracer.Start(ctx, spanName, attrs...)
+}
+
+// endSpan records err if any, and ends span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// uploadClient returns client tracing the calls of the uploader, such as the upload of each part.
+func (h *destinationHooks) uploadClient(client manager.UploadAPIClient, dest string) manager.UploadAPIClient {
+	if h == nil || h.tracer == nil {
+		return client
+	}
+	return &tracedUploadClient{UploadAPIClient: client, hooks: h, dest: dest}
+}
+
+type tracedUploadClient struct {
+	manager.UploadAPIClient
+	hooks *destinationHooks
+	dest  string
+}
+
+func (c *tracedUploadClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (output *s3.PutObjectOutput, err error) {
+	ctx, span := c.hooks.startSpan(ctx, "s3.PutObject", Attribute{"awstee.destination", c.dest})
+	defer func() { endSpan(span, err) }()
+	return c.UploadAPIClient.PutObject(ctx, params, optFns...)
+}
+
+func (c *tracedUploadClient) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (output *s3.UploadPartOutput, err error) {
+	ctx, span := c.hooks.startSpan(ctx, "s3.UploadPart",
+		Attribute{"awstee.destination", c.dest},
+		Attribute{"s3.part_number", int64(params.PartNumber)},
+	)
+	defer func() { endSpan(span, err) }()
+	return c.UploadAPIClient.UploadPart(ctx, params, optFns...)
+}
+
+func (c *tracedUploadClient) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (output *s3.CreateMultipartUploadOutput, err error) {
+	ctx, span := c.hooks.startSpan(ctx, "s3.CreateMultipartUpload", Attribute{"awstee.destination", c.dest})
+	defer func() { endSpan(span, err) }()
+	return c.UploadAPIClient.CreateMultipartUpload(ctx, params, optFns...)
+}
+
+func (c *tracedUploadClient) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (output *s3.CompleteMultipartUploadOutput, err error) {
+	ctx, span := c.hooks.startSpan(ctx, "s3.CompleteMultipartUpload", Attribute{"awstee.destination", c.dest})
+	defer func() { endSpan(span, err) }()
+	return c.UploadAPIClient.CompleteMultipartUpload(ctx, params, optFns...)
+}
+
+func (c *tracedUploadClient) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (output *s3.AbortMultipartUploadOutput, err error) {
+	ctx, span := c.hooks.startSpan(ctx, "s3.AbortMultipartUpload", Attribute{"awstee.destination", c.dest})
+	defer func() { endSpan(span, err) }()
+	return c.UploadAPIClient.AbortMultipartUpload(ctx, params, optFns...)
+}
@@ -0,0 +1,138 @@
+package awstee
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+type testSpanKey struct{}
+
+type testSpan struct {
+	tracer *testTracer
+	name   string
+	parent string
+	attrs  map[string]any
+	err    error
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attribute) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.err = err
+}
+
+func (s *testSpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.ended = append(s.tracer.ended, s)
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	ended []*testSpan
+}
+
+func (tr *testTracer) Tracer(string) Tracer {
+	return tr
+}
+
+func (tr *testTracer) Start(ctx context.Context, spanName string, attrs ...Attribute) (context.Context, Span) {
+	span := &testSpan{tracer: tr, name: spanName, attrs: make(map[string]any)}
+	if parent, ok := ctx.Value(testSpanKey{}).(*testSpan); ok {
+		span.parent = parent.name
+	}
+	span.SetAttributes(attrs...)
+	return context.WithValue(ctx, testSpanKey{}, span), span
+}
+
+func (tr *testTracer) span(name string) *testSpan {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, span := range tr.ended {
+		if span.name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestWithTracerProvider(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		nil, &smithy.GenericAPIError{Code: "NotFound"},
+	).Times(1)
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&s3.PutObjectOutput{}, nil,
+	).Times(1)
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("hoge")}},
+		}, nil,
+	).Times(1)
+	cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.PutLogEventsOutput{}, nil,
+	).Times(1)
+
+	cfg := &Config{
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+		},
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup:      "/awstee/logs",
+			FlushInterval: "1h",
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	tracer := &testTracer{}
+	app, err := NewWithClient(cfg, AWSClient{S3: s3Client, CloudwatchLogs: cloudwatchLogsClient}, WithTracerProvider(tracer))
+	require.NoError(t, err)
+	w, err := app.Writer(context.Background(), "hoge.log")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\nfuga\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	writerSpan := tracer.span("awstee.Writer")
+	require.NotNil(t, writerSpan)
+	require.EqualValues(t, map[string]any{
+		"awstee.output_name": "hoge.log",
+		"awstee.bytes":       int64(10),
+		"awstee.lines":       int64(2),
+	}, writerSpan.attrs)
+	require.NoError(t, writerSpan.err)
+
+	uploadSpan := tracer.span("s3.Upload")
+	require.NotNil(t, uploadSpan)
+	require.Equal(t, "awstee.Writer", uploadSpan.parent)
+	require.Equal(t, "s3://awstee-example-com/logs/hoge.log", uploadSpan.attrs["awstee.destination"])
+	putObjectSpan := tracer.span("s3.PutObject")
+	require.NotNil(t, putObjectSpan)
+	require.Equal(t, "s3.Upload", putObjectSpan.parent)
+
+	putLogEventsSpan := tracer.span("cloudwatchlogs.PutLogEvents")
+	require.NotNil(t, putLogEventsSpan)
+	require.Equal(t, "awstee.Writer", putLogEventsSpan.parent)
+	require.EqualValues(t, 2, putLogEventsSpan.attrs["cloudwatchlogs.events"])
+	require.Equal(t, "on close", putLogEventsSpan.attrs["cloudwatchlogs.reason"])
+}
@@ -0,0 +1,92 @@
+package awstee
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// transformFuncs is the functions of the transform templates.
+var transformFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trim":  strings.TrimSpace,
+}
+
+// TransformConfig rewrites each line written to a destination by a Go template.
+type TransformConfig struct {
+	Transform string `yaml:"transform,omitempty"`
+
+	transform *template.Template
+}
+
+func (cfg *TransformConfig) Enabled() bool {
+	return cfg.Transform != ""
+}
+
+func (cfg *TransformConfig) Restrict() error {
+	cfg.transform = nil
+	if cfg.Transform == "" {
+		return nil
+	}
+	tmpl, err := template.New("transform").Funcs(transformFuncs).Parse(cfg.Transform)
+	if err != nil {
+		return fmt.Errorf("transform has invalid format: %w", err)
+	}
+	cfg.transform = tmpl
+	return nil
+}
+
+// transformData is the data passed to the transform template for each line.
+type transformData struct {
+	*runMetadata
+	// Line is the line without the newline.
+	Line string
+	// Fields is the fields of the JSON object of the line, or nil if the line is not a JSON object.
+	Fields map[string]any
+}
+
+// processor returns the line processor of the template. An empty result drops the line,
+// and the line failing the template is written as it is.
+func (cfg *TransformConfig) processor(meta *runMetadata) lineProcessor {
+	var buf bytes.Buffer
+	return func(line []byte) []byte {
+		if len(line) == 0 {
+			return line
+		}
+		data := transformData{
+			runMetadata: meta,
+			Line:        string(line),
+			Fields:      parseJSONFields(line),
+		}
+		buf.Reset()
+		if err := cfg.transform.Execute(&buf, data); err != nil {
+			return line
+		}
+		if buf.Len() == 0 {
+			return nil
+		}
+		return buf.Bytes()
+	}
+}
+
+// parseJSONFields returns the fields of the JSON object in line, whose numbers are json.Number, or nil if line is not a JSON object.
+func parseJSONFields(line []byte) map[string]any {
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	dec.UseNumber()
+	var fields map[string]any
+	if err := dec.Decode(&fields); err != nil || dec.More() {
+		return nil
+	}
+	return fields
+}
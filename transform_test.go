@@ -0,0 +1,64 @@
+package awstee
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransformConfig(t *testing.T) {
+	meta := &runMetadata{Hostname: "localhost", OutputName: "hoge.log", PID: 1234}
+	cases := []struct {
+		name      string
+		transform string
+		line      string
+		expected  string
+	}{
+		{
+			name:      "fields",
+			transform: `{{ if .Fields }}[{{ upper .Fields.level }}] {{ .Fields.msg }}{{ else }}{{ .Line }}{{ end }}`,
+			line:      `{"level":"info","msg":"hoge"}`,
+			expected:  `[INFO] hoge`,
+		},
+		{
+			name:      "not json",
+			transform: `{{ if .Fields }}[{{ upper .Fields.level }}] {{ .Fields.msg }}{{ else }}{{ .Line }}{{ end }}`,
+			line:      `INFO hoge`,
+			expected:  `INFO hoge`,
+		},
+		{
+			name:      "metadata",
+			transform: `{{ json (printf "%s:%d %s" .Hostname .PID .Line) }}`,
+			line:      `hoge`,
+			expected:  `"localhost:1234 hoge"`,
+		},
+		{
+			name:      "numbers kept",
+			transform: `{{ json .Fields }}`,
+			line:      `{"id":12345678901234567890}`,
+			expected:  `{"id":12345678901234567890}`,
+		},
+		{
+			name:      "dropped",
+			transform: `{{ if ne .Fields.level "debug" }}{{ .Line }}{{ end }}`,
+			line:      `{"level":"debug","msg":"hoge"}`,
+			expected:  ``,
+		},
+		{
+			name:      "failed",
+			transform: `{{ upper .Fields.level }}`,
+			line:      `{"msg":"hoge"}`,
+			expected:  `{"msg":"hoge"}`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &TransformConfig{Transform: c.transform}
+			require.NoError(t, cfg.Restrict())
+			require.Equal(t, c.expected, string(cfg.processor(meta)([]byte(c.line))))
+		})
+	}
+
+	cfg := &TransformConfig{Transform: `{{ .Line`}
+	require.ErrorContains(t, cfg.Restrict(), "transform has invalid format")
+}
@@ -0,0 +1,112 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/smithy-go"
+)
+
+// cloudwatch logs PutLogEvents accepts at most 10,000 events per batch.
+const maxPutLogEventsCount = 10000
+
+// ValidationResult is the result of one check performed by Validate.
+type ValidationResult struct {
+	Check string
+	Err   error
+}
+
+func (r *ValidationResult) OK() bool {
+	return r.Err == nil
+}
+
+func (r *ValidationResult) String() string {
+	if r.OK() {
+		return fmt.Sprintf("[OK] %s", r.Check)
+	}
+	return fmt.Sprintf("[NG] %s: %s", r.Check, r.Err)
+}
+
+// validateProbeName is the output name of the upload probed by Validate.
+const validateProbeName = ".awstee-validate"
+
+// Validate runs semantic checks on the configuration and checks the destinations with the resolved credentials.
+// The s3 uploads are probed as Preflight does, with a multipart upload of the object validateProbeName created and aborted,
+// so that nothing is left in the bucket. The cloudwatch log groups are checked by DescribeLogStreams only,
+// creating the log streams and putting the events can not be probed without writing.
+func (app *AWSTee) Validate(ctx context.Context) []*ValidationResult {
+	app.logger.Debug("try validate")
+	results := make([]*ValidationResult, 0)
+	add := func(check string, err error) {
+		results = append(results, &ValidationResult{Check: check, Err: err})
+	}
+	switch {
+	case app.region == "":
+		add("aws region is resolved", errors.New("no region is set by aws_region, the environment or the shared config"))
+	case app.cfg.AWSRegion == "":
+		add(fmt.Sprintf("aws region is resolved: %s (from the environment)", app.region), nil)
+	default:
+		add(fmt.Sprintf("aws region is resolved: %s", app.region), nil)
+	}
+	if !app.cfg.EnableS3() && !app.cfg.EnableCloudwatchLogs() {
+		add("destination is configured", errors.New("no destination"))
+	}
+	if app.credentials != nil {
+		creds, err := app.credentials.Retrieve(ctx)
+		if err != nil {
+			add("aws credentials are resolved", err)
+		} else {
+			add(fmt.Sprintf("aws credentials are resolved: source = %s", creds.Source), nil)
+		}
+	}
+	for _, cfg := range app.cfg.allS3Configs() {
+		bucket, key := s3ObjectLocation(cfg, validateProbeName)
+		if bucket == "" {
+			add("s3 bucket name is set", fmt.Errorf("url_prefix %s has no bucket name", cfg.URLPrefix))
+		} else {
+			probeS3Upload(ctx, app.s3Client(cfg), cfg, bucket, key, add)
+		}
+	}
+	for _, cfg := range app.cfg.allCloudwatchConfigs() {
+		if cfg.BufferLines < 1 || cfg.BufferLines > maxPutLogEventsCount {
+			add("cloudwatch buffer_lines is in range", fmt.Errorf("buffer_lines must be between 1 and %d, got %d", maxPutLogEventsCount, cfg.BufferLines))
+		}
+		if cfg.flushInterval <= 0 {
+			add("cloudwatch flush_interval is positive", fmt.Errorf("flush_interval must be positive, got %s", cfg.flushInterval))
+		}
+		_, err := app.cloudwatchClient(cfg).DescribeLogStreams(ctx, &cloudwatchlogs.DescribeLogStreamsInput{
+			LogGroupName: aws.String(cfg.LogGroup),
+			Limit:        aws.Int32(1),
+		})
+		switch {
+		case err == nil:
+			add(fmt.Sprintf("cloudwatch log group %s exists", cfg.LogGroup), nil)
+		case isLogGroupNotFound(err) && cfg.CreateLogGroup:
+			add(fmt.Sprintf("cloudwatch log group %s does not exist, but create_log_group is enabled", cfg.LogGroup), nil)
+		default:
+			add(fmt.Sprintf("cloudwatch log group %s exists", cfg.LogGroup), preflightPermission(err, &cfg.Credentials, "logs:DescribeLogStreams"))
+		}
+	}
+	return results
+}
+
+func withRequiredPermission(err error, actions ...string) error {
+	if err == nil {
+		return nil
+	}
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "AccessDenied", "AccessDeniedException", "Forbidden":
+			if len(actions) > 1 {
+				return fmt.Errorf("%w (%s permissions are required)", err, strings.Join(actions, " and "))
+			}
+			return fmt.Errorf("%w (%s permission is required)", err, actions[0])
+		}
+	}
+	return err
+}
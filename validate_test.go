@@ -0,0 +1,58 @@
+package awstee
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().CreateMultipartUpload(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+			require.Equal(t, "logs/.awstee-validate", *input.Key)
+			return nil, &smithy.GenericAPIError{Code: "AccessDenied"}
+		},
+	).Times(1)
+	s3Client.EXPECT().AbortMultipartUpload(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{}, nil,
+	).Times(1)
+
+	cfg := &Config{
+		AWSRegion: "ap-northeast-1",
+		S3: &S3Config{
+			URLPrefix: "s3://awstee-example-com/logs/",
+		},
+		Cloudwatch: &CloudwatchLogsConfig{
+			LogGroup:    "/awstee/hoge",
+			BufferLines: 20000,
+		},
+	}
+	require.NoError(t, cfg.Restrict())
+	app, err := NewWithClient(cfg, AWSClient{
+		S3:             s3Client,
+		CloudwatchLogs: cloudwatchLogsClient,
+	})
+	require.NoError(t, err)
+	results := app.Validate(context.Background())
+	actual := make([]string, 0, len(results))
+	for _, result := range results {
+		actual = append(actual, result.String())
+	}
+	require.EqualValues(t, []string{
+		"[OK] aws region is resolved: ap-northeast-1",
+		"[NG] s3 object s3://awstee-example-com/logs/.awstee-validate can be uploaded: api error AccessDenied:  (s3:PutObject permission is required)",
+		"[NG] cloudwatch buffer_lines is in range: buffer_lines must be between 1 and 10000, got 20000",
+		"[OK] cloudwatch log group /awstee/hoge exists",
+	}, actual)
+}
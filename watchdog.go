@@ -0,0 +1,250 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var errStalled = errors.New("destination stalled")
+
+// WatchdogConfig detects the stalls of a destination: no part or batch is acknowledged for stall_timeout while data is waiting for it,
+// that is an API call in flight or a write blocked. A stall is logged as an error and shown as stalled in the runtime stats.
+// With restart, the calls in flight are canceled as stalled, so that they are retried by retry (or spilled, see SpillConfig).
+type WatchdogConfig struct {
+	StallTimeout string `yaml:"stall_timeout,omitempty"`
+	Restart      bool   `yaml:"restart,omitempty"`
+
+	stallTimeout time.Duration
+}
+
+func (cfg *WatchdogConfig) Enabled() bool {
+	return cfg.stallTimeout > 0
+}
+
+func (cfg *WatchdogConfig) Restrict() error {
+	var err error
+	if cfg.stallTimeout, err = parseOptionalDuration(cfg.StallTimeout); err != nil {
+		return fmt.Errorf("watchdog stall_timeout is invalid format: %w", err)
+	}
+	if cfg.stallTimeout < 0 {
+		return errors.New("watchdog stall_timeout must not be negative")
+	}
+	if cfg.Restart && cfg.stallTimeout == 0 {
+		return errors.New("watchdog restart requires stall_timeout")
+	}
+	return nil
+}
+
+// StalledError is the error of an API call canceled by the watchdog with restart. It is retryable.
+type StalledError struct {
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *StalledError) Error() string {
+	return fmt.Sprintf("no acknowledgement for %s, canceled by the watchdog: %v", e.Timeout, e.Err)
+}
+
+func (e *StalledError) Unwrap() error {
+	return e.Err
+}
+
+func (e *StalledError) RetryableError() bool {
+	return true
+}
+
+// watchdog watches the acknowledgements of a destination while data is waiting for it.
+// The nil watchdog watches nothing, for the destination without stall_timeout.
+type watchdog struct {
+	cfg     *WatchdogConfig
+	logger  *slog.Logger
+	now     func() time.Time
+	stalled atomic.Bool
+	stalls  int64
+
+	mu        sync.Mutex
+	seq       int64
+	waiting   map[int64]waiter
+	lastAck   time.Time
+	lastStall time.Time
+}
+
+// waiter is the data waiting for the destination. cancel is nil for a blocked write.
+type waiter struct {
+	start  time.Time
+	cancel context.CancelCauseFunc
+}
+
+func newWatchdog(logger *slog.Logger, cfg *WatchdogConfig, now func() time.Time) *watchdog {
+	if !cfg.Enabled() {
+		return nil
+	}
+	return &watchdog{
+		cfg:     cfg,
+		logger:  logger,
+		now:     now,
+		waiting: make(map[int64]waiter),
+		lastAck: now(),
+	}
+}
+
+// start starts watching, until the returned func is called.
+func (d *watchdog) start() func() {
+	if d == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(d.cfg.stallTimeout / 4)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				d.check()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// check detects a stall: the oldest data waiting, the last acknowledgement and the last stall are all older than stall_timeout.
+func (d *watchdog) check() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.waiting) == 0 {
+		return
+	}
+	since := d.lastAck
+	if d.lastStall.After(since) {
+		since = d.lastStall
+	}
+	oldest := d.now()
+	for _, w := range d.waiting {
+		if w.start.Before(oldest) {
+			oldest = w.start
+		}
+	}
+	if oldest.After(since) {
+		since = oldest
+	}
+	now := d.now()
+	if now.Sub(since) < d.cfg.stallTimeout {
+		return
+	}
+	d.lastStall = now
+	d.stalled.Store(true)
+	atomic.AddInt64(&d.stalls, 1)
+	d.logger.Error("destination stalled, no part or batch is acknowledged while data is waiting",
+		"since_last_ack", now.Sub(d.lastAck).Round(time.Second), "waiting", len(d.waiting), "restart", d.cfg.Restart)
+	if !d.cfg.Restart {
+		return
+	}
+	for _, w := range d.waiting {
+		if w.cancel != nil {
+			w.cancel(errStalled)
+		}
+	}
+}
+
+func (d *watchdog) begin(cancel context.CancelCauseFunc) int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seq++
+	d.waiting[d.seq] = waiter{start: d.now(), cancel: cancel}
+	return d.seq
+}
+
+func (d *watchdog) end(id int64, acked bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.waiting, id)
+	if !acked {
+		return
+	}
+	d.lastAck = d.now()
+	if d.stalled.CompareAndSwap(true, false) {
+		d.logger.Info("destination recovered from the stall")
+	}
+}
+
+// call watches an API call with ctx canceled by the watchdog with restart. The returned end must be called with the error of the call,
+// and it returns StalledError if the call is canceled by the watchdog.
+func (d *watchdog) call(ctx context.Context) (context.Context, func(err error) error) {
+	if d == nil {
+		return ctx, func(err error) error { return err }
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	id := d.begin(cancel)
+	return ctx, func(err error) error {
+		d.end(id, err == nil)
+		if err != nil && errors.Is(context.Cause(ctx), errStalled) {
+			err = &StalledError{Timeout: d.cfg.stallTimeout, Err: err}
+		}
+		cancel(nil)
+		return err
+	}
+}
+
+// write watches a write, which is blocked while the destination does not take it. The returned func must be called after it.
+func (d *watchdog) write() func() {
+	if d == nil {
+		return func() {}
+	}
+	id := d.begin(nil)
+	return func() {
+		d.end(id, false)
+	}
+}
+
+// Stalled reports whether the destination is stalled now.
+func (d *watchdog) Stalled() bool {
+	return d != nil && d.stalled.Load()
+}
+
+// Stalls returns the number of the stalls detected.
+func (d *watchdog) Stalls() int64 {
+	if d == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&d.stalls)
+}
+
+// watchdogUploadClient watches the calls of the s3 upload, whose success acknowledges the data.
+type watchdogUploadClient struct {
+	manager.UploadAPIClient
+	watchdog *watchdog
+}
+
+func (c *watchdogUploadClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	ctx, end := c.watchdog.call(ctx)
+	output, err := c.UploadAPIClient.PutObject(ctx, params, optFns...)
+	return output, end(err)
+}
+
+func (c *watchdogUploadClient) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	ctx, end := c.watchdog.call(ctx)
+	output, err := c.UploadAPIClient.UploadPart(ctx, params, optFns...)
+	return output, end(err)
+}
+
+func (c *watchdogUploadClient) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	ctx, end := c.watchdog.call(ctx)
+	output, err := c.UploadAPIClient.CreateMultipartUpload(ctx, params, optFns...)
+	return output, end(err)
+}
+
+func (c *watchdogUploadClient) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	ctx, end := c.watchdog.call(ctx)
+	output, err := c.UploadAPIClient.CompleteMultipartUpload(ctx, params, optFns...)
+	return output, end(err)
+}
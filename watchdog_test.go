@@ -0,0 +1,141 @@
+package awstee
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchdogConfigRestrict(t *testing.T) {
+	cfg := &WatchdogConfig{StallTimeout: "5m", Restart: true}
+	require.NoError(t, cfg.Restrict())
+	require.True(t, cfg.Enabled())
+	require.Equal(t, 5*time.Minute, cfg.stallTimeout)
+
+	cfg = &WatchdogConfig{}
+	require.NoError(t, cfg.Restrict())
+	require.False(t, cfg.Enabled())
+
+	cfg = &WatchdogConfig{Restart: true}
+	require.EqualError(t, cfg.Restrict(), "watchdog restart requires stall_timeout")
+}
+
+func TestCloudwatchLogsWriterWatchdogRestart(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	var calls int
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			calls++
+			if calls == 1 {
+				// hangs until canceled
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).Times(2)
+	w := newTestCloudwatchLogsWriter(t, client, &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/logs",
+		FlushInterval: "1h",
+		Retry:         RetryConfig{Attempts: 2, Backoff: "1ms"},
+		Watchdog:      WatchdogConfig{StallTimeout: "100ms", Restart: true},
+	})
+	_, err := io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Flush(context.Background()), "the stalled call is retried")
+	stats := w.Stats()
+	require.False(t, stats.Stalled, "recovered by the retry")
+	require.EqualValues(t, 1, stats.Stalls)
+	require.Contains(t, stats.String(), "stalls=1")
+	require.NoError(t, w.Close())
+}
+
+func TestCloudwatchLogsWriterWatchdog(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockCloudwatchLogsClient(ctrl)
+	expectDescribeLogStreams(client)
+	release := make(chan struct{})
+	client.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			select {
+			case <-release:
+				return &cloudwatchlogs.PutLogEventsOutput{}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+	).Times(1)
+	w := newTestCloudwatchLogsWriter(t, client, &CloudwatchLogsConfig{
+		LogGroup:      "/awstee/logs",
+		FlushInterval: "1h",
+		Retry:         RetryConfig{Attempts: 2, Backoff: "1ms"},
+		Watchdog:      WatchdogConfig{StallTimeout: "50ms"},
+	})
+	_, err := io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- w.Flush(context.Background())
+	}()
+	require.Eventually(t, func() bool { return w.Stats().Stalled }, 5*time.Second, 10*time.Millisecond)
+	require.Contains(t, w.Stats().String(), "stalled")
+	close(release)
+	require.NoError(t, <-flushed, "the call is not canceled without restart")
+	require.False(t, w.Stats().Stalled)
+	require.NoError(t, w.Close())
+}
+
+func TestS3WriterWatchdogRestart(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, &smithy.GenericAPIError{Code: "NotFound"}).Times(1)
+	var calls int
+	var body []byte
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			calls++
+			if calls == 1 {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			var err error
+			body, err = io.ReadAll(input.Body)
+			return &s3.PutObjectOutput{}, err
+		},
+	).Times(2)
+	cfg := &S3Config{
+		URLPrefix: "s3://awstee-example-com/logs/",
+		Retry:     RetryConfig{Attempts: 2, Backoff: "1ms"},
+		Watchdog:  WatchdogConfig{StallTimeout: "100ms", Restart: true},
+	}
+	require.NoError(t, cfg.Restrict())
+	w, err := newS3Writer(context.Background(), slog.Default(), s3Client, cfg, "hoge.log", nil)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, "hoge\n", string(body))
+	require.EqualValues(t, 1, w.Stats().Stalls)
+}
+
+func TestStalledErrorIsRetryable(t *testing.T) {
+	err := &StalledError{Timeout: time.Minute, Err: context.Canceled}
+	require.True(t, isRetryableError(err))
+	require.True(t, isAmbiguousError(err), "the canceled call may have been accepted")
+	require.False(t, isRetryableError(context.Canceled))
+	require.True(t, errors.Is(err, context.Canceled))
+}
@@ -0,0 +1,61 @@
+package awstee
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// WriterOptions is the options of NewS3Writer and NewCloudWatchLogsWriter. The zero value is the default.
+type WriterOptions struct {
+	// Logger is the logger of the diagnostics. The default is slog.Default().
+	Logger *slog.Logger
+	// Clock is the clock of the timestamps of the cloudwatch logs events. The default is time.Now.
+	Clock func() time.Time
+	// ErrorHandler is called as soon as a write or a batch fails, see WithErrorHandler. The default logs the error.
+	ErrorHandler func(dest string, err error)
+	// MetricsHook is notified of the throughput, see WithMetricsHook.
+	MetricsHook MetricsHook
+	// TracerProvider provides the tracer of the spans of the uploads, see WithTracerProvider.
+	TracerProvider TracerProvider
+}
+
+func (opts *WriterOptions) logger() *slog.Logger {
+	if opts == nil || opts.Logger == nil {
+		return slog.Default()
+	}
+	return opts.Logger
+}
+
+func (opts *WriterOptions) clock() func() time.Time {
+	if opts == nil || opts.Clock == nil {
+		return time.Now
+	}
+	return opts.Clock
+}
+
+func (opts *WriterOptions) hooks() *destinationHooks {
+	hooks := &destinationHooks{logger: opts.logger()}
+	if opts != nil {
+		hooks.errorHandler = opts.ErrorHandler
+		hooks.metrics = opts.MetricsHook
+		if opts.TracerProvider != nil {
+			hooks.tracer = opts.TracerProvider.Tracer(tracerName)
+		}
+	}
+	return hooks
+}
+
+// NewS3Writer returns an S3Writer uploading to the object of outputName under cfg.URLPrefix, without AWSTee.
+// cfg must be restricted by Restrict. ctx is used for the whole upload, see AWSTee.Writer. opts may be nil.
+// The limit of cfg is not applied.
+func NewS3Writer(ctx context.Context, client S3Client, cfg *S3Config, outputName string, opts *WriterOptions) (*S3Writer, error) {
+	return newS3Writer(ctx, opts.logger(), client, cfg, outputName, opts.hooks())
+}
+
+// NewCloudWatchLogsWriter returns a CloudWatchLogsWriter putting to the log stream of outputName in cfg.LogGroup, without AWSTee.
+// cfg must be restricted by Restrict. ctx is used for the whole puts, see AWSTee.Writer. opts may be nil.
+// The limit of cfg is not applied.
+func NewCloudWatchLogsWriter(ctx context.Context, client CloudwatchLogsClient, cfg *CloudwatchLogsConfig, outputName string, opts *WriterOptions) (*CloudWatchLogsWriter, error) {
+	return newCloudWatchLogsWriter(ctx, opts.logger(), client, cfg, outputName, opts.clock(), opts.hooks())
+}
@@ -0,0 +1,74 @@
+package awstee
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewS3Writer(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	s3Client := NewMockS3Client(ctrl)
+	s3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, &smithy.GenericAPIError{Code: "NotFound"}).Times(1)
+	var body []byte
+	s3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			require.EqualValues(t, "logs/hoge.log", *input.Key)
+			var err error
+			body, err = io.ReadAll(input.Body)
+			return &s3.PutObjectOutput{}, err
+		},
+	).Times(1)
+	cfg := &S3Config{URLPrefix: "s3://awstee-example-com/logs/"}
+	require.NoError(t, cfg.Restrict())
+	w, err := NewS3Writer(context.Background(), s3Client, cfg, "hoge.log", nil)
+	require.NoError(t, err)
+	require.EqualValues(t, "s3://awstee-example-com/logs/hoge.log", w.String())
+	_, err = io.WriteString(w, "hoge\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.EqualValues(t, "hoge\n", string(body))
+}
+
+func TestNewCloudWatchLogsWriter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cloudwatchLogsClient := NewMockCloudwatchLogsClient(ctrl)
+	cloudwatchLogsClient.EXPECT().DescribeLogStreams(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []types.LogStream{{LogStreamName: aws.String("hoge")}},
+		}, nil,
+	).Times(1)
+	now := time.Date(2022, 6, 3, 17, 28, 48, 0, time.UTC)
+	var events []types.InputLogEvent
+	cloudwatchLogsClient.EXPECT().PutLogEvents(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *cloudwatchlogs.PutLogEventsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			events = append(events, input.LogEvents...)
+			return &cloudwatchlogs.PutLogEventsOutput{}, nil
+		},
+	).Times(1)
+	cfg := &CloudwatchLogsConfig{LogGroup: "/awstee/logs", FlushInterval: "1h"}
+	require.NoError(t, cfg.Restrict())
+	hook := newTestMetricsHook()
+	w, err := NewCloudWatchLogsWriter(context.Background(), cloudwatchLogsClient, cfg, "hoge.log", &WriterOptions{
+		Clock:       func() time.Time { return now },
+		MetricsHook: hook,
+	})
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "hoge\nfuga\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Len(t, events, 2)
+	require.EqualValues(t, now.UnixMilli(), *events[1].Timestamp)
+	require.EqualValues(t, []int{2}, hook.batches[w.String()])
+}